@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/pkg/profile"
 	"github.com/urfave/cli/v2"
@@ -75,6 +76,15 @@ func (w *appWrapper) beforeCommandRun(c *cli.Context) error {
 
 	env := c.Generic(state.FlagName).(*state.LocalEnv)
 
+	if c.Command.Name == "convert" && c.Args().Get(1) == commands.StdoutDestination {
+		// book goes to stdout, keep it clean
+		env.Cfg.ConsoleLogger.Destination = "stderr"
+	}
+	if c.Command.Name == "validate" {
+		// report goes to stdout
+		env.Cfg.ConsoleLogger.Destination = "stderr"
+	}
+
 	// Prepare logs
 	env.Log, err = env.Cfg.PrepareLog()
 	if err != nil {
@@ -175,16 +185,20 @@ func main() {
 	app.Commands = []*cli.Command{
 		{
 			Name:   "convert",
-			Usage:  "Converts FB2 file(s) to specified format",
+			Usage:  "Converts FB2/FB3 file(s) to specified format",
 			Action: commands.Convert,
 			Before: wrap.beforeCommandRun,
 			After:  wrap.afterCommandRun,
 			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, kepub, azw3, mobi)"},
+				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, epub3, kepub, azw3, mobi, html, txt, md, pdf, docx)"},
 				&cli.BoolFlag{Name: "nodirs", Usage: "when producing output do not keep input directory structure"},
 				&cli.BoolFlag{Name: "stk", Usage: "send converted file to kindle (mobi only)"},
 				&cli.BoolFlag{Name: "ow", Usage: "continue even if destination exits, overwrite files"},
-				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL file names in archives (see IANA.org for character set names)"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL file names in archives (see IANA.org for character set names), by default it is detected"},
+				&cli.IntFlag{Name: "jobs", Value: 1, Usage: "convert up to `N` books simultaneously when processing directory or archive (0 - number of CPUs)"},
+				&cli.BoolFlag{Name: "incremental", Usage: "keep manifest in destination and convert only new or changed books when processing directory or archive"},
+				&cli.StringFlag{Name: "report", Usage: "write results of conversion for every book to `FILE` (JSON, or CSV if file has .csv extension)"},
+				&cli.DurationFlag{Name: "book-timeout", Usage: "give up converting a book if it takes longer than `DURATION` (0 - no limit)"},
 			},
 			ArgsUsage: "SOURCE [DESTINATION]",
 			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
@@ -196,9 +210,112 @@ func main() {
 
     When working on archive recursively only fb2 files will be considered, processing of archives inside archives is not supported.
 
+    With --incremental manifest file (.fb2c-manifest.jsonl) is kept in destination directory. It records hashes of the source and
+    effective configuration for every converted book, so unchanged books are skipped, changed ones are rebuilt and
+    interrupted batch could be resumed. Converted books which sources are gone are reported.
+
+    With --report FILE one record per book is written at the end of the run: source path (including archive member),
+    output path, format, duration, status (converted, unchanged or failed), error text, number of warnings, title,
+    authors, series and language.
+
+    With --book-timeout conversion of a book taking longer than specified is abandoned (running kindlegen is killed) and
+    book is reported as failed. On SIGINT or SIGTERM running conversions are stopped and their temporary files removed,
+    second signal terminates program immediately.
+
+    Program exits with non-zero code when any of the books could not be converted.
+
 DESTINATION:
     always a path, output file name(s) and extension will be derived from other parameters
     if absent - current working directory
+    "-" - write converted book to stdout (single book only, console messages are sent to stderr)
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "watch",
+			Usage:  "Watches inbox directories converting FB2/FB3 file(s) as they arrive",
+			Action: commands.Watch,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "to", Value: "epub", Usage: "conversion output `TYPE` (supported types: epub, epub3, kepub, azw3, mobi, html, txt, md, pdf, docx)"},
+				&cli.BoolFlag{Name: "nodirs", Usage: "when producing output do not keep input directory structure"},
+				&cli.BoolFlag{Name: "stk", Usage: "send converted file to kindle (mobi only)"},
+				&cli.BoolFlag{Name: "ow", Usage: "continue even if destination exits, overwrite files"},
+				&cli.StringFlag{Name: "force-zip-cp", Usage: "Force `ENCODING` for ALL file names in archives (see IANA.org for character set names), by default it is detected"},
+				&cli.IntFlag{Name: "jobs", Value: 1, Usage: "convert up to `N` books simultaneously (0 - number of CPUs)"},
+				&cli.DurationFlag{Name: "delay", Value: 5 * time.Second, Usage: "wait for `DURATION` after last change before processing file"},
+				&cli.DurationFlag{Name: "book-timeout", Usage: "give up converting a book if it takes longer than `DURATION` (0 - no limit)"},
+				&cli.StringFlag{Name: "done", Usage: "move successfully processed files to `DIRECTORY`"},
+				&cli.StringFlag{Name: "failed", Usage: "move files which could not be processed to `DIRECTORY`"},
+			},
+			ArgsUsage: "INBOX [INBOX...] DESTINATION",
+			CustomHelpTemplate: fmt.Sprintf(`%sINBOX:
+    path to directory to watch, all directories under it are watched too (symbolic links are not followed)
+    fb2 and fb3 files and archives with them are processed the same way convert command does it
+
+DESTINATION:
+    always a path, output file name(s) and extension will be derived from other parameters
+
+    Files which are already in inbox are processed on start. File is processed after it was not changed for --delay,
+    so partially written files are not picked up. Manifest (.fb2c-manifest.jsonl) is kept in destination directory, so
+    changed books are rebuilt and files touched without changes are skipped. Processed files could be moved out of inbox
+    keeping their relative location (--done and --failed). Watching stops on interrupt signal.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "serve",
+			Usage:  "Runs HTTP service converting uploaded FB2/FB3 file(s)",
+			Action: commands.Serve,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: "localhost:8080", Usage: "listen on `ADDRESS` for HTTP requests"},
+				&cli.IntFlag{Name: "jobs", Value: 1, Usage: "convert up to `N` books simultaneously"},
+				&cli.IntFlag{Name: "queue", Value: 16, Usage: "keep up to `N` jobs waiting for conversion, reject new jobs when queue is full"},
+				&cli.IntFlag{Name: "keep", Value: 100, Usage: "remember up to `N` recent jobs, older jobs and their results are removed"},
+				&cli.Int64Flag{Name: "max-size", Value: 64, Usage: "reject uploads larger than `MB` megabytes"},
+				&cli.DurationFlag{Name: "book-timeout", Usage: "give up converting a book if it takes longer than `DURATION` (0 - no limit)"},
+				&cli.StringSliceFlag{Name: "profile", Usage: "make configuration `NAME=FILE` available to jobs, FILE is applied on top of global configuration"},
+				&cli.StringFlag{Name: "workdir", Usage: "keep uploaded files and results in `DIRECTORY` (temporary directory is used by default)"},
+			},
+			CustomHelpTemplate: fmt.Sprintf(`%sAPI:
+    POST /jobs?to=TYPE&profile=NAME
+        submit book for conversion: FB2, FB3 or zip archive with them, either as "file" field of multipart form or as
+        request body with file name in "name" query parameter; responds with job description, format defaults to epub
+    GET /jobs
+        list recent jobs, newest first
+    GET /jobs/ID
+        job description: status (queued, running, done, failed), error and converted books with their metadata
+    GET /jobs/ID/result
+        download converted book, zip archive is sent when several books were converted
+    GET /jobs/ID/log
+        download job log
+
+    Interrupt signal stops accepting requests, queued jobs are completed before exiting.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "opds",
+			Usage:  "Serves OPDS catalog of the library converting books on request",
+			Action: commands.Opds,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: "localhost:8080", Usage: "listen on `ADDRESS` for HTTP requests"},
+				&cli.StringFlag{Name: "formats", Value: "epub,kepub,azw3,mobi", Usage: "offer books in comma separated list of `TYPES` (supported types: epub, kepub, azw3, mobi)"},
+				&cli.StringFlag{Name: "title", Value: "Library", Usage: "catalog `TITLE`"},
+				&cli.StringFlag{Name: "cache", Usage: "keep books converted on request in `DIRECTORY` (temporary directory is used by default)"},
+				&cli.DurationFlag{Name: "rescan", Value: 10 * time.Minute, Usage: "rescan library every `DURATION` (0 - never)"},
+				&cli.DurationFlag{Name: "book-timeout", Usage: "give up converting a book if it takes longer than `DURATION` (0 - no limit)"},
+			},
+			ArgsUsage: "LIBRARY",
+			CustomHelpTemplate: fmt.Sprintf(`%sLIBRARY:
+    path to directory with fb2 and fb3 files, zip archives with them and epub files (symbolic links are not followed)
+
+    OPDS 1.2 catalog is available at /opds, books could be browsed by author, series, genre and language. Book
+    metadata and covers are taken from book descriptions. Books converted earlier and located next to their sources
+    with the same name (book.epub, book.kepub.epub, book.azw3, book.mobi for book.fb2) are offered as is, missing
+    formats are converted on request using active configuration. EPUB files without sources are offered as is.
 `, cli.CommandHelpTemplate),
 		},
 		{
@@ -223,8 +340,80 @@ DESTINATION:
     always a path, output file name(s) and extension will be derived from other parameters
     if absent - current working directory
 
-Presently no processing of input files is performed - not even unpacking, so most of program functionality is disabled.
-This command is a mere convenience wrapper to simplify transfer of files to Kindle over USB or mail.
+EPUB is unpacked and its content is processed according to configuration before it is handed to kindlegen:
+soft hyphens are inserted into text, cover is resized and stamped, images are converted for Kindle and stylesheet is
+kept, replaced or merged (see document.transfer section of configuration).
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "tofb2",
+			Usage:  "Converts EPUB file(s) to FB2",
+			Action: commands.ToFB2,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "nodirs", Usage: "when producing output do not keep input directory structure"},
+				&cli.BoolFlag{Name: "ow", Usage: "continue even if destination exits, overwrite files"},
+			},
+			ArgsUsage: "SOURCE [DESTINATION]",
+			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
+    path to epub file(s) to process, following formats are supported:
+        path to a file: [path]file.epub
+        path to a directory: [path]directory - recursively process all files under directory (symbolic links are not followed)
+
+DESTINATION:
+    always a path, output file name(s) and extension will be derived from other parameters
+    if absent - current working directory
+
+Book metadata, content documents in spine order, navigation hierarchy, footnotes and images are mapped onto
+FictionBook 2.1 description, nested sections, notes body and binaries.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "fix",
+			Usage:  "Repairs malformed FB2 file(s)",
+			Action: commands.Fix,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "nodirs", Usage: "when producing output do not keep input directory structure"},
+				&cli.BoolFlag{Name: "ow", Usage: "continue even if destination exits, overwrite files"},
+			},
+			ArgsUsage: "SOURCE [DESTINATION]",
+			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
+    path to fb2 file(s) to repair, following formats are supported:
+        path to a file: [path]file.fb2
+        path to a zip archive: [path]archive.zip - all fb2 files in archive are repaired
+        path to a directory: [path]directory - recursively repair all fb2 files and archives under directory
+
+DESTINATION:
+    always a path, output file names are the same as input ones
+    if absent - current working directory
+
+Unclosed and stray tags, HTML entities, unescaped ampersands, illegal control characters, broken base64 in binaries
+and paragraphs inside of paragraphs are fixed, every change is logged. Repaired books are written in UTF-8.
+The same repairs are always applied by convert command before parsing FB2.
+`, cli.CommandHelpTemplate),
+		},
+		{
+			Name:   "validate",
+			Usage:  "Validates FB2 file(s) against FictionBook schema rules",
+			Action: commands.Validate,
+			Before: wrap.beforeCommandRun,
+			After:  wrap.afterCommandRun,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "json", Usage: "report results as JSON"},
+			},
+			ArgsUsage: "SOURCE [SOURCE...]",
+			CustomHelpTemplate: fmt.Sprintf(`%sSOURCE:
+    path to fb2 file(s) to validate, following formats are supported:
+        path to a file: [path]file.fb2
+        path to a zip archive: [path]archive.zip - all fb2 files in archive are validated
+        path to a directory: [path]directory - recursively validate all fb2 files and archives under directory
+
+Every book is checked against FictionBook 2.1/2.2 schema rules: required description fields, element nesting,
+references to notes and binaries, duplicate ids and binary content types. Each violation is reported with
+element path and line number, console messages are sent to stderr. Exit code is 1 if any book is not valid.
 `, cli.CommandHelpTemplate),
 		},
 		{
@@ -0,0 +1,327 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// bookResult keeps outcome of a single book conversion for the final summary.
+type bookResult struct {
+	src      string
+	err      error
+	skipped  bool
+	info     bookInfo
+	elapsed  time.Duration
+	warnings int
+}
+
+// bookFunc converts book read from "r", overwriting existing output if requested, and returns name of the resulting file
+// along with book metadata. Conversion should stop when "ctx" is done.
+type bookFunc func(ctx context.Context, env *state.LocalEnv, r io.Reader, overwrite bool) (bookInfo, error)
+
+type bookJob struct {
+	res     *bookResult
+	load    func(env *state.LocalEnv) ([]byte, error)
+	convert bookFunc
+}
+
+// batch schedules book conversions. With a single job books are converted in place, one by one, otherwise conversions run
+// concurrently on a pool of workers. Every job gets its own Processor (and temporary directory), so the only shared state
+// is program environment, which is read only. When batch context is done books which have not been started yet are not
+// converted, running conversions are cancelled.
+type batch struct {
+	ctx       context.Context
+	env       *state.LocalEnv
+	jobs      int
+	timeout   time.Duration // per book, 0 - no limit
+	overwrite bool
+	manifest  *manifest // nil when conversion is not incremental
+	report    *report   // nil when no report was requested
+	queue     chan *bookJob
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	results   []*bookResult
+}
+
+// newBatch creates batch and starts workers. If jobs is 0 number of CPUs is used.
+func newBatch(ctx context.Context, jobs int, timeout time.Duration, overwrite bool, m *manifest, env *state.LocalEnv) *batch {
+
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	b := &batch{ctx: ctx, env: env, jobs: jobs, timeout: timeout, overwrite: overwrite, manifest: m}
+	if jobs == 1 {
+		return b
+	}
+
+	limitKindlegen(jobs, env)
+
+	// keep queue short - archive entries are read into memory before being scheduled
+	b.queue = make(chan *bookJob, jobs)
+	for i := 0; i < jobs; i++ {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			for j := range b.queue {
+				b.run(j, true)
+			}
+		}()
+	}
+	return b
+}
+
+// limitKindlegen restricts number of simultaneously running kindlegen processes when books are converted by several
+// workers.
+func limitKindlegen(workers int, env *state.LocalEnv) {
+	if env.KindlegenSlots != nil {
+		return
+	}
+	slots := env.Cfg.Doc.Kindlegen.MaxRunning
+	if slots <= 0 {
+		slots = (workers + 1) / 2
+	}
+	env.KindlegenSlots = make(chan struct{}, slots)
+}
+
+// add schedules book conversion, "src" identifies book in the summary and in the manifest.
+func (b *batch) add(src string, load func(env *state.LocalEnv) ([]byte, error), convert bookFunc) {
+
+	j := &bookJob{res: &bookResult{src: src}, load: load, convert: convert}
+	b.mu.Lock()
+	b.results = append(b.results, j.res)
+	b.mu.Unlock()
+
+	if b.queue == nil {
+		b.run(j, false)
+		return
+	}
+	select {
+	case b.queue <- j:
+	case <-b.ctx.Done():
+		j.res.err = b.ctx.Err()
+	}
+}
+
+// run loads and converts single book counting reported warnings. When books are processed simultaneously log lines are
+// tagged to be attributable.
+func (b *batch) run(j *bookJob, tag bool) {
+
+	defer func(start time.Time) {
+		j.res.elapsed = time.Since(start)
+	}(time.Now())
+
+	var warnings int32
+	defer func() {
+		j.res.warnings = int(atomic.LoadInt32(&warnings))
+	}()
+
+	env := *b.env
+	env.Log = b.env.Log.WithOptions(zap.Hooks(func(e zapcore.Entry) error {
+		if e.Level == zapcore.WarnLevel {
+			atomic.AddInt32(&warnings, 1)
+		}
+		return nil
+	}))
+	if tag {
+		env.Log = env.Log.With(zap.String("book", j.res.src))
+	}
+	j.run(b, &env)
+}
+
+// run loads and converts single book, consulting manifest when conversion is incremental.
+func (j *bookJob) run(b *batch, env *state.LocalEnv) {
+
+	if err := b.ctx.Err(); err != nil {
+		// batch was interrupted, leave manifest as it is
+		j.res.err = err
+		return
+	}
+
+	data, err := j.load(env)
+	if err != nil {
+		j.res.err = err
+		if b.manifest != nil {
+			if err := b.manifest.forget(j.res.src); err != nil {
+				env.Log.Warn("Unable to update manifest", zap.String("from", j.res.src), zap.Error(err))
+			}
+		}
+		return
+	}
+
+	var hash string
+	overwrite := b.overwrite
+	if b.manifest != nil {
+		hash = contentHash(data)
+		bs, info := b.manifest.check(j.res.src, hash)
+		switch bs {
+		case bookUnchanged:
+			env.Log.Debug("Book has not changed since last conversion, skipping", zap.String("from", j.res.src))
+			j.res.skipped = true
+			j.res.info = info
+			return
+		case bookChanged:
+			// we produced existing output ourselves
+			overwrite = true
+		}
+	}
+
+	ctx := b.ctx
+	if b.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+	j.res.info, err = j.convert(ctx, env, bytes.NewReader(data), overwrite)
+	if err != nil && errors.Is(err, context.DeadlineExceeded) && b.ctx.Err() == nil {
+		err = fmt.Errorf("conversion did not finish in %s: %w", b.timeout, err)
+	}
+	j.res.err = err
+
+	if b.manifest != nil {
+		if err != nil {
+			err = b.manifest.forget(j.res.src)
+		} else {
+			err = b.manifest.record(j.res.src, hash, j.res.info)
+		}
+		if err != nil {
+			env.Log.Warn("Unable to update manifest", zap.String("from", j.res.src), zap.Error(err))
+		}
+	}
+}
+
+// prepareBatch creates batch, opening manifest in destination directory for incremental conversion. When "rep" is not nil
+// results of all conversions will be added to it.
+func prepareBatch(ctx context.Context, jobs int, timeout time.Duration, incremental bool, format processor.OutputFmt, nodirs, overwrite bool, dst string, rep *report, env *state.LocalEnv) (*batch, error) {
+
+	var m *manifest
+	if incremental {
+		var err error
+		if m, err = openManifest(dst, format, nodirs, env); err != nil {
+			return nil, err
+		}
+	}
+	b := newBatch(ctx, jobs, timeout, overwrite, m, env)
+	b.report = rep
+	return b, nil
+}
+
+// finish waits for all scheduled conversions and closes manifest, reporting converted books under any of the "roots"
+// which sources are gone.
+func (b *batch) finish(roots ...string) {
+
+	b.wait()
+
+	if b.report != nil {
+		for _, r := range b.results {
+			b.report.add(r)
+		}
+	}
+
+	if b.manifest != nil {
+		if b.ctx.Err() != nil {
+			// interrupted - not every source was seen, so none could be reported as gone
+			roots = nil
+		}
+		if err := b.manifest.close(roots, b.env); err != nil {
+			b.env.Log.Error("Unable to save manifest", zap.Error(err))
+		}
+		b.manifest = nil
+	}
+}
+
+// wait waits for all scheduled conversions to finish and reports results in the order books were discovered, so summary
+// does not depend on the order in which conversions completed.
+func (b *batch) wait() {
+
+	if b.queue != nil {
+		close(b.queue)
+		b.wg.Wait()
+		b.queue = nil
+	}
+
+	if len(b.results) == 0 || len(b.results) == 1 && b.manifest == nil {
+		// nothing to summarize
+		return
+	}
+
+	var failed, skipped int
+	for _, r := range b.results {
+		switch {
+		case r.err != nil:
+			failed++
+		case r.skipped:
+			skipped++
+		}
+	}
+	b.env.Log.Info("Batch summary",
+		zap.Int("jobs", b.jobs),
+		zap.Int("books", len(b.results)),
+		zap.Int("converted", len(b.results)-failed-skipped),
+		zap.Int("unchanged", skipped),
+		zap.Int("failed", failed))
+	for _, r := range b.results {
+		if r.err != nil {
+			b.env.Log.Warn("Book was not converted", zap.String("book", r.src), zap.Error(r.err))
+		}
+	}
+}
+
+// failed returns number of books which were not converted. Should only be called after wait.
+func (b *batch) failed() (n int) {
+	for _, r := range b.results {
+		if r.err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// outcome checks results of books originating from "src" (file or archive). Should only be called after wait.
+func (b *batch) outcome(src string) (books int, failed bool) {
+	for _, r := range b.results {
+		if underRoots(r.src, []string{src}) {
+			books++
+			failed = failed || r.err != nil
+		}
+	}
+	return books, failed
+}
+
+// bookTimeout returns requested time limit for a single book conversion, 0 if there is none.
+func bookTimeout(ctx *cli.Context, env *state.LocalEnv) time.Duration {
+	timeout := ctx.Duration("book-timeout")
+	if timeout < 0 {
+		env.Log.Warn("Invalid book timeout requested, books will not be timed out", zap.Duration("timeout", timeout))
+		timeout = 0
+	}
+	return timeout
+}
+
+// signalContext returns context which is done on SIGINT or SIGTERM, so running conversions could stop and clean after
+// themselves. Default handling is restored after the first signal - second one terminates program immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
@@ -0,0 +1,420 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// logWarnings makes environment log record messages of all warnings.
+func logWarnings(env *state.LocalEnv) func() []string {
+
+	var (
+		mu       sync.Mutex
+		messages []string
+	)
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(io.Discard), zapcore.WarnLevel)
+	env.Log = zap.New(core, zap.Hooks(func(e zapcore.Entry) error {
+		mu.Lock()
+		messages = append(messages, e.Message)
+		mu.Unlock()
+		return nil
+	}))
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), messages...)
+	}
+}
+
+// loadBytes returns book loader for the content.
+func loadBytes(content string) func(env *state.LocalEnv) ([]byte, error) {
+	return func(env *state.LocalEnv) ([]byte, error) {
+		return []byte(content), nil
+	}
+}
+
+func TestBatchResults(t *testing.T) {
+
+	for _, jobs := range []int{1, 4} {
+		env := testEnv(t)
+		logWarnings(env)
+		b := newBatch(context.Background(), jobs, 0, false, nil, env)
+
+		books := []struct {
+			src   string
+			delay time.Duration
+			fail  bool
+		}{
+			{filepath.Join("arc.zip", "a.fb2"), 30 * time.Millisecond, false},
+			{filepath.Join("arc.zip", "b.fb2"), 0, true},
+			{"c.fb2", 10 * time.Millisecond, false},
+			{"d.fb2", 0, false},
+		}
+		for _, book := range books {
+			book := book
+			b.add(book.src, loadBytes(book.src), func(ctx context.Context, env *state.LocalEnv, r io.Reader, overwrite bool) (bookInfo, error) {
+				time.Sleep(book.delay)
+				env.Log.Warn("conversion warning")
+				if book.fail {
+					return bookInfo{}, errors.New("bad book")
+				}
+				data, err := io.ReadAll(r)
+				if err != nil {
+					return bookInfo{}, err
+				}
+				return bookInfo{Output: string(data) + ".epub"}, nil
+			})
+		}
+		b.finish()
+
+		if len(b.results) != len(books) {
+			t.Fatalf("jobs %d: %d results, expected %d", jobs, len(b.results), len(books))
+		}
+		for i, r := range b.results {
+			if r.src != books[i].src {
+				t.Errorf("jobs %d: result %d is for %q, expected %q", jobs, i, r.src, books[i].src)
+			}
+			if (r.err != nil) != books[i].fail {
+				t.Errorf("jobs %d: %s error %v", jobs, r.src, r.err)
+			}
+			if !books[i].fail && r.info.Output != books[i].src+".epub" {
+				t.Errorf("jobs %d: %s output %q", jobs, r.src, r.info.Output)
+			}
+			if r.warnings != 1 {
+				t.Errorf("jobs %d: %s has %d warnings, expected 1", jobs, r.src, r.warnings)
+			}
+		}
+		if n := b.failed(); n != 1 {
+			t.Errorf("jobs %d: %d failed, expected 1", jobs, n)
+		}
+		for _, c := range []struct {
+			src    string
+			books  int
+			failed bool
+		}{
+			{"arc.zip", 2, true},
+			{"c.fb2", 1, false},
+			{"arc", 0, false},
+			{"e.fb2", 0, false},
+		} {
+			if books, failed := b.outcome(c.src); books != c.books || failed != c.failed {
+				t.Errorf("jobs %d: outcome of %s is %d, %t, expected %d, %t", jobs, c.src, books, failed, c.books, c.failed)
+			}
+		}
+	}
+}
+
+func TestBatchTimeout(t *testing.T) {
+
+	env := testEnv(t)
+	b := newBatch(context.Background(), 2, 20*time.Millisecond, false, nil, env)
+	b.add("slow.fb2", loadBytes("slow"), func(ctx context.Context, env *state.LocalEnv, r io.Reader, overwrite bool) (bookInfo, error) {
+		<-ctx.Done()
+		return bookInfo{}, ctx.Err()
+	})
+	b.finish()
+
+	err := b.results[0].err
+	if err == nil || !errors.Is(err, context.DeadlineExceeded) || !strings.HasPrefix(err.Error(), "conversion did not finish in 20ms") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestBatchInterrupted(t *testing.T) {
+
+	for _, jobs := range []int{1, 2} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		env := testEnv(t)
+		b := newBatch(ctx, jobs, 0, false, nil, env)
+		var called bool
+		b.add("book.fb2", loadBytes("book"), func(ctx context.Context, env *state.LocalEnv, r io.Reader, overwrite bool) (bookInfo, error) {
+			called = true
+			return bookInfo{}, nil
+		})
+		b.finish()
+
+		if called {
+			t.Errorf("jobs %d: book was converted after interruption", jobs)
+		}
+		if err := b.results[0].err; !errors.Is(err, context.Canceled) {
+			t.Errorf("jobs %d: unexpected error %v", jobs, err)
+		}
+	}
+}
+
+// manifestTest runs incremental conversions of in-memory books to files in destination directory.
+type manifestTest struct {
+	t     *testing.T
+	env   *state.LocalEnv
+	dst   string
+	books map[string]string // source -> content, missing sources are not seen
+	bad   map[string]bool   // sources which fail to convert
+}
+
+type manifestRun struct {
+	converted map[string]bool // source -> overwrite
+	skipped   []string
+	failed    []string
+	info      map[string]bookInfo
+	warnings  []string
+}
+
+// run converts all books under "roots".
+func (mt *manifestTest) run(roots ...string) *manifestRun {
+	mt.t.Helper()
+
+	res := &manifestRun{converted: make(map[string]bool), info: make(map[string]bookInfo)}
+	warnings := logWarnings(mt.env)
+
+	b, err := prepareBatch(context.Background(), 1, 0, true, processor.OEpub, false, false, mt.dst, nil, mt.env)
+	if err != nil {
+		mt.t.Fatal(err)
+	}
+	for _, src := range sortedKeys(mt.books) {
+		src := src
+		b.add(src, loadBytes(mt.books[src]), func(ctx context.Context, env *state.LocalEnv, r io.Reader, overwrite bool) (bookInfo, error) {
+			res.converted[src] = overwrite
+			if mt.bad[src] {
+				return bookInfo{}, errors.New("bad book")
+			}
+			out := filepath.Join(mt.dst, filepath.Base(src)+".epub")
+			if err := os.WriteFile(out, []byte(src), 0600); err != nil {
+				return bookInfo{}, err
+			}
+			return bookInfo{Output: out, Title: "Book " + mt.books[src], Authors: []string{"Author"}, Series: "Series", SeqNum: 1, Lang: "ru"}, nil
+		})
+	}
+	b.finish(roots...)
+
+	for _, r := range b.results {
+		res.info[r.src] = r.info
+		switch {
+		case r.err != nil:
+			res.failed = append(res.failed, r.src)
+		case r.skipped:
+			res.skipped = append(res.skipped, r.src)
+		}
+	}
+	res.warnings = warnings()
+	return res
+}
+
+// entries returns manifest lines.
+func (mt *manifestTest) entries() []*manifestEntry {
+	mt.t.Helper()
+
+	f, err := os.Open(filepath.Join(mt.dst, manifestName))
+	if err != nil {
+		mt.t.Fatal(err)
+	}
+	defer f.Close()
+
+	var res []*manifestEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := &manifestEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			mt.t.Fatal(err)
+		}
+		res = append(res, e)
+	}
+	if err := scanner.Err(); err != nil {
+		mt.t.Fatal(err)
+	}
+	return res
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestManifest(t *testing.T) {
+
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	a, b, c := filepath.Join(src, "a.fb2"), filepath.Join(src, "b.fb2"), filepath.Join(src, "c.fb2")
+	mt := &manifestTest{
+		t:     t,
+		env:   testEnv(t),
+		dst:   filepath.Join(tmp, "dst"),
+		books: map[string]string{a: "a", b: "b", c: "c"},
+		bad:   map[string]bool{},
+	}
+
+	// new books
+	res := mt.run(src)
+	if len(res.converted) != 3 || res.converted[a] || res.converted[b] || res.converted[c] || len(res.skipped) > 0 {
+		t.Fatalf("first run: converted %v, skipped %q", res.converted, res.skipped)
+	}
+	entries := mt.entries()
+	if len(entries) != 3 {
+		t.Fatalf("manifest has %d entries, expected 3", len(entries))
+	}
+	for i, e := range entries {
+		if e.Source != []string{a, b, c}[i] || e.Output != filepath.Base(e.Source)+".epub" || e.Hash != contentHash([]byte(mt.books[e.Source])) || e.Removed {
+			t.Errorf("unexpected manifest entry %+v", e)
+		}
+	}
+
+	// nothing changed
+	res = mt.run(src)
+	if len(res.converted) != 0 || !reflect.DeepEqual(res.skipped, []string{a, b, c}) {
+		t.Fatalf("unchanged run: converted %v, skipped %q", res.converted, res.skipped)
+	}
+	// unchanged books are described by manifest
+	for _, src := range []string{a, b, c} {
+		want := bookInfo{Output: filepath.Join(mt.dst, filepath.Base(src)+".epub"), Title: "Book " + mt.books[src], Authors: []string{"Author"}, Series: "Series", SeqNum: 1, Lang: "ru"}
+		if !reflect.DeepEqual(res.info[src], want) {
+			t.Errorf("unchanged %s: %+v, expected %+v", src, res.info[src], want)
+		}
+	}
+
+	// content changed, output removed, conversion failed
+	mt.books[a], mt.books[c] = "a2", "c2"
+	if err := os.Remove(filepath.Join(mt.dst, "b.fb2.epub")); err != nil {
+		t.Fatal(err)
+	}
+	mt.bad[c] = true
+	res = mt.run(src)
+	if len(res.converted) != 3 || !res.converted[a] || !res.converted[b] || !res.converted[c] || !reflect.DeepEqual(res.failed, []string{c}) {
+		t.Fatalf("changed run: converted %v, failed %q", res.converted, res.failed)
+	}
+	entries = mt.entries()
+	if len(entries) != 2 || entries[0].Source != a || entries[0].Hash != contentHash([]byte("a2")) || entries[1].Source != b {
+		t.Fatalf("unexpected manifest after changes %+v", entries)
+	}
+
+	// failed book is converted again as new one
+	mt.bad[c] = false
+	res = mt.run(src)
+	if overwrite, ok := res.converted[c]; len(res.converted) != 1 || !ok || overwrite {
+		t.Fatalf("run after failure: converted %v", res.converted)
+	}
+
+	// configuration changed
+	mt.env.Cfg.Doc.TitleFormat = "{{.BookTitle}} changed"
+	res = mt.run(src)
+	if len(res.converted) != 3 || !res.converted[a] || !res.converted[b] || !res.converted[c] {
+		t.Fatalf("run after configuration change: converted %v", res.converted)
+	}
+
+	// source disappeared, only books under roots are reported
+	delete(mt.books, b)
+	delete(mt.books, c)
+	res = mt.run(c)
+	if len(res.warnings) != 1 || res.warnings[0] != "Source of converted book disappeared" {
+		t.Fatalf("unexpected warnings %q", res.warnings)
+	}
+	entries = mt.entries()
+	if len(entries) != 2 || entries[0].Source != a || entries[1].Source != b {
+		t.Fatalf("unexpected manifest after removal %+v", entries)
+	}
+}
+
+func TestManifestJournal(t *testing.T) {
+
+	dst := t.TempDir()
+	env := testEnv(t)
+	out := filepath.Join(dst, "a.epub")
+	if err := os.WriteFile(out, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupted batch leaves journal with replaced and removed entries and possibly partial last line
+	m, err := openManifest(dst, processor.OEpub, false, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		m.record("a", "1", bookInfo{Output: out}),
+		m.record("b", "1", bookInfo{Output: out}),
+		m.record("a", "2", bookInfo{Output: out}),
+		m.forget("b"),
+		m.forget("c"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.journal.WriteString(`{"source":"d","ha`); err != nil {
+		t.Fatal(err)
+	}
+	m.journal.Close()
+
+	warnings := logWarnings(env)
+	m, err = openManifest(dst, processor.OEpub, false, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := warnings(); len(w) != 1 || w[0] != "Skipping bad manifest entry" {
+		t.Errorf("unexpected warnings %q", w)
+	}
+	for _, c := range []struct {
+		src, hash string
+		state     bookState
+	}{
+		{"a", "2", bookUnchanged},
+		{"a", "1", bookChanged},
+		{"b", "1", bookNew},
+		{"c", "1", bookNew},
+		{"d", "1", bookNew},
+	} {
+		if s, _ := m.check(c.src, c.hash); s != c.state {
+			t.Errorf("%s with hash %s: state %d, expected %d", c.src, c.hash, s, c.state)
+		}
+	}
+
+	// same configuration with different output format or layout is not the same
+	for _, c := range []struct {
+		format processor.OutputFmt
+		nodirs bool
+	}{
+		{processor.OKepub, false},
+		{processor.OEpub, true},
+	} {
+		other, err := openManifest(dst, c.format, c.nodirs, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, _ := other.check("a", "2"); s != bookChanged {
+			t.Errorf("%s, nodirs %t: state %d, expected changed", c.format, c.nodirs, s)
+		}
+		other.journal.Close()
+	}
+
+	if err := m.close(nil, env); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dst, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"source":"a","hash":"2"`) || !strings.Contains(lines[0], `"output":"a.epub"`) {
+		t.Errorf("manifest was not compacted: %q", lines)
+	}
+}
@@ -3,6 +3,7 @@ package commands
 
 import (
 	"archive/zip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
+	"golang.org/x/net/html/charset"
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/ianaindex"
 
@@ -24,40 +26,124 @@ import (
 	"fb2converter/state"
 )
 
-// processBook processes single FB2 file. "src" is part of the source path (always including file name) relative to the original
-// path. When actual file was specified it will be just base file name without a path. When looking inside archive or directory
-// it will be relative path inside archive or directory (including base file name).
-func processBook(r io.Reader, enc srcEncoding, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) error {
+// StdoutDestination used as destination requests converted book to be written to stdout.
+const StdoutDestination = "-"
 
-	var fname string
+// saveBook stores conversion results in destination directory or writes them to stdout.
+func saveBook(ctx context.Context, p *processor.Processor, dst string) (string, error) {
+	if dst == StdoutDestination {
+		return p.SaveTo(ctx, os.Stdout)
+	}
+	return p.Save(ctx)
+}
+
+// newProcessorFunc creates book processor, it has the same signature as processor.NewFB3.
+type newProcessorFunc func(r io.Reader, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) (*processor.Processor, error)
+
+// newFB2Processor returns constructor for FB2 book, "enc" is BOM encoding detected when book was recognized.
+func newFB2Processor(enc processor.BOMEncoding) newProcessorFunc {
+	return func(r io.Reader, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) (*processor.Processor, error) {
+		// when there is no BOM encoding has to be taken from XML declaration
+		return processor.NewFB2(processor.BOMReader(r, enc), enc == processor.BOMNone, src, dst, nodirs, stk, overwrite, format, env)
+	}
+}
+
+// detectBook checks if file is FB3 or FB2 book and returns constructor for its processor, nil if file is not a book.
+func detectBook(path string) (newProcessorFunc, error) {
+	if ok, err := isZipFile(path, ".fb3"); err != nil {
+		return nil, err
+	} else if ok {
+		return processor.NewFB3, nil
+	}
+	if ok, enc, err := isBookFile(path); err != nil {
+		return nil, err
+	} else if ok {
+		return newFB2Processor(enc), nil
+	}
+	return nil, nil
+}
+
+// detectBookInArchive is detectBook for compressed file.
+func detectBookInArchive(f *zip.File) (newProcessorFunc, error) {
+	if isFB3InArchive(f) {
+		return processor.NewFB3, nil
+	}
+	if ok, enc, err := isBookInArchive(f); err != nil {
+		return nil, err
+	} else if ok {
+		return newFB2Processor(enc), nil
+	}
+	return nil, nil
+}
+
+// processBook processes single FB2 or FB3 file created by "newProcessor". "src" is part of the source path (always including file
+// name) relative to the original path. When actual file was specified it will be just base file name without a path. When looking
+// inside archive or directory it will be relative path inside archive or directory (including base file name).
+func processBook(ctx context.Context, r io.Reader, newProcessor newProcessorFunc, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) (info bookInfo, err error) {
 
 	env.Log.Info("Conversion starting", zap.String("from", src))
 	defer func(start time.Time) {
 		if r := recover(); r != nil {
-			env.Log.Error("Conversion ended with panic", zap.Duration("elapsed", time.Since(start)), zap.String("to", fname), zap.ByteString("stack", debug.Stack()))
+			env.Log.Error("Conversion ended with panic", zap.Duration("elapsed", time.Since(start)), zap.String("to", info.Output), zap.ByteString("stack", debug.Stack()))
+			info.Output, err = "", fmt.Errorf("conversion ended with panic: %v", r)
 		} else {
-			env.Log.Info("Conversion completed", zap.Duration("elapsed", time.Since(start)), zap.String("to", fname))
+			env.Log.Info("Conversion completed", zap.Duration("elapsed", time.Since(start)), zap.String("to", info.Output))
 		}
 	}(time.Now())
 
-	p, err := processor.NewFB2(selectReader(r, enc), enc == encUnknown, src, dst, nodirs, stk, overwrite, format, env)
+	p, err := newProcessor(r, src, dst, nodirs, stk, overwrite, format, env)
 	if err != nil {
-		return err
+		return info, err
 	}
-	if err = p.Process(); err != nil {
-		return err
+	defer info.describe(p, env)
+	// temporary files should not be left behind even when conversion failed or was interrupted
+	defer func() {
+		if cerr := p.Clean(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	if err = p.Process(ctx); err != nil {
+		return info, err
 	}
-	if fname, err = p.Save(); err != nil {
-		return err
+	if info.Output, err = saveBook(ctx, p, dst); err != nil {
+		return info, err
 	}
-	if err = p.SendToKindle(fname); err != nil {
-		return err
+	return info, p.SendToKindle(info.Output)
+}
+
+// processFile schedules processing of a single file found under "dir": fb2 or fb3 book or archive with books. Returns
+// true if file is a book.
+func processFile(path, dir string, format processor.OutputFmt, nodirs, stk bool, cpage encoding.Encoding, dst string, b *batch, env *state.LocalEnv) bool {
+
+	if ok, err := isZipFile(path, ".zip"); err != nil {
+		// checking format - but cannot open target file
+		env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+	} else if ok {
+		if err := processArchive(path, "", filepath.Dir(strings.TrimPrefix(path, dir)), format, nodirs, stk, cpage, dst, b, env); err != nil {
+			env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
+		}
+	} else if newProcessor, err := detectBook(path); err != nil {
+		env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+	} else if newProcessor != nil {
+		b.add(path, loadFile(path), func(ctx context.Context, env *state.LocalEnv, r io.Reader, overwrite bool) (bookInfo, error) {
+			info, err := processBook(ctx, r, newProcessor,
+				strings.TrimPrefix(strings.TrimPrefix(path, dir), string(filepath.Separator)), dst,
+				nodirs, stk, overwrite, format, env)
+			if err != nil {
+				env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+			}
+			return info, err
+		})
+		return true
+	} else {
+		env.Log.Debug("Skipping file, not recognized as book or archive", zap.String("file", path))
 	}
-	return p.Clean()
+	return false
 }
 
-// processDir walks directory tree finding fb2 files and processes them.
-func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite bool, cpage encoding.Encoding, dst string, env *state.LocalEnv) (err error) {
+// processDir walks directory tree finding fb2 files and schedules their processing.
+func processDir(dir string, format processor.OutputFmt, nodirs, stk bool, cpage encoding.Encoding, dst string, b *batch, env *state.LocalEnv) (err error) {
 
 	count := 0
 	defer func() {
@@ -67,35 +153,14 @@ func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite b
 	}()
 
 	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
 		if err != nil {
 			env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
 		} else if info.Mode().IsRegular() {
-			var enc srcEncoding
-			if ok, err := isArchiveFile(path); err != nil {
-				// checking format - but cannot open target file
-				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
-			} else if ok {
-				if err := processArchive(path, "", filepath.Dir(strings.TrimPrefix(path, dir)), format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
-					env.Log.Error("Unable to process archive", zap.String("file", path), zap.Error(err))
-				}
-			} else if ok, enc, err = isBookFile(path); err != nil {
-				env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
-			} else if ok {
+			if processFile(path, dir, format, nodirs, stk, cpage, dst, b, env) {
 				count++
-				// encoding will be handled properly by processBook
-				if file, err := os.Open(path); err != nil {
-					env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
-				} else {
-					defer file.Close()
-					if err := processBook(file, enc,
-						strings.TrimPrefix(strings.TrimPrefix(path, dir), string(filepath.Separator)), dst,
-						nodirs, stk, overwrite, format, env); err != nil {
-
-						env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
-					}
-				}
-			} else {
-				env.Log.Debug("Skipping file, not recognized as book or archive", zap.String("file", path))
 			}
 		}
 		return nil
@@ -103,8 +168,82 @@ func processDir(dir string, format processor.OutputFmt, nodirs, stk, overwrite b
 	return err
 }
 
-// processArchive walks all files inside archive, finds fb2 files under "pathIn" and processes them.
-func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, nodirs, stk, overwrite bool, cpage encoding.Encoding, dst string, env *state.LocalEnv) (err error) {
+// archivePath returns name of the file in archive, converting it from forced or detected encoding if necessary.
+func archivePath(f *zip.File, cpage encoding.Encoding, env *state.LocalEnv) string {
+	apath := f.FileHeader.Name
+	if cpage != nil && f.FileHeader.NonUTF8 {
+		// forcing zip file name encoding
+		if n, err := cpage.NewDecoder().String(apath); err == nil {
+			apath = n
+		} else {
+			n, _ = ianaindex.IANA.Name(cpage)
+			env.Log.Warn("Unable to convert archive name from specified encoding", zap.String("charset", n), zap.String("path", apath), zap.Error(err))
+		}
+	}
+	return apath
+}
+
+// zipNamesCodepage detects encoding of file names in archive which are not marked as UTF-8. Returns nil if names could be
+// used as is.
+func zipNamesCodepage(path string, env *state.LocalEnv) encoding.Encoding {
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+
+	var names []byte
+	for _, f := range r.File {
+		if f.FileHeader.NonUTF8 {
+			names = append(names, f.FileHeader.Name...)
+			names = append(names, '\n')
+		}
+	}
+	name := processor.DetectCharset(names, "")
+	if len(name) == 0 || name == "utf-8" {
+		return nil
+	}
+	cpage, _ := charset.Lookup(name)
+	env.Log.Info("Detected encoding of file names in archive", zap.String("archive", path), zap.String("charset", name))
+	return cpage
+}
+
+// loadFile returns function to read book from file.
+func loadFile(path string) func(env *state.LocalEnv) ([]byte, error) {
+	return func(env *state.LocalEnv) ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+		}
+		return data, err
+	}
+}
+
+// loadFromArchive reads whole file from archive right away, so it could be processed after archive is closed, and returns
+// function to access the results.
+func loadFromArchive(archive string, f *zip.File) func(env *state.LocalEnv) ([]byte, error) {
+	data, err := func() ([]byte, error) {
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}()
+	return func(env *state.LocalEnv) ([]byte, error) {
+		if err != nil {
+			env.Log.Error("Unable to process file in archive",
+				zap.String("archive", archive),
+				zap.String("file", f.FileHeader.Name),
+				zap.Error(err))
+		}
+		return data, err
+	}
+}
+
+// processArchive walks all files inside archive, finds fb2 files under "pathIn" and schedules their processing.
+func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, nodirs, stk bool, cpage encoding.Encoding, dst string, b *batch, env *state.LocalEnv) (err error) {
 
 	count := 0
 	defer func() {
@@ -113,47 +252,57 @@ func processArchive(path, pathIn, pathOut string, format processor.OutputFmt, no
 		}
 	}()
 
+	if cpage == nil {
+		cpage = zipNamesCodepage(path, env)
+	}
+
 	err = archive.Walk(path, pathIn, func(archive string, f *zip.File) error {
-		if ok, enc, err := isBookInArchive(f); err != nil {
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
+		name := f.FileHeader.Name
+		if newProcessor, err := detectBookInArchive(f); err != nil {
 			env.Log.Warn("Skipping file in archive",
 				zap.String("archive", archive),
-				zap.String("path", f.FileHeader.Name),
+				zap.String("path", name),
 				zap.Error(err))
-		} else if ok {
+		} else if newProcessor != nil {
 			count++
-			// encoding will be handled properly by processBook
-			if r, err := f.Open(); err != nil {
-				env.Log.Error("Unable to process file in archive",
-					zap.String("archive", archive),
-					zap.String("file", f.FileHeader.Name),
-					zap.Error(err))
-			} else {
-				defer r.Close()
-				apath := f.FileHeader.Name
-				if cpage != nil && f.FileHeader.NonUTF8 {
-					// forcing zip file name encoding
-					if n, err := cpage.NewDecoder().String(apath); err == nil {
-						apath = n
-					} else {
-						n, _ = ianaindex.IANA.Name(cpage)
-						env.Log.Warn("Unable to convert archive name from specified encoding", zap.String("charset", n), zap.String("path", apath), zap.Error(err))
-					}
-				}
-				if err := processBook(r, enc, filepath.Join(pathOut, apath), dst, nodirs, stk, overwrite, format, env); err != nil {
+			apath := archivePath(f, cpage, env)
+			b.add(filepath.Join(archive, name), loadFromArchive(archive, f), func(ctx context.Context, env *state.LocalEnv, r io.Reader, overwrite bool) (bookInfo, error) {
+				info, err := processBook(ctx, r, newProcessor, filepath.Join(pathOut, apath), dst, nodirs, stk, overwrite, format, env)
+				if err != nil {
 					env.Log.Error("Unable to process file in archive",
 						zap.String("archive", archive),
-						zap.String("file", f.FileHeader.Name),
+						zap.String("file", name),
 						zap.Error(err))
 				}
-			}
+				return info, err
+			})
 		} else {
-			env.Log.Debug("Skipping file, not recognized as book", zap.String("archive", archive), zap.String("file", f.FileHeader.Name))
+			env.Log.Debug("Skipping file, not recognized as book", zap.String("archive", archive), zap.String("file", name))
 		}
 		return nil
 	})
 	return err
 }
 
+// zipCodepage returns encoding to be forced for all non UTF-8 file names in archives, nil if none was requested.
+func zipCodepage(page string, env *state.LocalEnv) encoding.Encoding {
+
+	if len(page) == 0 {
+		return nil
+	}
+	cpage, err := ianaindex.IANA.Encoding(page)
+	if err != nil {
+		env.Log.Warn("Unknown character set specification. Ignoring...", zap.String("charset", page), zap.Error(err))
+		return nil
+	}
+	n, _ := ianaindex.IANA.Name(cpage)
+	env.Log.Debug("Forcefully convert all non UTF-8 file names in archives", zap.String("charset", n))
+	return cpage
+}
+
 // Convert is "convert" command body.
 func Convert(ctx *cli.Context) (err error) {
 
@@ -174,7 +323,12 @@ func Convert(ctx *cli.Context) (err error) {
 	}
 
 	dst := ctx.Args().Get(1)
-	if len(dst) == 0 {
+	toStdout := dst == StdoutDestination
+	if toStdout {
+		if ctx.Bool("incremental") {
+			return cli.Exit(errors.New(errPrefix+"incremental conversion requires destination directory"), errCode)
+		}
+	} else if len(dst) == 0 {
 		if dst, err = os.Getwd(); err != nil {
 			return cli.Exit(fmt.Errorf("%sunable to get working directory", errPrefix), errCode)
 		}
@@ -188,19 +342,19 @@ func Convert(ctx *cli.Context) (err error) {
 	switch env.Mhl {
 	case config.MhlMobi:
 		format = processor.ParseFmtString(env.Cfg.Fb2Mobi.OutputFormat)
-		if format == processor.UnsupportedOutputFmt || format == processor.OEpub || format == processor.OKepub {
+		if format != processor.OMobi && format != processor.OAzw3 {
 			env.Log.Warn("Unknown output format in MHL mode requested, switching to mobi", zap.String("format", env.Cfg.Fb2Mobi.OutputFormat))
 			format = processor.OMobi
 		}
 	case config.MhlEpub:
 		format = processor.ParseFmtString(env.Cfg.Fb2Epub.OutputFormat)
-		if format == processor.UnsupportedOutputFmt || format == processor.OMobi || format == processor.OAzw3 {
+		if format != processor.OEpub && format != processor.OKepub && format != processor.OEpub3 {
 			env.Log.Warn("Unknown output format in MHL mode requested, switching to epub", zap.String("format", env.Cfg.Fb2Epub.OutputFormat))
 			format = processor.OEpub
 		}
 	default:
 		format = processor.ParseFmtString(ctx.String("to"))
-		if format == processor.UnsupportedOutputFmt {
+		if format == processor.UnsupportedOutputFmt || format == processor.OFb2 {
 			env.Log.Warn("Unknown output format requested, switching to epub", zap.String("format", ctx.String("to")))
 			format = processor.OEpub
 		}
@@ -208,23 +362,19 @@ func Convert(ctx *cli.Context) (err error) {
 	nodirs := ctx.Bool("nodirs")
 	overwrite := ctx.Bool("ow")
 
+	jobs := ctx.Int("jobs")
+	if jobs < 0 {
+		env.Log.Warn("Invalid number of jobs requested, converting books one by one", zap.Int("jobs", jobs))
+		jobs = 1
+	}
+	incremental := ctx.Bool("incremental")
+	timeout := bookTimeout(ctx, env)
+
 	if !env.Cfg.Doc.ChapterPerFile && (env.Cfg.Doc.PagesPerFile != math.MaxInt32 || len(env.Cfg.Doc.ChapterDividers) > 0) {
 		env.Log.Warn("With chapter_per_file=false settings to control resulting content size (ex: pages_per_file, chapter_subtitle_dividers) will be ignored")
 	}
 
-	var cpage encoding.Encoding
-
-	page := ctx.String("force-zip-cp")
-	if len(page) > 0 {
-		cpage, err = ianaindex.IANA.Encoding(page)
-		if err != nil {
-			env.Log.Warn("Unknown character set specification. Ignoring...", zap.String("charset", page), zap.Error(err))
-			cpage = nil
-		} else {
-			n, _ := ianaindex.IANA.Name(cpage)
-			env.Log.Debug("Forcefully convert all non UTF-8 file names in archives", zap.String("charset", n))
-		}
-	}
+	cpage := zipCodepage(ctx.String("force-zip-cp"), env)
 
 	stk := ctx.Bool("stk")
 	if env.Mhl == config.MhlMobi {
@@ -234,12 +384,40 @@ func Convert(ctx *cli.Context) (err error) {
 		env.Log.Warn("Send to Kindle could only be used with mobi output format, turning off", zap.Stringer("format", format))
 		stk = false
 	}
+	if stk && toStdout {
+		env.Log.Warn("Send to Kindle could not be used when writing to stdout, turning off")
+		stk = false
+	}
+
+	var rep *report
+	if fname := ctx.String("report"); len(fname) > 0 {
+		if fname, err = filepath.Abs(fname); err != nil {
+			return cli.Exit(fmt.Errorf("%scleaning report path failed", errPrefix), errCode)
+		}
+		rep = newReport(fname, src, dst, format)
+		defer func() {
+			if err := rep.save(); err != nil {
+				env.Log.Error("Unable to save report", zap.String("file", rep.fname), zap.Error(err))
+			}
+		}()
+	}
 
 	env.Log.Info("Processing starting", zap.String("source", src), zap.String("destination", dst), zap.Stringer("format", format))
 	defer func(start time.Time) {
 		env.Log.Info("Processing completed", zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
+	sctx, stop := signalContext()
+	defer stop()
+	defer func() {
+		if sctx.Err() != nil {
+			err = cli.Exit(errors.New(errPrefix+"interrupted, not all books were converted"), errCode)
+		}
+	}()
+
+	// books which could not be converted, each one was logged already
+	var failed int
+
 	var head, tail string
 	for head = src; len(head) != 0; head, tail = filepath.Split(head) {
 
@@ -252,11 +430,21 @@ func Convert(ctx *cli.Context) (err error) {
 		}
 
 		if fi.Mode().IsDir() {
+			if toStdout {
+				return cli.Exit(errors.New(errPrefix+"only single book could be written to stdout"), errCode)
+			}
 			if len(tail) != 0 {
 				// directory cannot have tail - it would be simple file
 				return cli.Exit(fmt.Errorf("%sinput source was not found (%s) => (%s)", errPrefix, head, strings.TrimPrefix(src, head)), errCode)
 			}
-			if err := processDir(head, format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
+			b, err := prepareBatch(sctx, jobs, timeout, incremental, format, nodirs, overwrite, dst, rep, env)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+			}
+			err = processDir(head, format, nodirs, stk, cpage, dst, b, env)
+			b.finish(head)
+			failed += b.failed()
+			if err != nil {
 				return cli.Exit(fmt.Errorf("%sunable to process directory", errPrefix), errCode)
 			}
 			break
@@ -264,44 +452,54 @@ func Convert(ctx *cli.Context) (err error) {
 
 		if fi.Mode().IsRegular() {
 
-			ok, err := isArchiveFile(head)
+			ok, err := isZipFile(head, ".zip")
 			if err != nil {
 				// checking format - but cannot open target file
 				return cli.Exit(fmt.Errorf("%sunable to check archive type: %w", errPrefix, err), errCode)
 			}
 
 			if ok {
+				if toStdout {
+					return cli.Exit(errors.New(errPrefix+"only single book could be written to stdout"), errCode)
+				}
 				// we need to look inside to see if path makes sense
 				tail = strings.TrimPrefix(strings.TrimPrefix(src, head), string(filepath.Separator))
-				if err := processArchive(head, tail, "", format, nodirs, stk, overwrite, cpage, dst, env); err != nil {
+				b, err := prepareBatch(sctx, jobs, timeout, incremental, format, nodirs, overwrite, dst, rep, env)
+				if err != nil {
+					return cli.Exit(fmt.Errorf("%s%w", errPrefix, err), errCode)
+				}
+				err = processArchive(head, tail, "", format, nodirs, stk, cpage, dst, b, env)
+				b.finish(src)
+				failed += b.failed()
+				if err != nil {
 					return cli.Exit(fmt.Errorf("%sunable to process archive: %w", errPrefix, err), errCode)
 				}
 				break
 			}
 
-			var enc srcEncoding
-			ok, enc, err = isBookFile(head)
+			newProcessor, err := detectBook(head)
 			if err != nil {
 				// checking format - but cannot open target file
 				return cli.Exit(fmt.Errorf("%sunable to check file type: %w", errPrefix, err), errCode)
-
 			}
 
-			if ok && len(tail) == 0 {
+			if newProcessor != nil && len(tail) == 0 {
 				// we have book, it cannot have tail
-				// encoding will be handled properly by processBook
-				if file, err := os.Open(head); err != nil {
-					env.Log.Error("Unable to process file", zap.String("file", head), zap.Error(err))
-				} else {
-					defer file.Close()
-					if err := processBook(file, enc, filepath.Base(head), dst, nodirs, stk, overwrite, format, env); err != nil {
+				b := newBatch(sctx, 1, timeout, overwrite, nil, env)
+				b.report = rep
+				b.add(head, loadFile(head), func(ctx context.Context, env *state.LocalEnv, r io.Reader, overwrite bool) (bookInfo, error) {
+					info, err := processBook(ctx, r, newProcessor, filepath.Base(head), dst, nodirs, stk, overwrite, format, env)
+					if err != nil {
 						env.Log.Error("Unable to process file", zap.String("file", head), zap.Error(err))
 					}
-				}
+					return info, err
+				})
+				b.finish(head)
+				failed += b.failed()
 				break
 			}
 
-			return cli.Exit(fmt.Errorf("%sinput was not recognized as FB2 book (%s)", errPrefix, head), errCode)
+			return cli.Exit(fmt.Errorf("%sinput was not recognized as FB2 or FB3 book (%s)", errPrefix, head), errCode)
 		}
 
 		return cli.Exit(fmt.Errorf("%sunexpected path mode for (%s) => (%s)", errPrefix, head, strings.TrimPrefix(src, head)), errCode)
@@ -309,6 +507,8 @@ func Convert(ctx *cli.Context) (err error) {
 	if len(head) == 0 {
 		return cli.Exit(fmt.Errorf("%sinput source was not found (%s)", errPrefix, src), errCode)
 	}
-
+	if failed > 0 {
+		return cli.Exit(fmt.Errorf("%s%d book(s) could not be converted", errPrefix, failed), errCode)
+	}
 	return nil
 }
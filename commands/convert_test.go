@@ -0,0 +1,237 @@
+package commands
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+)
+
+var convertFlags = []cli.Flag{
+	&cli.StringFlag{Name: "to", Value: "epub"},
+	&cli.BoolFlag{Name: "nodirs"},
+	&cli.BoolFlag{Name: "stk"},
+	&cli.BoolFlag{Name: "ow"},
+	&cli.StringFlag{Name: "force-zip-cp"},
+	&cli.IntFlag{Name: "jobs", Value: 1},
+	&cli.BoolFlag{Name: "incremental"},
+	&cli.StringFlag{Name: "report"},
+	&cli.DurationFlag{Name: "book-timeout"},
+}
+
+type testReport struct {
+	Converted int            `json:"converted"`
+	Unchanged int            `json:"unchanged"`
+	Failed    int            `json:"failed"`
+	Books     []reportRecord `json:"books"`
+}
+
+func readReport(t *testing.T, fname string) testReport {
+	t.Helper()
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("report was not written: %v", err)
+	}
+	var rep testReport
+	if err := json.Unmarshal(data, &rep); err != nil {
+		t.Fatalf("unable to parse report: %v", err)
+	}
+	return rep
+}
+
+func TestConvertExitCode(t *testing.T) {
+
+	cases := []struct {
+		name    string
+		jobs    string
+		timeout time.Duration
+		code    int
+		status  string
+	}{
+		{"converted", "1", 0, 0, statusConverted},
+		{"converted concurrently", "2", 0, 0, statusConverted},
+		{"timed out", "1", time.Nanosecond, 1, statusFailed},
+		{"timed out concurrently", "2", time.Nanosecond, 1, statusFailed},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			src, dst, fname := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst"), filepath.Join(tmp, "report.json")
+			copyBook(t, src, "a/book1.fb2")
+			copyBook(t, src, "b/book2.fb2")
+
+			err := runCommand(testEnv(t), Convert, convertFlags,
+				"--jobs", c.jobs, "--book-timeout", c.timeout.String(), "--report", fname, src, dst)
+			if code := exitCode(err); code != c.code {
+				t.Fatalf("exit code %d, expected %d (%v)", code, c.code, err)
+			}
+
+			rep := readReport(t, fname)
+			if len(rep.Books) != 2 {
+				t.Fatalf("report has %d books, expected 2", len(rep.Books))
+			}
+			for _, rec := range rep.Books {
+				if rec.Status != c.status {
+					t.Errorf("%s: status %q, expected %q (%s)", rec.Source, rec.Status, c.status, rec.Error)
+				}
+				if c.status == statusFailed && len(rec.Error) == 0 {
+					t.Errorf("%s: failure has no error text", rec.Source)
+				}
+				if c.status == statusConverted {
+					if _, err := os.Stat(rec.Output); err != nil {
+						t.Errorf("%s: output is missing: %v", rec.Source, err)
+					}
+					if rec.Title != "Тестовая книга" || rec.Series != "Серия" || rec.SeqNum != 2 || rec.Lang != "ru" {
+						t.Errorf("%s: unexpected book information %+v", rec.Source, rec)
+					}
+				}
+			}
+			if rep.Converted+rep.Failed != 2 || (c.code == 0) != (rep.Failed == 0) {
+				t.Errorf("unexpected totals: converted %d, failed %d", rep.Converted, rep.Failed)
+			}
+		})
+	}
+}
+
+func TestConvertSingleBookExitCode(t *testing.T) {
+
+	tmp := t.TempDir()
+	src := copyBook(t, tmp, "book.fb2")
+	fname := filepath.Join(tmp, "report.json")
+
+	err := runCommand(testEnv(t), Convert, convertFlags, "--book-timeout", "1ns", "--report", fname, src, filepath.Join(tmp, "dst"))
+	if code := exitCode(err); code != 1 {
+		t.Fatalf("exit code %d, expected 1 (%v)", code, err)
+	}
+	if rep := readReport(t, fname); len(rep.Books) != 1 || rep.Books[0].Status != statusFailed {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+}
+
+func TestConvertFB3(t *testing.T) {
+
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeFB3(t, filepath.Join(src, "dir", "book.fb3"))
+	copyBook(t, src, "dir/other.fb2")
+
+	// FB3 book inside archive is recognized by its name only
+	writeFB3(t, filepath.Join(tmp, "packed.fb3"))
+	data, err := os.ReadFile(filepath.Join(tmp, "packed.fb3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeZip(t, filepath.Join(src, "books.zip"), map[string]string{"inner/packed.fb3": string(data), "readme.txt": "not a book"})
+
+	for _, c := range []struct {
+		name  string
+		src   string
+		books int
+	}{
+		{"single", filepath.Join(src, "dir", "book.fb3"), 1},
+		{"archive", filepath.Join(src, "books.zip"), 1},
+		{"directory", src, 3},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dst, fname := filepath.Join(tmp, c.name), filepath.Join(tmp, c.name+".json")
+			err := runCommand(testEnv(t), Convert, convertFlags, "--report", fname, c.src, dst)
+			if code := exitCode(err); code != 0 {
+				t.Fatalf("exit code %d (%v)", code, err)
+			}
+			rep := readReport(t, fname)
+			if len(rep.Books) != c.books || rep.Converted != c.books {
+				t.Fatalf("unexpected report %+v", rep)
+			}
+			for _, rec := range rep.Books {
+				if rec.Status != statusConverted {
+					t.Errorf("%s: status %q (%s)", rec.Source, rec.Status, rec.Error)
+				}
+				if strings.HasSuffix(rec.Source, ".fb3") && (rec.Title != "Книга FB3" || rec.Series != "Серия" || rec.SeqNum != 3) {
+					t.Errorf("%s: unexpected book information %+v", rec.Source, rec)
+				}
+				if _, err := os.Stat(rec.Output); err != nil {
+					t.Errorf("%s: output is missing: %v", rec.Source, err)
+				}
+			}
+		})
+	}
+}
+
+func TestZipNamesCodepage(t *testing.T) {
+
+	names := []string{"Петров Иван/Тестовая книга.fb2", "Петров Иван/Вторая книга.fb2", "Сборник рассказов.fb2"}
+
+	cases := []struct {
+		name    string
+		charset string // empty - UTF-8 names
+	}{
+		{"utf-8", ""},
+		{"cp866", "ibm866"},
+		{"windows-1251", "windows-1251"},
+		{"koi8-r", "koi8-r"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "books.zip")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want encoding.Encoding
+			if len(c.charset) > 0 {
+				want, _ = charset.Lookup(c.charset)
+			}
+			z := zip.NewWriter(f)
+			for _, n := range names {
+				hdr := &zip.FileHeader{Name: n, Method: zip.Deflate}
+				if want != nil {
+					if hdr.Name, err = want.NewEncoder().String(n); err != nil {
+						t.Fatal(err)
+					}
+					hdr.NonUTF8 = true
+				}
+				if _, err := z.CreateHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := z.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			env := testEnv(t)
+			cpage := zipNamesCodepage(path, env)
+			// detected encoding is checked by decoding names
+			if (cpage == nil) != (want == nil) {
+				t.Fatalf("detected %v, expected %v", cpage, want)
+			}
+
+			r, err := zip.OpenReader(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			for i, zf := range r.File {
+				if got := archivePath(zf, cpage, env); got != names[i] {
+					t.Errorf("name %q, expected %q", got, names[i])
+				}
+			}
+		})
+	}
+
+	// plain ASCII names need no conversion
+	path := filepath.Join(t.TempDir(), "ascii.zip")
+	writeZip(t, path, map[string]string{"book.fb2": ""})
+	if cpage := zipNamesCodepage(path, testEnv(t)); cpage != nil {
+		t.Errorf("detected %v for ASCII names", cpage)
+	}
+}
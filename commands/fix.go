@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// fixBook repairs single FB2 book and writes result to "dst".
+func fixBook(r io.Reader, name, dst string, overwrite bool, env *state.LocalEnv) error {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	enc := processor.DetectBOM(data)
+
+	fixed, decision, repairs, err := processor.RepairFB2(processor.BOMReader(bytes.NewReader(data), enc), enc == processor.BOMNone)
+	if err != nil {
+		return err
+	}
+	if len(decision) > 0 {
+		env.Log.Info("FB2 encoding detected", zap.String("file", name), zap.String("decision", decision))
+	}
+	for _, r := range repairs {
+		env.Log.Warn("Malformed FB2 was repaired", zap.String("file", name), zap.Int("line", r.Line), zap.Int("count", r.Count), zap.String("repair", r.Message))
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		if !overwrite {
+			return fmt.Errorf("output file already exists: %s", dst)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+	if err := os.WriteFile(dst, fixed, 0644); err != nil {
+		return fmt.Errorf("unable to write repaired book: %w", err)
+	}
+	env.Log.Info("Book repaired", zap.String("from", name), zap.String("to", dst), zap.Int("repairs", len(repairs)))
+	return nil
+}
+
+// Fix is "fix" command body.
+func Fix(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "fix: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input source has been specified"), errCode)
+	}
+	src, err = filepath.Abs(src)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%scleaning source path failed: %w", errPrefix, err), errCode)
+	}
+
+	dst := ctx.Args().Get(1)
+	if len(dst) == 0 {
+		if dst, err = os.Getwd(); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to get working directory: %w", errPrefix, err), errCode)
+		}
+	} else {
+		if dst, err = filepath.Abs(dst); err != nil {
+			return cli.Exit(fmt.Errorf("%scleaning destination path failed: %w", errPrefix, err), errCode)
+		}
+	}
+
+	nodirs := ctx.Bool("nodirs")
+	overwrite := ctx.Bool("ow")
+
+	env.Log.Info("Processing starting", zap.String("source", src), zap.String("destination", dst))
+	defer func(start time.Time) {
+		env.Log.Info("Processing completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	var failed int
+	if err := walkFB2(src, func(r io.Reader, name, rel string, err error) {
+		if err == nil {
+			if nodirs {
+				rel = filepath.Base(rel)
+			}
+			err = fixBook(r, name, filepath.Join(dst, rel), overwrite, env)
+		}
+		if err != nil {
+			failed++
+			env.Log.Error("Unable to repair book", zap.String("file", name), zap.Error(err))
+		}
+	}, env); err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to process source: %w", errPrefix, err), errCode)
+	}
+	if failed > 0 {
+		return cli.Exit(fmt.Errorf("%s%d books could not be repaired", errPrefix, failed), errCode)
+	}
+	return nil
+}
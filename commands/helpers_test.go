@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+// testEnv returns program environment with default configuration and silent log.
+func testEnv(t *testing.T) *state.LocalEnv {
+	t.Helper()
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatalf("unable to build configuration: %v", err)
+	}
+	env := state.NewLocalEnv()
+	env.Cfg = cfg
+	env.Log = zap.NewNop()
+	return env
+}
+
+// runCommand executes command action the way cli application does, returning its error.
+func runCommand(env *state.LocalEnv, action cli.ActionFunc, flags []cli.Flag, args ...string) error {
+	app := cli.NewApp()
+	app.Writer, app.ErrWriter = io.Discard, io.Discard
+	app.Flags = []cli.Flag{&cli.GenericFlag{Name: state.FlagName, Hidden: true, Value: env}}
+	app.ExitErrHandler = func(*cli.Context, error) {}
+	app.Commands = []*cli.Command{{Name: "test", Action: action, Flags: flags}}
+	return app.Run(append([]string{"fb2c", "test"}, args...))
+}
+
+// exitCode returns exit code command would terminate program with.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if ec, ok := err.(cli.ExitCoder); ok {
+		return ec.ExitCode()
+	}
+	return -1
+}
+
+// copyBook places test book under "dir" with specified name.
+func copyBook(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "book.fb2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeZip creates zip archive "path" from name -> content map.
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	z := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeFB3 creates minimal FB3 book, package parts are found by default names.
+func writeFB3(t *testing.T, path string) {
+	t.Helper()
+
+	writeZip(t, path, map[string]string{
+		"fb3/description.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<fb3-description id="11111111-2222-3333-4444-555555555555">
+<title><main>Книга FB3</main></title>
+<sequence number="3"><title><main>Серия</main></title></sequence>
+<fb3-relations><subject link="author"><first-name>Иван</first-name><last-name>Петров</last-name></subject></fb3-relations>
+<lang>ru</lang>
+</fb3-description>`,
+		"fb3/body.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<fb3-body><section><title><p>Глава</p></title><p>Текст <em>книги</em>.</p></section></fb3-body>`,
+	})
+}
@@ -0,0 +1,251 @@
+package commands
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// manifestName is the name of the file in destination directory keeping state of incremental conversion.
+const manifestName = ".fb2c-manifest.jsonl"
+
+// manifestEntry describes single converted book. Manifest is kept as JSON lines journal - entries are appended as books
+// are converted, so interrupted batch could be resumed, later entries for the same source replace earlier ones. Book
+// metadata is kept to describe unchanged books in reports.
+type manifestEntry struct {
+	Source  string    `json:"source"`
+	Hash    string    `json:"hash,omitempty"`
+	Config  string    `json:"config,omitempty"`
+	Output  string    `json:"output,omitempty"`
+	Title   string    `json:"title,omitempty"`
+	Authors []string  `json:"authors,omitempty"`
+	Series  string    `json:"series,omitempty"`
+	SeqNum  int       `json:"series_number,omitempty"`
+	Lang    string    `json:"language,omitempty"`
+	Time    time.Time `json:"time"`
+	Removed bool      `json:"removed,omitempty"`
+}
+
+type bookState int
+
+const (
+	bookNew bookState = iota
+	bookChanged
+	bookUnchanged
+)
+
+// manifest tracks conversion results in destination directory.
+type manifest struct {
+	fname   string
+	dst     string
+	config  string
+	mu      sync.Mutex
+	entries map[string]*manifestEntry
+	seen    map[string]bool
+	journal *os.File
+}
+
+// contentHash returns hash of the book content.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// openManifest reads manifest from destination directory (if one exists) and prepares it for new records. Configuration
+// hash covers all effective settings and parameters which affect conversion results.
+func openManifest(dst string, format processor.OutputFmt, nodirs bool, env *state.LocalEnv) (*manifest, error) {
+
+	cfg, err := env.Cfg.GetActualBytes()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get actual configuration: %w", err)
+	}
+	cfg = append(cfg, fmt.Sprintf("\nformat=%s\nnodirs=%t\n", format, nodirs)...)
+
+	m := &manifest{
+		fname:   filepath.Join(dst, manifestName),
+		dst:     dst,
+		config:  contentHash(cfg),
+		entries: make(map[string]*manifestEntry),
+		seen:    make(map[string]bool),
+	}
+
+	if f, err := os.Open(m.fname); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			e := &manifestEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), e); err != nil || len(e.Source) == 0 {
+				// most likely interrupted write
+				env.Log.Warn("Skipping bad manifest entry", zap.String("manifest", m.fname), zap.Int("line", line), zap.Error(err))
+				continue
+			}
+			if e.Removed {
+				delete(m.entries, e.Source)
+			} else {
+				m.entries[e.Source] = e
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read manifest: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to open manifest: %w", err)
+	}
+
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create output directory: %w", err)
+	}
+	if m.journal, err = os.OpenFile(m.fname, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, fmt.Errorf("unable to open manifest: %w", err)
+	}
+	return m, nil
+}
+
+// check compares book with manifest record. For unchanged book results of its last conversion are returned.
+func (m *manifest) check(src, hash string) (bookState, bookInfo) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seen[src] = true
+	e, ok := m.entries[src]
+	if !ok {
+		return bookNew, bookInfo{}
+	}
+	if e.Hash != hash || e.Config != m.config {
+		return bookChanged, bookInfo{}
+	}
+	output := filepath.Join(m.dst, e.Output)
+	if _, err := os.Stat(output); err != nil {
+		// output was removed
+		return bookChanged, bookInfo{}
+	}
+	return bookUnchanged, bookInfo{Output: output, Title: e.Title, Authors: e.Authors, Series: e.Series, SeqNum: e.SeqNum, Lang: e.Lang}
+}
+
+// write appends record to the journal, must be called under lock.
+func (m *manifest) write(e *manifestEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = m.journal.Write(append(data, '\n'))
+	return err
+}
+
+// record remembers successfully converted book.
+func (m *manifest) record(src, hash string, info bookInfo) error {
+
+	output := info.Output
+	if rel, err := filepath.Rel(m.dst, output); err == nil {
+		output = rel
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := &manifestEntry{
+		Source:  src,
+		Hash:    hash,
+		Config:  m.config,
+		Output:  output,
+		Title:   info.Title,
+		Authors: info.Authors,
+		Series:  info.Series,
+		SeqNum:  info.SeqNum,
+		Lang:    info.Lang,
+		Time:    time.Now().UTC(),
+	}
+	m.entries[src] = e
+	if err := m.write(e); err != nil {
+		return fmt.Errorf("unable to update manifest: %w", err)
+	}
+	return nil
+}
+
+// forget drops record for the book, so it would be converted next time.
+func (m *manifest) forget(src string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seen[src] = true
+	if _, ok := m.entries[src]; !ok {
+		return nil
+	}
+	delete(m.entries, src)
+	if err := m.write(&manifestEntry{Source: src, Time: time.Now().UTC(), Removed: true}); err != nil {
+		return fmt.Errorf("unable to update manifest: %w", err)
+	}
+	return nil
+}
+
+// close reports converted books under any of the "roots" whose sources were not found during this run, removes them from
+// the manifest and compacts journal.
+func (m *manifest) close(roots []string, env *state.LocalEnv) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.journal.Close(); err != nil {
+		return fmt.Errorf("unable to close manifest: %w", err)
+	}
+
+	srcs := make([]string, 0, len(m.entries))
+	for src := range m.entries {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+
+	tmp := m.fname + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("unable to write manifest: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, src := range srcs {
+		e := m.entries[src]
+		if !m.seen[src] && underRoots(src, roots) {
+			env.Log.Warn("Source of converted book disappeared", zap.String("source", src), zap.String("output", filepath.Join(m.dst, e.Output)))
+			continue
+		}
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to write manifest: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write manifest: %w", err)
+	}
+	return os.Rename(tmp, m.fname)
+}
+
+// underRoots checks if path is one of the roots or is located under any of them.
+func underRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
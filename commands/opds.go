@@ -0,0 +1,623 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// OPDS 1.2 link and content types.
+const (
+	opdsNavigation  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisition = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	relAcquisition  = "http://opds-spec.org/acquisition"
+	relImage        = "http://opds-spec.org/image"
+	relThumbnail    = "http://opds-spec.org/image/thumbnail"
+	relSortNew      = "http://opds-spec.org/sort/new"
+	opdsPageSize    = 50
+)
+
+// opdsMimeTypes maps output formats offered by the catalog to their media types.
+var opdsMimeTypes = map[processor.OutputFmt]string{
+	processor.OEpub:  "application/epub+zip",
+	processor.OKepub: "application/kepub+zip",
+	processor.OAzw3:  "application/vnd.amazon.mobi8-ebook",
+	processor.OMobi:  "application/x-mobipocket-ebook",
+}
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Authors    []atomAuthor   `xml:"author"`
+	Language   string         `xml:"dc:language,omitempty"`
+	Issued     string         `xml:"dc:issued,omitempty"`
+	Categories []atomCategory `xml:"category"`
+	Content    *atomContent   `xml:"content,omitempty"`
+	Links      []atomLink     `xml:"link"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	DC      string      `xml:"xmlns:dc,attr"`
+	OPDS    string      `xml:"xmlns:opds,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// opdsServer serves library catalog and converts books on request.
+type opdsServer struct {
+	root    string
+	cache   string
+	title   string
+	formats []processor.OutputFmt
+	timeout time.Duration // per book, 0 - no limit
+	env     *state.LocalEnv
+
+	mu    sync.RWMutex
+	index *opdsIndex
+
+	convMu     sync.Mutex
+	converting map[string]*sync.Mutex // book id and format -> conversion lock
+}
+
+func (s *opdsServer) current() *opdsIndex {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index
+}
+
+// rescan rebuilds library index.
+func (s *opdsServer) rescan() {
+	start := time.Now()
+	idx := scanLibrary(s.root, []string{s.cache}, s.current(), s.env)
+	s.mu.Lock()
+	s.index = idx
+	s.mu.Unlock()
+	s.env.Log.Info("Library indexed", zap.String("dir", s.root), zap.Int("books", len(idx.books)), zap.Duration("elapsed", time.Since(start)))
+}
+
+func (s *opdsServer) newFeed(id, title, self, kind string, updated time.Time) *atomFeed {
+	return &atomFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		DC:      "http://purl.org/dc/terms/",
+		OPDS:    "http://opds-spec.org/2010/catalog",
+		ID:      "urn:fb2c:" + id,
+		Title:   title,
+		Updated: atomTime(updated),
+		Links: []atomLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: "/opds", Type: opdsNavigation},
+		},
+	}
+}
+
+func writeFeed(w http.ResponseWriter, f *atomFeed, kind string) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", kind+";charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// feedPage returns requested page of the list and adds navigation links to the feed.
+func feedPage(r *http.Request, f *atomFeed, total int, kind string) (from, to int) {
+
+	n, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if n < 0 {
+		n = 0
+	}
+	from = n * opdsPageSize
+	if from > total {
+		from = total
+	}
+	to = from + opdsPageSize
+	if to > total {
+		to = total
+	}
+
+	link := func(n int) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(n))
+		return r.URL.Path + "?" + q.Encode()
+	}
+	if n > 0 {
+		f.Links = append(f.Links, atomLink{Rel: "previous", Href: link(n - 1), Type: kind})
+	}
+	if to < total {
+		f.Links = append(f.Links, atomLink{Rel: "next", Href: link(n + 1), Type: kind})
+	}
+	return from, to
+}
+
+// languageName returns human readable language name.
+func languageName(lang string) string {
+	t, err := language.Parse(lang)
+	if err != nil {
+		return lang
+	}
+	if n := display.Self.Name(t); len(n) > 0 {
+		return n
+	}
+	return lang
+}
+
+func facetTitle(facet string) string {
+	switch facet {
+	case facetAuthors:
+		return "By author"
+	case facetSeries:
+		return "By series"
+	case facetGenres:
+		return "By genre"
+	case facetLanguages:
+		return "By language"
+	}
+	return facet
+}
+
+// bookEntry describes book with its acquisition links.
+func (s *opdsServer) bookEntry(b *opdsBook) atomEntry {
+
+	e := atomEntry{
+		Title:    b.title,
+		ID:       "urn:fb2c:book:" + b.id,
+		Updated:  atomTime(b.updated),
+		Language: b.lang,
+		Issued:   b.date,
+	}
+	for _, a := range b.authors {
+		e.Authors = append(e.Authors, atomAuthor{Name: a})
+	}
+	for _, g := range b.genres {
+		e.Categories = append(e.Categories, atomCategory{Term: g, Label: g})
+	}
+
+	var text []string
+	if len(b.series) > 0 {
+		if b.seqNum > 0 {
+			text = append(text, fmt.Sprintf("%s #%d", b.series, b.seqNum))
+		} else {
+			text = append(text, b.series)
+		}
+	}
+	if len(b.annotation) > 0 {
+		text = append(text, b.annotation)
+	}
+	if len(text) > 0 {
+		e.Content = &atomContent{Type: "text", Text: strings.Join(text, "\n\n")}
+	}
+
+	if b.cover {
+		href := "/opds/book/" + b.id + "/cover"
+		e.Links = append(e.Links, atomLink{Rel: relImage, Href: href}, atomLink{Rel: relThumbnail, Href: href})
+	}
+	for _, format := range s.formats {
+		if _, ok := b.outputs[format]; !ok && b.kind == bookEPUB {
+			// we do not convert from EPUB
+			continue
+		}
+		e.Links = append(e.Links, atomLink{
+			Rel:   relAcquisition,
+			Href:  "/opds/book/" + b.id + "/" + format.String(),
+			Type:  opdsMimeTypes[format],
+			Title: format.String(),
+		})
+	}
+	return e
+}
+
+// handle routes catalog requests.
+func (s *opdsServer) handle(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idx := s.current()
+	// keys may contain slashes
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/opds"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && len(parts[0]) == 0:
+		s.start(w, idx)
+	case len(parts) == 1 && parts[0] == "new":
+		books := append([]*opdsBook{}, idx.books...)
+		sort.SliceStable(books, func(i, j int) bool {
+			return books[i].updated.After(books[j].updated)
+		})
+		s.books(w, r, "new", "New books", books, idx.updated)
+	case len(parts) == 1 && idx.groups[parts[0]] != nil:
+		s.facet(w, r, idx, parts[0])
+	case len(parts) == 2 && idx.groups[parts[0]] != nil:
+		key, err := url.PathUnescape(parts[1])
+		books, ok := idx.groups[parts[0]][key]
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		title := key
+		if parts[0] == facetLanguages {
+			title = languageName(key)
+		}
+		s.books(w, r, parts[0]+":"+key, title, books, idx.updated)
+	case len(parts) == 3 && parts[0] == "book":
+		b, ok := idx.byID[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if parts[2] == "cover" {
+			s.cover(w, r, b)
+			return
+		}
+		format := processor.ParseFmtString(parts[2])
+		if _, ok := opdsMimeTypes[format]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.acquire(w, r, b, format)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// start is the catalog root - navigation feed.
+func (s *opdsServer) start(w http.ResponseWriter, idx *opdsIndex) {
+
+	f := s.newFeed("root", s.title, "/opds", opdsNavigation, idx.updated)
+	f.Links = append(f.Links, atomLink{Rel: relSortNew, Href: "/opds/new", Type: opdsAcquisition})
+	f.Entries = append(f.Entries, atomEntry{
+		Title:   "New books",
+		ID:      "urn:fb2c:new",
+		Updated: atomTime(idx.updated),
+		Content: &atomContent{Type: "text", Text: fmt.Sprintf("%d books", len(idx.books))},
+		Links:   []atomLink{{Rel: "subsection", Href: "/opds/new", Type: opdsAcquisition}},
+	})
+	for _, facet := range facets {
+		f.Entries = append(f.Entries, atomEntry{
+			Title:   facetTitle(facet),
+			ID:      "urn:fb2c:" + facet,
+			Updated: atomTime(idx.updated),
+			Content: &atomContent{Type: "text", Text: fmt.Sprintf("%d entries", len(idx.groups[facet]))},
+			Links:   []atomLink{{Rel: "subsection", Href: "/opds/" + facet, Type: opdsNavigation}},
+		})
+	}
+	writeFeed(w, f, opdsNavigation)
+}
+
+// facet is navigation feed listing all keys of the facet.
+func (s *opdsServer) facet(w http.ResponseWriter, r *http.Request, idx *opdsIndex, facet string) {
+
+	f := s.newFeed(facet, facetTitle(facet), r.URL.RequestURI(), opdsNavigation, idx.updated)
+	f.Links = append(f.Links, atomLink{Rel: "up", Href: "/opds", Type: opdsNavigation})
+
+	keys := idx.keys(facet)
+	from, to := feedPage(r, f, len(keys), opdsNavigation)
+	for _, key := range keys[from:to] {
+		title := key
+		if facet == facetLanguages {
+			title = languageName(key)
+		}
+		f.Entries = append(f.Entries, atomEntry{
+			Title:   title,
+			ID:      "urn:fb2c:" + facet + ":" + key,
+			Updated: atomTime(idx.updated),
+			Content: &atomContent{Type: "text", Text: fmt.Sprintf("%d books", len(idx.groups[facet][key]))},
+			Links:   []atomLink{{Rel: "subsection", Href: "/opds/" + facet + "/" + url.PathEscape(key), Type: opdsAcquisition}},
+		})
+	}
+	writeFeed(w, f, opdsNavigation)
+}
+
+// books is acquisition feed listing books.
+func (s *opdsServer) books(w http.ResponseWriter, r *http.Request, id, title string, books []*opdsBook, updated time.Time) {
+
+	f := s.newFeed(id, title, r.URL.RequestURI(), opdsAcquisition, updated)
+	f.Links = append(f.Links, atomLink{Rel: "up", Href: "/opds", Type: opdsNavigation})
+
+	from, to := feedPage(r, f, len(books), opdsAcquisition)
+	for _, b := range books[from:to] {
+		f.Entries = append(f.Entries, s.bookEntry(b))
+	}
+	writeFeed(w, f, opdsAcquisition)
+}
+
+// cover sends book cover image.
+func (s *opdsServer) cover(w http.ResponseWriter, r *http.Request, b *opdsBook) {
+
+	p, err := b.open(describeEnv(s.env))
+	if err != nil {
+		s.env.Log.Error("Unable to read book", zap.String("book", b.src), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer p.Clean()
+
+	data, ct, err := p.CoverImage()
+	if err != nil {
+		s.env.Log.Error("Unable to read cover", zap.String("book", b.src), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if len(ct) == 0 {
+		ct = http.DetectContentType(data)
+	}
+	w.Header().Set("Content-Type", ct)
+	http.ServeContent(w, r, "", b.updated, bytes.NewReader(data))
+}
+
+// acquire sends book in requested format, converting it when necessary. Conversion results are kept in cache directory
+// until source changes.
+func (s *opdsServer) acquire(w http.ResponseWriter, r *http.Request, b *opdsBook, format processor.OutputFmt) {
+
+	if path, ok := b.outputs[format]; ok {
+		serveBook(w, r, path, format)
+		return
+	}
+	if b.kind == bookEPUB {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := b.id + "-" + format.String()
+	s.convMu.Lock()
+	m, ok := s.converting[key]
+	if !ok {
+		m = new(sync.Mutex)
+		s.converting[key] = m
+	}
+	s.convMu.Unlock()
+
+	// do not convert the same book simultaneously
+	m.Lock()
+	defer m.Unlock()
+
+	dir := filepath.Join(s.cache, key)
+	if path, ok := cachedBook(dir, b.updated); ok {
+		serveBook(w, r, path, format)
+		return
+	}
+
+	path, err := s.convert(b, format, dir)
+	if err != nil {
+		s.env.Log.Error("Unable to convert book", zap.String("book", b.src), zap.Stringer("format", format), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveBook(w, r, path, format)
+}
+
+// cachedBook returns converted book from cache directory if it is not older than its source.
+func cachedBook(dir string, updated time.Time) (string, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() && !info.ModTime().Before(updated) {
+			return filepath.Join(dir, e.Name()), true
+		}
+	}
+	return "", false
+}
+
+// convert converts book into cache directory using the same pipeline as "convert" command.
+func (s *opdsServer) convert(b *opdsBook, format processor.OutputFmt, dir string) (string, error) {
+
+	data, err := b.read()
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.MkdirTemp(s.cache, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	env := *s.env
+	env.Log = s.env.Log.With(zap.String("book", b.src))
+
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	newProcessor := newFB2Processor(b.enc)
+	if b.kind == bookFB3 {
+		newProcessor = processor.NewFB3
+	}
+	info, err := processBook(ctx, bytes.NewReader(data), newProcessor, filepath.Base(b.src), tmp, true, false, true, format, &env)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, filepath.Base(info.Output))
+	if err := os.Rename(info.Output, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func serveBook(w http.ResponseWriter, r *http.Request, path string, format processor.OutputFmt) {
+	w.Header().Set("Content-Type", opdsMimeTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeFile(w, r, path)
+}
+
+// Opds is "opds" command body.
+func Opds(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "opds: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	root := ctx.Args().Get(0)
+	if len(root) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no library directory has been specified"), errCode)
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return cli.Exit(fmt.Errorf("%scleaning library path failed", errPrefix), errCode)
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return cli.Exit(fmt.Errorf("%slibrary directory was not found (%s)", errPrefix, root), errCode)
+	}
+
+	var formats []processor.OutputFmt
+	for _, name := range strings.Split(ctx.String("formats"), ",") {
+		format := processor.ParseFmtString(strings.TrimSpace(name))
+		if _, ok := opdsMimeTypes[format]; !ok {
+			return cli.Exit(fmt.Errorf("%sunsupported format (%s), supported formats: epub, kepub, azw3, mobi", errPrefix, name), errCode)
+		}
+		formats = append(formats, format)
+	}
+
+	cache := ctx.String("cache")
+	if len(cache) == 0 {
+		if cache, err = os.MkdirTemp("", "fb2c-opds-"); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to create cache directory: %w", errPrefix, err), errCode)
+		}
+		defer os.RemoveAll(cache)
+	} else {
+		if cache, err = filepath.Abs(cache); err != nil {
+			return cli.Exit(fmt.Errorf("%scleaning cache path failed", errPrefix), errCode)
+		}
+		if err := os.MkdirAll(cache, 0700); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to create cache directory: %w", errPrefix, err), errCode)
+		}
+	}
+
+	limitKindlegen(runtime.NumCPU(), env)
+
+	s := &opdsServer{
+		root:       root,
+		cache:      cache,
+		title:      ctx.String("title"),
+		formats:    formats,
+		timeout:    bookTimeout(ctx, env),
+		env:        env,
+		converting: make(map[string]*sync.Mutex),
+	}
+	s.rescan()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/opds", s.handle)
+	mux.HandleFunc("/opds/", s.handle)
+	srv := &http.Server{Addr: ctx.String("listen"), Handler: mux}
+
+	env.Log.Info("Serving catalog", zap.String("listen", srv.Addr), zap.String("library", root), zap.String("cache", cache))
+	defer func(start time.Time) {
+		env.Log.Info("Serving completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var tick <-chan time.Time
+	if d := ctx.Duration("rescan"); d > 0 {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	for {
+		select {
+		case err = <-errs:
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return cli.Exit(fmt.Errorf("%sserver failed: %w", errPrefix, err), errCode)
+			}
+			return nil
+		case <-tick:
+			s.rescan()
+		case sig := <-sigs:
+			env.Log.Info("Stopping on signal", zap.Stringer("signal", sig))
+			sctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err = srv.Shutdown(sctx)
+			cancel()
+			if err != nil {
+				return cli.Exit(fmt.Errorf("%sserver failed: %w", errPrefix, err), errCode)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/archive"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Kinds of books in OPDS catalog.
+const (
+	bookFB2  = "fb2"
+	bookFB3  = "fb3"
+	bookEPUB = "epub"
+)
+
+// opdsBook is a single book in OPDS catalog.
+type opdsBook struct {
+	id         string
+	src        string // path to the book, for books in archives - path to archive joined with path inside archive
+	archive    string // path to archive, empty if book is not in archive
+	member     string // path of the book inside archive
+	kind       string
+	enc        processor.BOMEncoding
+	stamp      string // size and modification time of the file book was read from
+	updated    time.Time
+	title      string
+	authors    []string
+	series     string
+	seqNum     int
+	lang       string
+	genres     []string
+	annotation string
+	date       string
+	cover      bool
+	outputs    map[processor.OutputFmt]string // books converted earlier and located next to the source
+}
+
+// read returns content of the book.
+func (b *opdsBook) read() ([]byte, error) {
+
+	if len(b.archive) == 0 {
+		return os.ReadFile(b.src)
+	}
+
+	zr, err := zip.OpenReader(b.archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.FileHeader.Name != b.member {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("book was not found in archive: %s", b.member)
+}
+
+// describeEnv returns program environment suitable for reading book descriptions - without preparations necessary only
+// for the actual conversion.
+func describeEnv(env *state.LocalEnv) *state.LocalEnv {
+	cfg := *env.Cfg
+	cfg.Doc.Hyphenate = false
+	cfg.Doc.Annotation.Create = false
+	denv := *env
+	denv.Cfg = &cfg
+	return &denv
+}
+
+// open parses book description, caller is responsible for cleaning processor.
+func (b *opdsBook) open(env *state.LocalEnv) (*processor.Processor, error) {
+
+	data, err := b.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var p *processor.Processor
+	switch b.kind {
+	case bookFB2:
+		p, err = processor.NewFB2(processor.BOMReader(bytes.NewReader(data), b.enc), b.enc == processor.BOMNone, filepath.Base(b.src), "", true, false, false, processor.OEpub, env)
+	case bookFB3:
+		p, err = processor.NewFB3(bytes.NewReader(data), filepath.Base(b.src), "", true, false, false, processor.OEpub, env)
+	case bookEPUB:
+		p, err = processor.NewEPUB(bytes.NewReader(data), filepath.Base(b.src), "", true, false, false, processor.OEpub, env)
+	default:
+		return nil, fmt.Errorf("unsupported kind of book: %s", b.kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Describe(); err != nil {
+		p.Clean()
+		return nil, err
+	}
+	return p, nil
+}
+
+// describe fills in book metadata.
+func (b *opdsBook) describe(env *state.LocalEnv) error {
+
+	p, err := b.open(env)
+	if err != nil {
+		return err
+	}
+	defer p.Clean()
+
+	var info bookInfo
+	info.describe(p, env)
+	b.title, b.authors, b.series, b.seqNum, b.lang = info.Title, info.Authors, info.Series, info.SeqNum, info.Lang
+	b.genres = p.Book.Genres
+	b.annotation = p.Book.Annotation
+	b.date = p.Book.Date
+	b.cover = len(p.Book.Cover) > 0
+	return nil
+}
+
+// Catalog facets.
+const (
+	facetAuthors   = "authors"
+	facetSeries    = "series"
+	facetGenres    = "genres"
+	facetLanguages = "languages"
+)
+
+var facets = []string{facetAuthors, facetSeries, facetGenres, facetLanguages}
+
+// opdsIndex is searchable state of the library.
+type opdsIndex struct {
+	books   []*opdsBook // sorted by title
+	byID    map[string]*opdsBook
+	groups  map[string]map[string][]*opdsBook // facet -> key -> books
+	updated time.Time
+}
+
+func newIndex(books []*opdsBook) *opdsIndex {
+
+	idx := &opdsIndex{
+		books:  books,
+		byID:   make(map[string]*opdsBook, len(books)),
+		groups: make(map[string]map[string][]*opdsBook, len(facets)),
+	}
+	for _, f := range facets {
+		idx.groups[f] = make(map[string][]*opdsBook)
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		return strings.ToLower(books[i].title) < strings.ToLower(books[j].title)
+	})
+	for _, b := range books {
+		idx.byID[b.id] = b
+		if b.updated.After(idx.updated) {
+			idx.updated = b.updated
+		}
+		for _, a := range b.authors {
+			idx.groups[facetAuthors][a] = append(idx.groups[facetAuthors][a], b)
+		}
+		if len(b.series) > 0 {
+			idx.groups[facetSeries][b.series] = append(idx.groups[facetSeries][b.series], b)
+		}
+		for _, g := range b.genres {
+			idx.groups[facetGenres][g] = append(idx.groups[facetGenres][g], b)
+		}
+		if len(b.lang) > 0 {
+			idx.groups[facetLanguages][b.lang] = append(idx.groups[facetLanguages][b.lang], b)
+		}
+	}
+	// books in series are listed in series order
+	for _, list := range idx.groups[facetSeries] {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].seqNum < list[j].seqNum
+		})
+	}
+	if idx.updated.IsZero() {
+		idx.updated = time.Now()
+	}
+	return idx
+}
+
+// keys returns sorted keys of the facet.
+func (idx *opdsIndex) keys(facet string) []string {
+	keys := make([]string, 0, len(idx.groups[facet]))
+	for k := range idx.groups[facet] {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.ToLower(keys[i]) < strings.ToLower(keys[j])
+	})
+	return keys
+}
+
+// outputExts lists extensions of converted books which could be found next to their sources.
+var outputExts = []struct {
+	ext    string
+	format processor.OutputFmt
+}{
+	{".kepub.epub", processor.OKepub},
+	{".epub", processor.OEpub},
+	{".azw3", processor.OAzw3},
+	{".mobi", processor.OMobi},
+}
+
+// outputFormat returns format of converted book and its name without extension.
+func outputFormat(path string) (processor.OutputFmt, string, bool) {
+	for _, o := range outputExts {
+		if strings.HasSuffix(strings.ToLower(path), o.ext) {
+			return o.format, path[:len(path)-len(o.ext)], true
+		}
+	}
+	return processor.UnsupportedOutputFmt, "", false
+}
+
+// fileStamp identifies file state, so unchanged books are not parsed again on rescan.
+func fileStamp(info os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// scanLibrary walks library directory collecting FB2, FB3 (including ones in zip archives) and EPUB books. Books converted
+// earlier are attached to their sources when they are located next to them and have the same name. Descriptions are
+// reused from previous scan for unchanged files.
+func scanLibrary(root string, skip []string, prev *opdsIndex, env *state.LocalEnv) *opdsIndex {
+
+	denv := describeEnv(env)
+
+	var (
+		books   []*opdsBook
+		outputs = make(map[string]map[processor.OutputFmt]string) // name without extension -> converted books
+		epubs   = make(map[string]*opdsBook)
+	)
+
+	add := func(b *opdsBook) {
+		b.id = contentHash([]byte(b.src))[:16]
+		if prev != nil {
+			if old, ok := prev.byID[b.id]; ok && old.stamp == b.stamp {
+				// previous index may still be in use
+				c := *old
+				books = append(books, &c)
+				return
+			}
+		}
+		if err := b.describe(denv); err != nil {
+			env.Log.Warn("Unable to read book description, skipping", zap.String("book", b.src), zap.Error(err))
+			return
+		}
+		books = append(books, b)
+	}
+
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		if underRoots(path, skip) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		stamp := fileStamp(info)
+
+		if format, name, ok := outputFormat(path); ok {
+			if outputs[name] == nil {
+				outputs[name] = make(map[processor.OutputFmt]string)
+			}
+			outputs[name][format] = path
+			if format == processor.OEpub {
+				if ok, err := isEpubFile(path); err == nil && ok {
+					epubs[name] = &opdsBook{src: path, kind: bookEPUB, stamp: stamp, updated: info.ModTime()}
+				}
+			}
+			return nil
+		}
+
+		if ok, err := isZipFile(path, ".zip"); err != nil {
+			env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+		} else if ok {
+			if err := archive.Walk(path, "", func(archive string, f *zip.File) error {
+				b := &opdsBook{src: filepath.Join(archive, f.FileHeader.Name), archive: archive, member: f.FileHeader.Name, stamp: stamp, updated: info.ModTime()}
+				if isFB3InArchive(f) {
+					b.kind = bookFB3
+				} else if ok, enc, err := isBookInArchive(f); err != nil {
+					env.Log.Warn("Skipping file in archive", zap.String("archive", archive), zap.String("path", f.FileHeader.Name), zap.Error(err))
+					return nil
+				} else if ok {
+					b.kind, b.enc = bookFB2, enc
+				} else {
+					return nil
+				}
+				add(b)
+				return nil
+			}); err != nil {
+				env.Log.Warn("Unable to process archive", zap.String("file", path), zap.Error(err))
+			}
+		} else if ok, err := isZipFile(path, ".fb3"); err != nil {
+			env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+		} else if ok {
+			add(&opdsBook{src: path, kind: bookFB3, stamp: stamp, updated: info.ModTime()})
+		} else if ok, enc, err := isBookFile(path); err != nil {
+			env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+		} else if ok {
+			add(&opdsBook{src: path, kind: bookFB2, enc: enc, stamp: stamp, updated: info.ModTime()})
+		}
+		return nil
+	}); err != nil {
+		env.Log.Warn("Unable to scan library", zap.String("dir", root), zap.Error(err))
+	}
+
+	// attach converted books to their sources, EPUBs without sources are books on their own
+	for _, b := range books {
+		if len(b.archive) > 0 {
+			continue
+		}
+		name := strings.TrimSuffix(b.src, filepath.Ext(b.src))
+		if o, ok := outputs[name]; ok {
+			b.outputs = o
+			delete(epubs, name)
+		}
+	}
+	for _, b := range epubs {
+		b.outputs = map[processor.OutputFmt]string{processor.OEpub: b.src}
+		add(b)
+	}
+	return newIndex(books)
+}
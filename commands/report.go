@@ -0,0 +1,202 @@
+package commands
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// bookInfo describes results of a single book conversion.
+type bookInfo struct {
+	Output  string
+	Title   string
+	Authors []string
+	Series  string
+	SeqNum  int
+	Lang    string
+}
+
+// describe fills book metadata from processor, it is safe to call it for a failed conversion - whatever was parsed
+// will be reported.
+func (bi *bookInfo) describe(p *processor.Processor, env *state.LocalEnv) {
+	b := p.Book
+	if b == nil {
+		return
+	}
+	bi.Title = b.Title
+	bi.Authors = bi.Authors[:0]
+	for _, an := range b.Authors {
+		bi.Authors = append(bi.Authors, processor.ReplaceKeywords(env.Cfg.Doc.AuthorFormat, processor.CreateAuthorKeywordsMap(an)))
+	}
+	bi.Series = b.SeqName
+	bi.SeqNum = b.SeqNum
+	bi.Lang = b.Lang.String()
+}
+
+const (
+	statusConverted = "converted"
+	statusFailed    = "failed"
+	statusUnchanged = "unchanged"
+)
+
+// reportRecord is single book entry in the conversion report.
+type reportRecord struct {
+	Source   string   `json:"source"`
+	Output   string   `json:"output,omitempty"`
+	Format   string   `json:"format"`
+	Duration float64  `json:"duration"` // seconds
+	Status   string   `json:"status"`
+	Error    string   `json:"error,omitempty"`
+	Warnings int      `json:"warnings"`
+	Title    string   `json:"title,omitempty"`
+	Authors  []string `json:"authors,omitempty"`
+	Series   string   `json:"series,omitempty"`
+	SeqNum   int      `json:"series_number,omitempty"`
+	Lang     string   `json:"language,omitempty"`
+}
+
+// report collects per-book records for machine readable run report.
+type report struct {
+	fname   string
+	format  processor.OutputFmt
+	src     string
+	dst     string
+	started time.Time
+	records []*reportRecord
+}
+
+func newReport(fname, src, dst string, format processor.OutputFmt) *report {
+	return &report{fname: fname, format: format, src: src, dst: dst, started: time.Now()}
+}
+
+// add stores results of the book conversion.
+func (r *report) add(res *bookResult) {
+
+	rec := &reportRecord{
+		Source:   res.src,
+		Output:   res.info.Output,
+		Format:   r.format.String(),
+		Duration: res.elapsed.Seconds(),
+		Warnings: res.warnings,
+		Title:    res.info.Title,
+		Authors:  res.info.Authors,
+		Series:   res.info.Series,
+		SeqNum:   res.info.SeqNum,
+		Lang:     res.info.Lang,
+	}
+	switch {
+	case res.err != nil:
+		rec.Status = statusFailed
+		rec.Error = res.err.Error()
+	case res.skipped:
+		rec.Status = statusUnchanged
+	default:
+		rec.Status = statusConverted
+	}
+	r.records = append(r.records, rec)
+}
+
+// save writes report to the file. When file has "csv" extension report is written as CSV with a header line, otherwise
+// JSON is used.
+func (r *report) save() error {
+
+	if err := os.MkdirAll(filepath.Dir(r.fname), 0700); err != nil {
+		return fmt.Errorf("unable to create report directory: %w", err)
+	}
+	f, err := os.Create(r.fname)
+	if err != nil {
+		return fmt.Errorf("unable to create report: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(r.fname), ".csv") {
+		err = r.writeCSV(f)
+	} else {
+		err = r.writeJSON(f)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write report: %w", err)
+	}
+	return f.Close()
+}
+
+func (r *report) writeJSON(f *os.File) error {
+
+	var converted, failed, unchanged int
+	for _, rec := range r.records {
+		switch rec.Status {
+		case statusConverted:
+			converted++
+		case statusFailed:
+			failed++
+		case statusUnchanged:
+			unchanged++
+		}
+	}
+	records := r.records
+	if records == nil {
+		records = []*reportRecord{}
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Source      string          `json:"source"`
+		Destination string          `json:"destination"`
+		Started     time.Time       `json:"started"`
+		Elapsed     float64         `json:"elapsed"`
+		Converted   int             `json:"converted"`
+		Unchanged   int             `json:"unchanged"`
+		Failed      int             `json:"failed"`
+		Books       []*reportRecord `json:"books"`
+	}{
+		Source:      r.src,
+		Destination: r.dst,
+		Started:     r.started.UTC(),
+		Elapsed:     time.Since(r.started).Seconds(),
+		Converted:   converted,
+		Unchanged:   unchanged,
+		Failed:      failed,
+		Books:       records,
+	})
+}
+
+func (r *report) writeCSV(f *os.File) error {
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"source", "output", "format", "duration", "status", "error", "warnings", "title", "authors", "series", "series_number", "language"}); err != nil {
+		return err
+	}
+	for _, rec := range r.records {
+		seqNum := ""
+		if rec.SeqNum > 0 {
+			seqNum = strconv.Itoa(rec.SeqNum)
+		}
+		if err := w.Write([]string{
+			rec.Source,
+			rec.Output,
+			rec.Format,
+			strconv.FormatFloat(rec.Duration, 'f', 3, 64),
+			rec.Status,
+			rec.Error,
+			strconv.Itoa(rec.Warnings),
+			rec.Title,
+			strings.Join(rec.Authors, "; "),
+			rec.Series,
+			seqNum,
+			rec.Lang,
+		}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
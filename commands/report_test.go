@@ -0,0 +1,133 @@
+package commands
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"fb2converter/processor"
+)
+
+// testResults returns converted, failed and unchanged book results.
+func testResults() []*bookResult {
+	return []*bookResult{
+		{
+			src:      "src/a.fb2",
+			elapsed:  1500 * time.Millisecond,
+			warnings: 2,
+			info: bookInfo{
+				Output:  "dst/a.epub",
+				Title:   "Книга",
+				Authors: []string{"Петров Иван", "Сидоров Петр"},
+				Series:  "Серия",
+				SeqNum:  3,
+				Lang:    "ru",
+			},
+		},
+		{
+			src:     "src/b.fb2",
+			err:     errors.New("bad book"),
+			elapsed: 250 * time.Millisecond,
+			info:    bookInfo{Title: "Плохая книга"},
+		},
+		{
+			src:     "src/c.fb2",
+			skipped: true,
+		},
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "reports", "report.json")
+	r := newReport(fname, "src", "dst", processor.OEpub)
+	for _, res := range testResults() {
+		r.add(res)
+	}
+	if err := r.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep struct {
+		Source      string         `json:"source"`
+		Destination string         `json:"destination"`
+		Converted   int            `json:"converted"`
+		Unchanged   int            `json:"unchanged"`
+		Failed      int            `json:"failed"`
+		Books       []reportRecord `json:"books"`
+	}
+	if err := json.Unmarshal(data, &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Source != "src" || rep.Destination != "dst" || rep.Converted != 1 || rep.Unchanged != 1 || rep.Failed != 1 {
+		t.Errorf("unexpected totals %+v", rep)
+	}
+	want := []reportRecord{
+		{Source: "src/a.fb2", Output: "dst/a.epub", Format: "epub", Duration: 1.5, Status: statusConverted, Warnings: 2, Title: "Книга",
+			Authors: []string{"Петров Иван", "Сидоров Петр"}, Series: "Серия", SeqNum: 3, Lang: "ru"},
+		{Source: "src/b.fb2", Format: "epub", Duration: 0.25, Status: statusFailed, Error: "bad book", Title: "Плохая книга"},
+		{Source: "src/c.fb2", Format: "epub", Status: statusUnchanged},
+	}
+	if !reflect.DeepEqual(rep.Books, want) {
+		t.Errorf("unexpected books\n%+v\nexpected\n%+v", rep.Books, want)
+	}
+}
+
+func TestReportJSONEmpty(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "report.json")
+	if err := newReport(fname, "src", "dst", processor.OEpub).save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rep); err != nil {
+		t.Fatal(err)
+	}
+	if books := string(rep["books"]); books != "[]" {
+		t.Errorf("books %s, expected empty list", books)
+	}
+}
+
+func TestReportCSV(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "report.CSV")
+	r := newReport(fname, "src", "dst", processor.OKepub)
+	for _, res := range testResults() {
+		r.add(res)
+	}
+	if err := r.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"source", "output", "format", "duration", "status", "error", "warnings", "title", "authors", "series", "series_number", "language"},
+		{"src/a.fb2", "dst/a.epub", "kepub", "1.500", "converted", "", "2", "Книга", "Петров Иван; Сидоров Петр", "Серия", "3", "ru"},
+		{"src/b.fb2", "", "kepub", "0.250", "failed", "bad book", "0", "Плохая книга", "", "", "", ""},
+		{"src/c.fb2", "", "kepub", "0.000", "unchanged", "", "0", "", "", "", "", ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("unexpected rows\n%q\nexpected\n%q", rows, want)
+	}
+}
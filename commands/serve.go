@@ -0,0 +1,580 @@
+package commands
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// serveJob is a single conversion request.
+type serveJob struct {
+	ID       string          `json:"id"`
+	Status   string          `json:"status"`
+	Source   string          `json:"source"`
+	Format   string          `json:"format"`
+	Profile  string          `json:"profile,omitempty"`
+	Size     int64           `json:"size"`
+	Created  time.Time       `json:"created"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Books    []*reportRecord `json:"books,omitempty"`
+
+	dir    string
+	format processor.OutputFmt
+	cfg    *config.Config
+}
+
+// jobLogName is the name of per-job log file in job directory.
+const jobLogName = "conversion.log"
+
+// server keeps conversion jobs and runs them on a pool of workers.
+type server struct {
+	ctx      context.Context // server lifetime, running conversions are cancelled when it is done
+	env      *state.LocalEnv
+	workdir  string
+	maxSize  int64
+	keep     int
+	timeout  time.Duration // per book, 0 - no limit
+	profiles map[string]*config.Config
+	queue    chan *serveJob
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	jobs  map[string]*serveJob
+	order []*serveJob // in order of creation
+}
+
+// snapshot returns copy of the job state safe to be serialized.
+func (s *server) snapshot(j *serveJob) *serveJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *j
+	return &c
+}
+
+func (s *server) job(id string) (*serveJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// forgetOldJobs removes finished jobs over the limit along with their files, must be called under lock.
+func (s *server) forgetOldJobs() {
+	for i := 0; len(s.order) > s.keep && i < len(s.order); {
+		j := s.order[i]
+		if j.Status == jobQueued || j.Status == jobRunning {
+			i++
+			continue
+		}
+		if err := os.RemoveAll(j.dir); err != nil {
+			s.env.Log.Warn("Unable to remove job files", zap.String("job", j.ID), zap.Error(err))
+		}
+		delete(s.jobs, j.ID)
+		s.order = append(s.order[:i], s.order[i+1:]...)
+	}
+}
+
+// jobLogger returns logger which additionally writes everything related to the job into its own log file.
+func jobLogger(j *serveJob, log *zap.Logger) (*zap.Logger, func(), error) {
+
+	f, err := os.Create(filepath.Join(j.dir, jobLogName))
+	if err != nil {
+		return nil, nil, err
+	}
+	core := zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()), zapcore.Lock(f), zap.DebugLevel)
+	l := log.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, core)
+	})).With(zap.String("job", j.ID))
+	return l, func() {
+		_ = l.Sync()
+		f.Close()
+	}, nil
+}
+
+// run converts uploaded file using the same pipeline as "convert" command.
+func (s *server) run(j *serveJob) {
+
+	now := time.Now()
+	s.mu.Lock()
+	j.Status, j.Started = jobRunning, &now
+	s.mu.Unlock()
+
+	status, msg := jobDone, ""
+	var books []*reportRecord
+	defer func() {
+		now := time.Now()
+		s.mu.Lock()
+		j.Status, j.Error, j.Books, j.Finished = status, msg, books, &now
+		s.mu.Unlock()
+	}()
+
+	env := *s.env
+	env.Cfg = j.cfg
+	log, closeLog, err := jobLogger(j, s.env.Log)
+	if err != nil {
+		status, msg = jobFailed, err.Error()
+		s.env.Log.Error("Unable to create job log", zap.String("job", j.ID), zap.Error(err))
+		return
+	}
+	defer closeLog()
+	env.Log = log
+
+	in, out := filepath.Join(j.dir, "in"), filepath.Join(j.dir, "out")
+	path := filepath.Join(in, j.Source)
+
+	// directory structure is kept, so books with the same name from different archive directories do not overwrite each other
+	b := newBatch(s.ctx, 1, s.timeout, true, nil, &env)
+	processFile(path, in, j.format, false, false, nil, out, b, &env)
+	b.wait()
+
+	rep := newReport("", path, out, j.format)
+	for _, r := range b.results {
+		rep.add(r)
+	}
+	for _, rec := range rep.records {
+		// do not expose server side paths
+		rec.Source = strings.TrimPrefix(strings.TrimPrefix(rec.Source, in), string(filepath.Separator))
+		if len(rec.Output) > 0 {
+			if rel, err := filepath.Rel(out, rec.Output); err == nil {
+				rec.Output = filepath.ToSlash(rel)
+			} else {
+				rec.Output = filepath.Base(rec.Output)
+			}
+		}
+		if rec.Status == statusFailed {
+			status, msg = jobFailed, rec.Error
+		}
+	}
+	books = rep.records
+
+	if len(books) == 0 {
+		status, msg = jobFailed, "input was not recognized as FB2 or FB3 book or archive"
+	}
+	log.Info("Job completed", zap.String("status", status))
+}
+
+// writeJSON sends value as JSON response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// writeError sends error as JSON response.
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+}
+
+// handler returns server request router.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	return mux
+}
+
+// handleJobs serves "/jobs" - list of recent jobs (GET) and job submission (POST).
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.list(w)
+	case http.MethodPost:
+		s.submit(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleJob serves "/jobs/{id}", "/jobs/{id}/result" and "/jobs/{id}/log".
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	j, ok := s.job(parts[0])
+	if !ok || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+	j = s.snapshot(j)
+
+	if len(parts) == 1 {
+		writeJSON(w, http.StatusOK, j)
+		return
+	}
+
+	switch parts[1] {
+	case "result":
+		s.result(w, r, j)
+	case "log":
+		if j.Status == jobQueued {
+			writeError(w, http.StatusConflict, errors.New("job has not started yet"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, filepath.Join(j.dir, jobLogName))
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *server) list(w http.ResponseWriter) {
+	s.mu.Lock()
+	jobs := make([]serveJob, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, *s.order[i])
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// submit stores uploaded book and queues conversion job. Book is either sent as "file" field of multipart form or as
+// request body with file name in "name" query parameter. Output format and configuration profile are selected by "to"
+// and "profile" query parameters.
+func (s *server) submit(w http.ResponseWriter, r *http.Request) {
+
+	q := r.URL.Query()
+
+	to := q.Get("to")
+	if len(to) == 0 {
+		to = "epub"
+	}
+	format := processor.ParseFmtString(to)
+	if format == processor.UnsupportedOutputFmt || format == processor.OFb2 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported output format: %s", to))
+		return
+	}
+
+	profile := q.Get("profile")
+	cfg, ok := s.profiles[profile]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown configuration profile: %s", profile))
+		return
+	}
+
+	j := &serveJob{
+		ID:      uuid.New().String(),
+		Status:  jobQueued,
+		Format:  format.String(),
+		Profile: profile,
+		Created: time.Now(),
+		format:  format,
+		cfg:     cfg,
+	}
+	j.dir = filepath.Join(s.workdir, j.ID)
+
+	body := &limitedBody{ReadCloser: r.Body, left: s.maxSize}
+	r.Body = body
+	name, size, err := s.upload(r, filepath.Join(j.dir, "in"))
+	if err != nil {
+		os.RemoveAll(j.dir)
+		code := http.StatusBadRequest
+		if body.exceeded {
+			// multipart reader does not always keep original error
+			code, err = http.StatusRequestEntityTooLarge, errTooLarge
+		}
+		writeError(w, code, err)
+		return
+	}
+	j.Source, j.Size = name, size
+
+	s.mu.Lock()
+	select {
+	case s.queue <- j:
+	default:
+		s.mu.Unlock()
+		os.RemoveAll(j.dir)
+		writeError(w, http.StatusServiceUnavailable, errors.New("job queue is full, try again later"))
+		return
+	}
+	s.jobs[j.ID] = j
+	s.order = append(s.order, j)
+	s.forgetOldJobs()
+	c := *j
+	s.mu.Unlock()
+
+	s.env.Log.Info("Job queued", zap.String("job", j.ID), zap.String("source", name), zap.Int64("size", size), zap.Stringer("format", format), zap.String("profile", profile))
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, &c)
+}
+
+// errTooLarge is returned when request body is over the upload size limit.
+var errTooLarge = errors.New("request body too large")
+
+// limitedBody fails reading request body after "left" bytes.
+type limitedBody struct {
+	io.ReadCloser
+	left     int64
+	exceeded bool
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errTooLarge
+	}
+	// read one byte over the limit to know that body does not fit
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	if l.left -= int64(n); l.left < 0 {
+		l.exceeded = true
+		return 0, errTooLarge
+	}
+	return n, err
+}
+
+// upload saves uploaded file into "dir" returning its name and size.
+func (s *server) upload(r *http.Request, dir string) (string, int64, error) {
+
+	var (
+		name string
+		src  io.Reader
+	)
+	if mr, err := r.MultipartReader(); err == nil {
+		var part *multipart.Part
+		for {
+			if part, err = mr.NextPart(); err != nil {
+				if err == io.EOF {
+					return "", 0, errors.New("no file was uploaded")
+				}
+				return "", 0, err
+			}
+			if part.FormName() == "file" {
+				break
+			}
+		}
+		name, src = part.FileName(), part
+	} else {
+		name, src = r.URL.Query().Get("name"), r.Body
+	}
+
+	name = filepath.Base(filepath.Clean("/" + filepath.FromSlash(name)))
+	if name == string(filepath.Separator) || name == "." {
+		return "", 0, errors.New("file name was not specified")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", 0, err
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(f, src)
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	return name, size, f.Close()
+}
+
+// result sends conversion result, when several books were converted they are sent as zip archive.
+func (s *server) result(w http.ResponseWriter, r *http.Request, j *serveJob) {
+
+	if j.Status == jobQueued || j.Status == jobRunning {
+		writeError(w, http.StatusConflict, fmt.Errorf("job is %s", j.Status))
+		return
+	}
+
+	var outputs []string
+	for _, b := range j.Books {
+		if b.Status == statusConverted && len(b.Output) > 0 {
+			outputs = append(outputs, b.Output)
+		}
+	}
+	out := filepath.Join(j.dir, "out")
+
+	switch len(outputs) {
+	case 0:
+		writeError(w, http.StatusNotFound, errors.New("job has no results"))
+	case 1:
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(outputs[0])))
+		http.ServeFile(w, r, filepath.Join(out, filepath.FromSlash(outputs[0])))
+	default:
+		sort.Strings(outputs)
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.TrimSuffix(j.Source, filepath.Ext(j.Source))+".zip"))
+		zw := zip.NewWriter(w)
+		for _, name := range outputs {
+			if err := addFileToZip(zw, filepath.Join(out, filepath.FromSlash(name)), name); err != nil {
+				s.env.Log.Error("Unable to send job results", zap.String("job", j.ID), zap.Error(err))
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			s.env.Log.Error("Unable to send job results", zap.String("job", j.ID), zap.Error(err))
+		}
+	}
+}
+
+func addFileToZip(zw *zip.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	to, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(to, f)
+	return err
+}
+
+// Serve is "serve" command body.
+func Serve(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "serve: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	workers := ctx.Int("jobs")
+	if workers <= 0 {
+		env.Log.Warn("Invalid number of jobs requested, converting books one by one", zap.Int("jobs", workers))
+		workers = 1
+	}
+	queue := ctx.Int("queue")
+	if queue <= 0 {
+		return cli.Exit(errors.New(errPrefix+"size of the job queue must be positive"), errCode)
+	}
+	keep := ctx.Int("keep")
+	if keep < queue+workers {
+		// we should not forget jobs before they are finished
+		keep = queue + workers
+	}
+	maxSize := ctx.Int64("max-size")
+	if maxSize <= 0 {
+		return cli.Exit(errors.New(errPrefix+"maximum upload size must be positive"), errCode)
+	}
+
+	profiles := map[string]*config.Config{"": env.Cfg}
+	for _, p := range ctx.StringSlice("profile") {
+		name, fname := p, ""
+		if i := strings.Index(p, "="); i > 0 {
+			name, fname = p[:i], p[i+1:]
+		}
+		if len(fname) == 0 {
+			return cli.Exit(fmt.Errorf("%sbad configuration profile specification (%s), NAME=FILE is expected", errPrefix, p), errCode)
+		}
+		cfg, err := config.BuildConfig(append(ctx.StringSlice("config"), fname)...)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to build configuration profile %s: %w", errPrefix, name, err), errCode)
+		}
+		profiles[name] = cfg
+	}
+
+	workdir := ctx.String("workdir")
+	if len(workdir) == 0 {
+		if workdir, err = os.MkdirTemp("", "fb2c-serve-"); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to create working directory: %w", errPrefix, err), errCode)
+		}
+		defer os.RemoveAll(workdir)
+	} else if workdir, err = filepath.Abs(workdir); err != nil {
+		return cli.Exit(fmt.Errorf("%scleaning working directory path failed", errPrefix), errCode)
+	}
+
+	if workers > 1 {
+		limitKindlegen(workers, env)
+	}
+
+	sctx, stop := signalContext()
+	defer stop()
+
+	s := &server{
+		ctx:      sctx,
+		env:      env,
+		workdir:  workdir,
+		maxSize:  maxSize * 1024 * 1024,
+		keep:     keep,
+		timeout:  bookTimeout(ctx, env),
+		profiles: profiles,
+		queue:    make(chan *serveJob, queue),
+		jobs:     make(map[string]*serveJob),
+	}
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for j := range s.queue {
+				s.run(j)
+			}
+		}()
+	}
+
+	srv := &http.Server{Addr: ctx.String("listen"), Handler: s.handler()}
+
+	env.Log.Info("Serving starting", zap.String("listen", srv.Addr), zap.Int("jobs", workers), zap.String("workdir", workdir))
+	defer func(start time.Time) {
+		env.Log.Info("Serving completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-errs:
+	case <-sctx.Done():
+		// running conversions are cancelled and clean after themselves, queued jobs fail without being started
+		env.Log.Info("Stopping on signal")
+		hctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = srv.Shutdown(hctx)
+		cancel()
+	}
+
+	// let running jobs stop
+	s.mu.Lock()
+	close(s.queue)
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return cli.Exit(fmt.Errorf("%sserver failed: %w", errPrefix, err), errCode)
+	}
+	return nil
+}
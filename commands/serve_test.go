@@ -0,0 +1,354 @@
+package commands
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fb2converter/config"
+)
+
+// newTestServer starts conversion server with "workers" workers, server is stopped when test ends.
+func newTestServer(t *testing.T, workers, queue, keep int, maxSize int64) (*server, *httptest.Server) {
+	t.Helper()
+
+	env := testEnv(t)
+	s := &server{
+		ctx:      context.Background(),
+		env:      env,
+		workdir:  t.TempDir(),
+		maxSize:  maxSize,
+		keep:     keep,
+		profiles: map[string]*config.Config{"": env.Cfg},
+		queue:    make(chan *serveJob, queue),
+		jobs:     make(map[string]*serveJob),
+	}
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for j := range s.queue {
+				s.run(j)
+			}
+		}()
+	}
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(func() {
+		ts.Close()
+		close(s.queue)
+		s.wg.Wait()
+	})
+	return s, ts
+}
+
+func readTestBook(t *testing.T) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "book.fb2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// submitJob uploads book as request body, returns response code and decoded job.
+func submitJob(t *testing.T, ts *httptest.Server, query string, data []byte) (int, *serveJob) {
+	t.Helper()
+
+	resp, err := http.Post(ts.URL+"/jobs?"+query, "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, decodeJob(t, resp)
+}
+
+func decodeJob(t *testing.T, resp *http.Response) *serveJob {
+	t.Helper()
+
+	var j serveJob
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	return &j
+}
+
+// getJob returns current job state.
+func getJob(t *testing.T, ts *httptest.Server, id string) (int, *serveJob) {
+	t.Helper()
+
+	resp, err := http.Get(ts.URL + "/jobs/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, decodeJob(t, resp)
+}
+
+// waitJob waits for the job to be finished.
+func waitJob(t *testing.T, ts *httptest.Server, id string) *serveJob {
+	t.Helper()
+
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if code, j := getJob(t, ts, id); code != http.StatusOK {
+			t.Fatalf("job status code %d", code)
+		} else if j.Status == jobDone || j.Status == jobFailed {
+			return j
+		}
+	}
+	t.Fatalf("job %s was not finished in time", id)
+	return nil
+}
+
+// get returns response code, headers and body.
+func get(t *testing.T, url string) (int, http.Header, []byte) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, body
+}
+
+func TestServeUpload(t *testing.T) {
+
+	s, ts := newTestServer(t, 1, 4, 10, 1<<20)
+
+	code, j := submitJob(t, ts, "name=../dir/book.fb2&to=epub", readTestBook(t))
+	if code != http.StatusAccepted || j.Status != jobQueued || j.Source != "book.fb2" || j.Format != "epub" {
+		t.Fatalf("unexpected response %d %+v", code, j)
+	}
+
+	j = waitJob(t, ts, j.ID)
+	if j.Status != jobDone || len(j.Books) != 1 {
+		t.Fatalf("unexpected job state %+v", j)
+	}
+	if b := j.Books[0]; b.Status != statusConverted || b.Source != "book.fb2" || b.Output != "book.epub" || b.Title != "Тестовая книга" {
+		t.Errorf("unexpected book %+v", b)
+	}
+
+	code, hdr, body := get(t, ts.URL+"/jobs/"+j.ID+"/result")
+	if code != http.StatusOK || !strings.Contains(hdr.Get("Content-Disposition"), `"book.epub"`) || !bytes.HasPrefix(body, []byte("PK")) {
+		t.Errorf("unexpected result %d %q, %d bytes", code, hdr.Get("Content-Disposition"), len(body))
+	}
+	code, _, body = get(t, ts.URL+"/jobs/"+j.ID+"/log")
+	if code != http.StatusOK || !bytes.Contains(body, []byte("Job completed")) {
+		t.Errorf("unexpected log %d %q", code, body)
+	}
+
+	code, _, body = get(t, ts.URL+"/jobs")
+	var jobs []serveJob
+	if err := json.Unmarshal(body, &jobs); code != http.StatusOK || err != nil || len(jobs) != 1 || jobs[0].ID != j.ID {
+		t.Errorf("unexpected job list %d %s", code, body)
+	}
+	if _, err := os.Stat(filepath.Join(s.workdir, j.ID, "in", "book.fb2")); err != nil {
+		t.Errorf("upload was not stored in job directory: %v", err)
+	}
+}
+
+func TestServeMultipartArchive(t *testing.T) {
+
+	_, ts := newTestServer(t, 1, 4, 10, 1<<20)
+
+	// archive with two books produces archive with two results, books with the same name are kept apart
+	var arc bytes.Buffer
+	zw := zip.NewWriter(&arc)
+	for _, name := range []string{"a/book.fb2", "b/book.fb2"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(readTestBook(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	if err := mw.WriteField("comment", "ignored"); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := mw.CreateFormFile("file", "books.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(arc.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(ts.URL+"/jobs?to=epub", mw.FormDataContentType(), &form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := decodeJob(t, resp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || j.Source != "books.zip" || j.Size != int64(arc.Len()) {
+		t.Fatalf("unexpected response %d %+v", resp.StatusCode, j)
+	}
+
+	j = waitJob(t, ts, j.ID)
+	if j.Status != jobDone || len(j.Books) != 2 {
+		t.Fatalf("unexpected job state %+v", j)
+	}
+	code, hdr, body := get(t, ts.URL+"/jobs/"+j.ID+"/result")
+	if code != http.StatusOK || hdr.Get("Content-Type") != "application/zip" || !strings.Contains(hdr.Get("Content-Disposition"), `"books.zip"`) {
+		t.Fatalf("unexpected result %d %v", code, hdr)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "a/book.epub" || zr.File[1].Name != "b/book.epub" {
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		t.Errorf("unexpected results in archive: %q", names)
+	}
+}
+
+func TestServeRequests(t *testing.T) {
+
+	s, ts := newTestServer(t, 1, 4, 10, 100)
+	book := readTestBook(t)
+
+	cases := []struct {
+		name, query string
+		data        []byte
+		code        int
+	}{
+		{"too large", "name=book.fb2", book, http.StatusRequestEntityTooLarge},
+		{"no name", "", []byte("x"), http.StatusBadRequest},
+		{"bad format", "name=book.fb2&to=fb2", []byte("x"), http.StatusBadRequest},
+		{"unknown profile", "name=book.fb2&profile=none", []byte("x"), http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+"/jobs?"+c.query, "application/octet-stream", bytes.NewReader(c.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var e struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || resp.StatusCode != c.code || len(e.Error) == 0 {
+				t.Errorf("status %d, expected %d, error %q (%v)", resp.StatusCode, c.code, e.Error, err)
+			}
+		})
+	}
+	// rejected uploads leave nothing behind
+	if entries, err := os.ReadDir(s.workdir); err != nil || len(entries) != 0 {
+		t.Errorf("working directory is not empty: %d entries (%v)", len(entries), err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/jobs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, POST" {
+		t.Errorf("unexpected response to PUT: %d", resp.StatusCode)
+	}
+	for _, path := range []string{"/jobs/unknown", "/jobs/unknown/result", "/jobs/a/b/c"} {
+		if code, _, _ := get(t, ts.URL+path); code != http.StatusNotFound {
+			t.Errorf("%s: status %d", path, code)
+		}
+	}
+
+	// not a book - job fails and has no results
+	code, j := submitJob(t, ts, "name=notes.txt", []byte("not a book"))
+	if code != http.StatusAccepted {
+		t.Fatalf("unexpected response %d", code)
+	}
+	if j = waitJob(t, ts, j.ID); j.Status != jobFailed || len(j.Error) == 0 {
+		t.Errorf("unexpected job state %+v", j)
+	}
+	if code, _, _ := get(t, ts.URL+"/jobs/"+j.ID+"/result"); code != http.StatusNotFound {
+		t.Errorf("failed job result status %d", code)
+	}
+	if code, _, _ := get(t, ts.URL+"/jobs/"+j.ID+"/unknown"); code != http.StatusNotFound {
+		t.Errorf("unknown job resource status %d", code)
+	}
+}
+
+func TestServeQueue(t *testing.T) {
+
+	// no workers - jobs stay queued
+	s, ts := newTestServer(t, 0, 1, 10, 1<<20)
+	book := readTestBook(t)
+
+	code, j := submitJob(t, ts, "name=book.fb2", book)
+	if code != http.StatusAccepted {
+		t.Fatalf("unexpected response %d", code)
+	}
+	if code, j := getJob(t, ts, j.ID); code != http.StatusOK || j.Status != jobQueued {
+		t.Errorf("unexpected job state %d %+v", code, j)
+	}
+	for _, r := range []string{"result", "log"} {
+		if code, _, _ := get(t, ts.URL+"/jobs/"+j.ID+"/"+r); code != http.StatusConflict {
+			t.Errorf("%s of queued job: status %d", r, code)
+		}
+	}
+
+	if code, _ := submitJob(t, ts, "name=book.fb2", book); code != http.StatusServiceUnavailable {
+		t.Errorf("full queue: status %d", code)
+	}
+	if entries, err := os.ReadDir(s.workdir); err != nil || len(entries) != 1 || entries[0].Name() != j.ID {
+		t.Errorf("rejected job left files behind: %d entries (%v)", len(entries), err)
+	}
+}
+
+func TestServeCleanup(t *testing.T) {
+
+	s, ts := newTestServer(t, 1, 1, 2, 1<<20)
+	book := readTestBook(t)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		code, j := submitJob(t, ts, "name=book.fb2", book)
+		if code != http.StatusAccepted {
+			t.Fatalf("unexpected response %d", code)
+		}
+		waitJob(t, ts, j.ID)
+		ids = append(ids, j.ID)
+	}
+
+	// only the most recent jobs are kept along with their files
+	if code, _, _ := get(t, ts.URL+"/jobs/"+ids[0]); code != http.StatusNotFound {
+		t.Errorf("old job is still available: %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(s.workdir, ids[0])); !os.IsNotExist(err) {
+		t.Errorf("old job files were not removed: %v", err)
+	}
+	for _, id := range ids[1:] {
+		if code, j := getJob(t, ts, id); code != http.StatusOK || j.Status != jobDone {
+			t.Errorf("recent job %s is not available: %d", id, code)
+		}
+		if _, err := os.Stat(filepath.Join(s.workdir, id)); err != nil {
+			t.Errorf("recent job files were removed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// processEpubToFB2 converts single EPUB file to FB2. "src" has the same meaning as for processEpub.
+func processEpubToFB2(ctx context.Context, r io.Reader, src, dst string, nodirs, overwrite bool, env *state.LocalEnv) (err error) {
+
+	var fname string
+
+	env.Log.Info("Conversion starting", zap.String("from", src))
+	defer func(start time.Time) {
+		env.Log.Info("Conversion completed", zap.Duration("elapsed", time.Since(start)), zap.String("to", fname))
+	}(time.Now())
+
+	p, err := processor.NewEPUB(r, src, dst, nodirs, false, overwrite, processor.OFb2, env)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := p.Clean(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	if err = p.Process(ctx); err != nil {
+		return err
+	}
+	fname, err = p.Save(ctx)
+	return err
+}
+
+// ToFB2 is "tofb2" command body.
+func ToFB2(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "tofb2: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	src := ctx.Args().Get(0)
+	if len(src) == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input source has been specified"), errCode)
+	}
+	src, err = filepath.Abs(src)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%scleaning source path failed: %w", errPrefix, err), errCode)
+	}
+
+	dst := ctx.Args().Get(1)
+	if len(dst) == 0 {
+		if dst, err = os.Getwd(); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to get working directory: %w", errPrefix, err), errCode)
+		}
+	} else {
+		if dst, err = filepath.Abs(dst); err != nil {
+			return cli.Exit(fmt.Errorf("%scleaning destination path failed: %w", errPrefix, err), errCode)
+		}
+	}
+
+	nodirs := ctx.Bool("nodirs")
+	overwrite := ctx.Bool("ow")
+
+	env.Log.Info("Processing starting", zap.String("source", src), zap.String("destination", dst), zap.Stringer("format", processor.OFb2))
+	defer func(start time.Time) {
+		env.Log.Info("Processing completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	sctx, stop := signalContext()
+	defer stop()
+	defer func() {
+		if sctx.Err() != nil {
+			err = cli.Exit(errors.New(errPrefix+"interrupted, not all books were processed"), errCode)
+		}
+	}()
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sinput source was not found (%s)", errPrefix, src), errCode)
+	}
+
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		count := 0
+		if err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err := sctx.Err(); err != nil {
+				return err
+			}
+			if err != nil {
+				env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+			} else if info.Mode().IsRegular() {
+				if ok, err := isEpubFile(path); err != nil {
+					// checking format - but cannot open target file
+					env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+				} else if ok {
+					count++
+					if file, err := os.Open(path); err != nil {
+						env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+					} else {
+						defer file.Close()
+						if err := processEpubToFB2(sctx, file,
+							strings.TrimPrefix(strings.TrimPrefix(path, src), string(filepath.Separator)), dst,
+							nodirs, overwrite, env); err != nil {
+
+							env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
+						}
+					}
+				}
+			}
+			return nil
+		}); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to process directory: %w", errPrefix, err), errCode)
+		}
+		if count == 0 {
+			env.Log.Debug("Nothing to process", zap.String("dir", src))
+		}
+	case mode.IsRegular():
+		if ok, err := isEpubFile(src); err != nil {
+			// checking format - but cannot open target file
+			return cli.Exit(fmt.Errorf("%sunable to check file type: %w", errPrefix, err), errCode)
+		} else if !ok {
+			// wrong file type
+			return cli.Exit(fmt.Errorf("%sinput was not recognized as epub book (%s)", errPrefix, src), errCode)
+		}
+		if file, err := os.Open(src); err != nil {
+			env.Log.Error("Unable to process file", zap.String("file", src), zap.Error(err))
+		} else {
+			defer file.Close()
+			if err := processEpubToFB2(sctx, file, filepath.Base(src), dst, nodirs, overwrite, env); err != nil {
+				env.Log.Error("Unable to process file", zap.String("file", src), zap.Error(err))
+			}
+		}
+	default:
+		return cli.Exit(fmt.Errorf("%sunsupported type of input source (%s)", errPrefix, src), errCode)
+	}
+	return nil
+}
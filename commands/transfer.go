@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -19,7 +20,7 @@ import (
 // processEpub processes single EPUB file. "src" is part of the source path (always including file name) relative to the original
 // path. When actual file was specified it will be just base file name without a path. When looking inside archive or directory
 // it will be relative path inside archive or directory (including base file name).
-func processEpub(r io.Reader, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) error {
+func processEpub(ctx context.Context, r io.Reader, src, dst string, nodirs, stk, overwrite bool, format processor.OutputFmt, env *state.LocalEnv) (err error) {
 
 	var fname string
 
@@ -32,16 +33,19 @@ func processEpub(r io.Reader, src, dst string, nodirs, stk, overwrite bool, form
 	if err != nil {
 		return err
 	}
-	if err = p.Process(); err != nil {
-		return err
-	}
-	if fname, err = p.Save(); err != nil {
+	defer func() {
+		if cerr := p.Clean(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	if err = p.Process(ctx); err != nil {
 		return err
 	}
-	if err = p.SendToKindle(fname); err != nil {
+	if fname, err = p.Save(ctx); err != nil {
 		return err
 	}
-	return p.Clean()
+	return p.SendToKindle(fname)
 }
 
 // Transfer is "transfer" command body.
@@ -94,6 +98,14 @@ func Transfer(ctx *cli.Context) (err error) {
 		env.Log.Info("Processing completed", zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
+	sctx, stop := signalContext()
+	defer stop()
+	defer func() {
+		if sctx.Err() != nil {
+			err = cli.Exit(errors.New(errPrefix+"interrupted, not all books were processed"), errCode)
+		}
+	}()
+
 	fi, err := os.Stat(src)
 	if err != nil {
 		return cli.Exit(fmt.Errorf("%sinput source was not found (%s)", errPrefix, src), errCode)
@@ -103,6 +115,9 @@ func Transfer(ctx *cli.Context) (err error) {
 	case mode.IsDir():
 		count := 0
 		if err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err := sctx.Err(); err != nil {
+				return err
+			}
 			if err != nil {
 				env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
 			} else if info.Mode().IsRegular() {
@@ -115,7 +130,7 @@ func Transfer(ctx *cli.Context) (err error) {
 						env.Log.Error("Unable to process file", zap.String("file", path), zap.Error(err))
 					} else {
 						defer file.Close()
-						if err := processEpub(file,
+						if err := processEpub(sctx, file,
 							strings.TrimPrefix(strings.TrimPrefix(path, src), string(filepath.Separator)), dst,
 							nodirs, stk, overwrite, format, env); err != nil {
 
@@ -143,7 +158,7 @@ func Transfer(ctx *cli.Context) (err error) {
 			env.Log.Error("Unable to process file", zap.String("file", src), zap.Error(err))
 		} else {
 			defer file.Close()
-			if err := processEpub(file, filepath.Base(src), dst, nodirs, stk, overwrite, format, env); err != nil {
+			if err := processEpub(sctx, file, filepath.Base(src), dst, nodirs, stk, overwrite, format, env); err != nil {
 				env.Log.Error("Unable to process file", zap.String("file", src), zap.Error(err))
 			}
 		}
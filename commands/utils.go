@@ -2,6 +2,7 @@ package commands
 
 import (
 	"archive/zip"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
@@ -9,15 +10,18 @@ import (
 	"strings"
 
 	"github.com/h2non/filetype"
-	"golang.org/x/text/encoding/unicode"
-	"golang.org/x/text/encoding/unicode/utf32"
-	"golang.org/x/text/transform"
+	"go.uber.org/zap"
+
+	"fb2converter/archive"
+	"fb2converter/processor"
+	"fb2converter/state"
 )
 
-// isArchiveFile detects if file is our supported archive.
-func isArchiveFile(fname string) (bool, error) {
+// isZipFile detects if file has extension "ext" and is zip archive: our supported archive (".zip") or FB3 book (".fb3", OPC
+// zip package).
+func isZipFile(fname, ext string) (bool, error) {
 
-	if !strings.EqualFold(filepath.Ext(fname), ".zip") {
+	if !strings.EqualFold(filepath.Ext(fname), ext) {
 		return false, nil
 	}
 
@@ -55,142 +59,79 @@ func isEpubFile(fname string) (bool, error) {
 	} else if count < 262 {
 		return false, nil
 	}
-	return filetype.Is(header, "epub"), nil
-}
-
-type srcEncoding int
-
-const (
-	encUnknown srcEncoding = iota
-	encUTF8
-	encUTF16BigEndian
-	encUTF16LittleEndian
-	encUTF32BigEndian
-	encUTF32LittleEndian
-)
-
-// selectReader handles various unicode encodings (with or without BOM).
-func selectReader(r io.Reader, enc srcEncoding) io.Reader {
-	switch enc {
-	case encUnknown:
-		return r
-	case encUTF8:
-		return transform.NewReader(r, unicode.BOMOverride(unicode.UTF8.NewDecoder()))
-	case encUTF16BigEndian:
-		return transform.NewReader(r, unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder())
-	case encUTF16LittleEndian:
-		return transform.NewReader(r, unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder())
-	case encUTF32BigEndian:
-		return transform.NewReader(r, utf32.UTF32(utf32.BigEndian, utf32.ExpectBOM).NewDecoder())
-	case encUTF32LittleEndian:
-		return transform.NewReader(r, utf32.UTF32(utf32.LittleEndian, utf32.ExpectBOM).NewDecoder())
-	default:
-		panic("unsupported encoding - should never happen")
-	}
-}
-
-func isUTF32BigEndianBOM4(buf []byte) bool {
-	return buf[0] == 0x00 && buf[1] == 0x00 && buf[2] == 0xFE && buf[3] == 0xFF
-}
-
-func isUTF32LittleEndianBOM4(buf []byte) bool {
-	return buf[0] == 0xFF && buf[1] == 0xFE && buf[2] == 0x00 && buf[3] == 0x00
-}
-
-func isUTF8BOM3(buf []byte) bool {
-	return buf[0] == 0xEF && buf[1] == 0xBB && buf[2] == 0xBF
-}
-
-func isUTF16BigEndianBOM2(buf []byte) bool {
-	return buf[0] == 0xFE && buf[1] == 0xFF
+	// NOTE: filetype epub matcher expects "mimetype" right after zip signature, while it is located after local file header
+	return filetype.Is(header, "zip") &&
+		bytes.Equal(header[30:38], []byte("mimetype")) &&
+		bytes.HasPrefix(header[38:], []byte("application/epub+zip")), nil
 }
 
-func isUTF16LittleEndianBOM2(buf []byte) bool {
-	return buf[0] == 0xFF && buf[1] == 0xFE
-}
-
-func detectUTF(buf []byte) (enc srcEncoding) {
-
-	if isUTF32BigEndianBOM4(buf) {
-		return encUTF32BigEndian
-	}
-	if isUTF32LittleEndianBOM4(buf) {
-		return encUTF32LittleEndian
-	}
-	if isUTF8BOM3(buf) {
-		return encUTF8
-	}
-	if isUTF16BigEndianBOM2(buf) {
-		return encUTF16BigEndian
-	}
-	if isUTF16LittleEndianBOM2(buf) {
-		return encUTF16LittleEndian
-	}
-	return encUnknown
+// isFB3InArchive detects if compressed file is FB3 book.
+func isFB3InArchive(f *zip.File) bool {
+	return strings.EqualFold(filepath.Ext(f.FileHeader.Name), ".fb3")
 }
 
 // isBookFile detects if file is fb2/xml file and if it is tries to detect its encoding.
-func isBookFile(fname string) (bool, srcEncoding, error) {
+func isBookFile(fname string) (bool, processor.BOMEncoding, error) {
 
 	if !strings.EqualFold(filepath.Ext(fname), ".fb2") {
-		return false, encUnknown, nil
+		return false, processor.BOMNone, nil
 	}
 
 	file, err := os.Open(fname)
 	if err != nil {
-		return false, encUnknown, err
+		return false, processor.BOMNone, err
 	}
 	defer file.Close()
 
 	buf := []byte{1, 1, 1, 1}
 	_, err = file.Read(buf)
 	if err != nil {
-		return false, encUnknown, err
+		return false, processor.BOMNone, err
 	}
-	enc := detectUTF(buf)
+	enc := processor.DetectBOM(buf)
 	if ref, err := file.Seek(0, 0); err != nil {
-		return false, encUnknown, err
+		return false, processor.BOMNone, err
 	} else if ref != 0 {
-		return false, encUnknown, fmt.Errorf("unable reset file: %s", fname)
+		return false, processor.BOMNone, fmt.Errorf("unable reset file: %s", fname)
 	}
 
 	header := make([]byte, 512)
-	if _, err := selectReader(file, enc).Read(header); err != nil {
-		return false, encUnknown, err
+	if _, err := processor.BOMReader(file, enc).Read(header); err != nil {
+		return false, processor.BOMNone, err
 	}
 	return filetype.Is(header, "fb2"), enc, nil
 }
 
 // isBookInArchive detects if compressed file is fb2/xml file and if it is tries to detect its encoding.
-func isBookInArchive(f *zip.File) (bool, srcEncoding, error) {
+func isBookInArchive(f *zip.File) (bool, processor.BOMEncoding, error) {
 
 	if !strings.EqualFold(filepath.Ext(f.FileHeader.Name), ".fb2") {
-		return false, encUnknown, nil
+		return false, processor.BOMNone, nil
 	}
 
 	r, err := f.Open()
 	if err != nil {
-		return false, encUnknown, err
+		return false, processor.BOMNone, err
 	}
 
 	buf := []byte{1, 1, 1, 1}
 	_, err = r.Read(buf)
 	if err != nil {
 		r.Close()
-		return false, encUnknown, err
+		return false, processor.BOMNone, err
 	}
-	enc := detectUTF(buf)
+	enc := processor.DetectBOM(buf)
 	r.Close()
 
 	r, err = f.Open()
 	if err != nil {
-		return false, encUnknown, err
+		return false, processor.BOMNone, err
 	}
 	defer r.Close()
 
 	header := make([]byte, 512)
-	if _, err := selectReader(r, enc).Read(header); err != nil {
-		return false, encUnknown, err
+	if _, err := processor.BOMReader(r, enc).Read(header); err != nil {
+		return false, processor.BOMNone, err
 	}
 	return filetype.Is(header, "fb2"), enc, nil
 }
@@ -204,3 +145,76 @@ func init() {
 			return strings.HasPrefix(text, `<?xml`) && strings.Contains(text, `<FictionBook`)
 		})
 }
+
+// walkFB2 calls "fn" for every FB2 book found in "src", which could be a file, a zip archive or a directory with files and
+// archives. "fn" receives full name of the book (for books in archives - path to archive joined with path inside archive),
+// its path relative to "src" (archives are treated as directories) and error if book could not be opened.
+func walkFB2(src string, fn func(r io.Reader, name, rel string, err error), env *state.LocalEnv) error {
+
+	walkFile := func(path, rel string) {
+		f, err := os.Open(path)
+		if err != nil {
+			fn(nil, path, rel, err)
+			return
+		}
+		defer f.Close()
+		fn(f, path, rel, nil)
+	}
+
+	walkArchive := func(path, rel string) error {
+		cpage := zipNamesCodepage(path, env)
+		return archive.Walk(path, "", func(archive string, f *zip.File) error {
+			if !strings.EqualFold(filepath.Ext(f.FileHeader.Name), ".fb2") {
+				return nil
+			}
+			apath := archivePath(f, cpage, env)
+			name, rel := filepath.Join(archive, apath), filepath.Join(rel, apath)
+			r, err := f.Open()
+			if err != nil {
+				fn(nil, name, rel, err)
+				return nil
+			}
+			defer r.Close()
+			fn(r, name, rel, nil)
+			return nil
+		})
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if ok, err := isZipFile(src, ".zip"); err != nil {
+			return err
+		} else if ok {
+			return walkArchive(src, "")
+		}
+		walkFile(src, filepath.Base(src))
+		return nil
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if ok, err := isZipFile(path, ".zip"); err != nil {
+			env.Log.Warn("Skipping file", zap.String("file", path), zap.Error(err))
+		} else if ok {
+			if err := walkArchive(path, strings.TrimSuffix(rel, filepath.Ext(rel))); err != nil {
+				env.Log.Warn("Unable to process archive", zap.String("file", path), zap.Error(err))
+			}
+		} else if strings.EqualFold(filepath.Ext(path), ".fb2") {
+			walkFile(path, rel)
+		}
+		return nil
+	})
+}
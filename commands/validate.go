@@ -0,0 +1,115 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// validationResult is outcome of validating single book.
+type validationResult struct {
+	File       string                `json:"file"`
+	Valid      bool                  `json:"valid"`
+	Error      string                `json:"error,omitempty"`
+	Violations []processor.Violation `json:"violations"`
+}
+
+// validateBook validates single FB2 book, encoding is detected from BOM or XML declaration.
+func validateBook(r io.Reader, name string) validationResult {
+
+	res := validationResult{File: name, Violations: []processor.Violation{}}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	enc := processor.DetectBOM(data)
+	violations, err := processor.ValidateFB2(processor.BOMReader(bytes.NewReader(data), enc), enc == processor.BOMNone)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Violations = append(res.Violations, violations...)
+	res.Valid = len(res.Violations) == 0
+	return res
+}
+
+// Validate is "validate" command body.
+func Validate(ctx *cli.Context) error {
+
+	const (
+		errPrefix = "validate: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.Args().Len() == 0 {
+		return cli.Exit(errors.New(errPrefix+"no input source has been specified"), errCode)
+	}
+	asJSON := ctx.Bool("json")
+
+	var results []validationResult
+	var total, invalid int
+	report := func(res validationResult) {
+		total++
+		if !res.Valid {
+			invalid++
+		}
+		if asJSON {
+			results = append(results, res)
+			return
+		}
+		if len(res.Error) > 0 {
+			fmt.Fprintf(os.Stdout, "%s: unable to read book: %s\n", res.File, res.Error)
+		}
+		for _, v := range res.Violations {
+			fmt.Fprintf(os.Stdout, "%s:%d: %s: %s\n", res.File, v.Line, v.Path, v.Message)
+		}
+	}
+
+	for _, src := range ctx.Args().Slice() {
+		src, err := filepath.Abs(src)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("%scleaning source path failed: %w", errPrefix, err), errCode)
+		}
+		env.Log.Info("Validation starting", zap.String("source", src))
+		if err := walkFB2(src, func(r io.Reader, name, _ string, err error) {
+			if err != nil {
+				report(validationResult{File: name, Error: err.Error(), Violations: []processor.Violation{}})
+				return
+			}
+			report(validateBook(r, name))
+		}, env); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to validate source: %w", errPrefix, err), errCode)
+		}
+	}
+
+	if asJSON {
+		if results == nil {
+			results = []validationResult{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return cli.Exit(fmt.Errorf("%sunable to write results: %w", errPrefix, err), errCode)
+		}
+	}
+
+	env.Log.Info("Validation completed", zap.Int("books", total), zap.Int("invalid", invalid))
+	if invalid > 0 {
+		return cli.Exit(fmt.Errorf("%s%d of %d books are not valid", errPrefix, invalid, total), errCode)
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// watchedFile is a file in inbox waiting to be processed.
+type watchedFile struct {
+	path  string
+	inbox string
+	event time.Time // last time change was noticed
+	size  int64
+	mod   time.Time
+}
+
+// watcher keeps track of changes in inbox directories, debouncing partial writes.
+type watcher struct {
+	fw      *fsnotify.Watcher
+	inboxes []string
+	skip    []string // directories under inboxes which should be ignored: destination, done and failed
+	delay   time.Duration
+	pending map[string]*watchedFile
+	env     *state.LocalEnv
+}
+
+// inbox returns inbox "path" belongs to.
+func (w *watcher) inbox(path string) (string, bool) {
+	for _, inbox := range w.inboxes {
+		if underRoots(path, []string{inbox}) {
+			return inbox, true
+		}
+	}
+	return "", false
+}
+
+// addDir starts watching directory tree, files which are already there will be processed as new.
+func (w *watcher) addDir(inbox, dir string) {
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			w.env.Log.Warn("Skipping path", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		if underRoots(path, w.skip) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := w.fw.Add(path); err != nil {
+				w.env.Log.Warn("Unable to watch directory", zap.String("dir", path), zap.Error(err))
+			}
+		} else if info.Mode().IsRegular() {
+			w.touch(inbox, path, info)
+		}
+		return nil
+	}); err != nil {
+		w.env.Log.Warn("Unable to watch directory", zap.String("dir", dir), zap.Error(err))
+	}
+}
+
+// touch (re)starts debounce interval for the file.
+func (w *watcher) touch(inbox, path string, info os.FileInfo) {
+	w.pending[path] = &watchedFile{path: path, inbox: inbox, event: time.Now(), size: info.Size(), mod: info.ModTime()}
+}
+
+// handle processes single file system notification.
+func (w *watcher) handle(e fsnotify.Event) {
+
+	inbox, ok := w.inbox(e.Name)
+	if !ok || underRoots(e.Name, w.skip) {
+		return
+	}
+
+	if e.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(w.pending, e.Name)
+		return
+	}
+	if e.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+		return
+	}
+
+	info, err := os.Stat(e.Name)
+	if err != nil {
+		delete(w.pending, e.Name)
+		return
+	}
+	switch {
+	case info.IsDir():
+		if e.Op&fsnotify.Create != 0 {
+			// files could be there already - before we started watching
+			w.addDir(inbox, e.Name)
+		}
+	case info.Mode().IsRegular():
+		w.touch(inbox, e.Name, info)
+	}
+}
+
+// ready returns files which have not been changed for debounce interval.
+func (w *watcher) ready(now time.Time) []*watchedFile {
+
+	var files []*watchedFile
+	for path, f := range w.pending {
+		if now.Sub(f.event) < w.delay {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			delete(w.pending, path)
+			continue
+		}
+		if info.Size() != f.size || !info.ModTime().Equal(f.mod) {
+			// still being written
+			w.touch(f.inbox, path, info)
+			continue
+		}
+		delete(w.pending, path)
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].path < files[j].path
+	})
+	return files
+}
+
+// enqueue adds ready files to the ones waiting for conversion round, file which became ready again is only kept once.
+func enqueue(queued, files []*watchedFile) []*watchedFile {
+next:
+	for _, f := range files {
+		for i, q := range queued {
+			if q.path == f.path {
+				queued[i] = f
+				continue next
+			}
+		}
+		queued = append(queued, f)
+	}
+	return queued
+}
+
+// moveSource moves processed source file under "dir" keeping its location relative to inbox.
+func moveSource(f *watchedFile, dir string, env *state.LocalEnv) {
+
+	to := filepath.Join(dir, strings.TrimPrefix(strings.TrimPrefix(f.path, f.inbox), string(filepath.Separator)))
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		env.Log.Error("Unable to move processed file", zap.String("file", f.path), zap.String("to", to), zap.Error(err))
+		return
+	}
+	if err := os.Rename(f.path, to); err != nil {
+		env.Log.Error("Unable to move processed file", zap.String("file", f.path), zap.String("to", to), zap.Error(err))
+		return
+	}
+	env.Log.Debug("Processed file moved", zap.String("file", f.path), zap.String("to", to))
+}
+
+// Watch is "watch" command body.
+func Watch(ctx *cli.Context) (err error) {
+
+	const (
+		errPrefix = "watch: "
+		errCode   = 1
+	)
+
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	if ctx.NArg() < 2 {
+		return cli.Exit(errors.New(errPrefix+"inbox directory and destination must be specified"), errCode)
+	}
+
+	dst, err := filepath.Abs(ctx.Args().Get(ctx.NArg() - 1))
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%scleaning destination path failed", errPrefix), errCode)
+	}
+
+	var inboxes []string
+	for _, arg := range ctx.Args().Slice()[:ctx.NArg()-1] {
+		inbox, err := filepath.Abs(arg)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("%scleaning inbox path failed", errPrefix), errCode)
+		}
+		if fi, err := os.Stat(inbox); err != nil || !fi.IsDir() {
+			return cli.Exit(fmt.Errorf("%sinbox directory was not found (%s)", errPrefix, inbox), errCode)
+		}
+		inboxes = append(inboxes, inbox)
+	}
+
+	skip := []string{dst}
+	var done, failed string
+	if dir := ctx.String("done"); len(dir) > 0 {
+		if done, err = filepath.Abs(dir); err != nil {
+			return cli.Exit(fmt.Errorf("%scleaning done path failed", errPrefix), errCode)
+		}
+		skip = append(skip, done)
+	}
+	if dir := ctx.String("failed"); len(dir) > 0 {
+		if failed, err = filepath.Abs(dir); err != nil {
+			return cli.Exit(fmt.Errorf("%scleaning failed path failed", errPrefix), errCode)
+		}
+		skip = append(skip, failed)
+	}
+
+	format := processor.ParseFmtString(ctx.String("to"))
+	if format == processor.UnsupportedOutputFmt || format == processor.OFb2 {
+		env.Log.Warn("Unknown output format requested, switching to epub", zap.String("format", ctx.String("to")))
+		format = processor.OEpub
+	}
+	nodirs := ctx.Bool("nodirs")
+	overwrite := ctx.Bool("ow")
+
+	jobs := ctx.Int("jobs")
+	if jobs < 0 {
+		env.Log.Warn("Invalid number of jobs requested, converting books one by one", zap.Int("jobs", jobs))
+		jobs = 1
+	}
+
+	timeout := bookTimeout(ctx, env)
+
+	delay := ctx.Duration("delay")
+	if delay <= 0 {
+		env.Log.Warn("Invalid delay requested, using default", zap.Duration("delay", delay))
+		delay = 5 * time.Second
+	}
+
+	stk := ctx.Bool("stk")
+	if stk && format != processor.OMobi {
+		env.Log.Warn("Send to Kindle could only be used with mobi output format, turning off", zap.Stringer("format", format))
+		stk = false
+	}
+
+	cpage := zipCodepage(ctx.String("force-zip-cp"), env)
+
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return cli.Exit(fmt.Errorf("%sunable to start watching: %w", errPrefix, err), errCode)
+	}
+	defer fw.Close()
+
+	w := &watcher{fw: fw, inboxes: inboxes, skip: skip, delay: delay, pending: make(map[string]*watchedFile), env: env}
+	for _, inbox := range inboxes {
+		w.addDir(inbox, inbox)
+	}
+
+	env.Log.Info("Watching starting", zap.Strings("inboxes", inboxes), zap.String("destination", dst), zap.Stringer("format", format))
+	defer func(start time.Time) {
+		env.Log.Info("Watching completed", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	sctx, stop := signalContext()
+	defer stop()
+
+	tick := time.Second
+	if delay < tick {
+		tick = delay
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	// conversion rounds are run one at a time in background, so inbox events are handled while books are converted
+	rounds := make(chan []*watchedFile)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for files := range rounds {
+			watchRound(sctx, files, jobs, timeout, format, nodirs, stk, overwrite, cpage, dst, done, failed, env)
+		}
+	}()
+	defer func() {
+		// running round is cancelled along with signal context
+		close(rounds)
+		wg.Wait()
+	}()
+
+	var queued []*watchedFile
+	for {
+		// ready files are handed over only when previous round is finished
+		var next chan<- []*watchedFile
+		if len(queued) > 0 {
+			next = rounds
+		}
+		select {
+		case e, ok := <-fw.Events:
+			if !ok {
+				return nil
+			}
+			w.handle(e)
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return nil
+			}
+			env.Log.Warn("Problem watching inbox", zap.Error(err))
+		case <-sctx.Done():
+			env.Log.Info("Stopping on signal")
+			return nil
+		case next <- queued:
+			queued = nil
+		case now := <-ticker.C:
+			queued = enqueue(queued, w.ready(now))
+		}
+	}
+}
+
+// watchRound converts books from files which are ready, keeping manifest in destination, so changed books are rebuilt and
+// files touched without changes are skipped. Interrupted round leaves files in inbox, so they are processed again on the
+// next start.
+func watchRound(ctx context.Context, files []*watchedFile, jobs int, timeout time.Duration, format processor.OutputFmt, nodirs, stk, overwrite bool, cpage encoding.Encoding, dst, done, failed string, env *state.LocalEnv) {
+
+	b, err := prepareBatch(ctx, jobs, timeout, true, format, nodirs, overwrite, dst, nil, env)
+	if err != nil {
+		env.Log.Error("Unable to process files", zap.Int("files", len(files)), zap.Error(err))
+		return
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.path)
+		processFile(f.path, f.inbox, format, nodirs, stk, cpage, dst, b, env)
+	}
+	b.finish(paths...)
+	if ctx.Err() != nil {
+		return
+	}
+
+	for _, f := range files {
+		books, bad := b.outcome(f.path)
+		if books == 0 {
+			continue
+		}
+		if bad && len(failed) > 0 {
+			moveSource(f, failed, env)
+		} else if !bad && len(done) > 0 {
+			moveSource(f, done, env)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fb2converter/processor"
+)
+
+func TestWatcherReady(t *testing.T) {
+
+	inbox := t.TempDir()
+	path := filepath.Join(inbox, "book.fb2")
+	if err := os.WriteFile(path, []byte("part"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &watcher{inboxes: []string{inbox}, delay: time.Second, pending: make(map[string]*watchedFile), env: testEnv(t)}
+	w.touch(inbox, path, info)
+	now := w.pending[path].event
+
+	if files := w.ready(now.Add(time.Second / 2)); len(files) != 0 {
+		t.Fatalf("file is ready before debounce interval: %d", len(files))
+	}
+
+	// file is still being written
+	if err := os.WriteFile(path, []byte("partial write"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if files := w.ready(now.Add(2 * time.Second)); len(files) != 0 {
+		t.Fatal("file is ready while it is still changing")
+	}
+	if _, ok := w.pending[path]; !ok {
+		t.Fatal("changing file is not pending any more")
+	}
+
+	files := w.ready(w.pending[path].event.Add(time.Second))
+	if len(files) != 1 || files[0].path != path || files[0].inbox != inbox {
+		t.Fatalf("unexpected ready files %+v", files)
+	}
+	if len(w.pending) != 0 {
+		t.Error("ready file is still pending")
+	}
+
+	// removed file is dropped
+	w.touch(inbox, path, info)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if files := w.ready(now.Add(time.Hour)); len(files) != 0 || len(w.pending) != 0 {
+		t.Errorf("removed file is ready %d, pending %d", len(files), len(w.pending))
+	}
+}
+
+func TestWatchEnqueue(t *testing.T) {
+
+	a, b, a2 := &watchedFile{path: "a"}, &watchedFile{path: "b"}, &watchedFile{path: "a"}
+	queued := enqueue(nil, []*watchedFile{a, b})
+	queued = enqueue(queued, []*watchedFile{a2})
+	if len(queued) != 2 || queued[0] != a2 || queued[1] != b {
+		t.Errorf("unexpected queue %+v", queued)
+	}
+}
+
+func TestWatchRound(t *testing.T) {
+
+	tmp := t.TempDir()
+	inbox, dst, done, failed := filepath.Join(tmp, "inbox"), filepath.Join(tmp, "dst"), filepath.Join(tmp, "done"), filepath.Join(tmp, "failed")
+	env := testEnv(t)
+
+	round := func(names ...string) {
+		t.Helper()
+
+		var files []*watchedFile
+		for _, name := range names {
+			files = append(files, &watchedFile{path: filepath.Join(inbox, name), inbox: inbox})
+		}
+		watchRound(context.Background(), files, 1, 0, processor.OEpub, false, false, false, nil, dst, done, failed, env)
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	copyBook(t, inbox, filepath.Join("sub", "good.fb2"))
+	// truncated book is recognized, but could not be converted
+	bad := copyBook(t, inbox, "bad.fb2")
+	data, err := os.ReadFile(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bad, data[:len(data)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inbox, "notes.txt"), []byte("not a book"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	round(filepath.Join("sub", "good.fb2"), "bad.fb2", "notes.txt")
+
+	for path, want := range map[string]bool{
+		filepath.Join(done, "sub", "good.fb2"):  true,
+		filepath.Join(failed, "bad.fb2"):        true,
+		filepath.Join(inbox, "notes.txt"):       true,
+		filepath.Join(inbox, "sub", "good.fb2"): false,
+		filepath.Join(inbox, "bad.fb2"):         false,
+	} {
+		if exists(path) != want {
+			t.Errorf("%s exists %t, expected %t", path, !want, want)
+		}
+	}
+	if !exists(filepath.Join(dst, manifestName)) {
+		t.Fatal("manifest was not created")
+	}
+
+	// same book dropped again is not converted, but still moved out of inbox
+	entries := (&manifestTest{t: t, dst: dst}).entries()
+	if len(entries) != 1 || entries[0].Source != filepath.Join(inbox, "sub", "good.fb2") {
+		t.Fatalf("unexpected manifest entries %+v", entries)
+	}
+	output := filepath.Join(dst, entries[0].Output)
+	if err := os.Remove(filepath.Join(done, "sub", "good.fb2")); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyBook(t, inbox, filepath.Join("sub", "good.fb2"))
+	round(filepath.Join("sub", "good.fb2"))
+
+	if !exists(filepath.Join(done, "sub", "good.fb2")) {
+		t.Error("unchanged book was not moved")
+	}
+	after, err := os.Stat(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Error("unchanged book was converted again")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
@@ -65,9 +66,13 @@ type SMTPConfig struct {
 
 // AuthorName is parsed author name from book metainfo.
 type AuthorName struct {
-	First  string `json:"first_name"`
-	Middle string `json:"middle_name"`
-	Last   string `json:"last_name"`
+	First     string   `json:"first_name"`
+	Middle    string   `json:"middle_name"`
+	Last      string   `json:"last_name"`
+	Nickname  string   `json:"nickname"`
+	HomePages []string `json:"home_pages"`
+	Emails    []string `json:"emails"`
+	ID        string   `json:"id"`
 }
 
 func (a *AuthorName) String() string {
@@ -81,6 +86,9 @@ func (a *AuthorName) String() string {
 	if len(a.Last) > 0 {
 		res += " " + a.Last
 	}
+	if len(res) == 0 {
+		res = a.Nickname
+	}
 	return res
 }
 
@@ -119,6 +127,9 @@ type Doc struct {
 	AuthorFormat          string   `json:"author_format"`
 	AuthorFormatMeta      string   `json:"author_format_meta"`
 	AuthorFormatFileName  string   `json:"author_format_file_name"`
+	AuthorFormatSort      string   `json:"author_format_sort"`
+	AuthorFormatTrl       string   `json:"author_format_translator"`
+	AuthorFormatIll       string   `json:"author_format_illustrator"`
 	TransliterateMeta     bool     `json:"transliterate_meta"`
 	OpenFromCover         bool     `json:"open_from_cover"`
 	ChapterPerFile        bool     `json:"chapter_per_file"`
@@ -152,6 +163,11 @@ type Doc struct {
 		AddToToc bool   `json:"add_to_toc"`
 		Title    string `json:"title"`
 	} `json:"annotation"`
+	Genres struct {
+		Subjects  string `json:"subjects"`
+		Language  string `json:"language"`
+		Authority string `json:"authority"`
+	} `json:"genres"`
 	TOC struct {
 		Type              string `json:"type"`
 		Title             string `json:"page_title"`
@@ -178,13 +194,34 @@ type Doc struct {
 	//
 	Kindlegen struct {
 		Path             string `json:"path"`
+		Native           bool   `json:"native"`
 		CompressionLevel int    `json:"compression_level"`
 		Verbose          bool   `json:"verbose"`
 		NoOptimization   bool   `json:"no_mobi_optimization"`
 		RemovePersonal   bool   `json:"remove_personal_label"`
 		PageMap          string `json:"generate_apnx"`
 		ForceASIN        bool   `json:"force_asin_on_azw3"`
+		MaxRunning       int    `json:"max_running"`
 	} `json:"kindlegen"`
+	Text struct {
+		Wrap     int    `json:"wrap"`
+		Encoding string `json:"encoding"`
+	} `json:"text"`
+	PDF struct {
+		Profile        string  `json:"profile"`
+		FontSize       float64 `json:"font_size"`
+		Margin         float64 `json:"margin"`
+		RunningHeaders bool    `json:"running_headers"`
+		Fonts          struct {
+			Regular    string `json:"regular"`
+			Bold       string `json:"bold"`
+			Italic     string `json:"italic"`
+			BoldItalic string `json:"bold_italic"`
+		} `json:"fonts"`
+	} `json:"pdf"`
+	Transfer struct {
+		Stylesheet string `json:"stylesheet"`
+	} `json:"transfer"`
 }
 
 // names of supported vignettes
@@ -243,6 +280,16 @@ var defaultConfig = []byte(`{
       "remove_personal_label": true,
       "generate_apnx": "none"
     },
+    "text": {
+      "encoding": "UTF-8"
+    },
+    "pdf": {
+      "profile": "6in",
+      "running_headers": true
+    },
+    "transfer": {
+      "stylesheet": "keep"
+    },
     "cover": {
       "height": 1680,
       "width": 1264
@@ -381,6 +428,15 @@ func BuildConfig(fnames ...string) (*Config, error) {
 	if len(conf.Doc.AuthorFormatFileName) == 0 {
 		conf.Doc.AuthorFormatFileName = conf.Doc.AuthorFormat
 	}
+	if len(conf.Doc.AuthorFormatSort) == 0 {
+		conf.Doc.AuthorFormatSort = "#l{, #f}{ #m}"
+	}
+	if len(conf.Doc.AuthorFormatTrl) == 0 {
+		conf.Doc.AuthorFormatTrl = conf.Doc.AuthorFormatMeta
+	}
+	if len(conf.Doc.AuthorFormatIll) == 0 {
+		conf.Doc.AuthorFormatIll = conf.Doc.AuthorFormatMeta
+	}
 	return &conf, nil
 }
 
@@ -506,6 +562,8 @@ func (conf *Config) GetActualBytes() ([]byte, error) {
 		}{Name: filepath.FromSlash(k), Meta: v}
 		a.H = append(a.H, s)
 	}
+	// keep output stable, so it could be compared or hashed
+	sort.Slice(a.H, func(i, j int) bool { return a.H[i].Name < a.H[j].Name })
 
 	// Marshall it to json
 	b, err := json.Marshal(a)
@@ -546,16 +604,22 @@ func (conf *Config) PrepareLog() (*zap.Logger, error) {
 		return lvl >= zapcore.ErrorLevel
 	})
 
+	// informational messages could be sent to stderr too, when stdout is used for the results
+	consoleLP := os.Stdout
+	if conf.ConsoleLogger.Destination == "stderr" {
+		consoleLP = os.Stderr
+	}
+
 	var consoleCoreHP, consoleCoreLP zapcore.Core
 	switch conf.ConsoleLogger.Level {
 	case "normal":
-		consoleCoreLP = zapcore.NewCore(consoleEncoderLP, zapcore.Lock(os.Stdout),
+		consoleCoreLP = zapcore.NewCore(consoleEncoderLP, zapcore.Lock(consoleLP),
 			zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
 				return zapcore.InfoLevel <= lvl && lvl < zapcore.ErrorLevel
 			}))
 		consoleCoreHP = zapcore.NewCore(consoleEncoderHP, zapcore.Lock(os.Stderr), highPriority)
 	case "debug":
-		consoleCoreLP = zapcore.NewCore(consoleEncoderLP, zapcore.Lock(os.Stdout),
+		consoleCoreLP = zapcore.NewCore(consoleEncoderLP, zapcore.Lock(consoleLP),
 			zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
 				return zapcore.DebugLevel <= lvl && lvl < zapcore.ErrorLevel
 			}))
@@ -0,0 +1,196 @@
+// Package convert provides API to convert FB2 and FB3 books from Go programs, independent of the command line interface.
+//
+//	cfg, err := config.BuildConfig("fb2c.toml") // or nil for built-in defaults
+//	...
+//	res, err := convert.Convert(ctx, r, convert.Options{Name: "book.fb2", Format: "epub", Config: cfg, Output: w})
+//
+// Module path is "fb2converter", which is not a location "go get" could download from, so other modules have to point
+// to the source tree explicitly - with a replace directive in their go.mod (copy of the tree could then be vendored with
+// "go mod vendor" as usual):
+//
+//	require fb2converter v0.0.0
+//	replace fb2converter => ../fb2converter
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/config"
+	"fb2converter/processor"
+	"fb2converter/state"
+)
+
+// Options controls conversion.
+type Options struct {
+	// Name of the source file, it is used to derive resulting file name and to recognize FB3 books. Default is "book.fb2".
+	Name string
+	// Format of the result: epub, epub3, kepub, azw3, mobi, html, txt, md, pdf or docx. Default is epub.
+	Format string
+	// Config is conversion configuration (see config.BuildConfig), built-in defaults are used when nil.
+	Config *config.Config
+	// Logger receives all conversion messages, nothing is logged when nil.
+	Logger *zap.Logger
+	// Output receives converted book, when nil book is returned in Result.Data.
+	Output io.Writer
+}
+
+// Result describes converted book.
+type Result struct {
+	// Name of the resulting file (without path).
+	Name string
+	// Format of the result.
+	Format string
+	// Size of the converted book in bytes.
+	Size int64
+	// Data is converted book, it is only set when Options.Output was nil.
+	Data []byte
+	// Book metadata.
+	Title   string
+	Authors []string
+	Series  string
+	SeqNum  int
+	Lang    string
+	// Warnings is number of warnings reported during conversion.
+	Warnings int
+}
+
+// Convert converts single FB2 or FB3 book read from "r". Only the book itself is produced, supplementary files (like
+// Kindle page maps) are not generated. Conversion stops shortly after "ctx" is done. Convert could be called from several
+// goroutines simultaneously.
+func Convert(ctx context.Context, r io.Reader, opts Options) (res Result, err error) {
+
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	name := filepath.Base(opts.Name)
+	if len(opts.Name) == 0 {
+		name = "book.fb2"
+	}
+
+	res.Format = opts.Format
+	if len(res.Format) == 0 {
+		res.Format = processor.OEpub.String()
+	}
+	format := processor.ParseFmtString(res.Format)
+	if format == processor.UnsupportedOutputFmt || format == processor.OFb2 {
+		return res, fmt.Errorf("unsupported output format: %s", res.Format)
+	}
+
+	cfg := opts.Config
+	if cfg == nil {
+		if cfg, err = config.BuildConfig(); err != nil {
+			return res, err
+		}
+	}
+	// we only return the book
+	c := *cfg
+	c.Doc.Kindlegen.PageMap = processor.APNXNone.String()
+
+	var warnings int32
+	log := opts.Logger
+	if log == nil {
+		log = zap.NewNop()
+	}
+	log = log.WithOptions(zap.Hooks(func(e zapcore.Entry) error {
+		if e.Level == zapcore.WarnLevel {
+			atomic.AddInt32(&warnings, 1)
+		}
+		return nil
+	}))
+	env := &state.LocalEnv{Cfg: &c, Log: log}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("Conversion ended with panic", zap.ByteString("stack", debug.Stack()))
+			err = fmt.Errorf("conversion ended with panic: %v", r)
+		}
+		res.Warnings = int(atomic.LoadInt32(&warnings))
+	}()
+
+	var p *processor.Processor
+	br := bufio.NewReader(r)
+	if isFB3(name, br) {
+		p, err = processor.NewFB3(br, name, "", true, false, true, format, env)
+	} else {
+		// when there is no BOM encoding has to be taken from XML declaration
+		head, _ := br.Peek(4)
+		enc := processor.DetectBOM(head)
+		p, err = processor.NewFB2(processor.BOMReader(br, enc), enc == processor.BOMNone, name, "", true, false, true, format, env)
+	}
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		if cerr := p.Clean(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	defer res.describe(p, &c)
+
+	if err = p.Process(ctx); err != nil {
+		return res, err
+	}
+	out := opts.Output
+	var buf *bytes.Buffer
+	if out == nil {
+		buf = new(bytes.Buffer)
+		out = buf
+	}
+	cw := &countingWriter{w: out}
+	if res.Name, err = p.SaveTo(ctx, cw); err != nil {
+		return res, err
+	}
+	res.Size = cw.n
+	if buf != nil {
+		res.Data = buf.Bytes()
+	}
+	return res, nil
+}
+
+// countingWriter keeps track of number of bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// describe fills in book metadata.
+func (res *Result) describe(p *processor.Processor, cfg *config.Config) {
+	b := p.Book
+	if b == nil {
+		return
+	}
+	res.Title = b.Title
+	for _, an := range b.Authors {
+		res.Authors = append(res.Authors, processor.ReplaceKeywords(cfg.Doc.AuthorFormat, processor.CreateAuthorKeywordsMap(an)))
+	}
+	res.Series = b.SeqName
+	res.SeqNum = b.SeqNum
+	res.Lang = b.Lang.String()
+}
+
+// isFB3 checks if book is FB3 package, either by name or by zip signature.
+func isFB3(name string, br *bufio.Reader) bool {
+	if strings.EqualFold(filepath.Ext(name), ".fb3") {
+		return true
+	}
+	head, _ := br.Peek(4)
+	return bytes.Equal(head, []byte("PK\x03\x04"))
+}
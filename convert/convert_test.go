@@ -0,0 +1,133 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/encoding/unicode"
+
+	"fb2converter/config"
+)
+
+func readBook(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/book.fb2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// checkEpub verifies that result is a zip archive with OPF in it.
+func checkEpub(t *testing.T, data []byte) {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("result is not an epub: %v", err)
+	}
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, ".opf") {
+			return
+		}
+	}
+	t.Fatal("result has no OPF")
+}
+
+func checkResult(t *testing.T, res Result) {
+	t.Helper()
+	if res.Name != "book.epub" || res.Format != "epub" {
+		t.Errorf("unexpected name %q or format %q", res.Name, res.Format)
+	}
+	if res.Title != "Тестовая книга" || res.Series != "Серия" || res.SeqNum != 2 || res.Lang != "ru" {
+		t.Errorf("unexpected metadata %+v", res)
+	}
+	if len(res.Authors) != 1 || res.Authors[0] != "Петров Иван" {
+		t.Errorf("unexpected authors %q", res.Authors)
+	}
+}
+
+func TestConvertWriter(t *testing.T) {
+
+	var out bytes.Buffer
+	res, err := Convert(context.Background(), bytes.NewReader(readBook(t)), Options{Name: "book.fb2", Output: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResult(t, res)
+	if res.Data != nil {
+		t.Error("data returned along with writing to output")
+	}
+	if res.Size != int64(out.Len()) {
+		t.Errorf("reported size %d, written %d", res.Size, out.Len())
+	}
+	checkEpub(t, out.Bytes())
+}
+
+func TestConvertBytes(t *testing.T) {
+
+	data := readBook(t)
+	utf16, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().Bytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, in := range map[string][]byte{"utf-8": data, "utf-16 with BOM": utf16} {
+		t.Run(name, func(t *testing.T) {
+			res, err := Convert(context.Background(), bytes.NewReader(in), Options{Name: "book.fb2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkResult(t, res)
+			if res.Size != int64(len(res.Data)) {
+				t.Errorf("reported size %d, returned %d bytes", res.Size, len(res.Data))
+			}
+			checkEpub(t, res.Data)
+		})
+	}
+}
+
+func TestConvertLogger(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.TOC.Type = "unknown"
+	cfg.Doc.Kindlegen.PageMap = "eink"
+
+	var buf bytes.Buffer
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf), zapcore.DebugLevel)
+
+	res, err := Convert(context.Background(), bytes.NewReader(readBook(t)), Options{Name: "book.fb2", Config: cfg, Logger: zap.New(core)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Warnings != 1 {
+		t.Errorf("expected 1 warning, got %d", res.Warnings)
+	}
+	if !strings.Contains(buf.String(), "Unknown TOC type requested") {
+		t.Errorf("warning was not logged: %s", buf.String())
+	}
+	if cfg.Doc.Kindlegen.PageMap != "eink" {
+		t.Error("configuration passed in was modified")
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+
+	if _, err := Convert(context.Background(), strings.NewReader(""), Options{Format: "fb2"}); err == nil {
+		t.Error("conversion to fb2 should not be supported")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Convert(ctx, bytes.NewReader(readBook(t)), Options{}); err != context.Canceled {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package convert_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+
+	"fb2converter/convert"
+)
+
+func ExampleConvert() {
+
+	f, err := os.Open("testdata/book.fb2")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer f.Close()
+
+	res, err := convert.Convert(context.Background(), f, convert.Options{
+		Name:   "book.fb2",
+		Format: "epub",
+		Logger: zap.NewNop(),
+		Output: io.Discard,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(res.Name, res.Title, res.Authors, res.Size > 0)
+	// Output: book.epub Тестовая книга [Петров Иван] true
+}
@@ -0,0 +1,61 @@
+package processor
+
+import (
+	"bytes"
+	"io"
+
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/encoding/unicode/utf32"
+	"golang.org/x/text/transform"
+)
+
+// BOMEncoding is unicode encoding of the text as marked by its BOM.
+type BOMEncoding int
+
+// Encodings recognized by BOM.
+const (
+	BOMNone BOMEncoding = iota // no BOM, encoding has to be taken from XML declaration or detected
+	BOMUTF8
+	BOMUTF16BigEndian
+	BOMUTF16LittleEndian
+	BOMUTF32BigEndian
+	BOMUTF32LittleEndian
+)
+
+// DetectBOM checks beginning of the text (4 bytes are enough) for unicode BOM.
+func DetectBOM(head []byte) BOMEncoding {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x00, 0x00, 0xFE, 0xFF}):
+		return BOMUTF32BigEndian
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE, 0x00, 0x00}):
+		return BOMUTF32LittleEndian
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return BOMUTF8
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return BOMUTF16BigEndian
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return BOMUTF16LittleEndian
+	}
+	return BOMNone
+}
+
+// BOMReader returns reader decoding text in specified encoding into UTF-8 and skipping BOM. When there is no BOM "r" is
+// returned as is.
+func BOMReader(r io.Reader, enc BOMEncoding) io.Reader {
+	switch enc {
+	case BOMNone:
+		return r
+	case BOMUTF8:
+		return transform.NewReader(r, unicode.BOMOverride(unicode.UTF8.NewDecoder()))
+	case BOMUTF16BigEndian:
+		return transform.NewReader(r, unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder())
+	case BOMUTF16LittleEndian:
+		return transform.NewReader(r, unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder())
+	case BOMUTF32BigEndian:
+		return transform.NewReader(r, utf32.UTF32(utf32.BigEndian, utf32.ExpectBOM).NewDecoder())
+	case BOMUTF32LittleEndian:
+		return transform.NewReader(r, utf32.UTF32(utf32.LittleEndian, utf32.ExpectBOM).NewDecoder())
+	default:
+		panic("unsupported encoding - should never happen")
+	}
+}
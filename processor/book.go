@@ -1,11 +1,14 @@
 package processor
 
 import (
+	gocontext "context"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
 
+	"github.com/asaskevich/govalidator"
 	"github.com/google/uuid"
 	"golang.org/x/text/language"
 
@@ -38,6 +41,20 @@ type notelink struct {
 	bodyName string
 }
 
+// Sequence is a series book belongs to. Sequences could be nested (cycle, sub-cycle) and could come from publisher.
+type Sequence struct {
+	Name      string
+	Number    int
+	Level     int  // nesting level, 0 for top level sequences
+	Publisher bool // sequence is from publish-info
+}
+
+// CustomInfo is arbitrary information attached to book description.
+type CustomInfo struct {
+	Type string
+	Text string
+}
+
 // Book information and parsing context.
 type Book struct {
 	// description
@@ -48,10 +65,31 @@ type Book struct {
 	Cover      string
 	Genres     []string
 	Authors    []*config.AuthorName
-	SeqName    string
+	SeqName    string // primary sequence, the first one in title-info
 	SeqNum     int
+	Sequences  []Sequence // all sequences in document order, nested sequences follow their parents
 	Annotation string
 	Date       string
+	DateValue  string // machine readable date, if available
+	// additional description
+	Translators  []*config.AuthorName
+	Illustrators []*config.AuthorName // FB2 has no place for them, could come from FB3
+	Keywords     []string
+	SrcLang      string
+	SrcTitle     string               // title of the original (src-title-info)
+	SrcAuthors   []*config.AuthorName // authors of the original (src-title-info)
+	Publisher    string
+	ISBN         string
+	PubBookName  string
+	PubCity      string
+	PubYear      string
+	DocAuthors   []*config.AuthorName // authors of the electronic document
+	DocProgram   string
+	DocDate      string
+	DocVersion   string
+	DocSrcURLs   []string
+	DocSrcOCR    string
+	CustomInfo   []CustomInfo
 	// book structure
 	TOC            []*tocEntry       // collected TOC entries
 	Files          []*dataFile       // generated content
@@ -86,6 +124,100 @@ func NewBook(u uuid.UUID, name string) *Book {
 	}
 }
 
+var (
+	reYear = regexp.MustCompile(`^\d{4}$`)
+	reDate = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+	reISBN = regexp.MustCompile(`^(\d{9}[\dX]|\d{13})$`)
+)
+
+// syncPrimarySequence makes sure primary sequence is the first of book sequences.
+func (b *Book) syncPrimarySequence() {
+	if len(b.SeqName) == 0 {
+		return
+	}
+	primary := Sequence{Name: b.SeqName, Number: b.SeqNum}
+	if len(b.Sequences) > 0 && !b.Sequences[0].Publisher {
+		b.Sequences[0].Name, b.Sequences[0].Number = primary.Name, primary.Number
+		return
+	}
+	b.Sequences = append([]Sequence{primary}, b.Sequences...)
+}
+
+// secondarySequences returns top level sequences from title-info except primary one.
+func (b *Book) secondarySequences() []Sequence {
+	var res []Sequence
+	for i, s := range b.Sequences {
+		if i > 0 && s.Level == 0 && !s.Publisher {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// subSequence returns first sequence nested in primary one.
+func (b *Book) subSequence() (Sequence, bool) {
+	for i := 1; i < len(b.Sequences) && b.Sequences[i].Level > 0 && !b.Sequences[i].Publisher; i++ {
+		if b.Sequences[i].Level == 1 {
+			return b.Sequences[i], true
+		}
+	}
+	return Sequence{}, false
+}
+
+// publisherSequence returns first sequence from publish-info.
+func (b *Book) publisherSequence() (Sequence, bool) {
+	for _, s := range b.Sequences {
+		if s.Publisher {
+			return s, true
+		}
+	}
+	return Sequence{}, false
+}
+
+// publicationDate returns date suitable for OPF metadata: publication year if known, date of writing otherwise.
+func (b *Book) publicationDate() string {
+	switch {
+	case reYear.MatchString(b.PubYear):
+		return b.PubYear
+	case reDate.MatchString(b.DateValue):
+		return b.DateValue
+	case reDate.MatchString(strings.TrimSpace(b.Date)):
+		return strings.TrimSpace(b.Date)
+	}
+	return ""
+}
+
+// cleanISBN returns book ISBN without separators and reports if its check digit is correct. Empty string is returned when
+// value does not look like ISBN at all. Printed books often have ISBN with wrong check digit, such ISBN still identifies the
+// book, so it is up to caller what to do with it.
+func (b *Book) cleanISBN() (string, bool) {
+	isbn := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(b.ISBN)))
+	if !reISBN.MatchString(isbn) {
+		return "", false
+	}
+	return isbn, govalidator.IsISBN10(isbn) || govalidator.IsISBN13(isbn)
+}
+
+// genreLanguage returns language of genre names: requested one if names are available in it, book language otherwise.
+func (b *Book) genreLanguage(requested string) string {
+	if requested == "en" || requested == "ru" {
+		return requested
+	}
+	if base, _ := b.Lang.Base(); base.String() == "ru" {
+		return "ru"
+	}
+	return "en"
+}
+
+// GenreNames returns names of the book genres in specified language.
+func (b *Book) GenreNames(lang string) []string {
+	names := make([]string, 0, len(b.Genres))
+	for _, g := range b.Genres {
+		names = append(names, GenreName(g, lang))
+	}
+	return names
+}
+
 // BookAuthors returns authors as a single string.
 func (b *Book) BookAuthors(format string, short bool) string {
 	if len(b.Authors) == 0 {
@@ -97,8 +229,13 @@ func (b *Book) BookAuthors(format string, short bool) string {
 		}
 		return ReplaceKeywords(format, CreateAuthorKeywordsMap(b.Authors[0])) + ", et al"
 	}
-	res := make([]string, 0, len(b.Authors))
-	for _, an := range b.Authors {
+	return authorsList(b.Authors, format)
+}
+
+// authorsList returns names formatted according to "format" as a single string.
+func authorsList(names []*config.AuthorName, format string) string {
+	res := make([]string, 0, len(names))
+	for _, an := range names {
 		res = append(res, ReplaceKeywords(format, CreateAuthorKeywordsMap(an)))
 	}
 	return strings.Join(res, ", ")
@@ -115,7 +252,7 @@ func (b *Book) flushMeta(path string) error {
 }
 
 // flushData saves all "data" files.
-func (b *Book) flushData(path string) error {
+func (b *Book) flushData(ctx gocontext.Context, path string) error {
 
 	if len(b.Data) == 0 {
 		return nil
@@ -143,6 +280,11 @@ func (b *Book) flushData(path string) error {
 				if f == nil || atomic.LoadInt32(&haveError) != 0 {
 					break
 				}
+				if err := ctx.Err(); err != nil {
+					atomic.AddInt32(&haveError, 1)
+					res <- err
+					break
+				}
 				err := f.flush(path)
 				if err != nil {
 					atomic.AddInt32(&haveError, 1)
@@ -171,7 +313,7 @@ func (b *Book) flushData(path string) error {
 }
 
 // flushXHTML saves all content files generated by transforming fb2.
-func (b *Book) flushXHTML(path string) error {
+func (b *Book) flushXHTML(ctx gocontext.Context, path string) error {
 
 	if len(b.Files) == 0 {
 		return nil
@@ -199,6 +341,11 @@ func (b *Book) flushXHTML(path string) error {
 				if f == nil || atomic.LoadInt32(&haveError) != 0 {
 					break
 				}
+				if err := ctx.Err(); err != nil {
+					atomic.AddInt32(&haveError, 1)
+					res <- err
+					break
+				}
 				err := f.flush(path)
 				if err != nil {
 					atomic.AddInt32(&haveError, 1)
@@ -227,7 +374,7 @@ func (b *Book) flushXHTML(path string) error {
 }
 
 // flushImages saves all images - coming from fb2 binary tags.
-func (b *Book) flushImages(path string) error {
+func (b *Book) flushImages(ctx gocontext.Context, path string) error {
 
 	if len(b.Images) == 0 {
 		return nil
@@ -257,6 +404,11 @@ func (b *Book) flushImages(path string) error {
 				if f == nil || atomic.LoadInt32(&haveError) != 0 {
 					break
 				}
+				if err := ctx.Err(); err != nil {
+					atomic.AddInt32(&haveError, 1)
+					res <- err
+					break
+				}
 				err := f.flush(path)
 				if err != nil {
 					atomic.AddInt32(&haveError, 1)
@@ -0,0 +1,158 @@
+package processor
+
+import (
+	"fmt"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+)
+
+// Frequencies of Russian letters (percent), other Cyrillic letters get some small weight.
+var cyrillicFreq = map[rune]float64{
+	'а': 8.01, 'б': 1.59, 'в': 4.54, 'г': 1.70, 'д': 2.98, 'е': 8.45, 'ё': 0.04, 'ж': 0.94, 'з': 1.65, 'и': 7.35, 'й': 1.21,
+	'к': 3.49, 'л': 4.40, 'м': 3.21, 'н': 6.70, 'о': 10.97, 'п': 2.81, 'р': 4.73, 'с': 5.47, 'т': 6.26, 'у': 2.62, 'ф': 0.26,
+	'х': 0.97, 'ц': 0.48, 'ч': 1.44, 'ш': 0.73, 'щ': 0.36, 'ъ': 0.04, 'ы': 1.90, 'ь': 1.74, 'э': 0.32, 'ю': 0.64, 'я': 2.01,
+	'і': 1.0, 'ї': 0.5, 'є': 0.5, 'ґ': 0.1, 'ў': 0.5,
+}
+
+// Single byte encodings detection could choose from, names are suitable for charset.Lookup.
+var cyrillicCharsets = []struct {
+	name  string
+	enc   encoding.Encoding
+	table [128]rune // upper half of the code page
+}{
+	{name: "windows-1251", enc: charmap.Windows1251},
+	{name: "koi8-r", enc: charmap.KOI8R},
+	{name: "ibm866", enc: charmap.CodePage866},
+	{name: "iso-8859-5", enc: charmap.ISO8859_5},
+}
+
+func init() {
+	for i := range cyrillicCharsets {
+		cs := &cyrillicCharsets[i]
+		for b := 0; b < 128; b++ {
+			cs.table[b] = cs.enc.(*charmap.Charmap).DecodeByte(byte(b + 128))
+		}
+	}
+}
+
+// Amount of text used for detection.
+const charsetSampleSize = 512 * 1024
+
+// DetectCharset guesses encoding of text without BOM. Only encodings commonly used for Russian FB2 are recognized: utf-8,
+// windows-1251, koi8-r, ibm866 (cp866) and iso-8859-5. "declared" is name of the encoding text claims to be in (could be
+// empty), it is kept unless content contradicts it. Returned name is suitable for charset.Lookup, it is empty when text
+// is plain ASCII or does not look like any of known encodings.
+func DetectCharset(data []byte, declared string) string {
+
+	sample := data
+	if len(sample) > charsetSampleSize {
+		sample = sample[:charsetSampleSize]
+		// sample may end in the middle of the character
+		for i := len(sample) - 1; i >= 0 && i >= len(sample)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(sample[i]) {
+				if !utf8.FullRune(sample[i:]) {
+					sample = sample[:i]
+				}
+				break
+			}
+		}
+	}
+
+	high, adjacent := 0, 0
+	for i, c := range sample {
+		if c < 0x80 {
+			continue
+		}
+		high++
+		if (i > 0 && sample[i-1] >= 0x80) || (i+1 < len(sample) && sample[i+1] >= 0x80) {
+			adjacent++
+		}
+	}
+	if high == 0 {
+		return ""
+	}
+
+	if utf8.Valid(sample) {
+		return "utf-8"
+	}
+
+	// in Cyrillic text non-ASCII characters form words, isolated ones are likely accented Latin letters
+	if float64(adjacent) < 0.5*float64(high) {
+		return ""
+	}
+
+	best, bestScore, declaredScore := "", -1.0, -1.0
+	for _, cs := range cyrillicCharsets {
+		score := 0.0
+		for _, c := range sample {
+			if c < 0x80 {
+				continue
+			}
+			r := cs.table[c-0x80]
+			if f, ok := cyrillicFreq[r]; ok {
+				score += f
+			} else if f, ok := cyrillicFreq[unicode.ToLower(r)]; ok {
+				// capital letters are rare in normal text
+				score += f * 0.2
+			}
+		}
+		if score > bestScore {
+			best, bestScore = cs.name, score
+		}
+		if cs.name == declared {
+			declaredScore = score
+		}
+	}
+	if declaredScore >= 0.8*bestScore {
+		return declared
+	}
+	return best
+}
+
+var reXMLEncoding = regexp.MustCompile(`^\s*<\?xml[^>]*encoding\s*=\s*["']([^"']+)["']`)
+
+// decodeFB2 converts document to UTF-8. Encoding is taken from XML declaration unless it is missing or contradicted by
+// content, in which case it is detected. Returned decision is empty when declaration was used.
+func decodeFB2(data []byte) ([]byte, string, error) {
+
+	var declared, label string
+	if m := reXMLEncoding.FindSubmatch(data); m != nil {
+		label = string(m[1])
+		if enc, name := charset.Lookup(label); enc != nil {
+			declared = name
+		}
+	}
+
+	var decision string
+	name := DetectCharset(data, declared)
+	switch {
+	case len(name) == 0 && len(declared) == 0 && len(label) > 0:
+		return nil, "", fmt.Errorf("unsupported encoding: %s", label)
+	case len(name) == 0 && len(declared) == 0:
+		name = "utf-8"
+	case len(name) == 0 || name == declared:
+		name = declared
+	case len(label) > 0 && len(declared) == 0:
+		decision = fmt.Sprintf("encoding %s detected, declared encoding %s is not supported", name, label)
+	case len(declared) > 0:
+		decision = fmt.Sprintf("encoding %s detected, declared encoding %s contradicts content", name, declared)
+	case name != "utf-8":
+		decision = fmt.Sprintf("encoding %s detected, document has no encoding declaration", name)
+	}
+
+	if name == "utf-8" {
+		return data, decision, nil
+	}
+	enc, _ := charset.Lookup(name)
+	out, _, err := transform.Bytes(enc.NewDecoder(), data)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to decode document from %s: %w", name, err)
+	}
+	return out, decision, nil
+}
@@ -0,0 +1,140 @@
+package processor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const charsetTestText = `Съешь же ещё этих мягких французских булок, да выпей чаю. В чащах юга жил бы цитрус? Да, но фальшивый экземпляр!`
+
+// encodeText converts UTF-8 text to specified encoding.
+func encodeText(t *testing.T, text, name string) []byte {
+	t.Helper()
+
+	if name == "utf-8" {
+		return []byte(text)
+	}
+	enc, _ := charset.Lookup(name)
+	if enc == nil {
+		t.Fatalf("unknown encoding %s", name)
+	}
+	out, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestDetectCharset(t *testing.T) {
+
+	latin, err := charmap.Windows1252.NewEncoder().Bytes([]byte("Le café était très animé, même à Noël. Ça va, naïve Zoë?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		data     []byte
+		declared string
+		want     string
+	}{
+		{"utf-8", encodeText(t, charsetTestText, "utf-8"), "", "utf-8"},
+		{"windows-1251", encodeText(t, charsetTestText, "windows-1251"), "", "windows-1251"},
+		{"koi8-r", encodeText(t, charsetTestText, "koi8-r"), "", "koi8-r"},
+		{"ibm866", encodeText(t, charsetTestText, "ibm866"), "", "ibm866"},
+		{"iso-8859-5", encodeText(t, charsetTestText, "iso-8859-5"), "", "iso-8859-5"},
+		{"declared is confirmed", encodeText(t, charsetTestText, "koi8-r"), "koi8-r", "koi8-r"},
+		{"declared is contradicted", encodeText(t, charsetTestText, "windows-1251"), "koi8-r", "windows-1251"},
+		{"utf-8 wins over declared", encodeText(t, charsetTestText, "utf-8"), "windows-1251", "utf-8"},
+		{"ascii", []byte("Plain ASCII text only."), "", ""},
+		{"ascii declared", []byte("Plain ASCII text only."), "windows-1251", ""},
+		{"accented latin", latin, "", ""},
+		{"empty", nil, "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := DetectCharset(c.data, c.declared); got != c.want {
+				t.Errorf("detected %q, expected %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDetectCharsetSampleBoundary(t *testing.T) {
+
+	// multibyte character split by the end of the sample must not turn valid UTF-8 into something else, whatever
+	// characters precede the split
+	text := []byte(strings.Repeat(charsetTestText+"\n", charsetSampleSize/len(charsetTestText)+2))
+	var split int
+	for shift := 0; shift < 8; shift++ {
+		data := append(bytes.Repeat([]byte{' '}, shift), text...)
+		if !utf8.RuneStart(data[charsetSampleSize]) {
+			split++
+		}
+		if got := DetectCharset(data, ""); got != "utf-8" {
+			t.Errorf("shift %d: detected %q, expected utf-8", shift, got)
+		}
+	}
+	if split < 2 {
+		t.Fatalf("sample boundary split character only %d times", split)
+	}
+
+	// only the sample is used: cp1251 text after it does not matter
+	data := append(bytes.Repeat([]byte("ascii "), charsetSampleSize/6+1), encodeText(t, charsetTestText, "windows-1251")...)
+	if got := DetectCharset(data, ""); got != "" {
+		t.Errorf("detected %q beyond the sample", got)
+	}
+}
+
+func TestDecodeFB2(t *testing.T) {
+
+	body := "<FictionBook><body><p>" + charsetTestText + "</p></body></FictionBook>"
+	decl := func(enc string) string {
+		return `<?xml version="1.0" encoding="` + enc + `"?>` + "\n"
+	}
+
+	cases := []struct {
+		name     string
+		data     []byte
+		decision string
+		err      string
+	}{
+		{"declared utf-8", []byte(decl("UTF-8") + body), "", ""},
+		{"declared windows-1251", encodeText(t, decl("windows-1251")+body, "windows-1251"), "", ""},
+		{"declared alias", encodeText(t, decl("cp1251")+body, "windows-1251"), "", ""},
+		{"declared koi8-r", encodeText(t, decl("koi8-r")+body, "koi8-r"), "", ""},
+		{"declared cp866", encodeText(t, decl("cp866")+body, "ibm866"), "", ""},
+		{"declared iso-8859-5", encodeText(t, decl("iso-8859-5")+body, "iso-8859-5"), "", ""},
+		{"no declaration", encodeText(t, body, "windows-1251"), "encoding windows-1251 detected, document has no encoding declaration", ""},
+		{"no declaration utf-8", []byte(body), "", ""},
+		{"no encoding in declaration", encodeText(t, `<?xml version="1.0"?>`+body, "koi8-r"), "encoding koi8-r detected, document has no encoding declaration", ""},
+		{"contradicted", encodeText(t, decl("utf-8")+body, "ibm866"), "encoding ibm866 detected, declared encoding utf-8 contradicts content", ""},
+		{"unsupported", encodeText(t, decl("x-unknown")+body, "koi8-r"), "encoding koi8-r detected, declared encoding x-unknown is not supported", ""},
+		{"unsupported ascii", []byte(decl("x-unknown") + "<FictionBook/>"), "", "unsupported encoding: x-unknown"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, decision, err := decodeFB2(c.data)
+			if len(c.err) > 0 {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("error %v, expected %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision != c.decision {
+				t.Errorf("decision %q, expected %q", decision, c.decision)
+			}
+			if !bytes.Contains(out, []byte(charsetTestText)) {
+				t.Errorf("text was not decoded: %q", out)
+			}
+		})
+	}
+}
@@ -48,13 +48,7 @@ func (f *dataFile) flush(path string) error {
 	}
 
 	if f.doc != nil {
-		if f.nofmt {
-			// on present day kindles when using mobi/azw3 formats and float-new notes mode chardata records interfere with notes formating on device
-			f.doc.Indent(etree.NoIndent)
-		} else {
-			// this is XML - ignore char data
-			f.doc.IndentTabs()
-		}
+		f.indent()
 		if err := f.doc.WriteToFile(filepath.Join(newdir, f.fname)); err != nil {
 			return fmt.Errorf("unable to flush XML content to %s: %w", filepath.Join(newdir, f.fname), err)
 		}
@@ -66,3 +60,31 @@ func (f *dataFile) flush(path string) error {
 	}
 	return nil
 }
+
+// indent formats XML document before it is stored.
+func (f *dataFile) indent() {
+	if f.nofmt {
+		// on present day kindles when using mobi/azw3 formats and float-new notes mode chardata records interfere with notes formating on device
+		f.doc.Indent(etree.NoIndent)
+	} else {
+		// this is XML - ignore char data
+		f.doc.IndentTabs()
+	}
+}
+
+// content returns file content as it should be stored, nil if there is nothing to store.
+func (f *dataFile) content() ([]byte, error) {
+
+	if len(f.fname) == 0 || (len(f.data) == 0 && f.doc == nil) {
+		return nil, nil
+	}
+	if f.doc == nil {
+		return f.data, nil
+	}
+	f.indent()
+	data, err := f.doc.WriteToBytes()
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize XML content of %s: %w", f.fname, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,888 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// WordprocessingML namespaces.
+const (
+	docxNSW   = `http://schemas.openxmlformats.org/wordprocessingml/2006/main`
+	docxNSR   = `http://schemas.openxmlformats.org/officeDocument/2006/relationships`
+	docxNSWP  = `http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing`
+	docxNSA   = `http://schemas.openxmlformats.org/drawingml/2006/main`
+	docxNSPic = `http://schemas.openxmlformats.org/drawingml/2006/picture`
+	docxNSRel = `http://schemas.openxmlformats.org/package/2006/relationships`
+)
+
+// A4 page with 2 cm margins, EMU in twip is 635.
+const (
+	docxPageWidth    = 11906
+	docxPageHeight   = 16838
+	docxPageMargin   = 1134
+	docxContentWidth = (docxPageWidth - 2*docxPageMargin) * 635
+)
+
+// docxRun describes character formatting.
+type docxRun struct {
+	bold, italic, strike bool
+	sup, sub, code       bool
+	style                string
+}
+
+// docxImage is media part of the package.
+type docxImage struct {
+	name          string // inside of word/media
+	rid           string
+	width, height int // EMU
+	data          []byte
+}
+
+// docxWriter converts generated XHTML into WordprocessingML.
+type docxWriter struct {
+	p     *Processor
+	fname string // file being processed, to resolve relative links
+
+	body      *etree.Element
+	footnotes *etree.Element
+	rels      *etree.Element
+	rid       int
+	links     map[string]string     // external link -> relationship id
+	images    map[string]*docxImage // content path -> media
+	media     []*docxImage
+	bookmarks map[string]string // content id -> bookmark name
+	bookmark  int
+	pending   []string // ids to be placed with next paragraph
+	drawing   int
+
+	notes     map[string]*etree.Element // note id -> content of the note
+	footnote  int
+	pageBreak bool // next paragraph starts new page
+	tocField  bool
+}
+
+// FinalizeDOCX produces Word document out of XHTML content generated from fb2.
+func (p *Processor) FinalizeDOCX(fname string) error {
+
+	if _, err := os.Stat(fname); err == nil {
+		if !p.env.Debug && !p.overwrite {
+			return fmt.Errorf("output file already exists: %s", fname)
+		}
+		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+		if err = os.Remove(fname); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	w := &docxWriter{
+		p:         p,
+		links:     make(map[string]string),
+		images:    make(map[string]*docxImage),
+		bookmarks: make(map[string]string),
+		notes:     make(map[string]*etree.Element),
+	}
+
+	document := docxDocument("w:document")
+	document.Root().CreateAttr("xmlns:wp", docxNSWP)
+	document.Root().CreateAttr("xmlns:a", docxNSA)
+	document.Root().CreateAttr("xmlns:pic", docxNSPic)
+	w.body = document.Root().AddNext("w:body")
+
+	footnotes := docxDocument("w:footnotes")
+	w.footnotes = footnotes.Root()
+	w.footnotes.AddNext("w:footnote", attr("w:type", "separator"), attr("w:id", "-1")).
+		AddNext("w:p").AddNext("w:r").AddNext("w:separator")
+	w.footnotes.AddNext("w:footnote", attr("w:type", "continuationSeparator"), attr("w:id", "0")).
+		AddNext("w:p").AddNext("w:r").AddNext("w:continuationSeparator")
+
+	rels := etree.NewDocument()
+	rels.CreateProcInst("xml", `version="1.0" encoding="UTF-8" standalone="yes"`)
+	w.rels = rels.CreateElement("Relationships")
+	w.rels.CreateAttr("xmlns", docxNSRel)
+	w.rel("styles", "styles.xml", false)
+	w.rel("settings", "settings.xml", false)
+	w.rel("footnotes", "footnotes.xml", false)
+
+	w.collectNotes()
+
+	for _, f := range p.Book.Files {
+		if f.transient&dataNotForSpline != 0 || f.doc == nil || w.isNotesFile(f.fname) {
+			continue
+		}
+		body := f.doc.FindElement("./html/body")
+		if body == nil {
+			continue
+		}
+		w.fname = f.fname
+		w.pending = append(w.pending, "file:"+f.fname)
+		switch f.id {
+		case "cover":
+			w.cover(body)
+		case "toc":
+			w.toc(body)
+		default:
+			w.blocks(body, "")
+		}
+	}
+
+	sect := w.body.AddNext("w:sectPr")
+	sect.AddNext("w:footnotePr").AddNext("w:numFmt", attr("w:val", "decimal"))
+	sect.AddNext("w:pgSz", attr("w:w", strconv.Itoa(docxPageWidth)), attr("w:h", strconv.Itoa(docxPageHeight)))
+	margin := strconv.Itoa(docxPageMargin)
+	sect.AddNext("w:pgMar",
+		attr("w:top", margin), attr("w:right", margin), attr("w:bottom", margin), attr("w:left", margin),
+		attr("w:header", "709"), attr("w:footer", "709"), attr("w:gutter", "0"))
+
+	return w.write(fname, map[string]*etree.Document{
+		"word/document.xml":            document,
+		"word/footnotes.xml":           footnotes,
+		"word/settings.xml":            w.settings(),
+		"word/_rels/document.xml.rels": rels,
+		"docProps/core.xml":            w.core(),
+	})
+}
+
+func docxDocument(root string) *etree.Document {
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8" standalone="yes"`)
+	e := doc.CreateElement(root)
+	e.CreateAttr("xmlns:w", docxNSW)
+	e.CreateAttr("xmlns:r", docxNSR)
+	return doc
+}
+
+// write packs all parts together.
+func (w *docxWriter) write(fname string, parts map[string]*etree.Document) error {
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("unable to create DOCX (%s): %w", fname, err)
+	}
+	defer f.Close()
+
+	z := zip.NewWriter(f)
+	t := time.Now()
+
+	add := func(name string, data []byte) error {
+		out, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: t})
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+	addXML := func(name string, doc *etree.Document) error {
+		var b bytes.Buffer
+		if _, err := doc.WriteTo(&b); err != nil {
+			return err
+		}
+		return add(name, b.Bytes())
+	}
+
+	// content types should be the first entry
+	if err := addXML("[Content_Types].xml", w.contentTypes()); err != nil {
+		return fmt.Errorf("unable to write DOCX (%s): %w", fname, err)
+	}
+	if err := add("_rels/.rels", []byte(docxPackageRels)); err != nil {
+		return fmt.Errorf("unable to write DOCX (%s): %w", fname, err)
+	}
+	if err := add("docProps/app.xml", []byte(docxApp)); err != nil {
+		return fmt.Errorf("unable to write DOCX (%s): %w", fname, err)
+	}
+	if err := add("word/styles.xml", []byte(fmt.Sprintf(docxStyles, w.p.Book.Lang.String()))); err != nil {
+		return fmt.Errorf("unable to write DOCX (%s): %w", fname, err)
+	}
+	for _, name := range []string{"word/document.xml", "word/footnotes.xml", "word/settings.xml", "word/_rels/document.xml.rels", "docProps/core.xml"} {
+		if err := addXML(name, parts[name]); err != nil {
+			return fmt.Errorf("unable to write DOCX (%s): %w", fname, err)
+		}
+	}
+	for _, m := range w.media {
+		if err := add("word/media/"+m.name, m.data); err != nil {
+			return fmt.Errorf("unable to write DOCX (%s): %w", fname, err)
+		}
+	}
+	return z.Close()
+}
+
+func (w *docxWriter) contentTypes() *etree.Document {
+
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8" standalone="yes"`)
+	types := doc.CreateElement("Types")
+	types.CreateAttr("xmlns", `http://schemas.openxmlformats.org/package/2006/content-types`)
+
+	types.AddNext("Default", attr("Extension", "rels"), attr("ContentType", "application/vnd.openxmlformats-package.relationships+xml"))
+	types.AddNext("Default", attr("Extension", "xml"), attr("ContentType", "application/xml"))
+	for _, ext := range []string{"png", "jpeg", "gif", "bmp"} {
+		types.AddNext("Default", attr("Extension", ext), attr("ContentType", "image/"+ext))
+	}
+	for name, ct := range map[string]string{
+		"/word/document.xml":  "application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml",
+		"/word/styles.xml":    "application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml",
+		"/word/settings.xml":  "application/vnd.openxmlformats-officedocument.wordprocessingml.settings+xml",
+		"/word/footnotes.xml": "application/vnd.openxmlformats-officedocument.wordprocessingml.footnotes+xml",
+		"/docProps/core.xml":  "application/vnd.openxmlformats-package.core-properties+xml",
+		"/docProps/app.xml":   "application/vnd.openxmlformats-officedocument.extended-properties+xml",
+	} {
+		types.AddNext("Override", attr("PartName", name), attr("ContentType", ct))
+	}
+	return doc
+}
+
+func (w *docxWriter) settings() *etree.Document {
+
+	doc := docxDocument("w:settings")
+	// order of elements is defined by schema
+	s := doc.Root()
+	s.AddNext("w:defaultTabStop", attr("w:val", "709"))
+	if w.p.env.Cfg.Doc.Hyphenate {
+		s.AddNext("w:autoHyphenation")
+	}
+	if w.tocField {
+		// ask Word to build table of contents on open
+		s.AddNext("w:updateFields", attr("w:val", "true"))
+	}
+	fp := s.AddNext("w:footnotePr")
+	fp.AddNext("w:footnote", attr("w:id", "-1"))
+	fp.AddNext("w:footnote", attr("w:id", "0"))
+	s.AddNext("w:compat").AddNext("w:compatSetting",
+		attr("w:name", "compatibilityMode"), attr("w:uri", "http://schemas.microsoft.com/office/word"), attr("w:val", "15"))
+	return doc
+}
+
+// core produces document core properties out of book description.
+func (w *docxWriter) core() *etree.Document {
+
+	b := w.p.Book
+
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8" standalone="yes"`)
+	cp := doc.CreateElement("cp:coreProperties")
+	cp.CreateAttr("xmlns:cp", `http://schemas.openxmlformats.org/package/2006/metadata/core-properties`)
+	cp.CreateAttr("xmlns:dc", `http://purl.org/dc/elements/1.1/`)
+	cp.CreateAttr("xmlns:dcterms", `http://purl.org/dc/terms/`)
+	cp.CreateAttr("xmlns:dcmitype", `http://purl.org/dc/dcmitype/`)
+	cp.CreateAttr("xmlns:xsi", `http://www.w3.org/2001/XMLSchema-instance`)
+
+	cp.AddNext("dc:title").SetText(b.Title)
+	if authors := b.BookAuthors(w.p.env.Cfg.Doc.AuthorFormat, false); len(authors) > 0 {
+		cp.AddNext("dc:creator").SetText(authors)
+	}
+	if len(b.SeqName) > 0 {
+		seq := b.SeqName
+		if b.SeqNum > 0 {
+			seq += " " + strconv.Itoa(b.SeqNum)
+		}
+		cp.AddNext("dc:subject").SetText(seq)
+	}
+	if len(b.Genres) > 0 {
+		cp.AddNext("cp:keywords").SetText(strings.Join(b.Genres, ", "))
+	}
+	if len(b.Annotation) > 0 {
+		cp.AddNext("dc:description").SetText(b.Annotation)
+	}
+	cp.AddNext("dc:identifier").SetText("urn:uuid:" + b.ID.String())
+	cp.AddNext("dc:language").SetText(b.Lang.String())
+	now := time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	cp.AddNext("dcterms:created", attr("xsi:type", "dcterms:W3CDTF")).SetText(now)
+	cp.AddNext("dcterms:modified", attr("xsi:type", "dcterms:W3CDTF")).SetText(now)
+	return doc
+}
+
+// rel adds document relationship and returns its id.
+func (w *docxWriter) rel(kind, target string, external bool) string {
+	w.rid++
+	id := "rId" + strconv.Itoa(w.rid)
+	r := w.rels.AddNext("Relationship",
+		attr("Id", id),
+		attr("Type", "http://schemas.openxmlformats.org/officeDocument/2006/relationships/"+kind),
+		attr("Target", target))
+	if external {
+		r.CreateAttr("TargetMode", "External")
+	}
+	return id
+}
+
+// collectNotes extracts content of every note from notes bodies.
+func (w *docxWriter) collectNotes() {
+
+	for _, f := range w.p.Book.Files {
+		if f.doc == nil || !w.isNotesFile(f.fname) {
+			continue
+		}
+		body := f.doc.FindElement("./html/body")
+		if body == nil {
+			continue
+		}
+		var cur *etree.Element
+		for _, c := range body.ChildElements() {
+			if id := getAttrValue(c, "id"); len(id) > 0 {
+				if _, ok := w.p.Book.Notes[id]; ok {
+					cur = etree.NewElement("div")
+					w.notes[id] = cur
+					continue
+				}
+			}
+			if cur != nil && getAttrValue(c, "class") != "titlenotes" {
+				cur.AddChild(c.Copy())
+			}
+		}
+	}
+}
+
+func (w *docxWriter) isNotesFile(fname string) bool {
+	for _, nl := range w.p.Book.NotesOrder {
+		if f, ok := w.p.Book.LinksLocations[nl.id]; ok && f == fname {
+			return true
+		}
+	}
+	return false
+}
+
+// bookmarkName returns valid Word bookmark name for content id.
+func (w *docxWriter) bookmarkName(id string) string {
+	if name, ok := w.bookmarks[id]; ok {
+		return name
+	}
+	name := "_fb2c" + strconv.Itoa(len(w.bookmarks)+1)
+	w.bookmarks[id] = name
+	return name
+}
+
+func (w *docxWriter) addBookmark(to *etree.Element, id string) {
+	w.bookmark++
+	bid := strconv.Itoa(w.bookmark)
+	to.AddNext("w:bookmarkStart", attr("w:id", bid), attr("w:name", w.bookmarkName(id)))
+	to.AddNext("w:bookmarkEnd", attr("w:id", bid))
+}
+
+// paragraph starts new paragraph of specified style placing pending bookmarks.
+func (w *docxWriter) paragraph(to *etree.Element, style string) *etree.Element {
+	p := to.AddNext("w:p")
+	if len(style) > 0 || w.pageBreak {
+		ppr := p.AddNext("w:pPr")
+		if len(style) > 0 {
+			ppr.AddNext("w:pStyle", attr("w:val", style))
+		}
+		if w.pageBreak {
+			ppr.AddNext("w:pageBreakBefore")
+			w.pageBreak = false
+		}
+	}
+	for _, id := range w.pending {
+		w.addBookmark(p, id)
+	}
+	w.pending = w.pending[:0]
+	return p
+}
+
+func (w *docxWriter) cover(body *etree.Element) {
+
+	var src string
+	if e := body.FindElement(".//image"); e != nil {
+		src = getAttrValue(e, "href")
+	} else if e := body.FindElement(".//img"); e != nil {
+		src = getAttrValue(e, "src")
+	}
+	if img := w.image(src); img != nil {
+		w.drawingRun(w.paragraph(w.body, "Image"), img)
+		w.pageBreak = true
+	}
+}
+
+// toc replaces generated TOC page with Word field.
+func (w *docxWriter) toc(body *etree.Element) {
+
+	title := "Contents"
+	if h := body.FindElement(".//div[@id='toc']"); h != nil {
+		title = strings.TrimSpace(h.Text())
+	}
+	if w.body.FindElement("./w:p") != nil {
+		w.pageBreak = true
+	}
+	w.paragraph(w.body, "TOCHeading").AddNext("w:r").AddNext("w:t").SetText(title)
+	w.paragraph(w.body, "").AddNext("w:fldSimple", attr("w:instr", `TOC \o "1-6" \h \z \u`))
+	w.tocField = true
+	w.pageBreak = true
+}
+
+// blocks walks block level content.
+func (w *docxWriter) blocks(e *etree.Element, style string) {
+	for _, c := range e.ChildElements() {
+		w.block(w.body, c, style)
+	}
+}
+
+func (w *docxWriter) block(to, c *etree.Element, style string) {
+
+	if id := getAttrValue(c, "id"); len(id) > 0 {
+		w.pending = append(w.pending, id)
+	}
+
+	css := getAttrValue(c, "class")
+	if len(c.Child) == 0 && c.Tag != "img" && css != "emptyline" {
+		// section markers, anchors will be placed with next paragraph
+		return
+	}
+
+	switch {
+	case css == "titleblock":
+		if w.body.FindElement("./w:p") != nil {
+			w.pageBreak = true
+		}
+		w.blocksTo(to, c, style)
+	case textHeaderCSS.MatchString(css):
+		level, _ := strconv.Atoi(css[1:])
+		if level > 5 {
+			level = 5
+		}
+		style := "Heading" + strconv.Itoa(level+1)
+		if titles := c.SelectElements("p"); len(titles) > 0 {
+			p := w.paragraph(to, style)
+			for i, t := range titles {
+				if i > 0 {
+					p.AddNext("w:r").AddNext("w:br")
+				}
+				w.inline(p, t, docxRun{})
+			}
+			trimRuns(p)
+		} else {
+			w.para(to, c, style)
+		}
+	case textSkippedCSS[css] || c.Tag == "img" || c.Tag == "svg":
+		// vignettes and images
+		for _, src := range imageRefs(c) {
+			if img := w.image(src); img != nil {
+				w.drawingRun(w.paragraph(to, "Image"), img)
+			}
+		}
+	case css == "epigraph":
+		w.blocksTo(to, c, "Epigraph")
+	case css == "cite" || css == "annotation":
+		w.blocksTo(to, c, "Quote")
+	case css == "poem" || css == "stanza":
+		w.blocksTo(to, c, "Verse")
+		if css == "stanza" {
+			// stanzas are separated
+			w.paragraph(to, "Verse")
+		}
+	case css == "text-author":
+		w.para(to, c, "TextAuthor")
+	case css == "subtitle":
+		w.para(to, c, "Subtitle")
+	case css == "emptyline":
+		w.paragraph(to, style)
+	case c.Tag == "table":
+		w.table(to, c)
+	case c.Tag == "p" || !hasBlocks(c):
+		w.para(to, c, style)
+	default:
+		w.blocksTo(to, c, style)
+	}
+}
+
+func (w *docxWriter) blocksTo(to, e *etree.Element, style string) {
+	for _, c := range e.ChildElements() {
+		w.block(to, c, style)
+	}
+}
+
+func (w *docxWriter) para(to, e *etree.Element, style string) {
+	p := w.paragraph(to, style)
+	w.inline(p, e, docxRun{})
+	trimRuns(p)
+}
+
+func (w *docxWriter) table(to, e *etree.Element) {
+
+	rows := e.FindElements(".//tr")
+	cols := 0
+	for _, tr := range rows {
+		if n := len(tr.ChildElements()); n > cols {
+			cols = n
+		}
+	}
+	if cols == 0 {
+		return
+	}
+
+	tbl := to.AddNext("w:tbl")
+	pr := tbl.AddNext("w:tblPr")
+	pr.AddNext("w:tblStyle", attr("w:val", "TableGrid"))
+	pr.AddNext("w:tblW", attr("w:w", "5000"), attr("w:type", "pct"))
+	grid := tbl.AddNext("w:tblGrid")
+	width := strconv.Itoa((docxPageWidth - 2*docxPageMargin) / cols)
+	for i := 0; i < cols; i++ {
+		grid.AddNext("w:gridCol", attr("w:w", width))
+	}
+
+	for _, tr := range rows {
+		row := tbl.AddNext("w:tr")
+		cells := tr.ChildElements()
+		for i := 0; i < cols; i++ {
+			tc := row.AddNext("w:tc")
+			tc.AddNext("w:tcPr").AddNext("w:tcW", attr("w:w", width), attr("w:type", "dxa"))
+			if i >= len(cells) {
+				tc.AddNext("w:p")
+				continue
+			}
+			style := "TableContents"
+			if cells[i].Tag == "th" {
+				style = "TableHeading"
+			}
+			if hasBlocks(cells[i]) {
+				w.blocksTo(tc, cells[i], style)
+			} else {
+				w.para(tc, cells[i], style)
+			}
+			if tc.FindElement("./w:p") == nil {
+				// cell must end with paragraph
+				tc.AddNext("w:p")
+			}
+		}
+	}
+	// tables could not be adjacent or end document
+	w.paragraph(to, "")
+}
+
+// inline converts formatted text of the element into runs.
+func (w *docxWriter) inline(to, e *etree.Element, rp docxRun) {
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			w.text(to, t.Data, rp)
+		case *etree.Element:
+			w.inlineElement(to, t, rp)
+			w.text(to, t.TailData, rp)
+		}
+	}
+}
+
+func (w *docxWriter) inlineElement(to, e *etree.Element, rp docxRun) {
+
+	if id := getAttrValue(e, "id"); len(id) > 0 && !(e.Tag == "a" && getAttrValue(e, "class") == "pagemarker") {
+		w.addBookmark(to, id)
+	}
+
+	css := getAttrValue(e, "class")
+	switch e.Tag {
+	case "br":
+		to.AddNext("w:r").AddNext("w:br")
+		return
+	case "img", "svg":
+		for _, src := range imageRefs(e) {
+			if img := w.image(src); img != nil {
+				w.drawingRun(to, img)
+			}
+		}
+		return
+	case "a":
+		if css == "pagemarker" {
+			return
+		}
+		href := getAttrValue(e, "href")
+		u, err := url.Parse(href)
+		if len(href) == 0 || err != nil {
+			break
+		}
+		if _, ok := w.p.Book.Notes[u.Fragment]; ok && len(u.Fragment) > 0 && w.footnoteRef(to, u.Fragment) {
+			return
+		}
+		var link *etree.Element
+		switch {
+		case len(u.Scheme) > 0 || len(u.Host) > 0:
+			rid, ok := w.links[href]
+			if !ok {
+				rid = w.rel("hyperlink", href, true)
+				w.links[href] = rid
+			}
+			link = to.AddNext("w:hyperlink", attr("r:id", rid))
+		case len(u.Fragment) > 0:
+			link = to.AddNext("w:hyperlink", attr("w:anchor", w.bookmarkName(u.Fragment)))
+		case len(u.Path) > 0:
+			link = to.AddNext("w:hyperlink", attr("w:anchor", w.bookmarkName("file:"+u.Path)))
+		default:
+			link = to.AddNext("w:hyperlink", attr("w:anchor", w.bookmarkName("file:"+w.fname)))
+		}
+		rp.style = "Hyperlink"
+		w.inline(link, e, rp)
+		return
+	case "strong", "b":
+		rp.bold = true
+	case "em", "i":
+		rp.italic = true
+	case "sup":
+		rp.sup = true
+	case "sub":
+		rp.sub = true
+	case "code":
+		rp.code = true
+	case "span":
+		switch css {
+		case "strong":
+			rp.bold = true
+		case "emphasis":
+			rp.italic = true
+		case "strike":
+			rp.strike = true
+		}
+	}
+	w.inline(to, e, rp)
+}
+
+// footnoteRef creates footnote with note content and puts reference to it into text.
+func (w *docxWriter) footnoteRef(to *etree.Element, id string) bool {
+
+	content, ok := w.notes[id]
+	if !ok {
+		n := w.p.Book.Notes[id]
+		if len(strings.TrimSpace(n.body)) == 0 {
+			return false
+		}
+		content = etree.NewElement("div")
+		content.AddNext("p").SetText(n.body)
+	}
+
+	w.footnote++
+	fid := strconv.Itoa(w.footnote)
+	fn := w.footnotes.AddNext("w:footnote", attr("w:id", fid))
+
+	// bookmarks and page breaks belong to main text
+	pending, pageBreak := w.pending, w.pageBreak
+	w.pending, w.pageBreak = nil, false
+	for _, c := range content.ChildElements() {
+		w.block(fn, c, "FootnoteText")
+	}
+	w.pending, w.pageBreak = pending, pageBreak
+
+	first := fn.FindElement("./w:p")
+	if first == nil {
+		first = w.paragraph(fn, "FootnoteText")
+	}
+	mark := etree.NewElement("w:r")
+	mark.AddNext("w:rPr").AddNext("w:rStyle", attr("w:val", "FootnoteReference"))
+	mark.AddNext("w:footnoteRef")
+	space := etree.NewElement("w:r")
+	space.AddNext("w:t", attr("xml:space", "preserve")).SetText(" ")
+	var ex etree.Token
+	for _, c := range first.ChildElements() {
+		if c.Space != "w" || c.Tag != "pPr" {
+			ex = c
+			break
+		}
+	}
+	first.InsertChild(ex, mark)
+	first.InsertChild(ex, space)
+
+	r := to.AddNext("w:r")
+	r.AddNext("w:rPr").AddNext("w:rStyle", attr("w:val", "FootnoteReference"))
+	r.AddNext("w:footnoteReference", attr("w:id", fid))
+	return true
+}
+
+func (w *docxWriter) text(to *etree.Element, s string, rp docxRun) {
+
+	// Word hyphenates text itself
+	s = textSpaces.ReplaceAllString(strings.ReplaceAll(s, "\u00AD", ""), " ")
+	if len(s) == 0 {
+		return
+	}
+
+	r := to.AddNext("w:r")
+	if rp != (docxRun{}) {
+		pr := r.AddNext("w:rPr")
+		if len(rp.style) > 0 {
+			pr.AddNext("w:rStyle", attr("w:val", rp.style))
+		}
+		if rp.code {
+			pr.AddNext("w:rFonts", attr("w:ascii", "Courier New"), attr("w:hAnsi", "Courier New"), attr("w:cs", "Courier New"))
+		}
+		if rp.bold {
+			pr.AddNext("w:b")
+		}
+		if rp.italic {
+			pr.AddNext("w:i")
+		}
+		if rp.strike {
+			pr.AddNext("w:strike")
+		}
+		if rp.sup {
+			pr.AddNext("w:vertAlign", attr("w:val", "superscript"))
+		} else if rp.sub {
+			pr.AddNext("w:vertAlign", attr("w:val", "subscript"))
+		}
+	}
+	r.AddNext("w:t", attr("xml:space", "preserve")).SetText(s)
+}
+
+// trimRuns removes spaces at the beginning and the end of paragraph.
+func trimRuns(p *etree.Element) {
+	ts := p.FindElements(".//w:t")
+	if len(ts) == 0 {
+		return
+	}
+	ts[0].SetText(strings.TrimLeft(ts[0].Text(), " "))
+	ts[len(ts)-1].SetText(strings.TrimRight(ts[len(ts)-1].Text(), " "))
+}
+
+func imageRefs(e *etree.Element) []string {
+	var res []string
+	if e.Tag == "img" {
+		res = append(res, getAttrValue(e, "src"))
+	}
+	for _, i := range e.FindElements(".//img") {
+		res = append(res, getAttrValue(i, "src"))
+	}
+	for _, i := range e.FindElements(".//image") {
+		res = append(res, getAttrValue(i, "href"))
+	}
+	return res
+}
+
+// image adds (once) image referenced from the content to the package.
+func (w *docxWriter) image(src string) *docxImage {
+
+	name := path.Clean(src)
+	if len(src) == 0 || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+		return nil
+	}
+	if img, ok := w.images[name]; ok {
+		return img
+	}
+	w.images[name] = nil
+
+	data, err := os.ReadFile(filepath.Join(w.p.tmpDir, DirContent, filepath.FromSlash(name)))
+	if err != nil {
+		w.p.env.Log.Warn("Unable to read image, skipping", zap.String("ref", src), zap.Error(err))
+		return nil
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		w.p.env.Log.Warn("Unable to use image, skipping", zap.String("ref", src), zap.Error(err))
+		return nil
+	}
+	ext := format
+	switch format {
+	case "png", "jpeg", "gif", "bmp":
+	default:
+		// Word does not understand it, convert
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			w.p.env.Log.Warn("Unable to use image, skipping", zap.String("ref", src), zap.Error(err))
+			return nil
+		}
+		var b bytes.Buffer
+		if err := png.Encode(&b, img); err != nil {
+			w.p.env.Log.Warn("Unable to convert image, skipping", zap.String("ref", src), zap.Error(err))
+			return nil
+		}
+		data, ext = b.Bytes(), "png"
+	}
+
+	// assume 96 dpi
+	width, height := cfg.Width*9525, cfg.Height*9525
+	if width > docxContentWidth {
+		width, height = docxContentWidth, int(int64(height)*docxContentWidth/int64(width))
+	}
+	img := &docxImage{
+		name:   fmt.Sprintf("image%d.%s", len(w.media)+1, ext),
+		width:  width,
+		height: height,
+		data:   data,
+	}
+	img.rid = w.rel("image", "media/"+img.name, false)
+	w.media = append(w.media, img)
+	w.images[name] = img
+	return img
+}
+
+// drawingRun puts inline picture into paragraph.
+func (w *docxWriter) drawingRun(to *etree.Element, img *docxImage) {
+
+	w.drawing++
+	id := strconv.Itoa(w.drawing)
+	cx, cy := strconv.Itoa(img.width), strconv.Itoa(img.height)
+
+	inline := to.AddNext("w:r").AddNext("w:drawing").AddNext("wp:inline",
+		attr("distT", "0"), attr("distB", "0"), attr("distL", "0"), attr("distR", "0"))
+	inline.AddNext("wp:extent", attr("cx", cx), attr("cy", cy))
+	inline.AddNext("wp:docPr", attr("id", id), attr("name", "Picture "+id))
+	inline.AddNext("wp:cNvGraphicFramePr").AddNext("a:graphicFrameLocks", attr("noChangeAspect", "1"))
+
+	pic := inline.AddNext("a:graphic").AddNext("a:graphicData", attr("uri", docxNSPic)).AddNext("pic:pic")
+	nv := pic.AddNext("pic:nvPicPr")
+	nv.AddNext("pic:cNvPr", attr("id", id), attr("name", img.name))
+	nv.AddNext("pic:cNvPicPr")
+	fill := pic.AddNext("pic:blipFill")
+	fill.AddNext("a:blip", attr("r:embed", img.rid))
+	fill.AddNext("a:stretch").AddNext("a:fillRect")
+	sp := pic.AddNext("pic:spPr")
+	xfrm := sp.AddNext("a:xfrm")
+	xfrm.AddNext("a:off", attr("x", "0"), attr("y", "0"))
+	xfrm.AddNext("a:ext", attr("cx", cx), attr("cy", cy))
+	sp.AddNext("a:prstGeom", attr("prst", "rect")).AddNext("a:avLst")
+}
+
+const docxPackageRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="docProps/core.xml"/>
+<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/extended-properties" Target="docProps/app.xml"/>
+</Relationships>`
+
+const docxApp = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/extended-properties">
+<Application>fb2converter</Application>
+</Properties>`
+
+// Styles used by generated document, mimics default book stylesheet. Single parameter is document language.
+const docxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:docDefaults>
+<w:rPrDefault><w:rPr><w:rFonts w:ascii="Times New Roman" w:hAnsi="Times New Roman" w:eastAsia="Times New Roman" w:cs="Times New Roman"/><w:sz w:val="24"/><w:szCs w:val="24"/><w:lang w:val="%s"/></w:rPr></w:rPrDefault>
+<w:pPrDefault><w:pPr><w:spacing w:after="0" w:line="276" w:lineRule="auto"/></w:pPr></w:pPrDefault>
+</w:docDefaults>
+<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/><w:qFormat/><w:pPr><w:ind w:firstLine="425"/><w:jc w:val="both"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="480" w:after="240"/><w:ind w:firstLine="0"/><w:jc w:val="center"/><w:outlineLvl w:val="0"/></w:pPr><w:rPr><w:b/><w:sz w:val="40"/><w:szCs w:val="40"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="360" w:after="240"/><w:ind w:firstLine="0"/><w:jc w:val="center"/><w:outlineLvl w:val="1"/></w:pPr><w:rPr><w:b/><w:sz w:val="34"/><w:szCs w:val="34"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading3"><w:name w:val="heading 3"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:ind w:firstLine="0"/><w:jc w:val="center"/><w:outlineLvl w:val="2"/></w:pPr><w:rPr><w:b/><w:sz w:val="30"/><w:szCs w:val="30"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading4"><w:name w:val="heading 4"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:ind w:firstLine="0"/><w:jc w:val="center"/><w:outlineLvl w:val="3"/></w:pPr><w:rPr><w:b/><w:sz w:val="28"/><w:szCs w:val="28"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading5"><w:name w:val="heading 5"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:ind w:firstLine="0"/><w:jc w:val="center"/><w:outlineLvl w:val="4"/></w:pPr><w:rPr><w:b/><w:sz w:val="26"/><w:szCs w:val="26"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading6"><w:name w:val="heading 6"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:ind w:firstLine="0"/><w:jc w:val="center"/><w:outlineLvl w:val="5"/></w:pPr><w:rPr><w:b/><w:i/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="TOCHeading"><w:name w:val="TOC Heading"/><w:basedOn w:val="Heading1"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:outlineLvl w:val="9"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Subtitle"><w:name w:val="Subtitle"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="120" w:after="120"/><w:ind w:firstLine="0"/><w:jc w:val="center"/></w:pPr><w:rPr><w:b/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Epigraph"><w:name w:val="Epigraph"/><w:basedOn w:val="Normal"/><w:qFormat/><w:pPr><w:ind w:left="3402" w:firstLine="0"/><w:jc w:val="left"/></w:pPr><w:rPr><w:i/><w:sz w:val="22"/><w:szCs w:val="22"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Quote"><w:name w:val="Quote"/><w:basedOn w:val="Normal"/><w:qFormat/><w:pPr><w:ind w:left="709" w:right="709"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="Verse"><w:name w:val="Verse"/><w:basedOn w:val="Normal"/><w:qFormat/><w:pPr><w:ind w:left="1134" w:firstLine="0"/><w:jc w:val="left"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="TextAuthor"><w:name w:val="Text Author"/><w:basedOn w:val="Normal"/><w:qFormat/><w:pPr><w:spacing w:after="120"/><w:ind w:firstLine="0"/><w:jc w:val="right"/></w:pPr><w:rPr><w:b/><w:i/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Image"><w:name w:val="Image"/><w:basedOn w:val="Normal"/><w:pPr><w:spacing w:before="120" w:after="120"/><w:ind w:firstLine="0"/><w:jc w:val="center"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="TableContents"><w:name w:val="Table Contents"/><w:basedOn w:val="Normal"/><w:pPr><w:ind w:firstLine="0"/><w:jc w:val="left"/></w:pPr></w:style>
+<w:style w:type="paragraph" w:styleId="TableHeading"><w:name w:val="Table Heading"/><w:basedOn w:val="TableContents"/><w:pPr><w:jc w:val="center"/></w:pPr><w:rPr><w:b/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="FootnoteText"><w:name w:val="footnote text"/><w:basedOn w:val="Normal"/><w:pPr><w:ind w:firstLine="0"/></w:pPr><w:rPr><w:sz w:val="20"/><w:szCs w:val="20"/></w:rPr></w:style>
+<w:style w:type="character" w:default="1" w:styleId="DefaultParagraphFont"><w:name w:val="Default Paragraph Font"/><w:uiPriority w:val="1"/><w:semiHidden/></w:style>
+<w:style w:type="character" w:styleId="FootnoteReference"><w:name w:val="footnote reference"/><w:rPr><w:vertAlign w:val="superscript"/></w:rPr></w:style>
+<w:style w:type="character" w:styleId="Hyperlink"><w:name w:val="Hyperlink"/><w:rPr><w:color w:val="0563C1"/><w:u w:val="single"/></w:rPr></w:style>
+<w:style w:type="table" w:default="1" w:styleId="TableNormal"><w:name w:val="Normal Table"/><w:semiHidden/><w:tblPr><w:tblInd w:w="0" w:type="dxa"/><w:tblCellMar><w:top w:w="0" w:type="dxa"/><w:left w:w="108" w:type="dxa"/><w:bottom w:w="0" w:type="dxa"/><w:right w:w="108" w:type="dxa"/></w:tblCellMar></w:tblPr></w:style>
+<w:style w:type="table" w:styleId="TableGrid"><w:name w:val="Table Grid"/><w:basedOn w:val="TableNormal"/><w:tblPr><w:tblBorders><w:top w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:left w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:bottom w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:right w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:insideH w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:insideV w:val="single" w:sz="4" w:space="0" w:color="auto"/></w:tblBorders></w:tblPr></w:style>
+</w:styles>`
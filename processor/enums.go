@@ -13,6 +13,13 @@ const (
 	OKepub                                // kepub
 	OAzw3                                 // azw3
 	OMobi                                 // mobi
+	OEpub3                                // epub3
+	OHtml                                 // html
+	OTxt                                  // txt
+	OMd                                   // md
+	OPdf                                  // pdf
+	ODocx                                 // docx
+	OFb2                                  // fb2
 	UnsupportedOutputFmt                  //
 )
 
@@ -162,3 +169,69 @@ func ParseCoverProcessingString(format string) CoverProcessing {
 	}
 	return UnsupportedCoverProcessing
 }
+
+// StylesheetMode specifies what to do with stylesheet of the EPUB being transferred.
+type StylesheetMode int
+
+// Supported stylesheet modes
+const (
+	StylesheetKeep            StylesheetMode = iota // keep
+	StylesheetReplace                               // replace
+	StylesheetMerge                                 // merge
+	UnsupportedStylesheetMode                       //
+)
+
+// ParseStylesheetModeString converts string to enum value. Case insensitive.
+func ParseStylesheetModeString(mode string) StylesheetMode {
+
+	for i := StylesheetKeep; i < UnsupportedStylesheetMode; i++ {
+		if strings.EqualFold(i.String(), mode) {
+			return i
+		}
+	}
+	return UnsupportedStylesheetMode
+}
+
+// GenreSubjects specifies how book genres are presented in metainfo.
+type GenreSubjects int
+
+// Supported genre presentations
+const (
+	GenreSubjectsName        GenreSubjects = iota // name
+	GenreSubjectsCode                             // code
+	GenreSubjectsBoth                             // both
+	UnsupportedGenreSubjects                      //
+)
+
+// ParseGenreSubjectsString converts string to enum value. Case insensitive.
+func ParseGenreSubjectsString(mode string) GenreSubjects {
+
+	for i := GenreSubjectsName; i < UnsupportedGenreSubjects; i++ {
+		if strings.EqualFold(i.String(), mode) {
+			return i
+		}
+	}
+	return UnsupportedGenreSubjects
+}
+
+// GenreAuthority specifies subject classification genres are mapped to.
+type GenreAuthority int
+
+// Supported subject classifications
+const (
+	GenreAuthorityNone        GenreAuthority = iota // none
+	GenreAuthorityBISAC                             // bisac
+	GenreAuthorityThema                             // thema
+	UnsupportedGenreAuthority                       //
+)
+
+// ParseGenreAuthorityString converts string to enum value. Case insensitive.
+func ParseGenreAuthorityString(authority string) GenreAuthority {
+
+	for i := GenreAuthorityNone; i < UnsupportedGenreAuthority; i++ {
+		if strings.EqualFold(i.String(), authority) {
+			return i
+		}
+	}
+	return UnsupportedGenreAuthority
+}
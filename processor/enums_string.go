@@ -1,4 +1,4 @@
-// Code generated by "stringer -linecomment -type OutputFmt,NotesFmt,TOCPlacement,TOCType,APNXGeneration,StampPlacement,CoverProcessing -output processor/enums_string.go processor/enums.go"; DO NOT EDIT.
+// Code generated by "stringer -linecomment -type OutputFmt,NotesFmt,TOCPlacement,TOCType,APNXGeneration,StampPlacement,CoverProcessing,StylesheetMode,GenreSubjects,GenreAuthority -output processor/enums_string.go processor/enums.go"; DO NOT EDIT.
 
 package processor
 
@@ -12,12 +12,19 @@ func _() {
 	_ = x[OKepub-1]
 	_ = x[OAzw3-2]
 	_ = x[OMobi-3]
-	_ = x[UnsupportedOutputFmt-4]
+	_ = x[OEpub3-4]
+	_ = x[OHtml-5]
+	_ = x[OTxt-6]
+	_ = x[OMd-7]
+	_ = x[OPdf-8]
+	_ = x[ODocx-9]
+	_ = x[OFb2-10]
+	_ = x[UnsupportedOutputFmt-11]
 }
 
-const _OutputFmt_name = "epubkepubazw3mobi"
+const _OutputFmt_name = "epubkepubazw3mobiepub3htmltxtmdpdfdocxfb2"
 
-var _OutputFmt_index = [...]uint8{0, 4, 9, 13, 17, 17}
+var _OutputFmt_index = [...]uint8{0, 4, 9, 13, 17, 22, 26, 29, 31, 34, 38, 41, 41}
 
 func (i OutputFmt) String() string {
 	if i < 0 || i >= OutputFmt(len(_OutputFmt_index)-1) {
@@ -149,3 +156,63 @@ func (i CoverProcessing) String() string {
 	}
 	return _CoverProcessing_name[_CoverProcessing_index[i]:_CoverProcessing_index[i+1]]
 }
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[StylesheetKeep-0]
+	_ = x[StylesheetReplace-1]
+	_ = x[StylesheetMerge-2]
+	_ = x[UnsupportedStylesheetMode-3]
+}
+
+const _StylesheetMode_name = "keepreplacemerge"
+
+var _StylesheetMode_index = [...]uint8{0, 4, 11, 16, 16}
+
+func (i StylesheetMode) String() string {
+	if i < 0 || i >= StylesheetMode(len(_StylesheetMode_index)-1) {
+		return "StylesheetMode(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _StylesheetMode_name[_StylesheetMode_index[i]:_StylesheetMode_index[i+1]]
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[GenreSubjectsName-0]
+	_ = x[GenreSubjectsCode-1]
+	_ = x[GenreSubjectsBoth-2]
+	_ = x[UnsupportedGenreSubjects-3]
+}
+
+const _GenreSubjects_name = "namecodeboth"
+
+var _GenreSubjects_index = [...]uint8{0, 4, 8, 12, 12}
+
+func (i GenreSubjects) String() string {
+	if i < 0 || i >= GenreSubjects(len(_GenreSubjects_index)-1) {
+		return "GenreSubjects(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _GenreSubjects_name[_GenreSubjects_index[i]:_GenreSubjects_index[i+1]]
+}
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[GenreAuthorityNone-0]
+	_ = x[GenreAuthorityBISAC-1]
+	_ = x[GenreAuthorityThema-2]
+	_ = x[UnsupportedGenreAuthority-3]
+}
+
+const _GenreAuthority_name = "nonebisacthema"
+
+var _GenreAuthority_index = [...]uint8{0, 4, 9, 14, 14}
+
+func (i GenreAuthority) String() string {
+	if i < 0 || i >= GenreAuthority(len(_GenreAuthority_index)-1) {
+		return "GenreAuthority(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _GenreAuthority_name[_GenreAuthority_index[i]:_GenreAuthority_index[i+1]]
+}
@@ -2,16 +2,88 @@ package processor
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/flate"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	fixzip "github.com/hidez8891/zip"
 	"go.uber.org/zap"
+
+	"fb2converter/etree"
 )
 
+// unzipEPUB extracts EPUB content to the directory and returns full path to its OPF file.
+func unzipEPUB(from, to string) (string, error) {
+
+	r, err := zip.OpenReader(from)
+	if err != nil {
+		return "", fmt.Errorf("unable to read EPUB (%s): %w", from, err)
+	}
+	defer r.Close()
+
+	for _, file := range r.File {
+		name := filepath.Join(to, filepath.FromSlash(file.Name))
+		if !strings.HasPrefix(name, filepath.Clean(to)+string(filepath.Separator)) {
+			return "", fmt.Errorf("illegal file path in EPUB (%s): %s", from, file.Name)
+		}
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(name, 0700); err != nil {
+				return "", fmt.Errorf("unable to create directory: %w", err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			return "", fmt.Errorf("unable to create directory: %w", err)
+		}
+		if err := extractFile(file, name); err != nil {
+			return "", err
+		}
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(filepath.Join(to, DirMata, "container.xml")); err != nil {
+		return "", fmt.Errorf("unable to read EPUB container: %w", err)
+	}
+	rf := doc.FindElement("./container/rootfiles/rootfile")
+	if rf == nil {
+		return "", fmt.Errorf("unable to find rootfile in EPUB container")
+	}
+	opf := rf.SelectAttrValue("full-path", "")
+	if len(opf) == 0 {
+		return "", fmt.Errorf("bad rootfile in EPUB container")
+	}
+	return filepath.Join(to, filepath.FromSlash(opf)), nil
+}
+
+func extractFile(file *zip.File, to string) error {
+
+	in, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("unable to read %s from EPUB: %w", file.Name, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", to, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("unable to extract %s: %w", file.Name, err)
+	}
+	return nil
+}
+
 func zipRemoveDataDescriptors(from, to string) error {
 
 	out, err := os.Create(to)
@@ -126,8 +198,174 @@ func (p *Processor) writeEPUB(fname string) error {
 	return nil
 }
 
-// FinalizeEPUB produces epub file out of previously saved temporary files.
-func (p *Processor) FinalizeEPUB(fname string) error {
+// epubEntry is a single file of EPUB container.
+type epubEntry struct {
+	name string
+	data []byte
+}
+
+// collectEPUB gathers content of the book in the order it should be stored in EPUB container: mimetype first, OCF
+// files next and content after that. When the same name is used more than once the last file wins, as it would when
+// files are saved to disk.
+func (p *Processor) collectEPUB() ([]epubEntry, error) {
+
+	var (
+		entries []epubEntry
+		index   = make(map[string]int)
+	)
+	add := func(relpath, fname string, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		name := path.Join(filepath.ToSlash(relpath), fname)
+		if i, ok := index[name]; ok {
+			entries[i].data = data
+			return
+		}
+		index[name] = len(entries)
+		entries = append(entries, epubEntry{name: name, data: data})
+	}
+	addFiles := func(files []*dataFile) error {
+		for _, f := range files {
+			data, err := f.content()
+			if err != nil {
+				return err
+			}
+			add(f.relpath, f.fname, data)
+		}
+		return nil
+	}
+
+	for _, f := range p.Book.Meta {
+		if f.fname == "mimetype" && len(f.relpath) == 0 {
+			add(f.relpath, f.fname, f.data)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("unable to find mimetype file")
+	}
+	if err := addFiles(p.Book.Meta); err != nil {
+		return nil, err
+	}
+	if err := addFiles(p.Book.Data); err != nil {
+		return nil, err
+	}
+	for _, b := range p.Book.Vignettes {
+		if len(b.fname) == 0 || (len(b.data) == 0 && b.img == nil) {
+			continue
+		}
+		data, err := b.prepare()
+		if err != nil {
+			return nil, err
+		}
+		add(b.relpath, b.fname, data)
+	}
+
+	// image processing is expensive, do it in parallel
+	images := make([][]byte, len(p.Book.Images))
+	errs := make([]error, len(p.Book.Images))
+	var wg sync.WaitGroup
+	job := make(chan int, len(p.Book.Images))
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range job {
+				b := p.Book.Images[i]
+				if len(b.fname) == 0 || (len(b.data) == 0 && b.img == nil) {
+					continue
+				}
+				if errs[i] = p.runCtx.Err(); errs[i] != nil {
+					continue
+				}
+				images[i], errs[i] = b.prepare()
+			}
+		}()
+	}
+	for i := range p.Book.Images {
+		job <- i
+	}
+	close(job)
+	wg.Wait()
+	for i, b := range p.Book.Images {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		add(b.relpath, b.fname, images[i])
+	}
+
+	if err := addFiles(p.Book.Files); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// streamEPUB writes EPUB directly from memory. Entries are compressed before their headers are written, so container
+// never has data descriptors and does not need fixing.
+func (p *Processor) streamEPUB(w io.Writer) error {
+
+	p.env.Log.Debug("Streaming EPUB - starting")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Streaming EPUB - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	entries, err := p.collectEPUB()
+	if err != nil {
+		return err
+	}
+
+	epub := zip.NewWriter(w)
+	t := time.Now()
+
+	var buf bytes.Buffer
+	for i, e := range entries {
+		if err := p.runCtx.Err(); err != nil {
+			return err
+		}
+		fh := &zip.FileHeader{
+			Name:               e.name,
+			Method:             zip.Store,
+			CreatorVersion:     20,
+			ReaderVersion:      20,
+			CRC32:              crc32.ChecksumIEEE(e.data),
+			UncompressedSize64: uint64(len(e.data)),
+		}
+		data := e.data
+		if i > 0 {
+			// do not set time for mimetype, it spoils epubcheck magic
+			fh.Method = zip.Deflate
+			fh.SetModTime(t) // unlike CreateHeader, CreateRaw ignores Modified
+			buf.Reset()
+			fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+			if err != nil {
+				return err
+			}
+			if _, err := fw.Write(e.data); err != nil {
+				return fmt.Errorf("unable to compress %s: %w", e.name, err)
+			}
+			if err := fw.Close(); err != nil {
+				return fmt.Errorf("unable to compress %s: %w", e.name, err)
+			}
+			data = buf.Bytes()
+		}
+		fh.CompressedSize64 = uint64(len(data))
+
+		out, err := epub.CreateRaw(fh)
+		if err != nil {
+			return fmt.Errorf("unable to add %s to EPUB: %w", e.name, err)
+		}
+		if _, err := out.Write(data); err != nil {
+			return fmt.Errorf("unable to add %s to EPUB: %w", e.name, err)
+		}
+	}
+	if err := epub.Close(); err != nil {
+		return fmt.Errorf("unable to write EPUB: %w", err)
+	}
+	return nil
+}
+
+// prepareOutputFile makes sure resulting file could be created.
+func (p *Processor) prepareOutputFile(fname string) error {
 
 	if _, err := os.Stat(fname); err == nil {
 		if !p.env.Debug && !p.overwrite {
@@ -142,6 +380,27 @@ func (p *Processor) FinalizeEPUB(fname string) error {
 	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
 		return fmt.Errorf("unable to create output directory: %w", err)
 	}
+	return nil
+}
+
+// FinalizeEPUB produces epub file. Converted FB2 is written directly from memory, EPUB source - out of its temporary files.
+func (p *Processor) FinalizeEPUB(fname string) error {
+
+	if err := p.prepareOutputFile(fname); err != nil {
+		return err
+	}
+
+	if p.streamable() {
+		f, err := os.Create(fname)
+		if err != nil {
+			return fmt.Errorf("unable to create EPUB (%s): %w", fname, err)
+		}
+		if err := p.streamEPUB(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
 
 	if p.env.Cfg.Doc.FixZip {
 		_, tmp := filepath.Split(fname)
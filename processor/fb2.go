@@ -0,0 +1,1667 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/png"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/net/html/charset"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+)
+
+// FinalizeFB2 produces FictionBook 2.1 document from the source EPUB.
+func (p *Processor) FinalizeFB2(fname string) error {
+
+	if _, err := os.Stat(fname); err == nil {
+		if !p.env.Debug && !p.overwrite {
+			return fmt.Errorf("output file already exists: %s", fname)
+		}
+		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+		if err = os.Remove(fname); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	if p.kind != InEpub {
+		return errors.New("fb2 could only be produced from epub")
+	}
+
+	r, err := zip.OpenReader(filepath.Join(p.tmpDir, filepath.Base(p.src)))
+	if err != nil {
+		return fmt.Errorf("unable to open EPUB: %w", err)
+	}
+	defer r.Close()
+
+	notes := "notes"
+	if len(p.env.Cfg.Doc.Notes.BodyNames) > 0 {
+		notes = p.env.Cfg.Doc.Notes.BodyNames[0]
+	}
+
+	er := newEpubReader(&r.Reader, notes, p.env.Log)
+	doc, err := er.convert()
+	if err != nil {
+		return err
+	}
+	doc.IndentTabs()
+	return doc.WriteToFile(fname)
+}
+
+// epubItem is manifest entry of EPUB package.
+type epubItem struct {
+	id, href, mediaType, properties string
+}
+
+// epubTOCEntry is navigation point, target is "path#fragment" key.
+type epubTOCEntry struct {
+	title  string
+	target string
+	depth  int
+	used   bool
+}
+
+// epubBlock is block level element of the flattened EPUB content.
+type epubBlock struct {
+	e     *etree.Element
+	path  string
+	keys  []string // link targets pointing to this block
+	level int      // heading level
+}
+
+// fb2Section accumulates content of resulting section while document is being split.
+type fb2Section struct {
+	depth    int
+	id       string
+	title    []*etree.Element
+	content  []*etree.Element
+	children []*fb2Section
+}
+
+// epubReader maps EPUB package onto FB2 document.
+type epubReader struct {
+	files  map[string]*zip.File
+	items  map[string]*epubItem // id -> item
+	paths  map[string]*epubItem // path -> item
+	spine  []string
+	docs   map[string]*etree.Element // path -> body
+	idx    map[string]*etree.Element // "path#id" -> element
+	notes  string
+	log    *zap.Logger
+	ids    map[string]string // "path#id" -> fb2 id
+	used   map[string]bool   // allocated fb2 ids
+	images map[string]string // image path -> binary id
+	bins   []*etree.Element
+
+	linked    map[string]bool           // link targets
+	noteElems map[*etree.Element]string // note element -> target key
+	noteByKey map[string]*etree.Element
+	noteOrder []string
+	noteTitle map[string]string
+	noteRefs  map[*etree.Element]string // link -> target key
+	backRefs  map[string]bool
+}
+
+func newEpubReader(z *zip.Reader, notes string, log *zap.Logger) *epubReader {
+	er := &epubReader{
+		files:     make(map[string]*zip.File),
+		items:     make(map[string]*epubItem),
+		paths:     make(map[string]*epubItem),
+		docs:      make(map[string]*etree.Element),
+		idx:       make(map[string]*etree.Element),
+		notes:     notes,
+		log:       log,
+		ids:       make(map[string]string),
+		used:      make(map[string]bool),
+		images:    make(map[string]string),
+		linked:    make(map[string]bool),
+		noteElems: make(map[*etree.Element]string),
+		noteByKey: make(map[string]*etree.Element),
+		noteTitle: make(map[string]string),
+		noteRefs:  make(map[*etree.Element]string),
+		backRefs:  make(map[string]bool),
+	}
+	for _, f := range z.File {
+		er.files[f.Name] = f
+	}
+	return er
+}
+
+func (er *epubReader) read(name string) ([]byte, error) {
+	f, ok := er.files[name]
+	if !ok {
+		return nil, fmt.Errorf("unable to find %s in EPUB", name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s from EPUB: %w", name, err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (er *epubReader) readXML(name string) (*etree.Document, error) {
+	data, err := er.read(name)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.ReadSettings = etree.ReadSettings{
+		CharsetReader: charset.NewReaderLabel,
+		Permissive:    true,
+		Entity:        xml.HTMLEntity,
+	}
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("unable to parse %s from EPUB: %w", name, err)
+	}
+	return doc, nil
+}
+
+// resolve converts href relative to the package part to "path#fragment" key.
+func resolve(base, href string) string {
+	var frag string
+	if i := strings.IndexByte(href, '#'); i >= 0 {
+		href, frag = href[:i], href[i+1:]
+	}
+	if u, err := url.PathUnescape(href); err == nil {
+		href = u
+	}
+	name := base
+	if len(href) > 0 {
+		name = path.Join(path.Dir(base), href)
+	}
+	if len(frag) == 0 {
+		return name
+	}
+	return name + "#" + frag
+}
+
+func isExternalLink(href string) bool {
+	return strings.Contains(href, ":")
+}
+
+func (er *epubReader) convert() (*etree.Document, error) {
+
+	container, err := er.readXML("META-INF/container.xml")
+	if err != nil {
+		return nil, err
+	}
+	rf := container.FindElement(".//rootfile")
+	if rf == nil {
+		return nil, errors.New("unable to find package document in EPUB")
+	}
+	opfName := getAttrValue(rf, "full-path")
+	opf, err := er.readXML(opfName)
+	if err != nil {
+		return nil, err
+	}
+	pkg := opf.Root()
+	if pkg == nil {
+		return nil, errors.New("unable to parse package document in EPUB")
+	}
+
+	// manifest and spine
+	var ncx, nav string
+	if m := pkg.SelectElement("manifest"); m != nil {
+		for _, i := range m.SelectElements("item") {
+			item := &epubItem{
+				id:         getAttrValue(i, "id"),
+				href:       resolve(opfName, getAttrValue(i, "href")),
+				mediaType:  getAttrValue(i, "media-type"),
+				properties: getAttrValue(i, "properties"),
+			}
+			er.items[item.id] = item
+			er.paths[item.href] = item
+			switch {
+			case item.mediaType == "application/x-dtbncx+xml":
+				ncx = item.href
+			case hasToken(item.properties, "nav"):
+				nav = item.href
+			}
+		}
+	}
+	if s := pkg.SelectElement("spine"); s != nil {
+		if item, ok := er.items[getAttrValue(s, "toc")]; ok {
+			ncx = item.href
+		}
+		// table of content pages are not needed, FB2 readers build their own
+		skip := map[string]bool{nav: true}
+		if g := pkg.SelectElement("guide"); g != nil {
+			for _, ref := range g.SelectElements("reference") {
+				if getAttrValue(ref, "type") == "toc" {
+					skip[resolve(opfName, getAttrValue(ref, "href"))] = true
+				}
+			}
+		}
+		for _, ref := range s.SelectElements("itemref") {
+			if item, ok := er.items[getAttrValue(ref, "idref")]; ok && !skip[item.href] {
+				er.spine = append(er.spine, item.href)
+			}
+		}
+	}
+
+	meta := pkg.SelectElement("metadata")
+	if meta == nil {
+		meta = etree.NewElement("metadata")
+	}
+
+	// cover image
+	var cover string
+	for _, m := range meta.SelectElements("meta") {
+		if getAttrValue(m, "name") == "cover" {
+			if item, ok := er.items[getAttrValue(m, "content")]; ok {
+				cover = item.href
+			}
+		}
+	}
+	if len(cover) == 0 {
+		for _, item := range er.items {
+			if hasToken(item.properties, "cover-image") {
+				cover = item.href
+			}
+		}
+	}
+
+	// content documents
+	for _, name := range er.spine {
+		doc, err := er.readXML(name)
+		if err != nil {
+			er.log.Warn("Unable to read EPUB content, skipping", zap.String("file", name), zap.Error(err))
+			continue
+		}
+		body := doc.FindElement(".//body")
+		if body == nil {
+			continue
+		}
+		er.docs[name] = body
+		for _, e := range body.FindElements(".//*[@id]") {
+			key := name + "#" + getAttrValue(e, "id")
+			if _, ok := er.idx[key]; !ok {
+				er.idx[key] = e
+			}
+		}
+	}
+
+	// navigation
+	var toc []*epubTOCEntry
+	if len(ncx) > 0 {
+		if doc, err := er.readXML(ncx); err == nil {
+			if nm := doc.FindElement(".//navMap"); nm != nil {
+				toc = er.ncxPoints(ncx, nm, 1, toc)
+			}
+		} else {
+			er.log.Warn("Unable to read NCX, ignoring", zap.Error(err))
+		}
+	}
+	if len(toc) == 0 && len(nav) > 0 {
+		if doc, err := er.readXML(nav); err == nil {
+			for _, n := range doc.FindElements(".//nav") {
+				if t := n.SelectAttrValue("type", "toc"); hasToken(t, "toc") {
+					if ol := n.SelectElement("ol"); ol != nil {
+						toc = er.navPoints(nav, ol, 1, toc)
+					}
+					break
+				}
+			}
+		} else {
+			er.log.Warn("Unable to read navigation document, ignoring", zap.Error(err))
+		}
+	}
+
+	for _, t := range toc {
+		er.linked[t.target] = true
+	}
+	er.findNotes()
+
+	// resulting document
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	fb := doc.CreateElement("FictionBook")
+	fb.CreateAttr("xmlns", "http://www.gribuser.ru/xml/fictionbook/2.0")
+	fb.CreateAttr("xmlns:l", "http://www.w3.org/1999/xlink")
+
+	description := fb.AddNext("description")
+	var coverID string
+	if len(cover) > 0 {
+		coverID = er.binary(cover)
+	}
+
+	// split content into sections
+	var blocks []*epubBlock
+	var pending []string
+	for _, name := range er.spine {
+		body, ok := er.docs[name]
+		pending = append(pending, name)
+		if ok && !er.isCoverPage(body, name, cover) {
+			n := len(blocks)
+			blocks, pending = er.flatten(body, name, blocks, pending)
+			if onlyHeadings(blocks[n:]) && er.hasNotes(name) {
+				// notes were moved out, what is left is notes page title
+				blocks = blocks[:n]
+			}
+		}
+	}
+	root := er.sections(blocks, toc)
+
+	body := fb.AddNext("body")
+	for _, s := range root.children {
+		er.renderSection(s, body)
+	}
+	if len(body.ChildElements()) == 0 {
+		body.AddNext("section").AddNext("empty-line")
+	}
+
+	// notes
+	if len(er.noteOrder) > 0 {
+		nb := fb.AddNext("body", attr("name", er.notes))
+		for _, key := range er.noteOrder {
+			e := er.noteByKey[key]
+			s := nb.AddNext("section", attr("id", er.allocID(key)))
+			if t := er.noteTitle[key]; len(t) > 0 {
+				s.AddNext("title").AddNext("p").SetText(t)
+			}
+			var content []*etree.Element
+			for _, b := range er.flattenNote(e, key) {
+				content = append(content, er.block(b)...)
+			}
+			if len(content) == 0 {
+				content = append(content, etree.NewElement("empty-line"))
+			}
+			for _, c := range content {
+				s.AddChild(c)
+			}
+		}
+	}
+
+	er.description(meta, pkg, opfName, description, coverID)
+
+	er.fixLinks(fb)
+
+	for _, b := range er.bins {
+		fb.AddChild(b)
+	}
+	return doc, nil
+}
+
+func hasToken(list, token string) bool {
+	for _, t := range strings.Fields(list) {
+		if t == token || strings.HasSuffix(t, ":"+token) {
+			return true
+		}
+	}
+	return false
+}
+
+func (er *epubReader) ncxPoints(base string, from *etree.Element, depth int, toc []*epubTOCEntry) []*epubTOCEntry {
+	for _, np := range from.SelectElements("navPoint") {
+		var title, target string
+		if l := np.FindElement("./navLabel/text"); l != nil {
+			title = normalizeSpace(l.Text())
+		}
+		if c := np.SelectElement("content"); c != nil {
+			target = resolve(base, getAttrValue(c, "src"))
+		}
+		if len(target) > 0 {
+			toc = append(toc, &epubTOCEntry{title: title, target: target, depth: depth})
+		}
+		toc = er.ncxPoints(base, np, depth+1, toc)
+	}
+	return toc
+}
+
+func (er *epubReader) navPoints(base string, from *etree.Element, depth int, toc []*epubTOCEntry) []*epubTOCEntry {
+	for _, li := range from.SelectElements("li") {
+		if a := li.SelectElement("a"); a != nil {
+			if href := getAttrValue(a, "href"); len(href) > 0 {
+				toc = append(toc, &epubTOCEntry{title: normalizeSpace(fb3Plain(a)), target: resolve(base, href), depth: depth})
+			}
+		}
+		if ol := li.SelectElement("ol"); ol != nil {
+			toc = er.navPoints(base, ol, depth+1, toc)
+		}
+	}
+	return toc
+}
+
+func onlyHeadings(blocks []*epubBlock) bool {
+	for _, b := range blocks {
+		if b.level == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (er *epubReader) hasNotes(name string) bool {
+	for _, key := range er.noteOrder {
+		if strings.HasPrefix(key, name+"#") {
+			return true
+		}
+	}
+	return false
+}
+
+// isCoverPage detects content document which only shows cover image.
+func (er *epubReader) isCoverPage(body *etree.Element, name, cover string) bool {
+	if len(cover) == 0 || len(strings.TrimSpace(fb3Plain(body))) > 0 {
+		return false
+	}
+	for _, e := range body.FindElements(".//*") {
+		var src string
+		switch e.Tag {
+		case "img":
+			src = getAttrValue(e, "src")
+		case "image":
+			src = getAttrValue(e, "href")
+		default:
+			continue
+		}
+		if resolve(name, src) == cover {
+			return true
+		}
+	}
+	return false
+}
+
+var reNoteText = regexp.MustCompile(`^[\[\(\{]?(\d{1,4}|\*{1,4})[\]\)\}]?$`)
+
+// findNotes detects footnote links and elements they point to.
+func (er *epubReader) findNotes() {
+
+	for _, name := range er.spine {
+		body, ok := er.docs[name]
+		if !ok {
+			continue
+		}
+		for _, a := range body.FindElements(".//a") {
+			href := getAttrValue(a, "href")
+			if len(href) == 0 || isExternalLink(href) {
+				continue
+			}
+			key := resolve(name, href)
+			er.linked[key] = true
+			if !strings.Contains(href, "#") {
+				continue
+			}
+			target, ok := er.idx[key]
+			if !ok || er.backRefs[key] || isLink(target) {
+				// links from notes back to the text are not notes
+				continue
+			}
+
+			text := strings.TrimSpace(fb3Plain(a))
+			isNote := hasToken(getAttrValue(a, "type"), "noteref") ||
+				hasToken(target.SelectAttrValue("type", ""), "footnote") ||
+				hasToken(target.SelectAttrValue("type", ""), "endnote") ||
+				hasToken(target.SelectAttrValue("type", ""), "rearnote")
+			if !isNote && reNoteText.MatchString(text) {
+				parent := a.Parent()
+				isNote = (parent != nil && parent.Tag == "sup") || a.SelectElement("sup") != nil ||
+					strings.Contains(strings.ToLower(getAttrValue(a, "class")), "note") ||
+					!strings.HasPrefix(key, name+"#")
+			}
+			if !isNote {
+				continue
+			}
+
+			note := noteBlock(target)
+			if note == nil {
+				continue
+			}
+			if prev, ok := er.noteElems[note]; ok {
+				key = prev
+			} else {
+				er.noteElems[note] = key
+				if len(strings.TrimSpace(fb3Plain(note))) == 0 {
+					// target is a marker, note is what follows it
+					note = er.noteRange(note, key)
+				}
+				er.noteByKey[key] = note
+				er.noteOrder = append(er.noteOrder, key)
+				er.noteTitle[key] = strings.Trim(text, "[](){}")
+			}
+			er.noteRefs[a] = key
+
+			// links from note back to the text
+			if id := getAttrValue(a, "id"); len(id) > 0 {
+				er.backRefs[name+"#"+id] = true
+			}
+			if parent := a.Parent(); parent != nil && parent.Tag == "sup" {
+				if id := getAttrValue(parent, "id"); len(id) > 0 {
+					er.backRefs[name+"#"+id] = true
+				}
+			}
+		}
+	}
+}
+
+// noteRange collects siblings following the marker up to the next element with id.
+func (er *epubReader) noteRange(marker *etree.Element, key string) *etree.Element {
+	note := etree.NewElement("div")
+	parent := marker.Parent()
+	if parent == nil {
+		return note
+	}
+	found := false
+	for _, c := range parent.ChildElements() {
+		if !found {
+			found = c == marker
+			continue
+		}
+		if len(getAttrValue(c, "id")) > 0 || headingLevel(c) > 0 {
+			break
+		}
+		er.noteElems[c] = key
+		note.AddChild(c.Copy())
+	}
+	return note
+}
+
+// headingLevel checks if element is heading, either by tag or by class (h1-h6).
+func headingLevel(e *etree.Element) int {
+	if len(e.Tag) == 2 && e.Tag[0] == 'h' && e.Tag[1] >= '1' && e.Tag[1] <= '6' {
+		return int(e.Tag[1] - '0')
+	}
+	if e.Tag == "div" {
+		for _, c := range strings.Fields(getAttrValue(e, "class")) {
+			if len(c) == 2 && c[0] == 'h' && c[1] >= '0' && c[1] <= '6' {
+				return int(c[1]-'0') + 1
+			}
+		}
+	}
+	return 0
+}
+
+func hasClass(e *etree.Element, names ...string) bool {
+	for _, c := range strings.Fields(getAttrValue(e, "class")) {
+		for _, n := range names {
+			if c == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isUnit detects containers which are converted as a whole.
+func isUnit(e *etree.Element) bool {
+	return headingLevel(e) > 0 || e.Tag == "blockquote" || hasClass(e, "poem", "cite", "epigraph", "annotation")
+}
+
+// isDecoration detects vignettes, which are added by conversion and are not part of the book.
+func isDecoration(e *etree.Element) bool {
+	for _, c := range strings.Fields(getAttrValue(e, "class")) {
+		if strings.HasPrefix(c, "vignette") {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmpty checks if element has neither text nor images.
+func isEmpty(e *etree.Element) bool {
+	return len(strings.TrimSpace(fb3Plain(e))) == 0 && len(e.FindElements(".//img")) == 0 && len(e.FindElements(".//svg")) == 0
+}
+
+var (
+	blockTags     = []string{"p", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "pre", "ul", "ol", "dl", "table", "hr", "figure", "figcaption"}
+	containerTags = []string{"body", "div", "section", "article", "main", "header", "footer", "aside", "nav", "figure", "switch", "case", "default", "center"}
+)
+
+func isBlock(e *etree.Element) bool {
+	return IsOneOf(e.Tag, blockTags) || IsOneOf(e.Tag, containerTags) || e.Tag == "img" || e.Tag == "svg"
+}
+
+func hasBlockChildren(e *etree.Element) bool {
+	for _, c := range e.ChildElements() {
+		if isBlock(c) && c.Tag != "img" {
+			return true
+		}
+	}
+	return false
+}
+
+// noteBlock finds block level element holding note text.
+func noteBlock(e *etree.Element) *etree.Element {
+	for ; e != nil && e.Tag != "body"; e = e.Parent() {
+		if isBlock(e) && e.Tag != "img" && e.Tag != "svg" {
+			return e
+		}
+	}
+	return nil
+}
+
+// flatten walks content document producing sequence of blocks. Ids of containers are attached to the following block.
+func (er *epubReader) flatten(from *etree.Element, name string, blocks []*epubBlock, pending []string) ([]*epubBlock, []string) {
+
+	if _, ok := er.noteElems[from]; ok {
+		return blocks, pending
+	}
+
+	if id := getAttrValue(from, "id"); len(id) > 0 && from.Tag != "body" {
+		pending = append(pending, name+"#"+id)
+	}
+
+	var run *etree.Element
+	flush := func() {
+		if run != nil && (len(strings.TrimSpace(fb3Plain(run))) > 0 || len(run.FindElements(".//img")) > 0) {
+			blocks = append(blocks, &epubBlock{e: run, path: name, keys: pending})
+			pending = nil
+		}
+		run = nil
+	}
+	text := func(s string) {
+		if len(strings.TrimSpace(s)) == 0 && run == nil {
+			return
+		}
+		if run == nil {
+			run = etree.NewElement("p")
+		}
+		fb3Text(run, s)
+	}
+
+	for _, t := range from.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			text(t.Data)
+		case *etree.Element:
+			switch {
+			case IsOneOf(t.Tag, []string{"script", "style", "head"}) || isDecoration(t):
+			case hasClass(t, "emptyline"):
+				flush()
+				blocks = append(blocks, &epubBlock{e: t, path: name, keys: pending})
+				pending = nil
+			case IsOneOf(t.Tag, containerTags) && isEmpty(t):
+				// section markers and such, only keep link targets
+				if _, ok := er.noteElems[t]; !ok {
+					if id := getAttrValue(t, "id"); len(id) > 0 {
+						pending = append(pending, name+"#"+id)
+					}
+					for _, e := range t.FindElements(".//*[@id]") {
+						pending = append(pending, name+"#"+getAttrValue(e, "id"))
+					}
+				}
+			case !isUnit(t) && IsOneOf(t.Tag, containerTags) && hasBlockChildren(t):
+				flush()
+				blocks, pending = er.flatten(t, name, blocks, pending)
+			case isBlock(t):
+				flush()
+				if _, ok := er.noteElems[t]; !ok {
+					b := &epubBlock{e: t, path: name, keys: pending}
+					pending = nil
+					for _, e := range t.FindElements(".//*[@id]") {
+						b.keys = append(b.keys, name+"#"+getAttrValue(e, "id"))
+					}
+					if id := getAttrValue(t, "id"); len(id) > 0 {
+						b.keys = append(b.keys, name+"#"+id)
+					}
+					b.level = headingLevel(t)
+					blocks = append(blocks, b)
+				}
+			default:
+				if run == nil {
+					run = etree.NewElement("p")
+				}
+				c := t.Copy()
+				c.TailData = ""
+				run.AddChild(c)
+			}
+			text(t.TailData)
+		}
+	}
+	flush()
+	return blocks, pending
+}
+
+// flattenNote produces note content blocks, note which is not a container is a block by itself.
+func (er *epubReader) flattenNote(e *etree.Element, key string) []*epubBlock {
+	name := key
+	if i := strings.IndexByte(key, '#'); i >= 0 {
+		name = key[:i]
+	}
+	if !hasBlockChildren(e) {
+		return []*epubBlock{{e: e, path: name}}
+	}
+	delete(er.noteElems, e)
+	blocks, _ := er.flatten(e, name, nil, nil)
+	er.noteElems[e] = key
+	// note title is already there
+	if len(blocks) > 0 && (blocks[0].level > 0 || normalizeSpace(fb3Plain(blocks[0].e)) == er.noteTitle[key]) {
+		blocks = blocks[1:]
+	}
+	return blocks
+}
+
+// sections builds sections hierarchy using navigation points, or headings when there is no navigation.
+func (er *epubReader) sections(blocks []*epubBlock, toc []*epubTOCEntry) *fb2Section {
+
+	byKey := make(map[string][]*epubTOCEntry)
+	for _, t := range toc {
+		byKey[t.target] = append(byKey[t.target], t)
+	}
+	minLevel := 7
+	if len(toc) == 0 {
+		for _, b := range blocks {
+			if b.level > 0 && b.level < minLevel {
+				minLevel = b.level
+			}
+		}
+	}
+
+	root := &fb2Section{}
+	stack := []*fb2Section{root}
+	open := func(depth int) *fb2Section {
+		for len(stack) > 1 && stack[len(stack)-1].depth >= depth {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1]
+		s := &fb2Section{depth: depth}
+		parent.children = append(parent.children, s)
+		stack = append(stack, s)
+		return s
+	}
+
+	for _, b := range blocks {
+
+		var opened *fb2Section
+		for _, k := range b.keys {
+			for _, t := range byKey[k] {
+				if t.used {
+					continue
+				}
+				t.used = true
+				opened = open(t.depth)
+				if len(t.title) > 0 {
+					opened.title = []*etree.Element{textPara(t.title)}
+				}
+			}
+		}
+		if len(toc) == 0 && b.level > 0 {
+			opened = open(b.level - minLevel + 1)
+		}
+
+		var id string
+		for _, k := range b.keys {
+			if !er.linked[k] {
+				continue
+			}
+			if len(id) == 0 {
+				id = er.allocID(k)
+			} else if _, ok := er.ids[k]; !ok {
+				er.ids[k] = id
+			}
+		}
+
+		if opened != nil {
+			opened.id = id
+			if b.level > 0 {
+				// heading is section title
+				if title := er.paras(b.e, b.path, "p", true); len(title) > 0 {
+					opened.title = title
+				}
+				continue
+			}
+			id = ""
+		}
+
+		cur := stack[len(stack)-1]
+		if cur == root {
+			cur = open(1)
+		}
+		content := er.block(b)
+		if len(id) > 0 {
+			for _, c := range content {
+				if IsOneOf(c.Tag, []string{"p", "subtitle", "cite", "poem", "table", "image"}) {
+					c.CreateAttr("id", id)
+					break
+				}
+			}
+		}
+		cur.content = append(cur.content, content...)
+	}
+	return root
+}
+
+func (er *epubReader) renderSection(s *fb2Section, to *etree.Element) {
+
+	if len(s.content) == 0 && len(s.children) == 0 {
+		return
+	}
+	sec := to.AddNext("section", attr("id", s.id))
+	if len(s.title) > 0 {
+		t := sec.AddNext("title")
+		for _, p := range s.title {
+			t.AddChild(p)
+		}
+	}
+	if len(s.content) > 0 {
+		into := sec
+		if len(s.children) > 0 {
+			// section could not have both content and subsections
+			into = sec.AddNext("section")
+		}
+		for _, c := range s.content {
+			into.AddChild(c)
+		}
+	}
+	for _, c := range s.children {
+		er.renderSection(c, sec)
+	}
+}
+
+// allocID returns FB2 id for the link target.
+func (er *epubReader) allocID(key string) string {
+
+	if id, ok := er.ids[key]; ok {
+		return id
+	}
+	base := key
+	if i := strings.IndexByte(key, '#'); i >= 0 {
+		base = key[i+1:]
+	} else {
+		base = strings.TrimSuffix(path.Base(key), path.Ext(key))
+	}
+	id := newID(base, er.used)
+	er.ids[key] = id
+	return id
+}
+
+// newID makes valid unique XML id out of the string.
+func newID(base string, used map[string]bool) string {
+	base = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, base)
+	if len(base) == 0 || !(unicode.IsLetter([]rune(base)[0]) || base[0] == '_') {
+		base = "_" + base
+	}
+	id := base
+	for i := 1; used[id]; i++ {
+		id = base + "_" + strconv.Itoa(i)
+	}
+	used[id] = true
+	return id
+}
+
+// block converts block level element to FB2 section content.
+func (er *epubReader) block(b *epubBlock) []*etree.Element {
+
+	e := b.e
+	switch {
+	case b.level > 0:
+		return er.paras(e, b.path, "subtitle", false)
+	case hasClass(e, "emptyline"):
+		return []*etree.Element{etree.NewElement("empty-line")}
+	case hasClass(e, "poem"):
+		if poem := er.poem(e, b.path); poem != nil {
+			return []*etree.Element{poem}
+		}
+		var res []*etree.Element
+		blocks, _ := er.flatten(e, b.path, nil, nil)
+		for _, cb := range blocks {
+			res = append(res, er.block(cb)...)
+		}
+		return res
+	case e.Tag == "blockquote" || hasClass(e, "cite", "epigraph", "annotation"):
+		cite := etree.NewElement("cite")
+		blocks, _ := er.flatten(e, b.path, nil, nil)
+		for _, cb := range blocks {
+			for _, c := range er.block(cb) {
+				switch c.Tag {
+				case "section", "title":
+				case "image":
+					p := etree.NewElement("p")
+					p.AddChild(c)
+					cite.AddChild(p)
+				case "p":
+					if hasClass(cb.e, "text-author") {
+						c.Tag = "text-author"
+					}
+					cite.AddChild(c)
+				default:
+					cite.AddChild(c)
+				}
+			}
+		}
+		if len(cite.ChildElements()) == 0 {
+			return nil
+		}
+		return []*etree.Element{cite}
+	case e.Tag == "pre":
+		var res []*etree.Element
+		for _, l := range strings.Split(strings.Trim(fb3Plain(e), "\n"), "\n") {
+			p := etree.NewElement("p")
+			p.AddNext("code").SetText(l)
+			res = append(res, p)
+		}
+		return res
+	case e.Tag == "ul" || e.Tag == "ol":
+		return er.list(e, b.path, "")
+	case e.Tag == "dl":
+		var res []*etree.Element
+		for _, c := range e.ChildElements() {
+			ps := er.paras(c, b.path, "p", false)
+			if c.Tag == "dt" {
+				for _, p := range ps {
+					s := etree.NewElement("strong")
+					for _, t := range append([]etree.Token(nil), p.Child...) {
+						s.AddChild(t)
+					}
+					p.AddChild(s)
+				}
+			}
+			res = append(res, ps...)
+		}
+		return res
+	case e.Tag == "table":
+		table := etree.NewElement("table")
+		for _, tr := range e.FindElements(".//tr") {
+			row := table.AddNext("tr")
+			for _, td := range tr.ChildElements() {
+				if td.Tag != "td" && td.Tag != "th" {
+					continue
+				}
+				cell := row.AddNext(td.Tag,
+					attr("colspan", getAttrValue(td, "colspan")),
+					attr("rowspan", getAttrValue(td, "rowspan")),
+					attr("align", getAttrValue(td, "align")))
+				er.inline(td, cell, b.path, &inlineState{start: true})
+				trimRight(cell)
+			}
+		}
+		if len(table.ChildElements()) == 0 {
+			return nil
+		}
+		return []*etree.Element{table}
+	case e.Tag == "hr":
+		return []*etree.Element{etree.NewElement("empty-line")}
+	case e.Tag == "img" || e.Tag == "svg":
+		if img := er.image(e, b.path); img != nil {
+			return []*etree.Element{img}
+		}
+		return nil
+	case IsOneOf(e.Tag, containerTags) && hasBlockChildren(e):
+		var res []*etree.Element
+		blocks, _ := er.flatten(e, b.path, nil, nil)
+		for _, cb := range blocks {
+			res = append(res, er.block(cb)...)
+		}
+		return res
+	}
+
+	// paragraph consisting of the single image is better shown as block image
+	if len(strings.TrimSpace(fb3Plain(e))) == 0 {
+		if imgs := e.FindElements(".//img"); len(imgs) == 1 {
+			if img := er.image(imgs[0], b.path); img != nil {
+				return []*etree.Element{img}
+			}
+		}
+		if imgs := e.FindElements(".//svg"); len(imgs) == 1 {
+			if img := er.image(imgs[0], b.path); img != nil {
+				return []*etree.Element{img}
+			}
+		}
+	}
+	tag := "p"
+	if hasClass(e, "subtitle") {
+		tag = "subtitle"
+	}
+	res := er.paras(e, b.path, tag, false)
+	if len(res) == 0 {
+		return []*etree.Element{etree.NewElement("empty-line")}
+	}
+	return res
+}
+
+// poem converts poem markup (as produced by FB2 converters), returns nil if there are no stanzas.
+func (er *epubReader) poem(e *etree.Element, name string) *etree.Element {
+
+	var title []*etree.Element
+	var stanzas, authors []*etree.Element
+	for _, c := range e.ChildElements() {
+		switch {
+		case isDecoration(c):
+		case headingLevel(c) > 0:
+			title = er.paras(c, name, "p", true)
+		case hasClass(c, "titleblock"):
+			for _, h := range c.FindElements(".//div") {
+				if headingLevel(h) > 0 {
+					title = er.paras(h, name, "p", true)
+					break
+				}
+			}
+		case hasClass(c, "stanza"):
+			stanza := etree.NewElement("stanza")
+			for _, v := range c.ChildElements() {
+				for _, l := range er.paras(v, name, "v", false) {
+					stanza.AddChild(l)
+				}
+			}
+			if len(stanza.ChildElements()) > 0 {
+				stanzas = append(stanzas, stanza)
+			}
+		case hasClass(c, "text-author"):
+			authors = append(authors, er.paras(c, name, "text-author", false)...)
+		}
+	}
+	if len(stanzas) == 0 {
+		return nil
+	}
+	poem := etree.NewElement("poem")
+	if len(title) > 0 {
+		t := poem.AddNext("title")
+		for _, p := range title {
+			t.AddChild(p)
+		}
+	}
+	for _, c := range append(stanzas, authors...) {
+		poem.AddChild(c)
+	}
+	return poem
+}
+
+func (er *epubReader) list(e *etree.Element, name, indent string) []*etree.Element {
+	var res []*etree.Element
+	n := 0
+	for _, li := range e.SelectElements("li") {
+		n++
+		item := li.Copy()
+		var nested []*etree.Element
+		for _, c := range item.ChildElements() {
+			if c.Tag == "ul" || c.Tag == "ol" {
+				nested = append(nested, c)
+				item.RemoveChild(c)
+			}
+		}
+		prefix := indent + "• "
+		if e.Tag == "ol" {
+			prefix = indent + strconv.Itoa(n) + ". "
+		}
+		p := etree.NewElement("p")
+		p.SetText(prefix)
+		er.inline(item, p, name, &inlineState{})
+		trimRight(p)
+		res = append(res, p)
+		for _, l := range nested {
+			res = append(res, er.list(l, name, indent+"    ")...)
+		}
+	}
+	return res
+}
+
+// inlineState keeps track of whitespace while converting inline content.
+type inlineState struct {
+	start bool
+	space bool
+}
+
+var (
+	reSpaces    = regexp.MustCompile(`\s+`)
+	reHTMLBreak = regexp.MustCompile(`(?i)</p>|<br\s*/?>`)
+	reHTMLTag   = regexp.MustCompile(`<[^>]*>`)
+)
+
+func (st *inlineState) text(to *etree.Element, s string) {
+	s = reSpaces.ReplaceAllString(s, " ")
+	if (st.start || st.space) && strings.HasPrefix(s, " ") {
+		s = s[1:]
+	}
+	if len(s) == 0 {
+		return
+	}
+	st.start = false
+	st.space = strings.HasSuffix(s, " ")
+	fb3Text(to, s)
+}
+
+// paras converts element to the sequence of paragraphs splitting them on line breaks.
+func (er *epubReader) paras(e *etree.Element, name, tag string, keepEmpty bool) []*etree.Element {
+
+	var res []*etree.Element
+	cur := etree.NewElement(tag)
+	st := &inlineState{start: true}
+	done := func() {
+		trimRight(cur)
+		if len(cur.Child) > 0 || keepEmpty && len(res) > 0 {
+			res = append(res, cur)
+		}
+		cur = etree.NewElement(tag)
+		st = &inlineState{start: true}
+	}
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			st.text(cur, t.Data)
+		case *etree.Element:
+			switch {
+			case t.Tag == "br":
+				done()
+			case isDecoration(t):
+			case isBlock(t) && t.Tag != "img" && t.Tag != "svg":
+				if len(cur.Child) > 0 {
+					done()
+				}
+				er.inline(t, cur, name, st)
+				done()
+			default:
+				er.inlineElement(t, cur, name, st)
+			}
+			st.text(cur, t.TailData)
+		}
+	}
+	done()
+	if keepEmpty {
+		// no empty lines at the end of title
+		for len(res) > 0 && len(res[len(res)-1].Child) == 0 {
+			res = res[:len(res)-1]
+		}
+		for i, p := range res {
+			if len(p.Child) == 0 {
+				res[i] = etree.NewElement("empty-line")
+			}
+		}
+	}
+	return res
+}
+
+func (er *epubReader) inline(from, to *etree.Element, name string, st *inlineState) {
+	for _, t := range from.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			st.text(to, t.Data)
+		case *etree.Element:
+			er.inlineElement(t, to, name, st)
+			st.text(to, t.TailData)
+		}
+	}
+}
+
+func (er *epubReader) inlineElement(e, to *etree.Element, name string, st *inlineState) {
+
+	var tag string
+	switch e.Tag {
+	case "b", "strong":
+		tag = "strong"
+	case "i", "em", "cite", "dfn", "var":
+		tag = "emphasis"
+	case "s", "strike", "del":
+		tag = "strikethrough"
+	case "sub", "sup":
+		if a := e.SelectElement("a"); a != nil && len(e.ChildElements()) == 1 && len(strings.TrimSpace(e.Text())) == 0 {
+			if _, ok := er.noteRefs[a]; ok {
+				// note reference is rendered as superscript anyway
+				er.inlineElement(a, to, name, st)
+				st.text(to, a.TailData)
+				return
+			}
+		}
+		tag = e.Tag
+	case "code", "kbd", "samp", "tt":
+		tag = "code"
+	case "span":
+		// classes our own XHTML uses for FB2 inline styles, so books produced by converter survive round trip
+		for _, css := range strings.Fields(getAttrValue(e, "class")) {
+			switch css {
+			case "strong":
+				tag = "strong"
+			case "emphasis":
+				tag = "emphasis"
+			case "strike":
+				tag = "strikethrough"
+			}
+			if len(tag) > 0 {
+				break
+			}
+		}
+	case "a":
+		if key, ok := er.noteRefs[e]; ok {
+			to.AddNext("a", attr("l:href", "#"+key), attr("type", "note")).SetText(strings.TrimSpace(fb3Plain(e)))
+			st.start, st.space = false, false
+			return
+		}
+		href := getAttrValue(e, "href")
+		if len(href) > 0 && !isExternalLink(href) {
+			key := resolve(name, href)
+			if er.backRefs[key] {
+				// link from note back to the text
+				return
+			}
+			href = "#" + key
+		}
+		if len(href) == 0 || insideLink(to) {
+			er.inline(e, to, name, st)
+			return
+		}
+		tag = "a"
+		a := to.AddNext(tag, attr("l:href", href))
+		er.inline(e, a, name, st)
+		return
+	case "img", "svg":
+		if img := er.image(e, name); img != nil {
+			to.AddChild(img)
+			st.start, st.space = false, false
+		} else if alt := getAttrValue(e, "alt"); len(alt) > 0 {
+			st.text(to, alt)
+		}
+		return
+	case "br":
+		st.text(to, " ")
+		return
+	case "script", "style":
+		return
+	}
+	if isDecoration(e) {
+		return
+	}
+	if len(tag) == 0 {
+		// span, u, small, font and everything FB2 does not know - keep the text
+		er.inline(e, to, name, st)
+		return
+	}
+	er.inline(e, to.AddNext(tag), name, st)
+}
+
+// image produces FB2 image element for XHTML img or SVG wrapped image.
+func (er *epubReader) image(e *etree.Element, name string) *etree.Element {
+	var src string
+	switch e.Tag {
+	case "img":
+		src = getAttrValue(e, "src")
+	case "svg":
+		if i := e.FindElement(".//image"); i != nil {
+			src = getAttrValue(i, "href")
+		}
+	}
+	if len(src) == 0 || isExternalLink(src) {
+		return nil
+	}
+	id := er.binary(resolve(name, src))
+	if len(id) == 0 {
+		return nil
+	}
+	img := etree.NewElement("image")
+	img.CreateAttr("l:href", "#"+id)
+	if alt := getAttrValue(e, "alt"); len(alt) > 0 {
+		img.CreateAttr("alt", alt)
+	}
+	return img
+}
+
+// binary embeds image into resulting document, returns binary id.
+func (er *epubReader) binary(name string) string {
+
+	if id, ok := er.images[name]; ok {
+		return id
+	}
+	er.images[name] = ""
+
+	data, err := er.read(name)
+	if err != nil {
+		er.log.Warn("Unable to read image, skipping", zap.String("image", name), zap.Error(err))
+		return ""
+	}
+	var ct string
+	if item, ok := er.paths[name]; ok {
+		ct = item.mediaType
+	}
+	if len(ct) == 0 {
+		ct = mime.TypeByExtension(strings.ToLower(path.Ext(name)))
+	}
+	base := path.Base(name)
+	if ct != "image/jpeg" && ct != "image/png" {
+		// FB2 readers only expect jpeg and png
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			er.log.Warn("Unable to decode image, skipping", zap.String("image", name), zap.Error(err))
+			return ""
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			er.log.Warn("Unable to encode image, skipping", zap.String("image", name), zap.Error(err))
+			return ""
+		}
+		data, ct = buf.Bytes(), "image/png"
+		base = strings.TrimSuffix(base, path.Ext(base)) + ".png"
+	}
+
+	id := newID(base, er.used)
+	er.images[name] = id
+
+	b := etree.NewElement("binary")
+	b.CreateAttr("id", id)
+	b.CreateAttr("content-type", ct)
+	b.SetText(base64.StdEncoding.EncodeToString(data))
+	er.bins = append(er.bins, b)
+	return id
+}
+
+// fixLinks replaces link targets with FB2 ids, links to the content which was not preserved are removed.
+func (er *epubReader) fixLinks(fb *etree.Element) {
+	for _, a := range fb.FindElements(".//a") {
+		href := getAttrValue(a, "l:href")
+		if !strings.HasPrefix(href, "#") {
+			continue
+		}
+		if id, ok := er.ids[href[1:]]; ok && er.used[id] {
+			a.SelectAttr("l:href").Value = "#" + id
+			continue
+		}
+		parent := a.Parent()
+		for _, t := range append([]etree.Token(nil), a.Child...) {
+			parent.InsertChild(a, t)
+		}
+		if len(a.TailData) > 0 {
+			parent.InsertChild(a, etree.NewCharData(a.TailData))
+		}
+		parent.RemoveChild(a)
+	}
+}
+
+// trimRight removes trailing whitespace from inline content.
+func trimRight(e *etree.Element) {
+	for len(e.Child) > 0 {
+		switch t := e.Child[len(e.Child)-1].(type) {
+		case *etree.CharData:
+			t.Data = strings.TrimRightFunc(t.Data, unicode.IsSpace)
+			if len(t.Data) > 0 {
+				return
+			}
+			e.RemoveChild(t)
+		case *etree.Element:
+			t.TailData = strings.TrimRightFunc(t.TailData, unicode.IsSpace)
+			if len(t.TailData) == 0 {
+				trimRight(t)
+			}
+			return
+		default:
+			return
+		}
+	}
+}
+
+func insideLink(e *etree.Element) bool {
+	for ; e != nil; e = e.Parent() {
+		if e.Tag == "a" {
+			return true
+		}
+	}
+	return false
+}
+
+// isLink checks if element is a link or wraps one.
+func isLink(e *etree.Element) bool {
+	if e.Tag == "sup" && len(e.ChildElements()) == 1 {
+		e = e.ChildElements()[0]
+	}
+	return e.Tag == "a" && len(getAttrValue(e, "href")) > 0
+}
+
+func textPara(s string) *etree.Element {
+	p := etree.NewElement("p")
+	p.SetText(s)
+	return p
+}
+
+func normalizeSpace(s string) string {
+	return strings.TrimSpace(reSpaces.ReplaceAllString(s, " "))
+}
+
+// description maps package metadata onto FB2 title-info, document-info and publish-info.
+func (er *epubReader) description(meta, pkg *etree.Element, opfName string, to *etree.Element, cover string) {
+
+	// EPUB3 refinements
+	refines := make(map[string]map[string]string)
+	var collections []*etree.Element
+	for _, m := range meta.SelectElements("meta") {
+		if prop := getAttrValue(m, "property"); len(prop) > 0 {
+			if ref := strings.TrimPrefix(getAttrValue(m, "refines"), "#"); len(ref) > 0 {
+				if refines[ref] == nil {
+					refines[ref] = make(map[string]string)
+				}
+				refines[ref][prop] = strings.TrimSpace(m.Text())
+			} else if prop == "belongs-to-collection" {
+				collections = append(collections, m)
+			}
+		}
+	}
+	refined := func(e *etree.Element, prop string) string {
+		if v := getAttrValue(e, prop); len(v) > 0 {
+			return v
+		}
+		if r, ok := refines[getAttrValue(e, "id")]; ok {
+			return r[prop]
+		}
+		return ""
+	}
+	calibre := func(name string) string {
+		for _, m := range meta.SelectElements("meta") {
+			if getAttrValue(m, "name") == name {
+				return getAttrValue(m, "content")
+			}
+		}
+		return ""
+	}
+
+	ti := to.AddNext("title-info")
+
+	var keywords []string
+	for _, s := range meta.SelectElements("subject") {
+		if g := strings.TrimSpace(s.Text()); len(g) > 0 {
+			if strings.IndexFunc(g, func(r rune) bool { return !(r >= 'a' && r <= 'z' || r == '_') }) < 0 {
+				ti.AddNext("genre").SetText(g)
+			} else {
+				keywords = append(keywords, g)
+			}
+		}
+	}
+	if len(ti.SelectElements("genre")) == 0 {
+		ti.AddNext("genre").SetText("unrecognised")
+	}
+
+	var translators []*etree.Element
+	for _, c := range meta.SelectElements("creator") {
+		switch refined(c, "role") {
+		case "", "aut":
+			epubAuthor(strings.TrimSpace(c.Text()), refined(c, "file-as"), ti.AddNext("author"))
+		case "trl":
+			translators = append(translators, c)
+		}
+	}
+	if len(ti.SelectElements("author")) == 0 {
+		ti.AddNext("author").AddNext("nickname").SetText("Unknown")
+	}
+
+	var title string
+	for _, t := range meta.SelectElements("title") {
+		if tt := refined(t, "title-type"); len(title) == 0 || tt == "main" {
+			title = normalizeSpace(t.Text())
+		}
+	}
+	ti.AddNext("book-title").SetText(title)
+
+	if d := meta.SelectElement("description"); d != nil {
+		text := d.Text()
+		if len(d.ChildElements()) > 0 {
+			text = fb3Plain(d)
+		}
+		text = reHTMLBreak.ReplaceAllString(text, "\n")
+		text = html.UnescapeString(reHTMLTag.ReplaceAllString(text, ""))
+		annotation := etree.NewElement("annotation")
+		for _, l := range strings.Split(text, "\n") {
+			if l = normalizeSpace(l); len(l) > 0 {
+				annotation.AddNext("p").SetText(l)
+			}
+		}
+		if len(annotation.ChildElements()) > 0 {
+			ti.AddChild(annotation)
+		}
+	}
+	if len(keywords) > 0 {
+		ti.AddNext("keywords").SetText(strings.Join(keywords, ", "))
+	}
+
+	var year string
+	if d := meta.SelectElement("date"); d != nil {
+		text := strings.TrimSpace(d.Text())
+		if len(text) >= 4 {
+			year = text[:4]
+			date := ti.AddNext("date").SetText(year)
+			if len(text) >= 10 {
+				date.CreateAttr("value", text[:10])
+			}
+		}
+	}
+	if len(cover) > 0 {
+		ti.AddNext("coverpage").AddNext("image", attr("l:href", "#"+cover))
+	}
+
+	lang := "en"
+	if l := meta.SelectElement("language"); l != nil && len(strings.TrimSpace(l.Text())) > 0 {
+		lang = strings.TrimSpace(l.Text())
+	}
+	ti.AddNext("lang").SetText(lang)
+
+	for _, t := range translators {
+		epubAuthor(strings.TrimSpace(t.Text()), refined(t, "file-as"), ti.AddNext("translator"))
+	}
+
+	if name := calibre("calibre:series"); len(name) > 0 {
+		ti.AddNext("sequence", attr("name", name), attr("number", seqNumber(calibre("calibre:series_index"))))
+	} else {
+		for _, c := range collections {
+			ti.AddNext("sequence", attr("name", strings.TrimSpace(c.Text())), attr("number", seqNumber(refined(c, "group-position"))))
+		}
+	}
+
+	// document info
+	di := to.AddNext("document-info")
+	di.AddNext("author").AddNext("nickname").SetText("fb2converter")
+	di.AddNext("program-used").SetText("fb2converter")
+	now := time.Now().Format("2006-01-02")
+	di.AddNext("date", attr("value", now)).SetText(now)
+
+	var id, isbn string
+	uid := getAttrValue(pkg, "unique-identifier")
+	for _, i := range meta.SelectElements("identifier") {
+		text := strings.TrimSpace(i.Text())
+		lower := strings.ToLower(text)
+		switch {
+		case strings.EqualFold(getAttrValue(i, "scheme"), "isbn"):
+			isbn = text
+		case strings.HasPrefix(lower, "urn:isbn:"):
+			isbn = text[len("urn:isbn:"):]
+		case strings.HasPrefix(lower, "isbn:"):
+			isbn = text[len("isbn:"):]
+		}
+		if getAttrValue(i, "id") == uid || len(id) == 0 {
+			id = text
+		}
+	}
+	id = strings.TrimPrefix(strings.TrimPrefix(id, "urn:uuid:"), "uuid:")
+	if u, err := uuid.Parse(id); err == nil {
+		id = u.String()
+	} else if len(id) > 0 {
+		id = uuid.NewSHA1(nameSpaceFB2, []byte(id)).String()
+	} else {
+		id = uuid.NewSHA1(nameSpaceFB2, []byte(title+opfName)).String()
+	}
+	di.AddNext("id").SetText(id)
+	di.AddNext("version").SetText("1.0")
+
+	// publish info
+	var publisher string
+	if p := meta.SelectElement("publisher"); p != nil {
+		publisher = strings.TrimSpace(p.Text())
+	}
+	if len(publisher) > 0 || len(isbn) > 0 {
+		pi := to.AddNext("publish-info")
+		if len(publisher) > 0 {
+			pi.AddNext("publisher").SetText(publisher)
+		}
+		if len(year) > 0 {
+			pi.AddNext("year").SetText(year)
+		}
+		if len(isbn) > 0 {
+			pi.AddNext("isbn").SetText(isbn)
+		}
+	}
+}
+
+// epubAuthorName splits person name, "file-as" is expected in "Last, First Middle" form. Single word names are returned as nickname.
+func epubAuthorName(name, fileAs string) (*config.AuthorName, string) {
+
+	an := &config.AuthorName{}
+	if parts := strings.SplitN(fileAs, ",", 2); len(parts) == 2 {
+		an.Last = strings.TrimSpace(parts[0])
+		names := strings.Fields(parts[1])
+		if len(names) > 0 {
+			an.First = names[0]
+			an.Middle = strings.Join(names[1:], " ")
+		}
+	} else {
+		names := strings.Fields(name)
+		switch len(names) {
+		case 0:
+		case 1:
+			return nil, names[0]
+		default:
+			an.First, an.Last = names[0], names[len(names)-1]
+			an.Middle = strings.Join(names[1:len(names)-1], " ")
+		}
+	}
+	if len(an.First) == 0 && len(an.Last) == 0 {
+		return nil, ""
+	}
+	return an, ""
+}
+
+// epubAuthor fills FB2 author element.
+func epubAuthor(name, fileAs string, to *etree.Element) {
+
+	an, nick := epubAuthorName(name, fileAs)
+	if an == nil {
+		if len(nick) == 0 {
+			nick = "Unknown"
+		}
+		to.AddNext("nickname").SetText(nick)
+		return
+	}
+	to.AddNext("first-name").SetText(an.First)
+	if len(an.Middle) > 0 {
+		to.AddNext("middle-name").SetText(an.Middle)
+	}
+	to.AddNext("last-name").SetText(an.Last)
+}
+
+func seqNumber(s string) string {
+	if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil && f > 0 {
+		return strconv.Itoa(int(f))
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	gocontext "context"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/state"
+)
+
+const fb2RoundTripBook = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+<title-info>
+<genre>prose_contemporary</genre>
+<author><first-name>Иван</first-name><last-name>Петров</last-name></author>
+<book-title>Тестовая книга</book-title>
+<lang>ru</lang>
+</title-info>
+<document-info>
+<id>11111111-2222-3333-4444-555555555555</id>
+</document-info>
+</description>
+<body>
+<section>
+<title><p>Глава 1</p></title>
+<p>Обычный <emphasis>курсив</emphasis>, <strong>жирный</strong> и <strikethrough>зачеркнутый</strikethrough> текст.</p>
+<p><strong>Жирный <emphasis>жирный курсив</emphasis></strong> конец.</p>
+</section>
+</body>
+</FictionBook>`
+
+func TestEpubRoundTripInlineStyles(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	p, err := NewFB2(strings.NewReader(fb2RoundTripBook), false, "book.fb2", "", true, false, true, OEpub, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Clean()
+
+	ctx := gocontext.Background()
+	if err := p.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := p.SaveTo(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := newEpubReader(z, "notes", zap.NewNop()).convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := doc.FindElement("//body")
+	if body == nil {
+		t.Fatal("no body in produced FB2")
+	}
+	for _, c := range []struct{ path, text string }{
+		{".//p/emphasis", "курсив"},
+		{".//p/strong", "жирный"},
+		{".//p/strikethrough", "зачеркнутый"},
+		{".//p/strong/emphasis", "жирный курсив"},
+	} {
+		var found bool
+		for _, e := range body.FindElements(c.path) {
+			if strings.TrimSpace(e.Text()) == c.text {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%s %q was lost in round trip", c.path, c.text)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+// OPC relationship types used by FB3.
+const (
+	fb3RelBook      = "http://www.fictionbook.org/FictionBook3/relationships/Book"
+	fb3RelBody      = "http://www.fictionbook.org/FictionBook3/relationships/body"
+	fb3RelThumbnail = "http://schemas.openxmlformats.org/package/2006/relationships/metadata/thumbnail"
+)
+
+// fb3Reader maps FB3 package (description, body, images) onto FB2 document, which is then processed as usual.
+type fb3Reader struct {
+	files    map[string]*zip.File
+	images   map[string]string // relationship id -> binary id
+	binaries *etree.Element
+	notes    string // name of notes body
+	log      *zap.Logger
+	// FB2 description has no place for illustrators, they are passed to the book directly
+	illustrators []*config.AuthorName
+}
+
+// NewFB3 creates FB3 book processor. FB3 package is converted to FB2 on the fly, so all the FB2 processing applies.
+func NewFB3(r io.Reader, src, dst string, nodirs, stk, overwrite bool, format OutputFmt, env *state.LocalEnv) (*Processor, error) {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read FB3: %w", err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read FB3: %w", err)
+	}
+
+	fr := &fb3Reader{
+		files:  make(map[string]*zip.File),
+		images: make(map[string]string),
+		notes:  "notes",
+		log:    env.Log,
+	}
+	if len(env.Cfg.Doc.Notes.BodyNames) > 0 {
+		fr.notes = env.Cfg.Doc.Notes.BodyNames[0]
+	}
+	for _, f := range z.File {
+		fr.files[strings.TrimPrefix(f.Name, "/")] = f
+	}
+
+	doc, err := fr.convert()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if _, err := doc.WriteTo(&b); err != nil {
+		return nil, fmt.Errorf("unable to convert FB3: %w", err)
+	}
+	p, err := NewFB2(&b, false, src, dst, nodirs, stk, overwrite, format, env)
+	if err != nil {
+		return nil, err
+	}
+	p.Book.Illustrators = fr.illustrators
+	return p, nil
+}
+
+// readXML parses package part.
+func (fr *fb3Reader) readXML(name string) (*etree.Document, error) {
+	f, ok := fr.files[name]
+	if !ok {
+		return nil, fmt.Errorf("unable to find %s in FB3", name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s from FB3: %w", name, err)
+	}
+	defer r.Close()
+
+	doc := etree.NewDocument()
+	if _, err := doc.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("unable to parse %s from FB3: %w", name, err)
+	}
+	doc.Indent(etree.NoIndent)
+	return doc, nil
+}
+
+// rels returns relationships of the package part (id -> (type, target)), targets are resolved to package names.
+func (fr *fb3Reader) rels(part string) map[string][2]string {
+
+	dir, base := path.Split(part)
+	res := make(map[string][2]string)
+
+	doc, err := fr.readXML(path.Join(dir, "_rels", base+".rels"))
+	if err != nil {
+		return res
+	}
+	for _, r := range doc.FindElements("./Relationships/Relationship") {
+		target := getAttrValue(r, "Target")
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join(dir, target)
+		}
+		res[getAttrValue(r, "Id")] = [2]string{getAttrValue(r, "Type"), target}
+	}
+	return res
+}
+
+func findRel(rels map[string][2]string, kind string) string {
+	for _, r := range rels {
+		if r[0] == kind {
+			return r[1]
+		}
+	}
+	return ""
+}
+
+func (fr *fb3Reader) convert() (*etree.Document, error) {
+
+	root := fr.rels("")
+	descName := findRel(root, fb3RelBook)
+	if len(descName) == 0 {
+		descName = "fb3/description.xml"
+	}
+	bodyName := findRel(fr.rels(descName), fb3RelBody)
+	if len(bodyName) == 0 {
+		bodyName = path.Join(path.Dir(descName), "body.xml")
+	}
+
+	desc, err := fr.readXML(descName)
+	if err != nil {
+		return nil, err
+	}
+	body, err := fr.readXML(bodyName)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	fb := doc.CreateElement("FictionBook")
+	fb.CreateAttr("xmlns", "http://www.gribuser.ru/xml/fictionbook/2.0")
+	fb.CreateAttr("xmlns:l", "http://www.w3.org/1999/xlink")
+
+	description := fb.AddNext("description")
+	main := fb.AddNext("body")
+	fr.binaries = etree.NewElement("binaries")
+
+	// images are referenced by relationship id
+	for id, r := range fr.rels(bodyName) {
+		if strings.HasSuffix(r[0], "/image") {
+			fr.images[id] = fr.binary(id, r[1])
+		}
+	}
+	var cover string
+	if name := findRel(root, fb3RelThumbnail); len(name) > 0 {
+		cover = fr.binary("fb3-cover", name)
+	}
+
+	if d := desc.Root(); d != nil {
+		fr.description(d, description, cover)
+	}
+
+	if b := body.Root(); b != nil {
+		for _, c := range b.ChildElements() {
+			switch c.Tag {
+			case "notes":
+				notes := fb.AddNext("body", attr("name", fr.notes))
+				for _, n := range c.ChildElements() {
+					switch n.Tag {
+					case "title":
+						fr.title(n, notes)
+					case "notebody":
+						s := notes.AddNext("section", attr("id", getAttrValue(n, "id")))
+						fr.blocks(n, s)
+					}
+				}
+			case "title", "epigraph":
+				fr.block(c, main)
+			case "section":
+				fr.block(c, main)
+			default:
+				// FB2 body consists of sections
+				fr.block(c, main.AddNext("section"))
+			}
+		}
+	}
+	if len(main.ChildElements()) == 0 {
+		main.AddNext("section").AddNext("empty-line")
+	}
+
+	for _, b := range fr.binaries.ChildElements() {
+		fb.AddChild(b)
+	}
+	return doc, nil
+}
+
+// binary embeds image from package and returns its id.
+func (fr *fb3Reader) binary(id, name string) string {
+
+	f, ok := fr.files[name]
+	if !ok {
+		fr.log.Warn("Unable to find FB3 image, skipping", zap.String("image", name))
+		return ""
+	}
+	r, err := f.Open()
+	if err != nil {
+		fr.log.Warn("Unable to read FB3 image, skipping", zap.String("image", name), zap.Error(err))
+		return ""
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		fr.log.Warn("Unable to read FB3 image, skipping", zap.String("image", name), zap.Error(err))
+		return ""
+	}
+	ct := mime.TypeByExtension(strings.ToLower(path.Ext(name)))
+	if len(ct) == 0 {
+		ct = "image/jpeg"
+	}
+	fr.binaries.AddNext("binary", attr("id", id), attr("content-type", ct)).SetText(base64.StdEncoding.EncodeToString(data))
+	return id
+}
+
+// description maps FB3 book description onto FB2 title-info, document-info and publish-info.
+func (fr *fb3Reader) description(from, to *etree.Element, cover string) {
+
+	ti := to.AddNext("title-info")
+	if cl := from.SelectElement("fb3-classification"); cl != nil {
+		for _, s := range cl.SelectElements("subject") {
+			if g := strings.TrimSpace(s.Text()); len(g) > 0 {
+				ti.AddNext("genre").SetText(g)
+			}
+		}
+	}
+	if len(ti.SelectElements("genre")) == 0 {
+		ti.AddNext("genre").SetText("unrecognised")
+	}
+
+	var translators []*etree.Element
+	if rel := from.SelectElement("fb3-relations"); rel != nil {
+		for _, s := range rel.SelectElements("subject") {
+			switch getAttrValue(s, "link") {
+			case "author":
+				fr.author(s, ti.AddNext("author"))
+			case "translator":
+				translators = append(translators, s)
+			case "illustrator":
+				if an := parseAuthor(s); an != nil {
+					fr.illustrators = append(fr.illustrators, an)
+				} else if t := fb3Title(s.SelectElement("title")); len(t) > 0 {
+					fr.illustrators = append(fr.illustrators, &config.AuthorName{Nickname: t})
+				}
+			}
+		}
+	}
+	if len(ti.SelectElements("author")) == 0 {
+		ti.AddNext("author").AddNext("nickname").SetText("Unknown")
+	}
+
+	ti.AddNext("book-title").SetText(fb3Title(from.SelectElement("title")))
+
+	if a := from.SelectElement("annotation"); a != nil {
+		fr.blocks(a, ti.AddNext("annotation"))
+	}
+	if w := from.SelectElement("written"); w != nil {
+		if d := w.SelectElement("date"); d != nil {
+			ti.AddNext("date", attr("value", getAttrValue(d, "value"))).SetText(strings.TrimSpace(d.Text()))
+		}
+	}
+	if len(cover) > 0 {
+		ti.AddNext("coverpage").AddNext("image", attr("l:href", "#"+cover))
+	}
+
+	lang := "ru"
+	if l := from.SelectElement("lang"); l != nil && len(strings.TrimSpace(l.Text())) > 0 {
+		lang = strings.TrimSpace(l.Text())
+	}
+	ti.AddNext("lang").SetText(lang)
+	if w := from.SelectElement("written"); w != nil {
+		if l := w.SelectElement("lang"); l != nil && !strings.EqualFold(strings.TrimSpace(l.Text()), lang) {
+			ti.AddNext("src-lang").SetText(strings.TrimSpace(l.Text()))
+		}
+	}
+	for _, t := range translators {
+		fr.author(t, ti.AddNext("translator"))
+	}
+	for _, s := range from.SelectElements("sequence") {
+		fr.sequence(s, ti)
+	}
+
+	di := to.AddNext("document-info")
+	di.AddNext("author").AddNext("nickname").SetText("fb2converter")
+	if info := from.SelectElement("document-info"); info != nil {
+		if pu := getAttrValue(info, "program-used"); len(pu) > 0 {
+			di.AddNext("program-used").SetText(pu)
+		}
+		created := getAttrValue(info, "created")
+		if len(created) >= 10 {
+			created = created[:10]
+		}
+		di.AddNext("date", attr("value", created)).SetText(created)
+	} else {
+		di.AddNext("date").SetText("")
+	}
+	di.AddNext("id").SetText(getAttrValue(from, "id"))
+	di.AddNext("version").SetText(from.SelectAttrValue("version", "1.0"))
+
+	if pi := from.SelectElement("paper-publish-info"); pi != nil {
+		publish := to.AddNext("publish-info")
+		if t := getAttrValue(pi, "title"); len(t) > 0 {
+			publish.AddNext("book-name").SetText(t)
+		}
+		for _, a := range []string{"publisher", "city", "year", "isbn"} {
+			if v := getAttrValue(pi, a); len(v) > 0 {
+				publish.AddNext(a).SetText(v)
+			}
+		}
+		if isbn := pi.SelectElement("isbn"); isbn != nil && len(publish.SelectElements("isbn")) == 0 {
+			publish.AddNext("isbn").SetText(strings.TrimSpace(isbn.Text()))
+		}
+	}
+}
+
+func (fr *fb3Reader) author(from, to *etree.Element) {
+
+	var found bool
+	for _, n := range []string{"first-name", "middle-name", "last-name"} {
+		if e := from.SelectElement(n); e != nil {
+			if v := strings.TrimSpace(e.Text()); len(v) > 0 {
+				to.AddNext(n).SetText(v)
+				found = true
+			}
+		}
+	}
+	if !found {
+		to.AddNext("nickname").SetText(fb3Title(from.SelectElement("title")))
+	}
+	if id := getAttrValue(from, "id"); len(id) > 0 {
+		to.AddNext("id").SetText(id)
+	}
+}
+
+func (fr *fb3Reader) sequence(from, to *etree.Element) {
+	seq := to.AddNext("sequence", attr("name", fb3Title(from.SelectElement("title"))), attr("number", getAttrValue(from, "number")))
+	// FB3 sequences could be nested
+	for _, s := range from.SelectElements("sequence") {
+		fr.sequence(s, seq)
+	}
+}
+
+// fb3Title extracts plain text of description title (main and subtitle).
+func fb3Title(e *etree.Element) string {
+	if e == nil {
+		return ""
+	}
+	var parts []string
+	for _, n := range []string{"main", "sub"} {
+		if t := e.SelectElement(n); t != nil {
+			if v := strings.TrimSpace(t.Text()); len(v) > 0 {
+				parts = append(parts, v)
+			}
+		}
+	}
+	return strings.Join(parts, ". ")
+}
+
+// blocks converts block level content.
+func (fr *fb3Reader) blocks(from, to *etree.Element) {
+	for _, c := range from.ChildElements() {
+		fr.block(c, to)
+	}
+}
+
+func (fr *fb3Reader) block(e, to *etree.Element) {
+
+	switch e.Tag {
+	case "section", "epigraph", "annotation":
+		fr.blocks(e, to.AddNext(e.Tag, attr("id", getAttrValue(e, "id"))))
+	case "title":
+		fr.title(e, to)
+	case "p", "subtitle", "text-author", "date":
+		fr.inline(e, to.AddNext(e.Tag, attr("id", getAttrValue(e, "id"))))
+	case "blockquote":
+		fr.blocks(e, to.AddNext("cite", attr("id", getAttrValue(e, "id"))))
+	case "poem":
+		poem := to.AddNext("poem", attr("id", getAttrValue(e, "id")))
+		for _, c := range e.ChildElements() {
+			if c.Tag == "stanza" {
+				stanza := poem.AddNext("stanza")
+				for _, v := range c.ChildElements() {
+					switch v.Tag {
+					case "title", "subtitle":
+						fr.block(v, stanza)
+					default:
+						fr.inline(v, stanza.AddNext("v"))
+					}
+				}
+			} else {
+				fr.block(c, poem)
+			}
+		}
+	case "br":
+		to.AddNext("empty-line")
+	case "img":
+		if id, ok := fr.images[getAttrValue(e, "src")]; ok && len(id) > 0 {
+			to.AddNext("image", attr("l:href", "#"+id), attr("id", getAttrValue(e, "id")))
+		}
+	case "table":
+		table := to.AddNext("table", attr("id", getAttrValue(e, "id")))
+		for _, tr := range e.FindElements(".//tr") {
+			row := table.AddNext("tr")
+			for _, td := range tr.ChildElements() {
+				cell := row.AddNext(td.Tag,
+					attr("colspan", getAttrValue(td, "colspan")),
+					attr("rowspan", getAttrValue(td, "rowspan")),
+					attr("align", getAttrValue(td, "align")))
+				fr.inline(td, cell)
+			}
+		}
+	case "ol", "ul":
+		for i, li := range e.SelectElements("li") {
+			p := to.AddNext("p")
+			if e.Tag == "ol" {
+				p.SetText(strconv.Itoa(i+1) + ". ")
+			} else {
+				p.SetText("• ")
+			}
+			fr.inline(li, p)
+		}
+	case "pre":
+		for _, l := range strings.Split(strings.Trim(fb3Plain(e), "\n"), "\n") {
+			to.AddNext("p").AddNext("code").SetText(l)
+		}
+	case "div":
+		fr.blocks(e, to)
+	case "clipped", "paper-page-break", "notes":
+		// nothing to show
+	default:
+		fr.log.Debug("Unknown FB3 element, converting as paragraph", zap.String("tag", e.Tag))
+		fr.inline(e, to.AddNext("p"))
+	}
+}
+
+func (fr *fb3Reader) title(e, to *etree.Element) {
+	t := to.AddNext("title")
+	for _, c := range e.ChildElements() {
+		switch c.Tag {
+		case "p":
+			fr.inline(c, t.AddNext("p"))
+		case "br":
+			t.AddNext("empty-line")
+		}
+	}
+}
+
+// inline converts formatted text.
+func (fr *fb3Reader) inline(from, to *etree.Element) {
+	for _, t := range from.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			fb3Text(to, t.Data)
+		case *etree.Element:
+			fr.inlineElement(t, to)
+			fb3Text(to, t.TailData)
+		}
+	}
+}
+
+func (fr *fb3Reader) inlineElement(e, to *etree.Element) {
+	switch e.Tag {
+	case "strong", "sub", "sup", "code":
+		fr.inline(e, to.AddNext(e.Tag))
+	case "em":
+		fr.inline(e, to.AddNext("emphasis"))
+	case "strikethrough":
+		fr.inline(e, to.AddNext("strikethrough"))
+	case "a":
+		fr.inline(e, to.AddNext("a", attr("l:href", fb3Link(getAttrValue(e, "href")))))
+	case "note":
+		a := to.AddNext("a", attr("l:href", fb3Link(getAttrValue(e, "href"))), attr("type", "note"))
+		if len(strings.TrimSpace(fb3Plain(e))) > 0 {
+			fr.inline(e, a)
+		} else if t := getAttrValue(e, "autotext"); len(t) > 0 && t != "0" && t != "1" {
+			a.SetText(t)
+		} else {
+			a.SetText("*")
+		}
+	case "img":
+		if id, ok := fr.images[getAttrValue(e, "src")]; ok && len(id) > 0 {
+			to.AddNext("image", attr("l:href", "#"+id))
+		}
+	case "br":
+		fb3Text(to, " ")
+	case "paper-page-break":
+	default:
+		// underline, span and everything FB2 does not know - keep the text
+		fr.inline(e, to)
+	}
+}
+
+// fb3Link converts FB3 reference to FB2 form - internal links in FB3 are plain ids.
+func fb3Link(href string) string {
+	if len(href) == 0 || strings.HasPrefix(href, "#") || strings.Contains(href, ":") {
+		return href
+	}
+	return "#" + href
+}
+
+// fb3Text appends text to the element keeping mixed content in order.
+func fb3Text(to *etree.Element, s string) {
+	if len(s) == 0 {
+		return
+	}
+	if n := len(to.Child); n > 0 {
+		switch t := to.Child[n-1].(type) {
+		case *etree.Element:
+			t.SetTail(t.Tail() + s)
+			return
+		case *etree.CharData:
+			t.Data += s
+			return
+		}
+	}
+	to.CreateCharData(s)
+}
+
+func fb3Plain(e *etree.Element) string {
+	var b strings.Builder
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			b.WriteString(t.Data)
+		case *etree.Element:
+			b.WriteString(fb3Plain(t))
+			b.WriteString(t.TailData)
+		}
+	}
+	return b.String()
+}
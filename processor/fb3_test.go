@@ -0,0 +1,284 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	gocontext "context"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+const fb3TestDescription = `<?xml version="1.0" encoding="UTF-8"?>
+<fb3-description xmlns="http://www.fictionbook.org/FictionBook3/description" id="11111111-2222-3333-4444-555555555555" version="1.1">
+<title><main>Тестовая книга</main><sub>Роман</sub></title>
+<sequence number="2"><title><main>Серия</main></title>
+<sequence number="5"><title><main>Подсерия</main></title></sequence>
+</sequence>
+<fb3-relations>
+<subject link="author"><title><main>Иван Петров</main></title><first-name>Иван</first-name><last-name>Петров</last-name></subject>
+<subject link="author" id="22222222-2222-3333-4444-555555555555"><title><main>Аноним</main></title></subject>
+<subject link="translator"><title><main>Анна Смирнова</main></title><first-name>Анна</first-name><last-name>Смирнова</last-name></subject>
+<subject link="illustrator"><title><main>Художник</main></title></subject>
+</fb3-relations>
+<fb3-classification><subject>prose_contemporary</subject><subject>humor</subject></fb3-classification>
+<lang>ru</lang>
+<written><lang>en</lang><date value="2001-01-01">2001</date></written>
+<document-info created="2020-05-06T07:08:09" program-used="test"/>
+<paper-publish-info title="Книга" publisher="Издательство" city="Москва" year="2020"><isbn>978-0-306-40615-7</isbn></paper-publish-info>
+<annotation><p>Аннотация <em>книги</em>.</p></annotation>
+</fb3-description>`
+
+const fb3TestBody = `<?xml version="1.0" encoding="UTF-8"?>
+<fb3-body xmlns="http://www.fictionbook.org/FictionBook3/body" xmlns:l="http://www.w3.org/1999/xlink">
+<title><p>Тестовая книга</p></title>
+<section id="ch1">
+<title><p>Глава 1</p></title>
+<p>Текст <em>курсив</em>, <strong>жирный</strong> и <strikethrough>зачеркнутый</strikethrough><note href="n1" autotext="1"/>.</p>
+<p><a href="ch2">Ссылка</a> <span>простой</span> текст</p>
+<ol><li>один</li><li>два</li></ol>
+<ul><li>пункт</li></ul>
+<pre>line 1
+line 2</pre>
+<img src="img1"/>
+</section>
+<section id="ch2">
+<title><p>Глава 2</p></title>
+<blockquote><p>Цитата</p></blockquote>
+</section>
+<p>Без раздела</p>
+<notes>
+<title><p>Примечания</p></title>
+<notebody id="n1"><p>Примечание</p></notebody>
+</notes>
+</fb3-body>`
+
+// makeFB3 builds OPC package from name -> content map.
+func makeFB3(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testFB3Files(t *testing.T) map[string]string {
+	t.Helper()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]string{
+		"[Content_Types].xml": `<?xml version="1.0" encoding="UTF-8"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`,
+		"_rels/.rels": `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId0" Type="` + fb3RelThumbnail + `" Target="covers/cover.png"/>
+<Relationship Id="rId1" Type="` + fb3RelBook + `" Target="/book/desc.xml"/>
+</Relationships>`,
+		"book/_rels/desc.xml.rels": `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId0" Type="` + fb3RelBody + `" Target="text.xml"/>
+</Relationships>`,
+		"book/_rels/text.xml.rels": `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="img1" Type="http://www.fictionbook.org/FictionBook3/relationships/image" Target="img/picture.png"/>
+</Relationships>`,
+		"book/desc.xml":        fb3TestDescription,
+		"book/text.xml":        fb3TestBody,
+		"book/img/picture.png": img.String(),
+		"covers/cover.png":     img.String(),
+	}
+}
+
+func newTestFB3Reader(t *testing.T, files map[string]string) *fb3Reader {
+	t.Helper()
+
+	data := makeFB3(t, files)
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fb3Reader{files: make(map[string]*zip.File), images: make(map[string]string), notes: "notes", log: zap.NewNop()}
+	for _, f := range z.File {
+		fr.files[f.Name] = f
+	}
+	return fr
+}
+
+func TestFB3Convert(t *testing.T) {
+
+	doc, err := newTestFB3Reader(t, testFB3Files(t)).convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := doc.Root()
+
+	text := func(path string) string {
+		if e := root.FindElement(path); e != nil {
+			return strings.TrimSpace(e.Text())
+		}
+		return "<missing>"
+	}
+	for path, want := range map[string]string{
+		"./description/title-info/genre[2]":              "humor",
+		"./description/title-info/author[1]/last-name":   "Петров",
+		"./description/title-info/author[2]/nickname":    "Аноним",
+		"./description/title-info/author[2]/id":          "22222222-2222-3333-4444-555555555555",
+		"./description/title-info/translator/first-name": "Анна",
+		"./description/title-info/book-title":            "Тестовая книга. Роман",
+		"./description/title-info/annotation/p/emphasis": "книги",
+		"./description/title-info/date":                  "2001",
+		"./description/title-info/lang":                  "ru",
+		"./description/title-info/src-lang":              "en",
+		"./description/document-info/program-used":       "test",
+		"./description/document-info/date":               "2020-05-06",
+		"./description/document-info/id":                 "11111111-2222-3333-4444-555555555555",
+		"./description/document-info/version":            "1.1",
+		"./description/publish-info/book-name":           "Книга",
+		"./description/publish-info/isbn":                "978-0-306-40615-7",
+		"./body[1]/title/p":                              "Тестовая книга",
+		"./body[1]/section[1]/title/p":                   "Глава 1",
+		"./body[1]/section[1]/p[1]/emphasis":             "курсив",
+		"./body[1]/section[1]/p[1]/strong":               "жирный",
+		"./body[1]/section[1]/p[1]/strikethrough":        "зачеркнутый",
+		"./body[1]/section[1]/p[1]/a[@type='note']":      "*",
+		"./body[1]/section[1]/p[2]/a[@l:href='#ch2']":    "Ссылка",
+		"./body[1]/section[1]/p[3]":                      "1. один",
+		"./body[1]/section[1]/p[4]":                      "2. два",
+		"./body[1]/section[1]/p[5]":                      "• пункт",
+		"./body[1]/section[1]/p[6]/code":                 "line 1",
+		"./body[1]/section[1]/p[7]/code":                 "line 2",
+		"./body[1]/section[2]/cite/p":                    "Цитата",
+		"./body[1]/section[3]/p":                         "Без раздела",
+		"./body[@name='notes']/title/p":                  "Примечания",
+		"./body[@name='notes']/section[@id='n1']/p":      "Примечание",
+	} {
+		if got := text(path); got != want {
+			t.Errorf("%s: %q, expected %q", path, got, want)
+		}
+	}
+	if s := root.FindElement("./description/title-info/sequence/sequence"); s == nil || getAttrValue(s, "name") != "Подсерия" || getAttrValue(s, "number") != "5" {
+		t.Error("nested sequence was lost")
+	}
+	if p := root.FindElement("./body[1]/section[1]/p[2]"); p == nil || !strings.Contains(fb3Plain(p), "простой текст") {
+		t.Error("text of unknown inline element was lost")
+	}
+
+	// images are embedded as binaries and referenced from text and cover
+	refs := map[string]bool{}
+	for _, e := range []*etree.Element{
+		root.FindElement("./body[1]/section[1]/image"),
+		root.FindElement("./description/title-info/coverpage/image"),
+	} {
+		if e == nil {
+			t.Fatal("image reference is missing")
+		}
+		refs[strings.TrimPrefix(getAttrValue(e, "l:href"), "#")] = true
+	}
+	for _, b := range root.SelectElements("binary") {
+		if getAttrValue(b, "content-type") != "image/png" || len(b.Text()) == 0 {
+			t.Errorf("bad binary %s", getAttrValue(b, "id"))
+		}
+		delete(refs, getAttrValue(b, "id"))
+	}
+	if len(refs) != 0 {
+		t.Errorf("images without binaries: %v", refs)
+	}
+}
+
+func TestFB3Defaults(t *testing.T) {
+
+	// no relationships - default part names, no authors, no body content
+	fr := newTestFB3Reader(t, map[string]string{
+		"fb3/description.xml": `<fb3-description id="x"><title><main>Книга</main></title></fb3-description>`,
+		"fb3/body.xml":        `<fb3-body/>`,
+	})
+	doc, err := fr.convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := doc.Root()
+	for path, want := range map[string]string{
+		"./description/title-info/genre":           "unrecognised",
+		"./description/title-info/author/nickname": "Unknown",
+		"./description/title-info/book-title":      "Книга",
+		"./description/title-info/lang":            "ru",
+		"./description/document-info/version":      "1.0",
+	} {
+		if e := root.FindElement(path); e == nil || e.Text() != want {
+			t.Errorf("%s: expected %q", path, want)
+		}
+	}
+	if root.FindElement("./body/section/empty-line") == nil {
+		t.Error("empty body should have placeholder section")
+	}
+
+	fr = newTestFB3Reader(t, map[string]string{"fb3/description.xml": `<fb3-description/>`})
+	if _, err := fr.convert(); err == nil {
+		t.Error("missing body should be reported")
+	}
+}
+
+func TestNewFB3(t *testing.T) {
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}
+
+	p, err := NewFB3(bytes.NewReader(makeFB3(t, testFB3Files(t))), "book.fb3", "", true, false, true, OEpub, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Clean()
+	if err := p.Process(gocontext.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	b := p.Book
+	if b.Title != "Тестовая книга. Роман" || b.Lang.String() != "ru" || b.SrcLang != "en" {
+		t.Errorf("unexpected title info: %q %s %q", b.Title, b.Lang, b.SrcLang)
+	}
+	if b.ID.String() != "11111111-2222-3333-4444-555555555555" {
+		t.Errorf("unexpected id %s", b.ID)
+	}
+	if len(b.Authors) != 2 || b.Authors[0].Last != "Петров" || b.Authors[1].Nickname != "Аноним" {
+		t.Errorf("unexpected authors %+v", b.Authors)
+	}
+	if len(b.Translators) != 1 || b.Translators[0].Last != "Смирнова" {
+		t.Errorf("unexpected translators %+v", b.Translators)
+	}
+	if len(b.Illustrators) != 1 || b.Illustrators[0].Nickname != "Художник" {
+		t.Errorf("unexpected illustrators %+v", b.Illustrators)
+	}
+	if b.SeqName != "Серия" || b.SeqNum != 2 || len(b.Sequences) != 2 || b.Sequences[1].Name != "Подсерия" || b.Sequences[1].Level != 1 {
+		t.Errorf("unexpected sequences %q %d %+v", b.SeqName, b.SeqNum, b.Sequences)
+	}
+	if b.Publisher != "Издательство" || b.PubCity != "Москва" || b.PubYear != "2020" || len(b.ISBN) == 0 {
+		t.Errorf("unexpected publish info %q %q %q %q", b.Publisher, b.PubCity, b.PubYear, b.ISBN)
+	}
+	if len(b.Cover) == 0 {
+		t.Error("cover was not set from thumbnail")
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/gosimple/slug"
 	"go.uber.org/zap"
 
+	"fb2converter/config"
 	"fb2converter/etree"
 )
 
@@ -168,8 +169,15 @@ func (p *Processor) generateCover() error {
 
 	if !kindle {
 		// resizing will be done on device
-		to, f := p.ctx().createXHTML("cover", attr("xmlns", `http://www.w3.org/1999/xhtml`))
+		ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
+		if p.format == OEpub3 {
+			ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
+		}
+		to, f := p.ctx().createXHTML("cover", ns...)
 		f.id = "cover-page"
+		if p.format == OEpub3 {
+			to.CreateAttr("epub:type", "cover")
+		}
 		// Cover page goes first
 		p.Book.Files = append(p.Book.Files, nil)
 		copy(p.Book.Files[1:], p.Book.Files[0:])
@@ -398,6 +406,11 @@ func (p *Processor) prepareStylesheet() error {
 // generatePagemap creates epub page map.
 func (p *Processor) generatePagemap() error {
 
+	if p.format == OEpub3 {
+		// page list is part of navigation document
+		return nil
+	}
+
 	p.env.Log.Debug("Generating page map - start")
 	defer func(start time.Time) {
 		p.env.Log.Debug("Generating page map - done", zap.Duration("elapsed", time.Since(start)))
@@ -406,13 +419,22 @@ func (p *Processor) generatePagemap() error {
 	to, f := p.ctx().createPM("page-map")
 	p.Book.Files = append(p.Book.Files, f)
 
+	p.pageList(func(name, href string) {
+		to.AddNext("page", attr("name", name), attr("href", href))
+	})
+	return nil
+}
+
+// pageList enumerates book pages in reading order.
+func (p *Processor) pageList(add func(name, href string)) {
+
 	page := 1
 	for _, f := range p.Book.Files {
 		if f.transient&dataNotForSpline != 0 {
 			continue
 		}
 
-		to.AddNext("page", attr("name", fmt.Sprintf("%d", page)), attr("href", f.fname))
+		add(fmt.Sprintf("%d", page), f.fname)
 		page++
 
 		additionalPages, ok := p.Book.Pages[f.fname]
@@ -421,10 +443,94 @@ func (p *Processor) generatePagemap() error {
 		}
 
 		for i := 0; i < additionalPages; i++ {
-			to.AddNext("page", attr("name", fmt.Sprintf("%d", page)), attr("href", fmt.Sprintf("%s#page_%d", f.fname, i)))
+			add(fmt.Sprintf("%d", page), fmt.Sprintf("%s#page_%d", f.fname, i))
 			page++
 		}
 	}
+}
+
+// generateNav creates epub3 navigation document. TOC mirrors NCX (which we keep for older readers), page list replaces page map.
+func (p *Processor) generateNav() error {
+
+	if p.format != OEpub3 {
+		return nil
+	}
+
+	p.env.Log.Debug("Generating navigation document - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Generating navigation document - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	var (
+		navMap *etree.Element
+		start  string
+	)
+	for _, f := range p.Book.Files {
+		if f.id == "ncx" && f.doc != nil {
+			navMap = f.doc.FindElement("./ncx/navMap")
+		}
+		if len(start) == 0 && strings.HasPrefix(f.fname, "index") {
+			start = f.fname
+		}
+	}
+
+	to, f := p.ctx().createXHTML("nav",
+		attr("xmlns", `http://www.w3.org/1999/xhtml`),
+		attr("xmlns:epub", `http://www.idpf.org/2007/ops`),
+	)
+	f.id = "nav"
+	f.transient = dataNotForSpline
+	p.Book.Files = append(p.Book.Files, f)
+
+	// toc
+	var addPoints func(to, from *etree.Element)
+	addPoints = func(to, from *etree.Element) {
+		points := from.SelectElements("navPoint")
+		if len(points) == 0 {
+			return
+		}
+		list := to.AddNext("ol")
+		for _, pt := range points {
+			var title, href string
+			if e := pt.FindElement("./navLabel/text"); e != nil {
+				title = e.Text()
+			}
+			if e := pt.SelectElement("content"); e != nil {
+				href = getAttrValue(e, "src")
+			}
+			item := list.AddNext("li")
+			item.AddNext("a", attr("href", href)).SetText(title)
+			addPoints(item, pt)
+		}
+	}
+
+	toc := to.AddNext("nav", attr("epub:type", "toc"), attr("id", "toc"))
+	toc.AddNext("h1").SetText(p.env.Cfg.Doc.TOC.Title)
+	if navMap != nil {
+		addPoints(toc, navMap)
+	}
+	if toc.SelectElement("ol") == nil {
+		// navigation document requires non empty toc
+		toc.AddNext("ol").AddNext("li").AddNext("a", attr("href", start)).SetText(p.Book.Title)
+	}
+
+	// landmarks
+	landmarks := to.AddNext("nav", attr("epub:type", "landmarks"), attr("hidden", "hidden")).AddNext("ol")
+	if len(p.Book.Cover) > 0 {
+		landmarks.AddNext("li").AddNext("a", attr("epub:type", "cover"), attr("href", "cover.xhtml")).SetText("Cover")
+	}
+	if p.tocPlacement != TOCNone && len(p.Book.TOC) > 0 {
+		landmarks.AddNext("li").AddNext("a", attr("epub:type", "toc"), attr("href", "toc.xhtml")).SetText(p.env.Cfg.Doc.TOC.Title)
+	}
+	if len(start) > 0 {
+		landmarks.AddNext("li").AddNext("a", attr("epub:type", "bodymatter"), attr("href", start)).SetText("Starts here")
+	}
+
+	// page list
+	pages := to.AddNext("nav", attr("epub:type", "page-list"), attr("hidden", "hidden")).AddNext("ol")
+	p.pageList(func(name, href string) {
+		pages.AddNext("li").AddNext("a", attr("href", href)).SetText(name)
+	})
 	return nil
 }
 
@@ -436,7 +542,13 @@ func (p *Processor) generateOPF() error {
 		p.env.Log.Debug("Generating OPF - done", zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
-	to, f := p.ctx().createOPF("content")
+	epub3 := p.format == OEpub3
+	version := "2.0"
+	if epub3 {
+		version = "3.0"
+	}
+
+	to, f := p.ctx().createOPF("content", version)
 	p.Book.Files = append(p.Book.Files, f)
 
 	kindle := p.format == OMobi || p.format == OAzw3
@@ -460,37 +572,227 @@ func (p *Processor) generateOPF() error {
 	}
 	meta.AddNext("dc:title").SetText(title)
 	meta.AddNext("dc:language").SetText(p.Book.Lang.String())
-	meta.AddNext("dc:identifier", attr("id", "BookId"), attr("opf:scheme", "uuid")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+	if epub3 {
+		meta.AddNext("dc:identifier", attr("id", "BookId")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+		meta.AddNext("meta", attr("property", "dcterms:modified")).SetText(time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	} else {
+		meta.AddNext("dc:identifier", attr("id", "BookId"), attr("opf:scheme", "uuid")).SetText(fmt.Sprintf("urn:uuid:%s", p.Book.ID))
+	}
+	if isbn, valid := p.Book.cleanISBN(); len(isbn) > 0 {
+		if !valid {
+			p.env.Log.Warn("ISBN has wrong check digit, keeping it as is", zap.String("isbn", p.Book.ISBN))
+		}
+		if epub3 {
+			meta.AddNext("dc:identifier", attr("id", "isbn")).SetText("urn:isbn:" + isbn)
+		} else {
+			meta.AddNext("dc:identifier", attr("opf:scheme", "ISBN")).SetText(isbn)
+		}
+	} else if len(p.Book.ISBN) > 0 {
+		p.env.Log.Warn("Invalid ISBN, ignoring", zap.String("isbn", p.Book.ISBN))
+	}
 
-	for _, an := range p.Book.Authors {
-		a := ReplaceKeywords(p.env.Cfg.Doc.AuthorFormatMeta, CreateAuthorKeywordsMap(an))
+	// person name formatted for display and for sorting
+	formatPerson := func(an *config.AuthorName, format string) (string, string) {
+		rd := CreateAuthorKeywordsMap(an)
+		name, fileAs := ReplaceKeywords(format, rd), ReplaceKeywords(p.env.Cfg.Doc.AuthorFormatSort, rd)
 		if p.env.Cfg.Doc.TransliterateMeta {
-			a = slug.Make(a)
+			name, fileAs = slug.Make(name), slug.Make(fileAs)
+		}
+		return name, fileAs
+	}
+	// person contacts and library id could only be attached to epub3 creator, using reserved schema.org vocabulary
+	refineContacts := func(an *config.AuthorName, id string) {
+		for _, c := range []struct {
+			property string
+			values   []string
+		}{
+			{"schema:url", an.HomePages},
+			{"schema:email", an.Emails},
+			{"schema:identifier", []string{an.ID}},
+		} {
+			for _, v := range c.values {
+				if len(v) > 0 {
+					meta.AddNext("meta", attr("refines", "#"+id), attr("property", c.property)).SetText(v)
+				}
+			}
 		}
-		meta.AddNext("dc:creator", attr("opf:role", "aut")).SetText(a)
 	}
 
-	meta.AddNext("dc:publisher")
+	var authorSort []string
+	for i, an := range p.Book.Authors {
+		a, fileAs := formatPerson(an, p.env.Cfg.Doc.AuthorFormatMeta)
+		if len(fileAs) > 0 {
+			authorSort = append(authorSort, fileAs)
+		}
+		if epub3 {
+			id := fmt.Sprintf("creator%d", i+1)
+			meta.AddNext("dc:creator", attr("id", id)).SetText(a)
+			meta.AddNext("meta", attr("refines", "#"+id), attr("property", "role"), attr("scheme", "marc:relators")).SetText("aut")
+			if len(fileAs) > 0 {
+				meta.AddNext("meta", attr("refines", "#"+id), attr("property", "file-as")).SetText(fileAs)
+			}
+			refineContacts(an, id)
+		} else {
+			c := meta.AddNext("dc:creator", attr("opf:role", "aut"))
+			if len(fileAs) > 0 {
+				c.CreateAttr("opf:file-as", fileAs)
+			}
+			c.SetText(a)
+		}
+	}
 
-	for _, g := range p.Book.Genres {
-		meta.AddNext("dc:subject").SetText(g)
+	contributors := 0
+	for _, c := range []struct {
+		names  []*config.AuthorName
+		role   string
+		format string
+	}{
+		{p.Book.Translators, "trl", p.env.Cfg.Doc.AuthorFormatTrl},
+		{p.Book.Illustrators, "ill", p.env.Cfg.Doc.AuthorFormatIll},
+		{p.Book.DocAuthors, "bkp", p.env.Cfg.Doc.AuthorFormatMeta},
+	} {
+		for _, an := range c.names {
+			a, fileAs := formatPerson(an, c.format)
+			if epub3 {
+				contributors++
+				id := fmt.Sprintf("contributor%d", contributors)
+				meta.AddNext("dc:contributor", attr("id", id)).SetText(a)
+				meta.AddNext("meta", attr("refines", "#"+id), attr("property", "role"), attr("scheme", "marc:relators")).SetText(c.role)
+				if len(fileAs) > 0 {
+					meta.AddNext("meta", attr("refines", "#"+id), attr("property", "file-as")).SetText(fileAs)
+				}
+				refineContacts(an, id)
+			} else {
+				e := meta.AddNext("dc:contributor", attr("opf:role", c.role))
+				if len(fileAs) > 0 {
+					e.CreateAttr("opf:file-as", fileAs)
+				}
+				e.SetText(a)
+			}
+		}
+	}
+
+	if len(p.Book.Publisher) > 0 {
+		meta.AddNext("dc:publisher").SetText(p.Book.Publisher)
+	} else if !epub3 {
+		// epub3 does not allow empty elements
+		meta.AddNext("dc:publisher")
+	}
+
+	if date := p.Book.publicationDate(); len(date) > 0 {
+		if epub3 {
+			meta.AddNext("dc:date").SetText(date)
+		} else {
+			meta.AddNext("dc:date", attr("opf:event", "publication")).SetText(date)
+		}
+	}
+
+	for _, u := range p.Book.DocSrcURLs {
+		meta.AddNext("dc:source").SetText(u)
+	}
+
+	genreLang := p.Book.genreLanguage(p.env.Cfg.Doc.Genres.Language)
+	for i, g := range p.Book.Genres {
+		var subjects []string
+		switch p.genreSubjects {
+		case GenreSubjectsName:
+			subjects = []string{GenreName(g, genreLang)}
+		case GenreSubjectsCode:
+			subjects = []string{g}
+		case GenreSubjectsBoth:
+			subjects = []string{GenreName(g, genreLang)}
+			if subjects[0] != g {
+				subjects = append(subjects, g)
+			}
+		}
+		term := genreSubject(g, p.genreAuthority)
+		if len(term) == 0 {
+			for _, s := range subjects {
+				meta.AddNext("dc:subject").SetText(s)
+			}
+			continue
+		}
+		// epub3 allows to specify subject classification, in epub2 subject code goes separately
+		if epub3 {
+			id := fmt.Sprintf("subject%d", i+1)
+			meta.AddNext("dc:subject", attr("id", id)).SetText(subjects[0])
+			meta.AddNext("meta", attr("refines", "#"+id), attr("property", "authority")).SetText(strings.ToUpper(p.genreAuthority.String()))
+			meta.AddNext("meta", attr("refines", "#"+id), attr("property", "term")).SetText(term)
+			for _, s := range subjects[1:] {
+				meta.AddNext("dc:subject").SetText(s)
+			}
+		} else {
+			for _, s := range subjects {
+				meta.AddNext("dc:subject").SetText(s)
+			}
+			meta.AddNext("dc:subject").SetText(term)
+		}
+	}
+	for _, k := range p.Book.Keywords {
+		meta.AddNext("dc:subject").SetText(k)
 	}
 
 	if len(p.Book.Annotation) > 0 {
 		meta.AddNext("dc:description").SetText(p.Book.Annotation)
 	}
 
+	// Keep the rest of FB2 description
+	for _, m := range []struct{ name, content string }{
+		{"fb2:src-title", p.Book.SrcTitle},
+		{"fb2:src-authors", authorsList(p.Book.SrcAuthors, p.env.Cfg.Doc.AuthorFormatMeta)},
+		{"fb2:src-lang", p.Book.SrcLang},
+		{"fb2:publish-book-name", p.Book.PubBookName},
+		{"fb2:publish-city", p.Book.PubCity},
+		{"fb2:document-version", p.Book.DocVersion},
+	} {
+		if len(m.content) > 0 {
+			meta.AddNext("meta", attr("name", m.name), attr("content", m.content))
+		}
+	}
+	for _, ci := range p.Book.CustomInfo {
+		meta.AddNext("meta", attr("name", "fb2:custom-info:"+ci.Type), attr("content", ci.Text))
+	}
+
 	// Amazon and Apple like this, but its epub3
 	if len(p.Book.Cover) > 0 {
 		meta.AddNext("meta", attr("name", "cover"), attr("content", "book-cover-image"))
 	}
-	// Do not let series metadata to disappear, use calibre meta tags
+	// calibre keeps single sort key for all authors
+	if len(authorSort) > 0 {
+		meta.AddNext("meta", attr("name", "calibre:author_sort"), attr("content", strings.Join(authorSort, " & ")))
+	}
+	// Do not let series metadata to disappear, use calibre meta tags - calibre only supports single series
 	if len(p.Book.SeqName) > 0 {
 		meta.AddNext("meta", attr("name", "calibre:series"), attr("content", p.Book.SeqName))
 		if p.Book.SeqNum > 0 {
 			meta.AddNext("meta", attr("name", "calibre:series_index"), attr("content", strconv.Itoa(p.Book.SeqNum)))
 		}
 	}
+	// the rest of sequences are kept too, in epub3 every sequence becomes collection
+	for i, seq := range p.Book.Sequences {
+		content := seq.Name
+		if seq.Number > 0 {
+			content += fmt.Sprintf(" [%d]", seq.Number)
+		}
+		name := "fb2:sequence"
+		if seq.Publisher {
+			name = "fb2:publisher-sequence"
+		}
+		if i > 0 || seq.Name != p.Book.SeqName || seq.Number != p.Book.SeqNum {
+			meta.AddNext("meta", attr("name", name), attr("content", content))
+		}
+		if epub3 {
+			id := "series"
+			if i > 0 {
+				id = fmt.Sprintf("series%d", i+1)
+			}
+			meta.AddNext("meta", attr("property", "belongs-to-collection"), attr("id", id)).SetText(seq.Name)
+			meta.AddNext("meta", attr("refines", "#"+id), attr("property", "collection-type")).SetText("series")
+			if seq.Number > 0 {
+				meta.AddNext("meta", attr("refines", "#"+id), attr("property", "group-position")).SetText(strconv.Itoa(seq.Number))
+			}
+		}
+	}
 
 	// Manifest generation
 
@@ -500,7 +802,20 @@ func (p *Processor) generateOPF() error {
 		if f.transient&dataNotForManifest != 0 {
 			continue
 		}
-		man.AddSame("item", attr("id", f.id), attr("media-type", f.ct), attr("href", f.fname))
+		attrs := append(make([]*etree.Attr, 0, 4), attr("id", f.id), attr("media-type", f.ct), attr("href", f.fname))
+		if epub3 {
+			var props []string
+			if f.id == "nav" {
+				props = append(props, "nav")
+			}
+			if f.doc != nil && f.doc.FindElement("//svg") != nil {
+				props = append(props, "svg")
+			}
+			if len(props) > 0 {
+				attrs = append(attrs, attr("properties", strings.Join(props, " ")))
+			}
+		}
+		man.AddSame("item", attrs...)
 	}
 
 	for i, f := range p.Book.Images {
@@ -537,7 +852,10 @@ func (p *Processor) generateOPF() error {
 
 	// Spine generation
 
-	spine := to.AddNext("spine", attr("toc", "ncx"), attr("page-map", "page-map"))
+	spine := to.AddNext("spine", attr("toc", "ncx"))
+	if !epub3 {
+		spine.CreateAttr("page-map", "page-map")
+	}
 
 	for _, f := range p.Book.Files {
 		id := f.id
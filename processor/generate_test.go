@@ -0,0 +1,573 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	gocontext "context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/state"
+)
+
+const opfTestDescription = `<title-info>
+<genre>sf_history</genre>
+<genre>humor</genre>
+<author><first-name>Иван</first-name><middle-name>Иванович</middle-name><last-name>Петров</last-name></author>
+<author><nickname>Аноним</nickname></author>
+<book-title>Тестовая книга</book-title>
+<annotation><p>Аннотация книги.</p></annotation>
+<keywords>первое, второе; третье</keywords>
+<date value="2001-02-03">2001</date>
+<lang>ru</lang>
+<src-lang>en</src-lang>
+<translator><first-name>Анна</first-name><last-name>Смирнова</last-name></translator>
+<sequence name="Серия" number="2"><sequence name="Подсерия" number="5"/></sequence>
+</title-info>
+<src-title-info>
+<genre>sf_history</genre>
+<author><first-name>John</first-name><last-name>Smith</last-name></author>
+<book-title>Test Book</book-title>
+<lang>en</lang>
+</src-title-info>
+<document-info>
+<author><nickname>tester</nickname></author>
+<program-used>test</program-used>
+<date>2020</date>
+<src-url>http://example.com/book</src-url>
+<id>11111111-2222-3333-4444-555555555555</id>
+<version>1.2</version>
+</document-info>
+<publish-info>
+<book-name>Книга</book-name>
+<publisher>Издательство</publisher>
+<city>Москва</city>
+<year>2005</year>
+<isbn>978-0-306-40615-7</isbn>
+<sequence name="Библиотека" number="7"/>
+</publish-info>
+<custom-info info-type="note">Заметка</custom-info>`
+
+// testFB2 returns book with specified description.
+func testFB2(description string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>` + description + `</description>
+<body><section><title><p>Глава</p></title><p>Текст.</p></section></body>
+</FictionBook>`
+}
+
+// generateTestOPF converts book to "format" and returns metadata of resulting package along with messages of all
+// logged warnings. Configuration could be adjusted by "setup".
+func generateTestOPF(t *testing.T, fb2 string, format OutputFmt, setup func(cfg *config.Config)) (*etree.Element, []string) {
+	t.Helper()
+
+	return generatePackageOPF(t, format, setup, func(env *state.LocalEnv) (*Processor, error) {
+		return NewFB2(strings.NewReader(fb2), false, "book.fb2", "", true, false, true, format, env)
+	})
+}
+
+// generatePackageOPF is generateTestOPF for book opened by "open".
+func generatePackageOPF(t *testing.T, format OutputFmt, setup func(cfg *config.Config), open func(env *state.LocalEnv) (*Processor, error)) (*etree.Element, []string) {
+	t.Helper()
+
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(cfg)
+	}
+	var log bytes.Buffer
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&log), zapcore.WarnLevel)
+	env := &state.LocalEnv{Cfg: cfg, Log: zap.New(core)}
+
+	p, err := open(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Clean()
+
+	ctx := gocontext.Background()
+	if err := p.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := p.SaveTo(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readXML := func(name string) *etree.Document {
+		for _, f := range z.File {
+			if f.Name != name {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			doc := etree.NewDocument()
+			if _, err := doc.ReadFrom(r); err != nil {
+				t.Fatal(err)
+			}
+			return doc
+		}
+		t.Fatalf("%s is missing", name)
+		return nil
+	}
+	rf := readXML("META-INF/container.xml").FindElement("//rootfile")
+	if rf == nil {
+		t.Fatal("no rootfile in container")
+	}
+	meta := readXML(getAttrValue(rf, "full-path")).FindElement("//metadata")
+	if meta == nil {
+		t.Fatal("no metadata in package")
+	}
+
+	var warnings []string
+	dec := json.NewDecoder(&log)
+	for {
+		var e struct {
+			Msg string `json:"msg"`
+		}
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		warnings = append(warnings, e.Msg)
+	}
+	return meta, warnings
+}
+
+// metaTexts returns text of all metadata elements with tag, satisfying "match".
+func metaTexts(meta *etree.Element, tag string, match func(e *etree.Element) bool) []string {
+	var res []string
+	for _, e := range meta.ChildElements() {
+		full := e.Tag
+		if len(e.Space) > 0 {
+			full = e.Space + ":" + e.Tag
+		}
+		if full == tag && (match == nil || match(e)) {
+			res = append(res, e.Text())
+		}
+	}
+	return res
+}
+
+// metaContent returns content of named meta elements.
+func metaContent(meta *etree.Element, name string) []string {
+	var res []string
+	for _, e := range meta.SelectElements("meta") {
+		if getAttrValue(e, "name") == name {
+			res = append(res, getAttrValue(e, "content"))
+		}
+	}
+	return res
+}
+
+// refines returns value of property refining element with specified id.
+func refines(meta *etree.Element, id, property string) string {
+	for _, e := range meta.SelectElements("meta") {
+		if getAttrValue(e, "refines") == "#"+id && getAttrValue(e, "property") == property {
+			return e.Text()
+		}
+	}
+	return ""
+}
+
+func hasAttr(name, value string) func(e *etree.Element) bool {
+	return func(e *etree.Element) bool {
+		return e.SelectAttrValue(name, "") == value
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOPFDescription(t *testing.T) {
+
+	fb2 := testFB2(opfTestDescription)
+	for _, format := range []OutputFmt{OEpub, OEpub3} {
+		t.Run(format.String(), func(t *testing.T) {
+			meta, warnings := generateTestOPF(t, fb2, format, nil)
+			if len(warnings) > 0 {
+				t.Errorf("unexpected warnings %q", warnings)
+			}
+
+			for _, c := range []struct {
+				tag   string
+				match func(e *etree.Element) bool
+				want  []string
+			}{
+				{"dc:title", nil, []string{"(С - 02) Тестовая книга"}},
+				{"dc:language", nil, []string{"ru"}},
+				{"dc:identifier", hasAttr("id", "BookId"), []string{"urn:uuid:11111111-2222-3333-4444-555555555555"}},
+				{"dc:publisher", nil, []string{"Издательство"}},
+				{"dc:date", nil, []string{"2005"}},
+				{"dc:source", nil, []string{"http://example.com/book"}},
+				{"dc:description", nil, []string{"Аннотация книги."}},
+			} {
+				if got := metaTexts(meta, c.tag, c.match); !equalStrings(got, c.want) {
+					t.Errorf("%s: %q, expected %q", c.tag, got, c.want)
+				}
+			}
+			subjects := strings.Join(metaTexts(meta, "dc:subject", nil), "|")
+			for _, k := range []string{"первое", "второе", "третье"} {
+				if !strings.Contains(subjects, "|"+k) {
+					t.Errorf("keyword %q is missing from subjects %q", k, subjects)
+				}
+			}
+
+			for name, want := range map[string]string{
+				"fb2:src-title":          "Test Book",
+				"fb2:src-authors":        "Smith John",
+				"fb2:src-lang":           "en",
+				"fb2:publish-book-name":  "Книга",
+				"fb2:publish-city":       "Москва",
+				"fb2:document-version":   "1.2",
+				"fb2:custom-info:note":   "Заметка",
+				"fb2:publisher-sequence": "Библиотека [7]",
+				"calibre:series":         "Серия",
+				"calibre:series_index":   "2",
+			} {
+				if got := metaContent(meta, name); len(got) != 1 || got[0] != want {
+					t.Errorf("%s: %q, expected %q", name, got, want)
+				}
+			}
+			if got := metaContent(meta, "fb2:sequence"); !equalStrings(got, []string{"Подсерия [5]"}) {
+				t.Errorf("fb2:sequence: %q", got)
+			}
+
+			if format == OEpub3 {
+				if got := metaTexts(meta, "dc:identifier", hasAttr("id", "isbn")); !equalStrings(got, []string{"urn:isbn:9780306406157"}) {
+					t.Errorf("isbn: %q", got)
+				}
+				if got := metaTexts(meta, "dc:contributor", nil); !equalStrings(got, []string{"Смирнова Анна", "tester"}) {
+					t.Errorf("contributors: %q", got)
+				}
+				for id, role := range map[string]string{"contributor1": "trl", "contributor2": "bkp", "creator1": "aut", "creator2": "aut"} {
+					if got := refines(meta, id, "role"); got != role {
+						t.Errorf("%s role %q, expected %q", id, got, role)
+					}
+				}
+				for id, want := range map[string]string{"series": "Серия", "series2": "Подсерия", "series3": "Библиотека"} {
+					if got := metaTexts(meta, "meta", hasAttr("id", id)); !equalStrings(got, []string{want}) {
+						t.Errorf("collection %s: %q, expected %q", id, got, want)
+					}
+				}
+				if got := refines(meta, "series2", "group-position"); got != "5" {
+					t.Errorf("collection position %q", got)
+				}
+			} else {
+				if got := metaTexts(meta, "dc:identifier", hasAttr("opf:scheme", "ISBN")); !equalStrings(got, []string{"9780306406157"}) {
+					t.Errorf("isbn: %q", got)
+				}
+				if got := metaTexts(meta, "dc:contributor", hasAttr("opf:role", "trl")); !equalStrings(got, []string{"Смирнова Анна"}) {
+					t.Errorf("translators: %q", got)
+				}
+				if got := metaTexts(meta, "dc:contributor", hasAttr("opf:role", "bkp")); !equalStrings(got, []string{"tester"}) {
+					t.Errorf("document authors: %q", got)
+				}
+				if got := metaTexts(meta, "dc:date", hasAttr("opf:event", "publication")); len(got) != 1 {
+					t.Errorf("publication date: %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestOPFISBN(t *testing.T) {
+
+	cases := []struct {
+		name, isbn, want, warning string
+	}{
+		{"valid ISBN-13", "978-0-306-40615-7", "9780306406157", ""},
+		{"valid ISBN-10", "0 8044 2957 x", "080442957X", ""},
+		{"wrong check digit", "978-0-306-40615-8", "9780306406158", "ISBN has wrong check digit, keeping it as is"},
+		{"not an ISBN", "нет", "", "Invalid ISBN, ignoring"},
+		{"no ISBN", "", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			desc := `<title-info><genre>humor</genre><author><nickname>a</nickname></author><book-title>b</book-title><lang>ru</lang></title-info>`
+			if len(c.isbn) > 0 {
+				desc += `<publish-info><isbn>` + c.isbn + `</isbn></publish-info>`
+			}
+			for _, format := range []OutputFmt{OEpub, OEpub3} {
+				meta, warnings := generateTestOPF(t, testFB2(desc), format, nil)
+
+				match, prefix := hasAttr("opf:scheme", "ISBN"), ""
+				if format == OEpub3 {
+					match, prefix = hasAttr("id", "isbn"), "urn:isbn:"
+				}
+				var want []string
+				if len(c.want) > 0 {
+					want = []string{prefix + c.want}
+				}
+				if got := metaTexts(meta, "dc:identifier", match); !equalStrings(got, want) {
+					t.Errorf("%s: isbn %q, expected %q", format, got, want)
+				}
+				var found bool
+				for _, w := range warnings {
+					found = found || w == c.warning
+				}
+				if len(c.warning) > 0 && !found {
+					t.Errorf("%s: expected warning %q, got %q", format, c.warning, warnings)
+				} else if len(c.warning) == 0 && len(warnings) > 0 {
+					t.Errorf("%s: unexpected warnings %q", format, warnings)
+				}
+			}
+		})
+	}
+}
+
+func TestOPFGenreSubjects(t *testing.T) {
+
+	desc := `<title-info><genre>sf_fantasy</genre><genre>humor_anecdote</genre><genre>my_genre</genre><author><nickname>a</nickname></author><book-title>b</book-title><lang>ru</lang></title-info>`
+
+	cases := []struct {
+		name      string
+		subjects  string
+		language  string
+		authority string
+		epub      []string // epub2 subjects
+		epub3     []string // epub3 subjects
+		terms     []string // epub3 subject refinements: id, authority, term
+		warning   string
+	}{
+		{name: "default", epub: []string{"Фэнтези", "Анекдоты", "my_genre"}},
+		{name: "name", subjects: "name", epub: []string{"Фэнтези", "Анекдоты", "my_genre"}},
+		{name: "name in english", subjects: "name", language: "en", epub: []string{"Fantasy", "Anecdote", "my_genre"}},
+		{name: "code", subjects: "code", epub: []string{"sf_fantasy", "humor_anecdote", "my_genre"}},
+		{name: "both", subjects: "Both", epub: []string{"Фэнтези", "sf_fantasy", "Анекдоты", "humor_anecdote", "my_genre"}},
+		{name: "unknown mode", subjects: "all", epub: []string{"Фэнтези", "Анекдоты", "my_genre"}, warning: "Unknown genre subjects mode requested, using genre names"},
+		{name: "bisac", subjects: "both", authority: "bisac",
+			epub:  []string{"Фэнтези", "sf_fantasy", "FIC009000", "Анекдоты", "humor_anecdote", "HUM000000", "my_genre"},
+			epub3: []string{"Фэнтези", "sf_fantasy", "Анекдоты", "humor_anecdote", "my_genre"},
+			terms: []string{"subject1", "BISAC", "FIC009000", "subject2", "BISAC", "HUM000000"}},
+		{name: "thema", subjects: "code", authority: "thema",
+			epub:  []string{"sf_fantasy", "FM", "humor_anecdote", "WH", "my_genre"},
+			epub3: []string{"sf_fantasy", "humor_anecdote", "my_genre"},
+			terms: []string{"subject1", "THEMA", "FM", "subject2", "THEMA", "WH"}},
+		{name: "unknown authority", subjects: "code", authority: "dewey", epub: []string{"sf_fantasy", "humor_anecdote", "my_genre"},
+			warning: "Unknown genre subject classification requested, turning off"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, format := range []OutputFmt{OEpub, OEpub3} {
+				meta, warnings := generateTestOPF(t, testFB2(desc), format, func(cfg *config.Config) {
+					cfg.Doc.Genres.Subjects = c.subjects
+					cfg.Doc.Genres.Language = c.language
+					cfg.Doc.Genres.Authority = c.authority
+				})
+				if len(c.warning) > 0 && !equalStrings(warnings, []string{c.warning}) || len(c.warning) == 0 && len(warnings) > 0 {
+					t.Errorf("%s: warnings %q, expected %q", format, warnings, c.warning)
+				}
+
+				want := c.epub
+				if format == OEpub3 && c.epub3 != nil {
+					want = c.epub3
+				}
+				if got := metaTexts(meta, "dc:subject", nil); !equalStrings(got, want) {
+					t.Errorf("%s: subjects %q, expected %q", format, got, want)
+				}
+				if format != OEpub3 {
+					continue
+				}
+				var terms []string
+				for _, e := range meta.SelectElements("dc:subject") {
+					if id := getAttrValue(e, "id"); len(id) > 0 {
+						terms = append(terms, id, refines(meta, id, "authority"), refines(meta, id, "term"))
+					}
+				}
+				if !equalStrings(terms, c.terms) {
+					t.Errorf("%s: subject terms %q, expected %q", format, terms, c.terms)
+				}
+			}
+		})
+	}
+}
+
+func TestOPFSequences(t *testing.T) {
+
+	desc := `<title-info><genre>humor</genre><author><nickname>a</nickname></author><book-title>Книга</book-title><lang>ru</lang>
+<sequence name="Цикл" number="3"><sequence name="Подцикл"><sequence name="Часть" number="1"/></sequence></sequence>
+<sequence name="Другой цикл" number="7"/>
+<sequence number="9"/>
+</title-info>
+<publish-info><sequence name="Библиотека" number="12"/></publish-info>`
+
+	for _, format := range []OutputFmt{OEpub, OEpub3} {
+		meta, warnings := generateTestOPF(t, testFB2(desc), format, nil)
+		if len(warnings) > 0 {
+			t.Errorf("%s: unexpected warnings %q", format, warnings)
+		}
+
+		// calibre supports single series
+		if got := metaContent(meta, "calibre:series"); !equalStrings(got, []string{"Цикл"}) {
+			t.Errorf("%s: calibre series %q", format, got)
+		}
+		if got := metaContent(meta, "calibre:series_index"); !equalStrings(got, []string{"3"}) {
+			t.Errorf("%s: calibre series index %q", format, got)
+		}
+		if got := metaContent(meta, "fb2:sequence"); !equalStrings(got, []string{"Подцикл", "Часть [1]", "Другой цикл [7]"}) {
+			t.Errorf("%s: sequences %q", format, got)
+		}
+		if got := metaContent(meta, "fb2:publisher-sequence"); !equalStrings(got, []string{"Библиотека [12]"}) {
+			t.Errorf("%s: publisher sequences %q", format, got)
+		}
+
+		var collections []string
+		for _, e := range meta.SelectElements("meta") {
+			if getAttrValue(e, "property") != "belongs-to-collection" {
+				continue
+			}
+			id := getAttrValue(e, "id")
+			collections = append(collections, id, e.Text(), refines(meta, id, "collection-type"), refines(meta, id, "group-position"))
+		}
+		var want []string
+		if format == OEpub3 {
+			want = []string{
+				"series", "Цикл", "series", "3",
+				"series2", "Подцикл", "series", "",
+				"series3", "Часть", "series", "1",
+				"series4", "Другой цикл", "series", "7",
+				"series5", "Библиотека", "series", "12",
+			}
+		}
+		if !equalStrings(collections, want) {
+			t.Errorf("%s: collections %q, expected %q", format, collections, want)
+		}
+	}
+}
+
+func TestOPFAuthors(t *testing.T) {
+
+	desc := `<title-info><genre>humor</genre>
+<author><first-name>Иван</first-name><middle-name>Иванович</middle-name><last-name>Петров</last-name><home-page>http://petrov.example.com</home-page><email>petrov@example.com</email><id>a1</id></author>
+<author><nickname>Аноним</nickname></author>
+<author><first-name>Мария</first-name><last-name>Сидорова</last-name></author>
+<book-title>Книга</book-title><lang>ru</lang>
+<translator><first-name>Анна</first-name><middle-name>Петровна</middle-name><last-name>Смирнова</last-name><email>smirnova@example.com</email></translator>
+</title-info>
+<document-info><author><nickname>tester</nickname></author></document-info>`
+
+	setup := func(cfg *config.Config) {
+		cfg.Doc.AuthorFormatMeta = "{#f }#l"
+		cfg.Doc.AuthorFormatTrl = "{#fi }{#mi }#l"
+		cfg.Doc.AuthorFormatSort = "#l{, #f}"
+	}
+	for _, format := range []OutputFmt{OEpub, OEpub3} {
+		meta, warnings := generateTestOPF(t, testFB2(desc), format, setup)
+		if len(warnings) > 0 {
+			t.Errorf("%s: unexpected warnings %q", format, warnings)
+		}
+
+		if got := metaTexts(meta, "dc:creator", nil); !equalStrings(got, []string{"Иван Петров", "Аноним", "Мария Сидорова"}) {
+			t.Errorf("%s: creators %q", format, got)
+		}
+		if got := metaContent(meta, "calibre:author_sort"); !equalStrings(got, []string{"Петров, Иван & Аноним & Сидорова, Мария"}) {
+			t.Errorf("%s: author sort %q", format, got)
+		}
+		// contacts are only attached to epub3 persons, epub2 has no place for them
+		for _, e := range meta.SelectElements("meta") {
+			if strings.Contains(getAttrValue(e, "content"), "example.com") || format == OEpub && strings.Contains(e.Text(), "example.com") {
+				t.Errorf("%s: unexpected contact %s", format, getXMLFragmentFromElement(e))
+			}
+		}
+
+		if format == OEpub3 {
+			for _, c := range []struct{ id, property, want string }{
+				{"creator1", "schema:url", "http://petrov.example.com"},
+				{"creator1", "schema:email", "petrov@example.com"},
+				{"creator1", "schema:identifier", "a1"},
+				{"creator2", "schema:email", ""},
+				{"contributor1", "schema:email", "smirnova@example.com"},
+			} {
+				if got := refines(meta, c.id, c.property); got != c.want {
+					t.Errorf("%s: %s %s %q, expected %q", format, c.id, c.property, got, c.want)
+				}
+			}
+			for id, want := range map[string]string{
+				"creator1":     "Петров, Иван",
+				"creator2":     "Аноним",
+				"creator3":     "Сидорова, Мария",
+				"contributor1": "Смирнова, Анна",
+				"contributor2": "tester",
+			} {
+				if got := refines(meta, id, "file-as"); got != want {
+					t.Errorf("%s: %s file-as %q, expected %q", format, id, got, want)
+				}
+			}
+			if got := metaTexts(meta, "dc:contributor", nil); !equalStrings(got, []string{"А. П. Смирнова", "tester"}) {
+				t.Errorf("%s: contributors %q", format, got)
+			}
+			continue
+		}
+		var fileAs []string
+		for _, e := range meta.ChildElements() {
+			if e.Space == "dc" && (e.Tag == "creator" || e.Tag == "contributor") {
+				fileAs = append(fileAs, e.SelectAttrValue("opf:role", ""), e.SelectAttrValue("opf:file-as", ""), e.Text())
+			}
+		}
+		want := []string{
+			"aut", "Петров, Иван", "Иван Петров",
+			"aut", "Аноним", "Аноним",
+			"aut", "Сидорова, Мария", "Мария Сидорова",
+			"trl", "Смирнова, Анна", "А. П. Смирнова",
+			"bkp", "tester", "tester",
+		}
+		if !equalStrings(fileAs, want) {
+			t.Errorf("%s: persons %q, expected %q", format, fileAs, want)
+		}
+	}
+}
+
+func TestOPFIllustrators(t *testing.T) {
+
+	data := makeFB3(t, testFB3Files(t))
+	setup := func(cfg *config.Config) {
+		cfg.Doc.AuthorFormatIll = "худ. #l"
+	}
+	for _, format := range []OutputFmt{OEpub, OEpub3} {
+		meta, _ := generatePackageOPF(t, format, setup, func(env *state.LocalEnv) (*Processor, error) {
+			return NewFB3(bytes.NewReader(data), "book.fb3", "", true, false, true, format, env)
+		})
+
+		var got []string
+		for _, e := range meta.SelectElements("dc:contributor") {
+			role := e.SelectAttrValue("opf:role", "")
+			if format == OEpub3 {
+				role = refines(meta, getAttrValue(e, "id"), "role")
+			}
+			if role == "ill" {
+				got = append(got, e.Text())
+			}
+		}
+		if !equalStrings(got, []string{"худ. Художник"}) {
+			t.Errorf("%s: illustrators %q", format, got)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package processor
+
+import (
+	"strings"
+)
+
+// genreInfo describes single FB2 genre code. Groups (top level of hierarchy) are genres themselves with empty parent.
+// Subject codes are optional, when absent the parent ones are used.
+type genreInfo struct {
+	parent string
+	en     string
+	ru     string
+	bisac  string
+	thema  string
+}
+
+// fb2Genres is the FB2 2.1 genre list with the most common extensions used by librusec derived libraries.
+var fb2Genres = map[string]genreInfo{
+	// Science Fiction & Fantasy
+	"sf":                 {"", "Science Fiction", "Фантастика", "FIC028000", "FL"},
+	"sf_history":         {"sf", "Alternative History", "Альтернативная история", "FIC040000", ""},
+	"sf_action":          {"sf", "Action Science Fiction", "Боевая фантастика", "FIC028010", "FLR"},
+	"sf_epic":            {"sf", "Epic Science Fiction", "Эпическая фантастика", "FIC028000", "FL"},
+	"sf_heroic":          {"sf", "Heroic Fantasy", "Героическая фантастика", "FIC009000", "FMB"},
+	"sf_detective":       {"sf", "Science Fiction Detective", "Детективная фантастика", "FIC028000", "FL"},
+	"sf_cyberpunk":       {"sf", "Cyberpunk", "Киберпанк", "", "FLPB"},
+	"sf_space":           {"sf", "Space Science Fiction", "Космическая фантастика", "FIC028030", "FLS"},
+	"sf_social":          {"sf", "Social Science Fiction", "Социально-психологическая фантастика", "FIC028000", "FL"},
+	"sf_horror":          {"sf", "Horror & Mystic", "Ужасы и мистика", "FIC015000", "FK"},
+	"sf_humor":           {"sf", "Humorous Science Fiction", "Юмористическая фантастика", "", ""},
+	"sf_fantasy":         {"sf", "Fantasy", "Фэнтези", "FIC009000", "FM"},
+	"sf_fantasy_city":    {"sf", "Urban Fantasy", "Городское фэнтези", "", ""},
+	"sf_postapocalyptic": {"sf", "Post-Apocalyptic", "Постапокалипсис", "FIC028070", "FLQ"},
+	"sf_stimpank":        {"sf", "Steampunk", "Стимпанк", "", "FLM"},
+	"sf_mystic":          {"sf", "Mystic", "Мистика", "FIC024000", "FK"},
+	"sf_etc":             {"sf", "Other Science Fiction", "Фантастика: прочее", "", ""},
+	"popadanec":          {"sf", "Time Travel", "Попаданцы", "", "FLG"},
+	"fantasy_fight":      {"sf", "Action Fantasy", "Боевое фэнтези", "FIC009000", "FM"},
+	"fairy_fantasy":      {"sf", "Fairy Tale Fantasy", "Мифологическое фэнтези", "FIC009000", "FM"},
+	"hronoopera":         {"sf", "Chrono Opera", "Хроноопера", "", "FLG"},
+	"love_sf":            {"sf", "Romantic Fantasy", "Любовное фэнтези", "FIC027030", "FRT"},
+	"humor_fantasy":      {"sf", "Humorous Fantasy", "Юмористическое фэнтези", "FIC009000", "FM"},
+	// Detectives & Thrillers
+	"detective":     {"", "Detective", "Детективы", "FIC022000", "FF"},
+	"det_classic":   {"detective", "Classical Detective", "Классический детектив", "FIC022030", "FFC"},
+	"det_police":    {"detective", "Police Procedural", "Полицейский детектив", "FIC022020", "FFP"},
+	"det_action":    {"detective", "Action Detective", "Боевик", "FIC002000", "FJ"},
+	"det_irony":     {"detective", "Ironical Detective", "Иронический детектив", "", "FFK"},
+	"det_history":   {"detective", "Historical Detective", "Исторический детектив", "FIC022060", "FFH"},
+	"det_espionage": {"detective", "Espionage Detective", "Шпионский детектив", "FIC006000", "FHD"},
+	"det_crime":     {"detective", "Crime Detective", "Криминальный детектив", "FIC022000", "FF"},
+	"det_political": {"detective", "Political Detective", "Политический детектив", "FIC031060", "FHP"},
+	"det_maniac":    {"detective", "Maniacs", "Про маньяков", "FIC031000", "FH"},
+	"det_hard":      {"detective", "Hard-boiled Detective", "Крутой детектив", "FIC022010", "FFL"},
+	"det_cozy":      {"detective", "Cozy Mystery", "Уютный детектив", "FIC022070", "FFJ"},
+	"thriller":      {"detective", "Thriller", "Триллер", "FIC031000", "FH"},
+	// Prose
+	"prose":                {"", "Prose", "Проза", "FIC000000", "FB"},
+	"prose_classic":        {"prose", "Classics Prose", "Классическая проза", "FIC004000", "FBC"},
+	"prose_history":        {"prose", "Historical Prose", "Историческая проза", "FIC014000", "FV"},
+	"prose_contemporary":   {"prose", "Contemporary Prose", "Современная проза", "FIC019000", "FBA"},
+	"prose_counter":        {"prose", "Counterculture", "Контркультура", "FIC019000", "FBA"},
+	"prose_rus_classic":    {"prose", "Russian Classics", "Русская классическая проза", "FIC004000", "FBC"},
+	"prose_su_classics":    {"prose", "Soviet Classics", "Советская классическая проза", "FIC004000", "FBC"},
+	"prose_military":       {"prose", "Military Prose", "Проза о войне", "FIC032000", "FJM"},
+	"prose_magic":          {"prose", "Magical Realism", "Магический реализм", "FIC061000", ""},
+	"prose_abs":            {"prose", "Absurdist Fiction", "Фантасмагория, абсурдистская проза", "FIC019000", "FBA"},
+	"prose_neformatny":     {"prose", "Experimental Fiction", "Неформатная проза", "FIC019000", "FBA"},
+	"russian_contemporary": {"prose", "Russian Contemporary Prose", "Современная русская проза", "FIC019000", "FBA"},
+	"foreign_contemporary": {"prose", "Foreign Contemporary Prose", "Современная зарубежная проза", "FIC019000", "FBA"},
+	"aphorisms":            {"prose", "Aphorisms", "Афоризмы", "LCO000000", "DN"},
+	"epistolary_fiction":   {"prose", "Epistolary Fiction", "Эпистолярная проза", "FIC019000", "FBA"},
+	"essay":                {"prose", "Essay", "Эссе, очерк, этюд, набросок", "LCO010000", "DNL"},
+	"story":                {"prose", "Short Story", "Малые литературные формы прозы", "FIC029000", "FYB"},
+	"sagas":                {"prose", "Saga", "Семейный роман/Семейная сага", "FIC008000", ""},
+	"network_literature":   {"prose", "Network Literature", "Сетевая литература", "", ""},
+	// Romance
+	"love":              {"", "Romance", "Любовные романы", "FIC027000", "FR"},
+	"love_contemporary": {"love", "Contemporary Romance", "Современные любовные романы", "FIC027020", "FRD"},
+	"love_history":      {"love", "Historical Romance", "Исторические любовные романы", "FIC027050", "FRH"},
+	"love_detective":    {"love", "Detective Romance", "Остросюжетные любовные романы", "FIC027110", ""},
+	"love_short":        {"love", "Short Romance", "Короткие любовные романы", "FIC027000", "FR"},
+	"love_erotica":      {"love", "Erotica", "Эротика", "FIC005000", "FP"},
+	"love_hard":         {"love", "Adult Romance", "Порно", "FIC005000", "FP"},
+	// Adventure
+	"adventure":    {"", "Adventure", "Приключения", "FIC002000", "FJ"},
+	"adv_western":  {"adventure", "Western", "Вестерн", "FIC033000", "FJW"},
+	"adv_history":  {"adventure", "History Adventure", "Исторические приключения", "FIC014000", "FJH"},
+	"adv_indian":   {"adventure", "Indians", "Приключения про индейцев", "FIC002000", "FJ"},
+	"adv_maritime": {"adventure", "Maritime Fiction", "Морские приключения", "FIC047000", ""},
+	"adv_geo":      {"adventure", "Travel & Geography", "Путешествия и география", "FIC002000", "FJ"},
+	"adv_animal":   {"adventure", "Nature & Animals", "Природа и животные", "FIC002000", "FJ"},
+	"adv_modern":   {"adventure", "Modern Adventure", "Приключения в современном мире", "FIC002000", "FJ"},
+	// Children
+	"children":        {"", "Children's", "Детское", "JUV000000", "YF"},
+	"child_tale":      {"children", "Fairy Tales", "Сказка", "JUV012000", "YFJ"},
+	"child_verse":     {"children", "Verses", "Детские стихи", "JUV070000", "YDP"},
+	"child_prose":     {"children", "Prose for Kids", "Детская проза", "JUV000000", "YF"},
+	"child_sf":        {"children", "Science Fiction for Kids", "Детская фантастика", "JUV053000", "YFG"},
+	"child_det":       {"children", "Detectives & Thrillers", "Детские остросюжетные", "JUV028000", "YFCF"},
+	"child_adv":       {"children", "Adventures for Kids", "Детские приключения", "JUV001000", "YFC"},
+	"child_education": {"children", "Education for Kids", "Детская образовательная литература", "JNF000000", "YP"},
+	"child_folklore":  {"children", "Children's Folklore", "Детский фольклор", "JUV012000", "YFJ"},
+	// Poetry & Dramaturgy
+	"poetry":           {"", "Poetry", "Поэзия", "POE000000", "DC"},
+	"poetry_classical": {"poetry", "Classical Poetry", "Классическая поэзия", "POE000000", "DCF"},
+	"poetry_modern":    {"poetry", "Modern Poetry", "Современная поэзия", "POE000000", "DCF"},
+	"poetry_east":      {"poetry", "Eastern Poetry", "Поэзия Востока", "POE000000", "DC"},
+	"lyrics":           {"poetry", "Lyrics", "Лирика", "POE000000", "DC"},
+	"poem":             {"poetry", "Poem", "Поэма, эпическая поэзия", "", ""},
+	"song_poetry":      {"poetry", "Song Poetry", "Песенная поэзия", "POE000000", "DC"},
+	"humor_verse":      {"poetry", "Humorous Verses", "Юмористические стихи", "POE000000", "DCF"},
+	"dramaturgy":       {"", "Dramaturgy", "Драматургия", "DRA000000", "DD"},
+	"comedy":           {"dramaturgy", "Comedy", "Комедия", "DRA000000", "DD"},
+	"drama":            {"dramaturgy", "Drama", "Драма", "DRA000000", "DD"},
+	"tragedy":          {"dramaturgy", "Tragedy", "Трагедия", "DRA000000", "DD"},
+	"screenplays":      {"dramaturgy", "Screenplays", "Сценарий", "PER004000", ""},
+	// Antique literature & Folklore
+	"antique":          {"", "Antique Literature", "Старинное", "FIC004000", "FBC"},
+	"antique_ant":      {"antique", "Antique", "Античная литература", "LCO003000", "DB"},
+	"antique_european": {"antique", "European Antique Literature", "Европейская старинная литература", "FIC004000", "DB"},
+	"antique_russian":  {"antique", "Old Russian Literature", "Древнерусская литература", "FIC004000", "DB"},
+	"antique_east":     {"antique", "Old East Literature", "Древневосточная литература", "FIC004000", "DB"},
+	"antique_myths":    {"antique", "Myths & Legends", "Мифы, легенды, эпос", "FIC010000", "FN"},
+	"folklore":         {"", "Folklore", "Фольклор", "FIC010000", "FN"},
+	"epic":             {"folklore", "Epic", "Былины", "FIC010000", "FN"},
+	"folk_songs":       {"folklore", "Folk Songs", "Народные песни", "FIC010000", "FN"},
+	"folk_tale":        {"folklore", "Folk Tales", "Народные сказки", "FIC010000", "FN"},
+	"proverbs":         {"folklore", "Proverbs", "Пословицы, поговорки", "FIC010000", "FN"},
+	"riddles":          {"folklore", "Riddles", "Загадки", "FIC010000", "FN"},
+	// Science & Education
+	"science":            {"", "Science", "Научная литература", "SCI000000", "P"},
+	"sci_history":        {"science", "History", "История", "HIS000000", "NH"},
+	"sci_psychology":     {"science", "Psychology", "Психология", "PSY000000", "JM"},
+	"sci_culture":        {"science", "Cultural Science", "Культурология", "SOC000000", "JBC"},
+	"sci_religion":       {"science", "Religious Studies", "Религиоведение", "REL000000", "QRA"},
+	"sci_philosophy":     {"science", "Philosophy", "Философия", "PHI000000", "QD"},
+	"sci_politics":       {"science", "Politics", "Политика", "POL000000", "JP"},
+	"sci_business":       {"science", "Business Literature", "Деловая литература", "BUS000000", "KJ"},
+	"sci_juris":          {"science", "Jurisprudence", "Юриспруденция", "LAW000000", "L"},
+	"sci_linguistic":     {"science", "Linguistics", "Языкознание", "LAN000000", "CF"},
+	"sci_medicine":       {"science", "Medicine", "Медицина", "MED000000", "M"},
+	"sci_phys":           {"science", "Physics", "Физика", "SCI055000", "PH"},
+	"sci_math":           {"science", "Mathematics", "Математика", "MAT000000", "PB"},
+	"sci_chem":           {"science", "Chemistry", "Химия", "SCI013000", "PN"},
+	"sci_biology":        {"science", "Biology", "Биология", "SCI008000", "PS"},
+	"sci_tech":           {"science", "Technical", "Технические науки", "TEC000000", "T"},
+	"sci_economy":        {"science", "Economics", "Экономика", "BUS069000", "KC"},
+	"sci_state":          {"science", "State & Law", "Государство и право", "LAW000000", "L"},
+	"sci_pedagogy":       {"science", "Pedagogy", "Педагогика", "EDU000000", "JN"},
+	"sci_philology":      {"science", "Philology", "Литературоведение", "LIT000000", "DS"},
+	"sci_cosmos":         {"science", "Astronomy & Space", "Астрономия и космос", "SCI004000", "PG"},
+	"sci_geo":            {"science", "Geology & Geography", "Геология и география", "SCI031000", "RG"},
+	"sci_ecology":        {"science", "Ecology", "Экология", "SCI026000", "RN"},
+	"sci_zoo":            {"science", "Zoology", "Зоология", "SCI070000", "PSV"},
+	"sci_botany":         {"science", "Botany", "Ботаника", "SCI011000", "PST"},
+	"sci_biochem":        {"science", "Biochemistry", "Биохимия", "SCI007000", "PSB"},
+	"sci_social_studies": {"science", "Social Studies", "Обществознание, социология", "SOC000000", "JH"},
+	"sci_popular":        {"science", "Popular Science", "Научно-популярная литература", "SCI000000", "P"},
+	"sci_textbook":       {"science", "Textbooks", "Учебники и пособия", "EDU000000", ""},
+	"military_history":   {"science", "Military History", "Военная история", "HIS027000", "NHW"},
+	"military_weapon":    {"science", "Weapons", "Военная техника и вооружение", "HIS027000", "JW"},
+	"military_special":   {"science", "Military Science", "Военное дело", "HIS027000", "JW"},
+	// Computers & Internet
+	"computers":        {"", "Computers", "Компьютеры и Интернет", "COM000000", "U"},
+	"comp_www":         {"computers", "Internet", "Интернет", "COM060000", "UD"},
+	"comp_programming": {"computers", "Programming", "Программирование", "COM051000", "UM"},
+	"comp_hard":        {"computers", "Hardware", "Компьютерное железо", "COM067000", "UK"},
+	"comp_soft":        {"computers", "Software", "Программы", "", ""},
+	"comp_db":          {"computers", "Databases", "Базы данных", "COM021000", "UN"},
+	"comp_osnet":       {"computers", "OS & Networking", "ОС и Сети", "COM046000", "UL"},
+	// Reference
+	"reference":  {"", "Reference", "Справочная литература", "", ""},
+	"ref_encyc":  {"reference", "Encyclopedias", "Энциклопедии", "REF007000", "GBC"},
+	"ref_dict":   {"reference", "Dictionaries", "Словари", "REF008000", "GBCD"},
+	"ref_ref":    {"reference", "Reference", "Справочники", "", ""},
+	"ref_guide":  {"reference", "Guidebooks", "Руководства", "", ""},
+	"geo_guides": {"reference", "Travel Guides", "Путеводители", "TRV000000", "WTH"},
+	// Nonfiction
+	"nonfiction":        {"", "Nonfiction", "Документальная литература", "", ""},
+	"nonf_biography":    {"nonfiction", "Biography & Memoirs", "Биографии и мемуары", "BIO000000", "DNB"},
+	"nonf_publicism":    {"nonfiction", "Publicism", "Публицистика", "SOC000000", "DNL"},
+	"nonf_criticism":    {"nonfiction", "Criticism", "Критика", "LIT000000", "DS"},
+	"nonf_military":     {"nonfiction", "Military Documentary", "Военная документалистика", "HIS027000", "NHW"},
+	"travel_notes":      {"nonfiction", "Travel Notes", "Путевые заметки", "TRV000000", "WTL"},
+	"design":            {"nonfiction", "Art & Design", "Искусство и Дизайн", "DES000000", "AK"},
+	"art_criticism":     {"nonfiction", "Art Criticism", "Искусствоведение", "ART000000", "A"},
+	"architecture_book": {"nonfiction", "Architecture", "Архитектура", "ARC000000", "AM"},
+	"cine":              {"nonfiction", "Cinema", "Кино", "PER004000", "ATF"},
+	"music":             {"nonfiction", "Music", "Музыка", "MUS000000", "AV"},
+	"theatre":           {"nonfiction", "Theatre", "Театр", "PER011000", "ATD"},
+	"visual_arts":       {"nonfiction", "Visual Arts", "Изобразительное искусство, фотография", "ART000000", "A"},
+	// Religion & Spirituality
+	"religion":               {"", "Religion & Spirituality", "Религия и духовность", "REL000000", "QR"},
+	"religion_rel":           {"religion", "Religion", "Религия", "", ""},
+	"religion_esoterics":     {"religion", "Esoterics", "Эзотерика", "OCC000000", "VX"},
+	"religion_self":          {"religion", "Self-improvement", "Самосовершенствование", "SEL000000", "VS"},
+	"religion_orthodoxy":     {"religion", "Orthodoxy", "Православие", "REL049000", "QRMB2"},
+	"religion_christianity":  {"religion", "Christianity", "Христианство", "REL070000", "QRM"},
+	"religion_catholicism":   {"religion", "Catholicism", "Католицизм", "REL010000", "QRMB1"},
+	"religion_protestantism": {"religion", "Protestantism", "Протестантизм", "REL053000", "QRMB3"},
+	"religion_islam":         {"religion", "Islam", "Ислам", "REL037000", "QRP"},
+	"religion_judaism":       {"religion", "Judaism", "Иудаизм", "REL040000", "QRJ"},
+	"religion_buddhism":      {"religion", "Buddhism", "Буддизм", "REL007000", "QRF"},
+	"religion_hinduism":      {"religion", "Hinduism", "Индуизм", "REL032000", "QRD"},
+	"religion_paganism":      {"religion", "Paganism", "Язычество", "", ""},
+	// Humor
+	"humor":          {"", "Humor", "Юмор", "HUM000000", "WH"},
+	"humor_anecdote": {"humor", "Anecdote", "Анекдоты", "", ""},
+	"humor_prose":    {"humor", "Humor Prose", "Юмористическая проза", "FIC016000", "FU"},
+	"humor_satire":   {"humor", "Satire", "Сатира", "FIC052000", "FUP"},
+	// Home & Family
+	"home":            {"", "Home & Family", "Дом и семья", "FAM000000", "WK"},
+	"home_cooking":    {"home", "Cooking", "Кулинария", "CKB000000", "WB"},
+	"home_pets":       {"home", "Pets", "Домашние животные", "PET000000", "WNG"},
+	"home_crafts":     {"home", "Hobbies & Crafts", "Хобби и ремесла", "CRA000000", "WF"},
+	"home_entertain":  {"home", "Entertaining", "Развлечения", "GAM000000", "WD"},
+	"home_health":     {"home", "Health", "Здоровье", "HEA000000", "VF"},
+	"home_garden":     {"home", "Garden", "Сад и огород", "GAR000000", "WM"},
+	"home_diy":        {"home", "Do It Yourself", "Сделай сам", "HOM000000", "WK"},
+	"home_sport":      {"home", "Sports", "Спорт", "SPO000000", "S"},
+	"home_sex":        {"home", "Erotica & Sex", "Эротика, Секс", "HEA042000", "VFV"},
+	"home_collecting": {"home", "Collecting", "Коллекционирование", "ANT000000", "WC"},
+	// Economics & Business
+	"economics":        {"", "Economics & Business", "Экономика и бизнес", "BUS000000", "K"},
+	"banking":          {"economics", "Banking", "Банковское дело", "BUS004000", "KFF"},
+	"accounting":       {"economics", "Accounting", "Бухучет и аудит", "BUS001000", "KFC"},
+	"marketing":        {"economics", "Marketing", "Маркетинг, PR, реклама", "BUS043000", "KJS"},
+	"management":       {"economics", "Management", "Управление, подбор персонала", "BUS041000", "KJM"},
+	"personal_finance": {"economics", "Personal Finance", "Личные финансы", "BUS050000", "VSB"},
+	"real_estate":      {"economics", "Real Estate", "Недвижимость", "BUS054000", ""},
+	"small_business":   {"economics", "Small Business", "Малый бизнес", "BUS060000", "KJH"},
+	"stock":            {"economics", "Stock", "Ценные бумаги, инвестиции", "BUS036000", "KFFM"},
+	"trade":            {"economics", "Trade", "Торговля", "", ""},
+	// Other
+	"other":        {"", "Other", "Неотсортированное", "", ""},
+	"unfinished":   {"other", "Unfinished", "Недописанное", "", ""},
+	"unrecognised": {"other", "Unrecognised", "Неизвестный жанр", "", ""},
+}
+
+// normalizeGenre brings genre code to the form used in genre table.
+func normalizeGenre(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+// GenreName returns name of the genre in requested language ("ru" or anything else for English). Unknown codes are returned
+// unchanged.
+func GenreName(code, lang string) string {
+	g, ok := fb2Genres[normalizeGenre(code)]
+	if !ok {
+		return code
+	}
+	if lang == "ru" {
+		return g.ru
+	}
+	return g.en
+}
+
+// GenreGroup returns code of the top level genre code belongs to. Unknown codes are returned unchanged.
+func GenreGroup(code string) string {
+	code = normalizeGenre(code)
+	for g, ok := fb2Genres[code]; ok && len(g.parent) > 0; g, ok = fb2Genres[code] {
+		code = g.parent
+	}
+	return code
+}
+
+// genreSubject returns subject code of the genre according to requested classification, when genre does not have it its
+// parents are consulted.
+func genreSubject(code string, authority GenreAuthority) string {
+	code = normalizeGenre(code)
+	for g, ok := fb2Genres[code]; ok; g, ok = fb2Genres[code] {
+		var subject string
+		switch authority {
+		case GenreAuthorityBISAC:
+			subject = g.bisac
+		case GenreAuthorityThema:
+			subject = g.thema
+		}
+		if len(subject) > 0 || len(g.parent) == 0 {
+			return subject
+		}
+		code = g.parent
+	}
+	return ""
+}
@@ -0,0 +1,210 @@
+package processor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// HTML void elements, everything else has to have closing tag or browser will not be able to parse our XHTML as HTML.
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// FinalizeHTML produces single self-contained html file out of previously saved temporary files.
+func (p *Processor) FinalizeHTML(fname string) error {
+
+	if err := p.prepareOutputFile(fname); err != nil {
+		return err
+	}
+
+	// content types of everything we may want to embed
+	types := make(map[string]string)
+	for _, b := range p.Book.Images {
+		types[path.Join(DirImages, b.fname)] = b.ct
+	}
+	for _, b := range p.Book.Vignettes {
+		types[path.Join(DirVignettes, b.fname)] = b.ct
+	}
+	for _, d := range p.Book.Data {
+		rel := strings.TrimPrefix(strings.TrimPrefix(d.relpath, DirContent), string(filepath.Separator))
+		types[path.Join(filepath.ToSlash(rel), d.fname)] = d.ct
+	}
+
+	embed := func(ref string) (string, bool) {
+		name := path.Clean(ref)
+		if strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return ref, false
+		}
+		data, err := os.ReadFile(filepath.Join(p.tmpDir, DirContent, filepath.FromSlash(name)))
+		if err != nil {
+			p.env.Log.Warn("Unable to embed resource, leaving reference as is", zap.String("ref", ref), zap.Error(err))
+			return ref, false
+		}
+		ct, ok := types[name]
+		if !ok || len(ct) == 0 {
+			if ct = mime.TypeByExtension(path.Ext(name)); len(ct) == 0 {
+				ct = "application/octet-stream"
+			}
+		}
+		return "data:" + ct + ";base64," + base64.StdEncoding.EncodeToString(data), true
+	}
+
+	// every source file gets anchor, so links to file itself will still work
+	anchors := make(map[string]string)
+	for _, f := range p.Book.Files {
+		if f.transient&dataNotForSpline == 0 {
+			anchors[f.fname] = "file_" + strings.TrimSuffix(f.fname, filepath.Ext(f.fname))
+		}
+	}
+
+	doc := etree.NewDocument()
+	doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+	doc.CreateDirective("DOCTYPE html")
+
+	html := doc.Element.AddNext("html",
+		attr("xmlns", `http://www.w3.org/1999/xhtml`),
+		attr("lang", p.Book.Lang.String()),
+	)
+
+	head := html.AddNext("head")
+	head.AddNext("meta", attr("charset", "utf-8"))
+	head.AddNext("title").SetText(p.Book.Title)
+
+	// for HTML parsers style element content is raw text, which must not be escaped, so stylesheets are put in place after
+	// document is serialized
+	var styles []string
+	for _, d := range p.Book.Data {
+		if d.id != "style" {
+			continue
+		}
+		css := p.embedStylesheet(string(d.data), embed)
+		// closing tag anywhere in the text would end style element
+		styles = append(styles, strings.ReplaceAll(css, "</", `<\/`))
+		head.AddNext("style", attr("type", "text/css")).SetText(fmt.Sprintf("fb2c-stylesheet-%d", len(styles)-1))
+	}
+
+	body := html.AddNext("body")
+	for _, f := range p.Book.Files {
+		if f.transient&dataNotForSpline != 0 || f.doc == nil {
+			continue
+		}
+		from := f.doc.FindElement("./html/body")
+		if from == nil {
+			continue
+		}
+		to := body.AddNext("div", attr("id", anchors[f.fname]))
+		for _, c := range from.ChildElements() {
+			to.AddChild(c.Copy())
+		}
+		p.inlineHTML(to, f.fname, anchors, embed)
+	}
+
+	closeHTMLElements(html)
+
+	doc.IndentTabs()
+	out, err := doc.WriteToString()
+	if err != nil {
+		return fmt.Errorf("unable to write HTML (%s): %w", fname, err)
+	}
+	// head precedes any book text, so first occurrence is always ours
+	for i, css := range styles {
+		out = strings.Replace(out, fmt.Sprintf("fb2c-stylesheet-%d", i), css, 1)
+	}
+	if err := os.WriteFile(fname, []byte(out), 0644); err != nil {
+		return fmt.Errorf("unable to write HTML (%s): %w", fname, err)
+	}
+	return nil
+}
+
+// inlineHTML rewrites references of the content file to point inside of single page.
+func (p *Processor) inlineHTML(e *etree.Element, fname string, anchors map[string]string, embed func(string) (string, bool)) {
+
+	for _, c := range e.ChildElements() {
+		p.inlineHTML(c, fname, anchors, embed)
+	}
+
+	if e.Tag == "a" && getAttrValue(e, "class") == "pagemarker" {
+		// page markers are only needed for page maps and their ids are not unique across files
+		e.RemoveAttr("id")
+		return
+	}
+
+	if src := getAttrValue(e, "src"); len(src) > 0 && e.Tag == "img" {
+		if data, ok := embed(src); ok {
+			e.CreateAttr("src", data)
+		}
+	}
+
+	href := e.SelectAttr("href")
+	if href == nil || len(href.Value) == 0 {
+		return
+	}
+	if e.Tag == "image" {
+		// svg images
+		if data, ok := embed(href.Value); ok {
+			href.Value = data
+		}
+		return
+	}
+
+	u, err := url.Parse(href.Value)
+	if err != nil || len(u.Scheme) > 0 || len(u.Host) > 0 {
+		// external links are left alone
+		return
+	}
+
+	switch target := u.Path; {
+	case len(u.Fragment) > 0:
+		// ids are unique book wide (see Book.LinksLocations), so page-wide anchors could be used
+		href.Value = "#" + u.Fragment
+	case len(target) == 0:
+		href.Value = "#" + anchors[fname]
+	default:
+		if a, ok := anchors[target]; ok {
+			href.Value = "#" + a
+		}
+	}
+}
+
+// embedStylesheet replaces all resources stylesheet references with data URIs.
+func (p *Processor) embedStylesheet(css string, embed func(string) (string, bool)) string {
+
+	pattern := regexp.MustCompile(`url\(\s*["']?([^"'\)\s]+)["']?\s*\)`)
+
+	return pattern.ReplaceAllStringFunc(css, func(m string) string {
+		ref := pattern.FindStringSubmatch(m)[1]
+		if strings.HasPrefix(ref, "data:") {
+			return m
+		}
+		if data, ok := embed(ref); ok {
+			return `url("` + data + `")`
+		}
+		return m
+	})
+}
+
+// closeHTMLElements makes sure that non void elements are never self closing, html parsers do not understand that.
+func closeHTMLElements(e *etree.Element) {
+	if e.Tag == "svg" {
+		// foreign content is fine
+		return
+	}
+	if len(e.Child) == 0 && !htmlVoidElements[e.Tag] {
+		e.CreateCharData("")
+	}
+	for _, c := range e.ChildElements() {
+		closeHTMLElements(c)
+	}
+}
@@ -59,13 +59,29 @@ func (b *binImage) flush(path string) error {
 		return fmt.Errorf("unable to create directory %s: %w", newdir, err)
 	}
 
+	data, err := b.prepare()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(newdir, b.fname), data, 0644); err != nil {
+		return fmt.Errorf("unable to save image %s: %w", filepath.Join(newdir, b.fname), err)
+	}
+	return nil
+}
+
+// prepare does requested image processing and returns image as it should be stored.
+func (b *binImage) prepare() ([]byte, error) {
+
 	// Do not touch svg images
 	if b.imgType == "svg" {
 		goto Storing
 	}
 
 	// See if processing is needed
-	if b.flags != 0 {
+	if flags := b.flags; flags != 0 {
+
+		// image could be stored more than once (debug mode), process it only once
+		b.flags = 0
 
 		// Just in case
 		if b.img == nil && len(b.data) != 0 {
@@ -81,7 +97,7 @@ func (b *binImage) flush(path string) error {
 		}
 
 		// Scaling
-		if b.flags&imageScale != 0 {
+		if flags&imageScale != 0 {
 			if resizedImg := imaging.Resize(b.img,
 				int(float64(b.img.Bounds().Dx())*b.scaleFactor),
 				int(float64(b.img.Bounds().Dy())*b.scaleFactor),
@@ -95,7 +111,7 @@ func (b *binImage) flush(path string) error {
 		}
 
 		// PNG transparency
-		if b.flags&imageOpaquePNG != 0 {
+		if flags&imageOpaquePNG != 0 {
 
 			opaque := func(im image.Image) bool {
 				if oimg, ok := im.(interface{ Opaque() bool }); ok {
@@ -116,7 +132,7 @@ func (b *binImage) flush(path string) error {
 		targetType := b.imgType
 
 		// Unsupported format
-		if b.flags&imageKindle != 0 {
+		if flags&imageKindle != 0 {
 			if targetType != "jpeg" {
 				b.log.Warn("Image type is not supported by targeted device, converting to jpeg",
 					zap.String("id", b.id),
@@ -163,12 +179,9 @@ func (b *binImage) flush(path string) error {
 
 	// Sanity - should never happen
 	if len(b.data) == 0 {
-		return fmt.Errorf("no image to save %s (%s)", b.id, filepath.Join(newdir, b.fname))
+		return nil, fmt.Errorf("no image to save %s (%s)", b.id, b.fname)
 	}
 
 Storing:
-	if err := os.WriteFile(filepath.Join(newdir, b.fname), b.data, 0644); err != nil {
-		return fmt.Errorf("unable to save image %s: %w", filepath.Join(newdir, b.fname), err)
-	}
-	return nil
+	return b.data, nil
 }
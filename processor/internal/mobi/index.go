@@ -0,0 +1,292 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Index records (INDX) generation. Layout follows calibre's writer8/index.py - header record with TAGX
+// section and geometry of index records followed by index records themselves and CNCX string records.
+
+const (
+	indexHeaderLength = 192
+	// PalmDB record could not be larger than 0x10000, kindlegen leaves some space
+	indexRecordLimit = 0x10000 - 1024
+)
+
+// indexTag describes single tag in index TAGX section.
+type indexTag struct {
+	number byte
+	values byte // values per entry
+	mask   byte
+}
+
+// indexEntry is a single index record: key and values for every tag (in the same order as tags).
+type indexEntry struct {
+	key  string
+	tags [][]int
+}
+
+// cncx accumulates strings referenced from index entries.
+type cncx struct {
+	offsets map[string]int
+	records [][]byte
+	buf     bytes.Buffer
+}
+
+func newCNCX() *cncx {
+	return &cncx{offsets: make(map[string]int)}
+}
+
+// add stores string (if necessary) and returns its offset.
+func (c *cncx) add(s string) int {
+
+	// calibre and kindlegen truncate strings to 500 characters
+	const maxLength = 500
+
+	if ofs, ok := c.offsets[s]; ok {
+		return ofs
+	}
+	data := []byte(s)
+	if r := []rune(s); len(r) > maxLength {
+		data = []byte(string(r[:maxLength]))
+	}
+	raw := append(encodeVarint(len(data)), data...)
+	if c.buf.Len()+len(raw) > indexRecordLimit {
+		c.records = append(c.records, alignBlock(c.buf.Bytes()))
+		c.buf = bytes.Buffer{}
+	}
+	ofs := len(c.records)*0x10000 + c.buf.Len()
+	c.buf.Write(raw)
+	c.offsets[s] = ofs
+	return ofs
+}
+
+// finish returns all CNCX records.
+func (c *cncx) finish() [][]byte {
+	if c.buf.Len() > 0 {
+		c.records = append(c.records, alignBlock(c.buf.Bytes()))
+		c.buf = bytes.Buffer{}
+	}
+	return c.records
+}
+
+// encodeVarint produces "forward" variable width integer - 7 bits per byte, high bit is set on the last byte.
+func encodeVarint(value int) []byte {
+	var out []byte
+	for {
+		out = append(out, byte(value&0x7f))
+		value >>= 7
+		if value == 0 {
+			break
+		}
+	}
+	out[0] |= 0x80
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// alignBlock pads data with zeroes to 4 bytes boundary.
+func alignBlock(data []byte) []byte {
+	if extra := len(data) % 4; extra > 0 {
+		data = append(data, make([]byte, 4-extra)...)
+	}
+	return data
+}
+
+// buildIndex returns header index record, index records and CNCX records (if any) in this order.
+func buildIndex(tags []indexTag, entries []indexEntry, names *cncx) [][]byte {
+
+	var tagx bytes.Buffer
+	tagx.WriteString("TAGX")
+	binary.Write(&tagx, binary.BigEndian, uint32(12+4*(len(tags)+1)))
+	binary.Write(&tagx, binary.BigEndian, uint32(1)) // control byte count
+	for _, t := range tags {
+		tagx.Write([]byte{t.number, t.values, t.mask, 0})
+	}
+	tagx.Write([]byte{0, 0, 0, 1}) // end of control byte
+
+	// render entries
+	rendered := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		var (
+			buf     bytes.Buffer
+			control byte
+		)
+		for i, t := range tags {
+			if i >= len(e.tags) || len(e.tags[i]) == 0 {
+				continue
+			}
+			control |= t.mask & byte((len(e.tags[i])/int(t.values))<<bits.TrailingZeros8(t.mask))
+		}
+		buf.WriteByte(byte(len(e.key)))
+		buf.WriteString(e.key)
+		buf.WriteByte(control)
+		for i := range tags {
+			if i >= len(e.tags) {
+				continue
+			}
+			for _, v := range e.tags[i] {
+				buf.Write(encodeVarint(v))
+			}
+		}
+		rendered = append(rendered, buf.Bytes())
+	}
+
+	// split entries into index records
+	type indexRecord struct {
+		data    []byte
+		lastKey string
+		count   int
+	}
+	var (
+		records []indexRecord
+		body    bytes.Buffer
+		offsets []int
+		lastKey string
+	)
+	flush := func() {
+		if len(offsets) == 0 {
+			return
+		}
+		block := alignBlock(append([]byte(nil), body.Bytes()...))
+		var idxt bytes.Buffer
+		idxt.WriteString("IDXT")
+		for _, ofs := range offsets {
+			binary.Write(&idxt, binary.BigEndian, uint16(indexHeaderLength+ofs))
+		}
+
+		var rec bytes.Buffer
+		rec.WriteString("INDX")
+		binary.Write(&rec, binary.BigEndian, uint32(indexHeaderLength))
+		rec.Write(make([]byte, 4))
+		binary.Write(&rec, binary.BigEndian, uint32(1))
+		rec.Write(make([]byte, 4))
+		binary.Write(&rec, binary.BigEndian, uint32(indexHeaderLength+len(block)))
+		binary.Write(&rec, binary.BigEndian, uint32(len(offsets)))
+		rec.Write(bytes.Repeat([]byte{0xff}, 8))
+		rec.Write(make([]byte, 156))
+		rec.Write(block)
+		rec.Write(alignBlock(idxt.Bytes()))
+
+		records = append(records, indexRecord{data: rec.Bytes(), lastKey: lastKey, count: len(offsets)})
+		body.Reset()
+		offsets = offsets[:0]
+	}
+	for i, raw := range rendered {
+		if indexHeaderLength+body.Len()+len(raw)+4+2*(len(offsets)+1)+8 > indexRecordLimit {
+			flush()
+		}
+		offsets = append(offsets, body.Len())
+		body.Write(raw)
+		lastKey = entries[i].key
+	}
+	flush()
+
+	// header record
+	var geometry bytes.Buffer
+	geometryOffsets := make([]int, 0, len(records))
+	tagxBlock := alignBlock(tagx.Bytes())
+	for _, r := range records {
+		geometryOffsets = append(geometryOffsets, indexHeaderLength+len(tagxBlock)+geometry.Len())
+		geometry.WriteByte(byte(len(r.lastKey)))
+		geometry.WriteString(r.lastKey)
+		binary.Write(&geometry, binary.BigEndian, uint16(r.count))
+	}
+	geometryBlock := alignBlock(geometry.Bytes())
+
+	var idxt bytes.Buffer
+	idxt.WriteString("IDXT")
+	for _, ofs := range geometryOffsets {
+		binary.Write(&idxt, binary.BigEndian, uint16(ofs))
+	}
+
+	var ncncx int
+	var cncxRecords [][]byte
+	if names != nil {
+		cncxRecords = names.finish()
+		ncncx = len(cncxRecords)
+	}
+
+	hdr := make([]byte, indexHeaderLength)
+	copy(hdr, "INDX")
+	putInt32(hdr, 4, indexHeaderLength)
+	putInt32(hdr, 16, 2)
+	putInt32(hdr, 20, indexHeaderLength+len(tagxBlock)+len(geometryBlock))
+	putInt32(hdr, 24, len(records))
+	putInt32(hdr, 28, 65001)
+	putInt32(hdr, 32, -1)
+	putInt32(hdr, 36, len(entries))
+	putInt32(hdr, 52, ncncx)
+	putInt32(hdr, 180, indexHeaderLength)
+
+	var header bytes.Buffer
+	header.Write(hdr)
+	header.Write(tagxBlock)
+	header.Write(geometryBlock)
+	header.Write(alignBlock(idxt.Bytes()))
+
+	result := make([][]byte, 0, 1+len(records)+ncncx)
+	result = append(result, header.Bytes())
+	for _, r := range records {
+		result = append(result, r.data)
+	}
+	return append(result, cncxRecords...)
+}
+
+// ncxEntry is a single TOC entry, parent, first and last child are indexes of other entries or -1.
+type ncxEntry struct {
+	label      string
+	offset     int
+	length     int
+	depth      int
+	parent     int
+	firstChild int
+	lastChild  int
+	fid, off   int // KF8 position
+}
+
+// buildNCXIndex produces NCX index, entries are expected to be sorted by depth and offset. When kf8
+// is requested every entry gets additional position tag (fid, off).
+func buildNCXIndex(entries []ncxEntry, kf8 bool) [][]byte {
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	tags := []indexTag{
+		{1, 1, 1},   // offset
+		{2, 1, 2},   // length
+		{3, 1, 4},   // label
+		{4, 1, 8},   // depth
+		{21, 1, 16}, // parent
+		{22, 1, 32}, // first child
+		{23, 1, 64}, // last child
+		{6, 2, 128}, // position
+	}
+	if !kf8 {
+		tags = tags[:len(tags)-1]
+	}
+
+	names := newCNCX()
+	list := make([]indexEntry, 0, len(entries))
+	for i, e := range entries {
+		values := [][]int{{e.offset}, {e.length}, {names.add(e.label)}, {e.depth}, nil, nil, nil}
+		if e.parent >= 0 {
+			values[4] = []int{e.parent}
+		}
+		if e.firstChild >= 0 {
+			values[5] = []int{e.firstChild}
+			values[6] = []int{e.lastChild}
+		}
+		if kf8 {
+			values = append(values, []int{e.fid, e.off})
+		}
+		list = append(list, indexEntry{key: fmt.Sprintf("%02X", i), tags: values})
+	}
+	return buildIndex(tags, list, names)
+}
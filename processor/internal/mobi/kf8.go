@@ -0,0 +1,513 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+// KF8 part of combo file. Every XHTML document is split into skeleton (markup without body content) and
+// chunks (pieces of body content) which are inserted into skeleton by reader. Elements get "aid" attributes
+// so positions in text could be expressed as fragment and offset, all links are converted to "kindle:pos",
+// "kindle:embed" and "kindle:flow" references. See calibre's writer8/skeleton.py for details.
+
+const chunkSize = 8192
+
+type kf8Skeleton struct {
+	chunks int
+	start  int
+	length int
+}
+
+type kf8Fragment struct {
+	insertPos int
+	selector  string
+	file      int
+	start     int
+	length    int
+}
+
+type kf8Guide struct {
+	kind, title string
+	fid, off    int
+}
+
+type kf8Text struct {
+	raw   []byte
+	flows [][2]int
+	skels []kf8Skeleton
+	frags []kf8Fragment
+	ncx   []ncxEntry
+	guide []kf8Guide
+	pages []int
+	start int
+}
+
+var (
+	reAID       = regexp.MustCompile(`<[^>]+? aid="([0-9A-V]+)"`)
+	rePosLink   = regexp.MustCompile(`kindle:pos:fid:0000:off:([0-9A-V]{10})`)
+	reCSSURL    = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+	reCSSImport = regexp.MustCompile(`@import[^;]*;`)
+	kf8VoidTags = map[string]bool{"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true, "link": true, "meta": true, "param": true, "source": true, "wbr": true}
+)
+
+func (w *Writer) buildKF8() *kf8Text {
+
+	t := &kf8Text{start: nullIndex}
+
+	// assign aids and collect all possible link targets
+	var (
+		aid     int
+		targets = make(map[string]string)
+	)
+	for _, f := range w.files {
+		for _, e := range append([]*etree.Element{f.body}, f.body.FindElements(".//*")...) {
+			aid++
+			id := toBase32(aid, 0)
+			e.CreateAttr("aid", id)
+			if v := e.SelectAttrValue("id", ""); len(v) > 0 {
+				targets[f.name+"#"+v] = id
+			}
+			if v := e.SelectAttrValue("name", ""); len(v) > 0 && e.Tag == "a" {
+				if _, ok := targets[f.name+"#"+v]; !ok {
+					targets[f.name+"#"+v] = id
+				}
+			}
+		}
+		targets[f.name] = f.body.SelectAttrValue("aid", "")
+	}
+	target := func(href string) (string, bool) {
+		if id, ok := targets[href]; ok {
+			return id, true
+		}
+		id, ok := targets[fileOf(href)]
+		return id, ok
+	}
+
+	for _, f := range w.files {
+		w.prepareKF8(f, target)
+	}
+
+	// layout
+	var html, rebuilt bytes.Buffer
+	for _, f := range w.files {
+		start := html.Len()
+		skel, chunks := layoutKF8(f)
+
+		t.skels = append(t.skels, kf8Skeleton{chunks: len(chunks), start: start, length: len(skel)})
+		html.Write(skel)
+
+		prev, shift, cp := 0, 0, 0
+		for _, c := range chunks {
+			html.Write(c.data)
+			rebuilt.Write(skel[prev:c.at])
+			rebuilt.Write(c.data)
+			prev = c.at
+			t.frags = append(t.frags, kf8Fragment{
+				insertPos: start + c.at + shift,
+				selector:  fmt.Sprintf("P-//*[@aid='%s']", c.aid),
+				file:      f.num,
+				start:     cp,
+				length:    len(c.data),
+			})
+			shift += len(c.data)
+			cp += len(c.data)
+		}
+		rebuilt.Write(skel[prev:])
+	}
+
+	positions := make(map[string]int)
+	for _, m := range reAID.FindAllSubmatchIndex(rebuilt.Bytes(), -1) {
+		positions[string(rebuilt.Bytes()[m[2]:m[3]])] = m[0]
+	}
+	resolve := func(href string) (int, bool) {
+		id, ok := target(href)
+		if !ok {
+			return 0, false
+		}
+		pos, ok := positions[id]
+		return pos, ok
+	}
+
+	// now when we know all positions links could be finalized
+	t.raw = rePosLink.ReplaceAllFunc(html.Bytes(), func(link []byte) []byte {
+		fid, off := 0, 0
+		if pos, ok := positions[strings.TrimLeft(string(link[len(link)-10:]), "0")]; ok {
+			fid, off = t.posFid(pos)
+		}
+		return []byte(fmt.Sprintf("kindle:pos:fid:%s:off:%s", toBase32(fid, 4), toBase32(off, 10)))
+	})
+	t.flows = append(t.flows, [2]int{0, len(t.raw)})
+
+	t.ncx = w.tocEntries(resolve, len(t.raw))
+	for i := range t.ncx {
+		t.ncx[i].fid, t.ncx[i].off = t.posFid(t.ncx[i].offset)
+	}
+
+	seen := make(map[string]bool)
+	for _, g := range w.guide {
+		pos, ok := resolve(g.href)
+		if !ok || len(g.kind) == 0 || seen[g.kind] {
+			continue
+		}
+		seen[g.kind] = true
+		fid, off := t.posFid(pos)
+		t.guide = append(t.guide, kf8Guide{kind: g.kind, title: g.title, fid: fid, off: off})
+		if g.kind == "text" {
+			t.start = pos
+		}
+	}
+	sort.Slice(t.guide, func(i, j int) bool { return t.guide[i].kind < t.guide[j].kind })
+
+	for _, p := range w.pages {
+		if pos, ok := resolve(p); ok {
+			t.pages = append(t.pages, pos)
+		}
+	}
+
+	for _, css := range w.css {
+		start := len(t.raw)
+		t.raw = append(t.raw, css...)
+		t.flows = append(t.flows, [2]int{start, len(t.raw)})
+	}
+	return t
+}
+
+// prepareKF8 converts all references in the document to KF8 form.
+func (w *Writer) prepareKF8(f *bookFile, target func(string) (string, bool)) {
+
+	html := f.doc.Root()
+	if head := html.SelectElement("head"); head != nil {
+		for _, l := range head.SelectElements("link") {
+			if !strings.EqualFold(l.SelectAttrValue("rel", ""), "stylesheet") {
+				continue
+			}
+			if n, ok := w.flows[resolveHref(f.name, l.SelectAttrValue("href", ""))]; ok {
+				l.CreateAttr("href", fmt.Sprintf("kindle:flow:%s?mime=text/css", toBase32(n, 4)))
+			} else {
+				head.RemoveChild(l)
+			}
+		}
+	}
+	for _, s := range html.FindElements(".//script") {
+		if p := s.Parent(); p != nil {
+			p.RemoveChild(s)
+		}
+	}
+
+	for _, e := range f.body.FindElements(".//*") {
+		switch e.Tag {
+		case "img":
+			w.embed(f, e, "src")
+		case "image":
+			w.embed(f, e, "href")
+		case "a":
+			href := e.SelectAttrValue("href", "")
+			if len(href) == 0 || isExternal(href) {
+				continue
+			}
+			if id, ok := target(resolveHref(f.name, href)); ok {
+				e.CreateAttr("href", "kindle:pos:fid:0000:off:"+strings.Repeat("0", 10-len(id))+id)
+			} else {
+				w.log.Debug("Unable to resolve link target", zap.String("file", f.name), zap.String("href", href))
+			}
+		}
+	}
+}
+
+// embed replaces image reference in attribute with "kindle:embed" one.
+func (w *Writer) embed(f *bookFile, e *etree.Element, key string) {
+	a := e.SelectAttr(key)
+	if a == nil {
+		return
+	}
+	name := resolveHref(f.name, a.Value)
+	if n, ok := w.resource[name]; ok {
+		a.Value = fmt.Sprintf("kindle:embed:%s?mime=%s", toBase32(n, 4), w.byName[name].ct)
+	}
+}
+
+// rewriteCSS replaces resource references in stylesheet.
+func (w *Writer) rewriteCSS(name string, data []byte) []byte {
+	data = reCSSImport.ReplaceAll(data, nil)
+	return reCSSURL.ReplaceAllFunc(data, func(u []byte) []byte {
+		m := reCSSURL.FindSubmatch(u)
+		ref := resolveHref(name, strings.TrimSpace(string(m[2])))
+		if n, ok := w.resource[ref]; ok {
+			return []byte(fmt.Sprintf(`url(kindle:embed:%s?mime=%s)`, toBase32(n, 4), w.byName[ref].ct))
+		}
+		return u
+	})
+}
+
+// posFid converts text position to fragment number and offset in it.
+func (t *kf8Text) posFid(pos int) (int, int) {
+	for i, f := range t.frags {
+		if pos >= f.insertPos && pos < f.insertPos+f.length {
+			return i, pos - f.insertPos
+		}
+		if f.insertPos > pos {
+			// position in skeleton, use next fragment
+			return i, 0
+		}
+	}
+	if len(t.frags) > 0 {
+		return len(t.frags) - 1, 0
+	}
+	return 0, 0
+}
+
+func (t *kf8Text) skelIndex() [][]byte {
+	tags := []indexTag{{1, 1, 3}, {6, 2, 12}}
+	entries := make([]indexEntry, 0, len(t.skels))
+	for i, s := range t.skels {
+		entries = append(entries, indexEntry{
+			key:  fmt.Sprintf("SKEL%010d", i),
+			tags: [][]int{{s.chunks, s.chunks}, {s.start, s.length, s.start, s.length}},
+		})
+	}
+	return buildIndex(tags, entries, nil)
+}
+
+func (t *kf8Text) fragIndex() [][]byte {
+	tags := []indexTag{{2, 1, 1}, {3, 1, 2}, {4, 1, 4}, {6, 2, 8}}
+	names := newCNCX()
+	entries := make([]indexEntry, 0, len(t.frags))
+	for i, f := range t.frags {
+		entries = append(entries, indexEntry{
+			key:  fmt.Sprintf("%010d", f.insertPos),
+			tags: [][]int{{names.add(f.selector)}, {f.file}, {i}, {f.start, f.length}},
+		})
+	}
+	return buildIndex(tags, entries, names)
+}
+
+func (t *kf8Text) ncxIndex() [][]byte {
+	return buildNCXIndex(t.ncx, true)
+}
+
+func (t *kf8Text) guideIndex() [][]byte {
+	if len(t.guide) == 0 {
+		return nil
+	}
+	tags := []indexTag{{1, 1, 1}, {6, 2, 2}}
+	names := newCNCX()
+	entries := make([]indexEntry, 0, len(t.guide))
+	for _, g := range t.guide {
+		entries = append(entries, indexEntry{
+			key:  g.kind,
+			tags: [][]int{{names.add(g.title)}, {g.fid, g.off}},
+		})
+	}
+	return buildIndex(tags, entries, names)
+}
+
+func (t *kf8Text) fdst() []byte {
+	var out bytes.Buffer
+	out.WriteString("FDST")
+	binary.Write(&out, binary.BigEndian, uint32(12))
+	binary.Write(&out, binary.BigEndian, uint32(len(t.flows)))
+	for _, f := range t.flows {
+		binary.Write(&out, binary.BigEndian, uint32(f[0]))
+		binary.Write(&out, binary.BigEndian, uint32(f[1]))
+	}
+	return out.Bytes()
+}
+
+// pageRecord produces PAGE record in the same format kindlegen does, so Splitter could produce APNX from it.
+func (t *kf8Text) pageRecord() []byte {
+
+	if len(t.pages) == 0 || len(t.pages) > 0xFFFF {
+		return nil
+	}
+
+	pm := `{"description":"","pageMap":"(1,a,1)"}`
+
+	var out bytes.Buffer
+	out.WriteString("PAGE")
+	out.Write(make([]byte, 6))
+	binary.Write(&out, binary.BigEndian, uint16(1)) // version
+	out.Write(make([]byte, 4))
+	binary.Write(&out, binary.BigEndian, uint32(0)) // revision string length
+	binary.Write(&out, binary.BigEndian, uint16(1))
+	binary.Write(&out, binary.BigEndian, uint16(len(pm)))
+	binary.Write(&out, binary.BigEndian, uint16(len(t.pages)))
+	binary.Write(&out, binary.BigEndian, uint16(32))
+	out.WriteString(pm)
+	for _, p := range t.pages {
+		binary.Write(&out, binary.BigEndian, uint32(p))
+	}
+	return out.Bytes()
+}
+
+type kf8Chunk struct {
+	at   int // insertion offset in skeleton
+	aid  string
+	data []byte
+}
+
+// layoutKF8 splits document into skeleton and chunks.
+func layoutKF8(f *bookFile) ([]byte, []kf8Chunk) {
+
+	// run is a sequence of body tokens between skeleton tags
+	type run struct {
+		at    int
+		aid   string
+		items [][]byte
+	}
+
+	var (
+		skel bytes.Buffer
+		runs []*run
+		cur  *run
+	)
+
+	add := func(aid string, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		if cur == nil {
+			cur = &run{at: skel.Len(), aid: aid}
+			runs = append(runs, cur)
+		}
+		cur.items = append(cur.items, data)
+	}
+
+	var container func(e *etree.Element)
+	container = func(e *etree.Element) {
+		writeStartTag(&skel, e)
+		aid := e.SelectAttrValue("aid", "")
+		for _, t := range e.Child {
+			switch t := t.(type) {
+			case *etree.Element:
+				var buf bytes.Buffer
+				writeElement(&buf, t, false)
+				if buf.Len() > chunkSize && len(t.ChildElements()) > 0 {
+					cur = nil
+					container(t)
+					cur = nil
+					add(aid, escapeText(t.TailData))
+				} else {
+					buf.Write(escapeText(t.TailData))
+					add(aid, buf.Bytes())
+				}
+			case *etree.CharData:
+				add(aid, escapeText(t.Data))
+			case *etree.Comment:
+				add(aid, escapeText(t.TailData))
+			case *etree.ProcInst:
+				add(aid, escapeText(t.TailData))
+			case *etree.Directive:
+				add(aid, escapeText(t.TailData))
+			}
+		}
+		cur = nil
+		writeEndTag(&skel, e)
+	}
+
+	skel.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	html := f.doc.Root()
+	writeStartTag(&skel, html)
+	for _, t := range html.Child {
+		switch t := t.(type) {
+		case *etree.Element:
+			if t == f.body {
+				container(t)
+				skel.Write(escapeText(t.TailData))
+			} else {
+				writeElement(&skel, t, true)
+			}
+		case *etree.CharData:
+			skel.Write(escapeText(t.Data))
+		}
+	}
+	writeEndTag(&skel, html)
+
+	// split runs into chunks of reasonable size
+	var chunks []kf8Chunk
+	for _, r := range runs {
+		c := kf8Chunk{at: r.at, aid: r.aid}
+		for _, data := range r.items {
+			if len(c.data) > 0 && len(c.data)+len(data) > chunkSize {
+				chunks = append(chunks, c)
+				c = kf8Chunk{at: r.at, aid: r.aid}
+			}
+			c.data = append(c.data, data...)
+		}
+		chunks = append(chunks, c)
+	}
+	return skel.Bytes(), chunks
+}
+
+func qualifiedName(space, name string) string {
+	if len(space) > 0 {
+		return space + ":" + name
+	}
+	return name
+}
+
+func writeStartTag(buf *bytes.Buffer, e *etree.Element) {
+	buf.WriteByte('<')
+	buf.WriteString(qualifiedName(e.Space, e.Tag))
+	for _, a := range e.Attr {
+		fmt.Fprintf(buf, ` %s="%s"`, qualifiedName(a.Space, a.Key), escapeAttr(a.Value))
+	}
+	buf.WriteByte('>')
+}
+
+func writeEndTag(buf *bytes.Buffer, e *etree.Element) {
+	buf.WriteString("</" + qualifiedName(e.Space, e.Tag) + ">")
+}
+
+// writeElement serializes element, comments and processing instructions are dropped.
+func writeElement(buf *bytes.Buffer, e *etree.Element, tail bool) {
+
+	if len(e.Child) == 0 && kf8VoidTags[e.Tag] {
+		writeStartTag(buf, e)
+		buf.Truncate(buf.Len() - 1)
+		buf.WriteString("/>")
+	} else {
+		writeStartTag(buf, e)
+		for _, t := range e.Child {
+			switch t := t.(type) {
+			case *etree.Element:
+				writeElement(buf, t, true)
+			case *etree.CharData:
+				buf.Write(escapeText(t.Data))
+			case *etree.Comment:
+				buf.Write(escapeText(t.TailData))
+			case *etree.ProcInst:
+				buf.Write(escapeText(t.TailData))
+			case *etree.Directive:
+				buf.Write(escapeText(t.TailData))
+			}
+		}
+		writeEndTag(buf, e)
+	}
+	if tail {
+		buf.Write(escapeText(e.TailData))
+	}
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+func escapeText(s string) []byte {
+	if len(s) == 0 {
+		return nil
+	}
+	return []byte(textEscaper.Replace(s))
+}
+
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(s)
+}
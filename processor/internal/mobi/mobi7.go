@@ -0,0 +1,221 @@
+package mobi
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+
+	"fb2converter/etree"
+)
+
+// MOBI7 part of combo file - old style single flow HTML with filepos links and recindex images. Older devices
+// (and apps) understand very limited subset of HTML and no CSS, so we only keep basic formatting here.
+
+type mobi7Text struct {
+	data  []byte
+	start int
+	ncx   []ncxEntry
+}
+
+func (t *mobi7Text) index() [][]byte {
+	return buildNCXIndex(t.ncx, false)
+}
+
+// mobi7Tags lists tags understood by MOBI7 renderer, values are replacement tags.
+var mobi7Tags = map[string]string{
+	"p": "p", "div": "div", "h1": "h1", "h2": "h2", "h3": "h3", "h4": "h4", "h5": "h5", "h6": "h6",
+	"b": "b", "i": "i", "u": "u", "s": "s", "em": "em", "strong": "strong", "sub": "sub", "sup": "sup",
+	"small": "small", "big": "big", "blockquote": "blockquote", "br": "br", "hr": "hr", "cite": "cite",
+	"table": "table", "tr": "tr", "td": "td", "th": "th", "caption": "caption",
+	"ul": "ul", "ol": "ol", "li": "li", "dl": "dl", "dt": "dt", "dd": "dd",
+	"pre": "pre", "code": "code", "tt": "tt", "strike": "strike", "del": "del", "ins": "ins", "q": "q", "center": "center",
+	"section": "div", "article": "div", "nav": "div", "aside": "div", "header": "div", "footer": "div",
+	"figure": "div", "figcaption": "div", "main": "div",
+}
+
+// mobi7Spans maps span classes produced by converter to MOBI7 formatting.
+var mobi7Spans = map[string]string{
+	"strong":   "b",
+	"emphasis": "i",
+	"strike":   "s",
+}
+
+type mobi7Link struct {
+	pos    int // position of placeholder
+	target string
+}
+
+type mobi7Builder struct {
+	w     *Writer
+	out   bytes.Buffer
+	ids   map[string]int
+	links []mobi7Link
+}
+
+func (w *Writer) buildMOBI7() *mobi7Text {
+
+	b := &mobi7Builder{w: w, ids: make(map[string]int)}
+
+	b.out.WriteString("<html><head><guide>")
+	for _, g := range w.guide {
+		if _, ok := w.fileMap[fileOf(g.href)]; !ok {
+			continue
+		}
+		fmt.Fprintf(&b.out, `<reference type="%s" title="%s" `, html.EscapeString(g.kind), html.EscapeString(g.title))
+		b.fileposAttr(g.href)
+		b.out.WriteString(" />")
+	}
+	b.out.WriteString("</guide></head><body>")
+	for i, f := range w.files {
+		if i > 0 {
+			b.out.WriteString("<mbp:pagebreak/>")
+		}
+		b.ids[f.name] = b.out.Len()
+		b.children(f, f.body)
+	}
+	b.out.WriteString("</body></html>")
+
+	res := &mobi7Text{data: b.out.Bytes(), start: nullIndex}
+	for _, l := range b.links {
+		copy(res.data[l.pos:], fmt.Sprintf("%010d", b.resolve(l.target)))
+	}
+	for _, g := range w.guide {
+		if g.kind == "text" {
+			if _, ok := w.fileMap[fileOf(g.href)]; ok {
+				res.start = b.resolve(g.href)
+				break
+			}
+		}
+	}
+	res.ncx = w.tocEntries(func(href string) (int, bool) {
+		if _, ok := w.fileMap[fileOf(href)]; !ok {
+			return 0, false
+		}
+		return b.resolve(href), true
+	}, len(res.data))
+	return res
+}
+
+// resolve returns position of link target falling back to the beginning of the file when anchor is unknown.
+func (b *mobi7Builder) resolve(target string) int {
+	if pos, ok := b.ids[target]; ok {
+		return pos
+	}
+	return b.ids[fileOf(target)]
+}
+
+func (b *mobi7Builder) fileposAttr(target string) {
+	b.out.WriteString("filepos=")
+	b.links = append(b.links, mobi7Link{pos: b.out.Len(), target: target})
+	b.out.WriteString("0000000000")
+}
+
+func (b *mobi7Builder) children(f *bookFile, e *etree.Element) {
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *etree.Element:
+			b.element(f, t)
+		case *etree.CharData:
+			b.text(t.Data)
+		case *etree.Comment:
+			b.text(t.TailData)
+		case *etree.ProcInst:
+			b.text(t.TailData)
+		case *etree.Directive:
+			b.text(t.TailData)
+		}
+	}
+}
+
+func (b *mobi7Builder) text(s string) {
+	if len(s) > 0 {
+		b.out.WriteString(html.EscapeString(s))
+	}
+}
+
+func (b *mobi7Builder) element(f *bookFile, e *etree.Element) {
+
+	defer b.text(e.TailData)
+
+	for _, name := range []string{"id", "name"} {
+		if id := e.SelectAttrValue(name, ""); len(id) > 0 {
+			if _, ok := b.ids[f.name+"#"+id]; !ok {
+				b.ids[f.name+"#"+id] = b.out.Len()
+			}
+		}
+	}
+
+	switch e.Tag {
+	case "script", "style", "head", "title":
+		return
+	case "img":
+		b.image(resolveHref(f.name, e.SelectAttrValue("src", "")))
+		return
+	case "svg":
+		if img := e.FindElement(".//image"); img != nil {
+			b.image(resolveHref(f.name, img.SelectAttrValue("href", "")))
+		}
+		return
+	case "br", "hr":
+		b.out.WriteString("<" + e.Tag + "/>")
+		return
+	}
+
+	tag, ok := mobi7Tags[e.Tag]
+	var attrs string
+	switch e.Tag {
+	case "a":
+		href := e.SelectAttrValue("href", "")
+		switch {
+		case len(href) == 0:
+		case isExternal(href):
+			ok, tag, attrs = true, "a", fmt.Sprintf(` href="%s"`, html.EscapeString(href))
+		default:
+			if target := resolveHref(f.name, href); b.w.fileMap[fileOf(target)] != nil {
+				b.out.WriteString("<a ")
+				b.fileposAttr(target)
+				b.out.WriteString(" >")
+				b.children(f, e)
+				b.out.WriteString("</a>")
+				return
+			}
+		}
+	case "span":
+		for _, c := range strings.Fields(e.SelectAttrValue("class", "")) {
+			if t, found := mobi7Spans[c]; found {
+				ok, tag = true, t
+				break
+			}
+		}
+	case "td", "th":
+		for _, name := range []string{"colspan", "rowspan"} {
+			if v := e.SelectAttrValue(name, ""); len(v) > 0 {
+				attrs += fmt.Sprintf(` %s="%s"`, name, html.EscapeString(v))
+			}
+		}
+	}
+
+	if !ok {
+		// unknown tags are unwrapped
+		b.children(f, e)
+		return
+	}
+	b.out.WriteString("<" + tag + attrs + ">")
+	b.children(f, e)
+	b.out.WriteString("</" + tag + ">")
+}
+
+func (b *mobi7Builder) image(name string) {
+	if n, ok := b.w.resource[name]; ok && b.w.byName[name] != nil && resourceKind(b.w.byName[name]) == "image" {
+		fmt.Fprintf(&b.out, `<img recindex="%05d" />`, n)
+	}
+}
+
+// fileOf strips fragment identifier from reference.
+func fileOf(href string) string {
+	if i := strings.IndexByte(href, '#'); i >= 0 {
+		return href[:i]
+	}
+	return href
+}
@@ -0,0 +1,66 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// compressPalmDoc compresses single text record using PalmDOC LZ77 variant. Follows calibre's reference
+// implementation - longest match from 10 to 3 bytes in 2047 bytes window, "space + character" folding
+// and short binary runs.
+func compressPalmDoc(data []byte) []byte {
+
+	var out bytes.Buffer
+
+	ldata := len(data)
+	for i := 0; i < ldata; {
+		if i > 10 && ldata-i > 10 {
+			start := i - 2047
+			if start < 0 {
+				start = 0
+			}
+			found := false
+			for n := 10; n > 2; n-- {
+				match := bytes.LastIndex(data[start:i], data[i:i+n])
+				if match < 0 {
+					continue
+				}
+				code := 0x8000 + (((i - (start + match)) << 3) & 0x3ff8) + (n - 3)
+				binary.Write(&out, binary.BigEndian, uint16(code))
+				i += n
+				found = true
+				break
+			}
+			if found {
+				continue
+			}
+		}
+
+		ch := data[i]
+		i++
+		if ch == ' ' && i+1 < ldata {
+			if next := data[i]; next >= 0x40 && next < 0x80 {
+				out.WriteByte(next ^ 0x80)
+				i++
+				continue
+			}
+		}
+		if ch == 0 || (ch > 8 && ch < 0x80) {
+			out.WriteByte(ch)
+			continue
+		}
+
+		j := i
+		for j < ldata && j-i < 7 {
+			if c := data[j]; c == 0 || (c > 8 && c < 0x80) {
+				break
+			}
+			j++
+		}
+		out.WriteByte(byte(j - i + 1))
+		out.WriteByte(ch)
+		out.Write(data[i:j])
+		i = j
+	}
+	return out.Bytes()
+}
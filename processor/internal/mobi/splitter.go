@@ -134,7 +134,7 @@ func (s *Splitter) produceCombo(data []byte, u []byte, nonPersonal bool) {
 	if srcs >= 0 && numSrcs > 0 {
 		for i := srcs; i < numSrcs; i++ {
 			d := readSection(data, i)
-			if bytes.Equal(d[0:4], []byte("PAGE")) {
+			if bytes.HasPrefix(d, []byte("PAGE")) {
 				pdata = d
 			}
 		}
@@ -298,7 +298,7 @@ func (s *Splitter) produceKF8(data []byte, u []byte, nonPersonal, forceASIN bool
 	if srcs >= 0 && numSrcs > 0 {
 		for i := srcs; i < numSrcs; i++ {
 			d := readSection(data, i)
-			if bytes.Equal(d[0:4], []byte("PAGE")) {
+			if bytes.HasPrefix(d, []byte("PAGE")) {
 				pdata = d
 			}
 		}
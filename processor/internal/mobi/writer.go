@@ -0,0 +1,889 @@
+package mobi
+
+// Native replacement for kindlegen. Produces combo (MOBI7 + KF8) file out of unpacked OEBPS content,
+// result is expected to go through Splitter the same way kindlegen output does. Record layout and
+// header values are modeled after calibre's MOBI writers (calibre.ebooks.mobi.writer2 and writer8),
+// visit https://github.com/kovidgoyal/calibre and KindleUnpack for format details.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	// additional image formats for thumbnail
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/disintegration/imaging"
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+)
+
+const (
+	textRecordSize = 4096
+	nullIndex      = -1
+)
+
+var (
+	recordFLIS = []byte("FLIS\x00\x00\x00\x08\x00\x41\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff\x00\x01\x00\x03\x00\x00\x00\x03\x00\x00\x00\x01\xff\xff\xff\xff")
+	recordEOF  = []byte("\xe9\x8e\r\n")
+)
+
+type manifestItem struct {
+	id    string
+	name  string // path relative to OPF directory
+	ct    string
+	props string
+}
+
+type guideRef struct {
+	kind  string
+	title string
+	href  string // resolved, relative to OPF directory
+}
+
+type tocItem struct {
+	label    string
+	href     string // resolved, relative to OPF directory
+	children []*tocItem
+}
+
+type bookMeta struct {
+	title       string
+	lang        string
+	uid         string
+	isbn        string
+	publisher   string
+	description string
+	date        string
+	creators    []string
+	subjects    []string
+}
+
+type bookFile struct {
+	num  int
+	name string
+	doc  *etree.Document
+	body *etree.Element
+}
+
+// Writer - native mobi writer.
+type Writer struct {
+	log      *zap.Logger
+	compress bool
+	base     string
+	//
+	meta     bookMeta
+	items    []*manifestItem
+	byID     map[string]*manifestItem
+	byName   map[string]*manifestItem
+	spine    []*manifestItem
+	guide    []guideRef
+	toc      []*tocItem
+	pages    []string
+	coverID  string
+	files    []*bookFile
+	fileMap  map[string]*bookFile
+	flows    map[string]int // css file -> flow number
+	css      [][]byte
+	resource map[string]int // resource name -> 1 based resource index
+	res      [][]byte
+	cover    int
+	thumb    int
+	//
+	result []byte
+}
+
+// NewWriter reads OPF and all referenced content and produces combo mobi file in memory.
+// Compression levels follow kindlegen: 0 - none, 1 - PalmDOC, 2 - Huffman/CDIC (not supported, PalmDOC is used instead).
+func NewWriter(opf string, compression int, log *zap.Logger) (*Writer, error) {
+
+	w := &Writer{
+		log:      log,
+		compress: compression > 0,
+		base:     filepath.Dir(opf),
+		byID:     make(map[string]*manifestItem),
+		byName:   make(map[string]*manifestItem),
+		fileMap:  make(map[string]*bookFile),
+		flows:    make(map[string]int),
+		resource: make(map[string]int),
+		cover:    nullIndex,
+		thumb:    nullIndex,
+	}
+	if compression > 1 {
+		log.Debug("Huffman/CDIC compression is not supported by native writer, using PalmDOC")
+	}
+
+	if err := w.readPackage(opf); err != nil {
+		return nil, err
+	}
+	if err := w.readResources(); err != nil {
+		return nil, err
+	}
+	if err := w.readContent(); err != nil {
+		return nil, err
+	}
+
+	// MOBI7 conversion does not modify documents, KF8 conversion does - order is important
+	m7 := w.buildMOBI7()
+	k8 := w.buildKF8()
+
+	w.result = w.assemble(m7, k8)
+	return w, nil
+}
+
+// SaveResult saves combo mobi to the requested location.
+func (w *Writer) SaveResult(fname string) error {
+	if len(w.result) == 0 {
+		return errors.New("nothing to save")
+	}
+	return os.WriteFile(fname, w.result, 0644)
+}
+
+// readPackage parses OPF: metadata, manifest, spine, guide and everything referenced from there.
+func (w *Writer) readPackage(opf string) error {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(opf); err != nil {
+		return fmt.Errorf("unable to parse OPF: %w", err)
+	}
+
+	pkg := doc.Root()
+	if pkg == nil || pkg.Tag != "package" {
+		return errors.New("unable to find package in OPF")
+	}
+
+	if man := pkg.SelectElement("manifest"); man != nil {
+		for _, e := range man.SelectElements("item") {
+			href := e.SelectAttrValue("href", "")
+			if len(href) == 0 {
+				continue
+			}
+			item := &manifestItem{
+				id:    e.SelectAttrValue("id", ""),
+				name:  resolveHref("", href),
+				ct:    e.SelectAttrValue("media-type", ""),
+				props: e.SelectAttrValue("properties", ""),
+			}
+			w.items = append(w.items, item)
+			w.byID[item.id] = item
+			w.byName[item.name] = item
+			if strings.Contains(" "+item.props+" ", " cover-image ") {
+				w.coverID = item.id
+			}
+		}
+	}
+
+	if meta := pkg.SelectElement("metadata"); meta != nil {
+		uid := pkg.SelectAttrValue("unique-identifier", "")
+		for _, e := range meta.ChildElements() {
+			text := strings.TrimSpace(e.Text())
+			switch e.Tag {
+			case "title":
+				if len(w.meta.title) == 0 {
+					w.meta.title = text
+				}
+			case "language":
+				if len(w.meta.lang) == 0 {
+					w.meta.lang = text
+				}
+			case "identifier":
+				if id := e.SelectAttrValue("id", ""); (len(uid) > 0 && id == uid) || len(w.meta.uid) == 0 {
+					w.meta.uid = text
+				}
+				if strings.EqualFold(e.SelectAttrValue("scheme", ""), "isbn") {
+					w.meta.isbn = text
+				}
+			case "creator":
+				if role := e.SelectAttrValue("role", "aut"); role == "aut" && len(text) > 0 {
+					w.meta.creators = append(w.meta.creators, text)
+				}
+			case "publisher":
+				w.meta.publisher = text
+			case "description":
+				w.meta.description = text
+			case "date":
+				w.meta.date = text
+			case "subject":
+				if len(text) > 0 {
+					w.meta.subjects = append(w.meta.subjects, text)
+				}
+			case "meta":
+				if e.SelectAttrValue("name", "") == "cover" && len(w.coverID) == 0 {
+					w.coverID = e.SelectAttrValue("content", "")
+				}
+			}
+		}
+	}
+	if len(w.meta.title) == 0 {
+		w.meta.title = "Unknown"
+	}
+	if len(w.meta.lang) == 0 {
+		w.meta.lang = "en"
+	}
+
+	spine := pkg.SelectElement("spine")
+	if spine == nil {
+		return errors.New("unable to find spine in OPF")
+	}
+	for _, e := range spine.SelectElements("itemref") {
+		if item, ok := w.byID[e.SelectAttrValue("idref", "")]; ok {
+			w.spine = append(w.spine, item)
+		}
+	}
+	if len(w.spine) == 0 {
+		return errors.New("OPF spine is empty")
+	}
+
+	if guide := pkg.SelectElement("guide"); guide != nil {
+		for _, e := range guide.SelectElements("reference") {
+			w.guide = append(w.guide, guideRef{
+				kind:  e.SelectAttrValue("type", ""),
+				title: e.SelectAttrValue("title", ""),
+				href:  resolveHref("", e.SelectAttrValue("href", "")),
+			})
+		}
+	}
+
+	if item, ok := w.byID[spine.SelectAttrValue("toc", "")]; ok {
+		if err := w.readNCX(item.name); err != nil {
+			w.log.Warn("Unable to read NCX, ignoring", zap.String("ncx", item.name), zap.Error(err))
+		}
+	}
+	if item, ok := w.byID[spine.SelectAttrValue("page-map", "")]; ok {
+		if err := w.readPageMap(item.name); err != nil {
+			w.log.Warn("Unable to read page map, ignoring", zap.String("page-map", item.name), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (w *Writer) readNCX(name string) error {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(w.path(name)); err != nil {
+		return err
+	}
+	nm := doc.FindElement("./ncx/navMap")
+	if nm == nil {
+		return errors.New("navMap not found")
+	}
+
+	var walk func(e *etree.Element) []*tocItem
+	walk = func(e *etree.Element) []*tocItem {
+		var res []*tocItem
+		for _, np := range e.SelectElements("navPoint") {
+			t := &tocItem{}
+			if l := np.FindElement("./navLabel/text"); l != nil {
+				t.label = strings.TrimSpace(l.Text())
+			}
+			if c := np.SelectElement("content"); c != nil {
+				t.href = resolveHref(name, c.SelectAttrValue("src", ""))
+			}
+			t.children = walk(np)
+			res = append(res, t)
+		}
+		return res
+	}
+	w.toc = walk(nm)
+	return nil
+}
+
+func (w *Writer) readPageMap(name string) error {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(w.path(name)); err != nil {
+		return err
+	}
+	pm := doc.Root()
+	if pm == nil {
+		return errors.New("page-map not found")
+	}
+	for _, e := range pm.SelectElements("page") {
+		w.pages = append(w.pages, resolveHref(name, e.SelectAttrValue("href", "")))
+	}
+	return nil
+}
+
+// readResources prepares image and font records along with stylesheets.
+func (w *Writer) readResources() error {
+
+	for _, item := range w.items {
+		kind := resourceKind(item)
+		if len(kind) == 0 {
+			continue
+		}
+		data, err := os.ReadFile(w.path(item.name))
+		if err != nil {
+			return fmt.Errorf("unable to read resource %s: %w", item.name, err)
+		}
+		switch kind {
+		case "image":
+			w.res = append(w.res, data)
+			w.resource[item.name] = len(w.res)
+			if item.id == w.coverID {
+				w.cover = len(w.res) - 1
+			}
+		case "font":
+			w.res = append(w.res, fontRecord(data))
+			w.resource[item.name] = len(w.res)
+		case "css":
+			w.css = append(w.css, data)
+			w.flows[item.name] = len(w.css)
+		}
+	}
+
+	// stylesheets may reference fonts and images
+	for name, n := range w.flows {
+		w.css[n-1] = w.rewriteCSS(name, w.css[n-1])
+	}
+
+	if w.cover != nullIndex {
+		if thumb, err := makeThumbnail(w.res[w.cover]); err != nil {
+			w.log.Warn("Unable to produce thumbnail, ignoring", zap.Error(err))
+		} else {
+			w.res = append(w.res, thumb)
+			w.thumb = len(w.res) - 1
+		}
+	}
+	return nil
+}
+
+// readContent parses all XHTML documents in spine order.
+func (w *Writer) readContent() error {
+
+	for _, item := range w.spine {
+		if item.ct != "application/xhtml+xml" && item.ct != "text/html" {
+			w.log.Debug("Skipping non XHTML spine item", zap.String("item", item.name))
+			continue
+		}
+		if _, ok := w.fileMap[item.name]; ok {
+			continue
+		}
+
+		doc := etree.NewDocument()
+		doc.ReadSettings.Permissive = true
+		doc.ReadSettings.Entity = xml.HTMLEntity
+		doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
+		if err := doc.ReadFromFile(w.path(item.name)); err != nil {
+			return fmt.Errorf("unable to parse %s: %w", item.name, err)
+		}
+		doc.Indent(etree.NoIndent)
+
+		html := doc.Root()
+		if html == nil || html.Tag != "html" {
+			return fmt.Errorf("unable to find html element in %s", item.name)
+		}
+		body := html.SelectElement("body")
+		if body == nil {
+			return fmt.Errorf("unable to find body element in %s", item.name)
+		}
+
+		f := &bookFile{num: len(w.files), name: item.name, doc: doc, body: body}
+		w.files = append(w.files, f)
+		w.fileMap[f.name] = f
+	}
+	if len(w.files) == 0 {
+		return errors.New("no content found")
+	}
+	return nil
+}
+
+// assemble puts together all records of combo file.
+func (w *Writer) assemble(m7 *mobi7Text, k8 *kf8Text) []byte {
+
+	records := [][]byte{nil}
+
+	// MOBI7 part
+	text7 := textRecords(m7.data, w.compress)
+	records = append(records, text7...)
+	firstNonText7 := len(records)
+
+	ncx7 := nullIndex
+	if idx := m7.index(); len(idx) > 0 {
+		ncx7 = len(records)
+		records = append(records, idx...)
+	}
+	firstResource, lastContent := nullIndex, len(records)-1
+	if len(w.res) > 0 {
+		firstResource = len(records)
+		records = append(records, w.res...)
+		lastContent = len(records) - 1
+	}
+	flis7 := len(records)
+	records = append(records, recordFLIS)
+	fcis7 := len(records)
+	records = append(records, recordFCIS(len(m7.data), false))
+	records = append(records, []byte("BOUNDARY"))
+
+	// KF8 part, all indexes are relative to KF8 header record
+	kf8 := len(records)
+	records = append(records, nil)
+	text8 := textRecords(k8.raw, w.compress)
+	records = append(records, text8...)
+	firstNonText8 := len(records) - kf8
+
+	fragIdx := len(records) - kf8
+	records = append(records, k8.fragIndex()...)
+	skelIdx := len(records) - kf8
+	records = append(records, k8.skelIndex()...)
+	ncxIdx := nullIndex
+	if idx := k8.ncxIndex(); len(idx) > 0 {
+		ncxIdx = len(records) - kf8
+		records = append(records, idx...)
+	}
+	guideIdx := nullIndex
+	if idx := k8.guideIndex(); len(idx) > 0 {
+		guideIdx = len(records) - kf8
+		records = append(records, idx...)
+	}
+	// this is where resources will be inserted when KF8 is extracted
+	firstResource8 := len(records) - kf8
+	fdst := len(records) - kf8
+	records = append(records, k8.fdst())
+	flis8 := len(records) - kf8
+	records = append(records, recordFLIS)
+	fcis8 := len(records) - kf8
+	records = append(records, recordFCIS(len(k8.raw), true))
+	if page := k8.pageRecord(); len(page) > 0 {
+		records = append(records, page)
+	}
+	records = append(records, recordEOF)
+
+	uid := int(crc32.ChecksumIEEE([]byte(w.meta.uid)) & 0x7fffffff)
+
+	// MOBI7 header
+	hdr7 := w.header(232, 6, len(m7.data), len(text7), uid)
+	putInt32(hdr7, firstNonText, firstNonText7)
+	putInt32(hdr7, firstRescRecord, firstResource)
+	putInt32(hdr7, 0x80, 0x1850)
+	putInt16(hdr7, firstContentIndex, 1)
+	putInt16(hdr7, lastContentIndex, lastContent)
+	putInt32(hdr7, 0xC4, 1)
+	putInt32(hdr7, fcisIndex, fcis7)
+	putInt32(hdr7, flisIndex, flis7)
+	putInt32(hdr7, primaryIndex, ncx7)
+
+	exth7 := w.exth(false)
+	exth7 = append(exth7, exthRecord{exthKF8Offset, putInt32(nil, 0, kf8)})
+	if m7.start >= 0 {
+		exth7 = append(exth7, exthRecord{exthStartReading, putInt32(nil, 0, m7.start)})
+	}
+	records[0] = w.record0(hdr7, exth7)
+
+	// KF8 header
+	hdr8 := w.header(264, 8, len(k8.raw), len(text8), uid)
+	putInt32(hdr8, firstNonText, firstNonText8)
+	putInt32(hdr8, firstRescRecord, firstResource8)
+	putInt32(hdr8, 0x80, 0x1050)
+	putInt32(hdr8, kf8FdstIndex, fdst)
+	putInt32(hdr8, 0xC4, len(k8.flows))
+	putInt32(hdr8, fcisIndex, fcis8)
+	putInt32(hdr8, flisIndex, flis8)
+	putInt32(hdr8, primaryIndex, ncxIdx)
+	putInt32(hdr8, 0xF8, fragIdx)
+	putInt32(hdr8, 0xFC, skelIdx)
+	putInt32(hdr8, datpIndex, nullIndex)
+	putInt32(hdr8, 0x104, guideIdx)
+	putInt32(hdr8, 0x108, nullIndex)
+	putInt32(hdr8, 0x110, nullIndex)
+
+	exth8 := w.exth(true)
+	if k8.start >= 0 {
+		exth8 = append(exth8, exthRecord{exthStartReading, putInt32(nil, 0, k8.start)})
+	}
+	records[kf8] = w.record0(hdr8, exth8)
+
+	return palmDB(w.meta.title, records)
+}
+
+// header prepares PalmDOC and MOBI headers with common values filled.
+func (w *Writer) header(length, version, textLength, textCount, uid int) []byte {
+
+	hdr := make([]byte, mobiHeaderBase+length)
+
+	compression := 1
+	if w.compress {
+		compression = 2
+	}
+	putInt16(hdr, 0, compression)
+	putInt32(hdr, 4, textLength)
+	putInt16(hdr, 8, textCount)
+	putInt16(hdr, 10, textRecordSize)
+
+	copy(hdr[mobiHeaderBase:], "MOBI")
+	putInt32(hdr, mobiHeaderLength, length)
+	putInt32(hdr, mobiType, 2) // book
+	putInt32(hdr, 28, 65001)   // UTF-8
+	putInt32(hdr, 32, uid)
+	putInt32(hdr, mobiVersion, version)
+	for ofs := 40; ofs < 80; ofs += 4 {
+		putInt32(hdr, ofs, nullIndex)
+	}
+	putInt32(hdr, 92, mobiLocale(w.meta.lang))
+	putInt32(hdr, 104, version)
+	putInt32(hdr, 164, nullIndex) // DRM
+	putInt32(hdr, srcsIndex, nullIndex)
+	putInt32(hdr, 232, nullIndex)
+	putInt32(hdr, 236, nullIndex)
+	putInt32(hdr, 240, 1) // extra record data flags: multibyte overlap
+	return hdr
+}
+
+type exthRecord struct {
+	id   int
+	data []byte
+}
+
+// exth returns common EXTH records.
+func (w *Writer) exth(kf8 bool) []exthRecord {
+
+	var recs []exthRecord
+	add := func(id int, s string) {
+		if len(s) > 0 {
+			recs = append(recs, exthRecord{id, []byte(s)})
+		}
+	}
+
+	for _, a := range w.meta.creators {
+		add(100, a)
+	}
+	add(101, w.meta.publisher)
+	add(103, w.meta.description)
+	add(104, w.meta.isbn)
+	for _, s := range w.meta.subjects {
+		add(105, s)
+	}
+	add(106, w.meta.date)
+	add(503, w.meta.title)
+	add(524, w.meta.lang)
+	add(525, "horizontal-lr")
+
+	if kf8 {
+		recs = append(recs, exthRecord{125, putInt32(nil, 0, len(w.res))})
+	}
+	if w.cover != nullIndex {
+		recs = append(recs, exthRecord{exthCoverOffset, putInt32(nil, 0, w.cover)})
+		recs = append(recs, exthRecord{203, putInt32(nil, 0, 0)})
+	}
+	if w.thumb != nullIndex {
+		recs = append(recs, exthRecord{exthThumbOffset, putInt32(nil, 0, w.thumb)})
+	}
+	// creator software, the same values calibre is using
+	for i, v := range []int{201, 2, 0, 0} {
+		recs = append(recs, exthRecord{204 + i, putInt32(nil, 0, v)})
+	}
+	return recs
+}
+
+// record0 puts together headers, EXTH and full book title.
+func (w *Writer) record0(hdr []byte, recs []exthRecord) []byte {
+
+	// start with empty EXTH block followed by the title and let addExth do the rest
+	title := []byte(w.meta.title)
+	rec0 := make([]byte, 0, len(hdr)+12+len(title)+2)
+	rec0 = append(rec0, hdr...)
+	rec0 = append(rec0, "EXTH"...)
+	rec0 = append(rec0, putInt32(nil, 0, 12)...)
+	rec0 = append(rec0, putInt32(nil, 0, 0)...)
+	rec0 = append(rec0, title...)
+	rec0 = append(rec0, 0, 0)
+	putInt32(rec0, titleOffset, len(hdr)+12)
+	putInt32(rec0, 88, len(title))
+
+	// addExth prepends records, keep requested order
+	for i := len(recs) - 1; i >= 0; i-- {
+		rec0 = addExth(rec0, recs[i].id, recs[i].data)
+	}
+
+	// EXTH block is padded to 4 bytes, always with at least one byte, padding is not included into its length
+	ebase, elen, _ := getExthParams(rec0)
+	pad := 4 - elen%4
+	data := make([]byte, 0, len(rec0)+pad)
+	data = append(data, rec0[:ebase+elen]...)
+	data = append(data, make([]byte, pad)...)
+	data = append(data, rec0[ebase+elen:]...)
+	putInt32(data, titleOffset, getInt32(data, titleOffset)+pad)
+	return alignBlock(data)
+}
+
+// textRecords splits text into records, compressing them if necessary. Every record gets trailing entry with
+// bytes of the last multibyte character crossing record boundary.
+func textRecords(text []byte, compress bool) [][]byte {
+
+	var records [][]byte
+	for pos := 0; pos < len(text); pos += textRecordSize {
+		end := pos + textRecordSize
+		if end > len(text) {
+			end = len(text)
+		}
+
+		var overlap []byte
+		if end < len(text) {
+			k := end - 1
+			for k > pos && end-k < utf8.UTFMax && !utf8.RuneStart(text[k]) {
+				k--
+			}
+			if _, size := utf8.DecodeRune(text[k:]); k+size > end {
+				overlap = text[end : k+size]
+			}
+		}
+
+		data := text[pos:end]
+		if compress {
+			data = compressPalmDoc(data)
+		}
+		rec := make([]byte, 0, len(data)+len(overlap)+1)
+		rec = append(rec, data...)
+		rec = append(rec, overlap...)
+		records = append(records, append(rec, byte(len(overlap))))
+	}
+	return records
+}
+
+// palmDB produces final PalmDB file.
+func palmDB(title string, records [][]byte) []byte {
+
+	name := []byte(strings.Map(func(r rune) rune {
+		if r < 0x80 && (r == '-' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')) {
+			return r
+		}
+		return '_'
+	}, title))
+	if len(name) > 31 {
+		name = name[:31]
+	}
+
+	now := int(time.Now().Unix())
+
+	// database with a single empty record, actual records are placed with writeSection and insertSectionRange,
+	// which maintain offsets table and unique ID seed
+	empty := make([]byte, firstPdbRecord+8+2)
+	copy(empty, name)
+	putInt32(empty, 36, now) // created
+	putInt32(empty, 40, now) // modified
+	copy(empty[60:], "BOOKMOBI")
+	putInt16(empty, numberOfPdbRecords, 1)
+	putInt32(empty, firstPdbRecord, len(empty))
+
+	// join halves, so every record is copied log(n) times rather than n
+	var build func(records [][]byte) []byte
+	build = func(records [][]byte) []byte {
+		if len(records) == 1 {
+			return writeSection(empty, 0, records[0])
+		}
+		half := len(records) / 2
+		left, right := build(records[:half]), build(records[half:])
+		return insertSectionRange(left, 0, half-1, right, 0)
+	}
+	return build(records)
+}
+
+func recordFCIS(textLength int, kf8 bool) []byte {
+	var out bytes.Buffer
+	if kf8 {
+		out.WriteString("FCIS\x00\x00\x00\x14\x00\x00\x00\x10\x00\x00\x00\x02\x00\x00\x00\x00")
+		binary.Write(&out, binary.BigEndian, uint32(textLength))
+		out.WriteString("\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x08\x00\x01\x00\x01\x00\x00\x00\x00")
+	} else {
+		out.WriteString("FCIS\x00\x00\x00\x14\x00\x00\x00\x10\x00\x00\x00\x01\x00\x00\x00\x00")
+		binary.Write(&out, binary.BigEndian, uint32(textLength))
+		out.WriteString("\x00\x00\x00\x00\x00\x00\x00\x20\x00\x00\x00\x08\x00\x01\x00\x01\x00\x00\x00\x00")
+	}
+	return out.Bytes()
+}
+
+// fontRecord wraps font data into compressed FONT record.
+func fontRecord(data []byte) []byte {
+
+	var z bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&z, zlib.BestCompression)
+	zw.Write(data)
+	zw.Close()
+
+	var out bytes.Buffer
+	out.WriteString("FONT")
+	binary.Write(&out, binary.BigEndian, uint32(len(data))) // uncompressed size
+	binary.Write(&out, binary.BigEndian, uint32(1))         // flags: zlib
+	binary.Write(&out, binary.BigEndian, uint32(24))        // data start
+	binary.Write(&out, binary.BigEndian, uint32(0))         // XOR key length
+	binary.Write(&out, binary.BigEndian, uint32(24))        // XOR key start
+	out.Write(z.Bytes())
+	return out.Bytes()
+}
+
+func makeThumbnail(data []byte) ([]byte, error) {
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf = new(bytes.Buffer)
+	if err := imaging.Encode(buf, imaging.Thumbnail(img, 330, 470, imaging.Lanczos), imaging.JPEG, imaging.JPEGQuality(75)); err != nil {
+		return nil, err
+	}
+	buf, _ = SetJpegDPI(buf, DpiPxPerInch, 300, 300)
+	return buf.Bytes(), nil
+}
+
+func resourceKind(item *manifestItem) string {
+	switch ct := strings.ToLower(item.ct); {
+	case ct == "image/jpeg" || ct == "image/jpg" || ct == "image/png" || ct == "image/gif":
+		return "image"
+	case ct == "text/css":
+		return "css"
+	case strings.Contains(ct, "font") || strings.Contains(ct, "opentype"):
+		return "font"
+	}
+	switch strings.ToLower(path.Ext(item.name)) {
+	case ".ttf", ".otf":
+		return "font"
+	}
+	return ""
+}
+
+// path returns file system location of the package file.
+func (w *Writer) path(name string) string {
+	return filepath.Join(w.base, filepath.FromSlash(name))
+}
+
+// resolveHref converts relative reference made from document "from" to the name relative to OPF directory,
+// fragment identifier is preserved.
+func resolveHref(from, href string) string {
+
+	ref, frag := href, ""
+	if i := strings.IndexByte(href, '#'); i >= 0 {
+		ref, frag = href[:i], href[i:]
+	}
+	if u, err := url.PathUnescape(ref); err == nil {
+		ref = u
+	}
+	if len(ref) == 0 {
+		return from + frag
+	}
+	return path.Join(path.Dir(from), ref) + frag
+}
+
+// isExternal checks if reference points outside of the book.
+func isExternal(href string) bool {
+	u, err := url.Parse(href)
+	return err == nil && len(u.Scheme) > 0
+}
+
+// toBase32 produces base 32 representation used by KF8 references, padded with zeroes up to min digits.
+func toBase32(value, min int) string {
+
+	const alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+
+	var out []byte
+	for {
+		out = append(out, alphabet[value%32])
+		value /= 32
+		if value == 0 {
+			break
+		}
+	}
+	for len(out) < min {
+		out = append(out, '0')
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+// mobiLocale returns MOBI language code for most common languages.
+func mobiLocale(lang string) int {
+
+	var codes = map[string]int{
+		"ar": 1, "bg": 2, "ca": 3, "zh": 4, "cs": 5, "da": 6, "de": 7, "el": 8, "en": 9, "es": 10,
+		"fi": 11, "fr": 12, "he": 13, "hu": 14, "is": 15, "it": 16, "ja": 17, "ko": 18, "nl": 19,
+		"no": 20, "pl": 21, "pt": 22, "ro": 24, "ru": 25, "hr": 26, "sk": 27, "sq": 28, "sv": 29,
+		"th": 30, "tr": 31, "ur": 32, "id": 33, "uk": 34, "be": 35, "sl": 36, "et": 37, "lv": 38,
+		"lt": 39, "fa": 41, "vi": 42, "hy": 43, "az": 44, "eu": 45, "mk": 47, "ka": 55,
+	}
+
+	lang = strings.ToLower(lang)
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	return codes[lang]
+}
+
+// tocEntries flattens TOC resolving positions with provided function, result is sorted by depth and offset as
+// required by NCX index. Entries which could not be resolved are dropped along with their children.
+func (w *Writer) tocEntries(resolve func(href string) (int, bool), end int) []ncxEntry {
+
+	var list []ncxEntry
+	var walk func(items []*tocItem, depth, parent int)
+	walk = func(items []*tocItem, depth, parent int) {
+		for _, t := range items {
+			pos, ok := resolve(t.href)
+			if !ok {
+				w.log.Debug("Unable to resolve TOC entry, skipping", zap.String("label", t.label), zap.String("href", t.href))
+				continue
+			}
+			list = append(list, ncxEntry{label: t.label, offset: pos, depth: depth, parent: parent, firstChild: nullIndex, lastChild: nullIndex})
+			walk(t.children, depth+1, len(list)-1)
+		}
+	}
+	walk(w.toc, 0, nullIndex)
+
+	order := make([]int, len(list))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := list[order[i]], list[order[j]]
+		if a.depth != b.depth {
+			return a.depth < b.depth
+		}
+		return a.offset < b.offset
+	})
+	remap := make([]int, len(list))
+	for n, i := range order {
+		remap[i] = n
+	}
+
+	res := make([]ncxEntry, len(list))
+	for i, e := range list {
+		if e.parent >= 0 {
+			e.parent = remap[e.parent]
+		}
+		res[remap[i]] = e
+	}
+	for i := range res {
+		// length spans to the next entry of the same or higher level
+		next := end
+		for j := range res {
+			if res[j].depth <= res[i].depth && res[j].offset > res[i].offset && res[j].offset < next {
+				next = res[j].offset
+			}
+		}
+		res[i].length = next - res[i].offset
+		if p := res[i].parent; p >= 0 {
+			if res[p].firstChild < 0 || i < res[p].firstChild {
+				res[p].firstChild = i
+			}
+			if i > res[p].lastChild {
+				res[p].lastChild = i
+			}
+		}
+	}
+	return res
+}
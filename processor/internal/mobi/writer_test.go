@@ -0,0 +1,319 @@
+package mobi
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const testOPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="BookId">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>Test Book</dc:title>
+    <dc:language>ru</dc:language>
+    <dc:identifier id="BookId" opf:scheme="uuid">urn:uuid:0c5e7f2a-1b67-4d39-9a5e-6f0e3b9c8d11</dc:identifier>
+    <dc:identifier opf:scheme="ISBN">9785170902345</dc:identifier>
+    <dc:creator opf:role="aut">First Author</dc:creator>
+    <dc:creator opf:role="aut">Second Author</dc:creator>
+    <dc:creator opf:role="trl">Translator</dc:creator>
+    <dc:publisher>Publisher</dc:publisher>
+    <dc:subject>Fiction</dc:subject>
+    <meta name="cover" content="cover"/>
+  </metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="page-map" href="page-map.xml" media-type="application/oebps-page-map+xml"/>
+    <item id="css" href="book.css" media-type="text/css"/>
+    <item id="cover" href="cover.png" media-type="image/png"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine toc="ncx" page-map="page-map">
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+  <guide>
+    <reference type="text" title="Start" href="ch1.xhtml"/>
+  </guide>
+</package>
+`
+
+const testNCX = `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <navMap>
+    <navPoint id="p1" playOrder="1"><navLabel><text>Chapter 1</text></navLabel><content src="ch1.xhtml"/></navPoint>
+    <navPoint id="p2" playOrder="2"><navLabel><text>Chapter 2</text></navLabel><content src="ch2.xhtml#part"/></navPoint>
+  </navMap>
+</ncx>
+`
+
+const testPageMap = `<?xml version="1.0" encoding="UTF-8"?>
+<page-map xmlns="http://www.idpf.org/2007/opf">
+  <page name="1" href="ch1.xhtml"/>
+  <page name="2" href="ch2.xhtml#part"/>
+</page-map>
+`
+
+const testChapter = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>%s</title><link rel="stylesheet" type="text/css" href="book.css"/></head>
+<body><h1 id="part">%s</h1>%s</body>
+</html>
+`
+
+// makeTestBook writes small OPF book into "dir" and returns path to OPF. Text is long enough to span several text
+// records and has multibyte characters crossing record boundaries.
+func makeTestBook(t *testing.T, dir string) string {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 60, 80))
+	for x := 0; x < 60; x++ {
+		for y := 0; y < 80; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 3), 128, 255})
+		}
+	}
+	var cover bytes.Buffer
+	if err := png.Encode(&cover, img); err != nil {
+		t.Fatal(err)
+	}
+
+	var para bytes.Buffer
+	for i := 0; i < 300; i++ {
+		para.WriteString("<p>Съешь же ещё этих мягких французских булок, да выпей чаю.</p>")
+	}
+
+	files := map[string][]byte{
+		"content.opf":  []byte(testOPF),
+		"toc.ncx":      []byte(testNCX),
+		"page-map.xml": []byte(testPageMap),
+		"book.css":     []byte("p { text-indent: 1em; }\n"),
+		"cover.png":    cover.Bytes(),
+		"ch1.xhtml":    []byte(fmt.Sprintf(testChapter, "Chapter 1", "Chapter 1", para.String())),
+		"ch2.xhtml":    []byte(fmt.Sprintf(testChapter, "Chapter 2", "Chapter 2", para.String())),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "content.opf")
+}
+
+func writeTestBook(t *testing.T, compression int) (string, []byte) {
+	t.Helper()
+
+	dir := t.TempDir()
+	w, err := NewWriter(makeTestBook(t, dir), compression, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unable to create mobi: %v", err)
+	}
+	fname := filepath.Join(dir, "book.mobi")
+	if err := w.SaveResult(fname); err != nil {
+		t.Fatalf("unable to save mobi: %v", err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname, data
+}
+
+func exthStrings(rec0 []byte, id int) []string {
+	var res []string
+	for _, v := range readExth(rec0, id) {
+		res = append(res, string(v))
+	}
+	return res
+}
+
+func exthInt(t *testing.T, rec0 []byte, id int) int {
+	t.Helper()
+	v := readExth(rec0, id)
+	if len(v) != 1 || len(v[0]) != 4 {
+		t.Fatalf("EXTH %d: expected single 4 bytes value, got %q", id, v)
+	}
+	return getInt32(v[0], 0)
+}
+
+// checkRecord0 verifies EXTH block and title placement.
+func checkRecord0(t *testing.T, rec0 []byte, version int) {
+	t.Helper()
+
+	if v := getInt32(rec0, mobiVersion); v != version {
+		t.Fatalf("expected MOBI version %d, got %d", version, v)
+	}
+	ebase, elen, enum := getExthParams(rec0)
+	if string(rec0[ebase:ebase+4]) != "EXTH" {
+		t.Fatalf("no EXTH block at %d", ebase)
+	}
+	n, ofs := 0, ebase+12
+	for ; ofs < ebase+elen; n++ {
+		ofs += getInt32(rec0, ofs+4)
+	}
+	if ofs != ebase+elen || n != enum {
+		t.Fatalf("EXTH length %d and count %d do not match records: %d, %d", elen, enum, ofs-ebase, n)
+	}
+	title := getInt32(rec0, titleOffset)
+	if pad := title - ebase - elen; pad < 1 || pad > 4 || title%4 != 0 {
+		t.Fatalf("bad EXTH padding: block ends at %d, title starts at %d", ebase+elen, title)
+	}
+	if s := string(rec0[title : title+getInt32(rec0, 88)]); s != "Test Book" {
+		t.Fatalf("unexpected title %q", s)
+	}
+	if len(rec0)%4 != 0 {
+		t.Fatalf("record 0 is not aligned: %d", len(rec0))
+	}
+}
+
+func TestWriterLayout(t *testing.T) {
+
+	for _, compression := range []int{0, 1} {
+		_, data := writeTestBook(t, compression)
+
+		if s := string(data[60:68]); s != "BOOKMOBI" {
+			t.Fatalf("unexpected type/creator %q", s)
+		}
+		if s := string(bytes.TrimRight(data[:32], "\x00")); s != "Test_Book" {
+			t.Fatalf("unexpected database name %q", s)
+		}
+		nsec := getInt16(data, numberOfPdbRecords)
+		if seed := getInt32(data, uniqueIDSseed); seed != 2*nsec+1 {
+			t.Fatalf("unexpected unique ID seed %d for %d records", seed, nsec)
+		}
+		prev := firstPdbRecord + 8*nsec
+		for i := 0; i < nsec; i++ {
+			start, end := getSectionAddr(data, i)
+			if start < prev || end < start || end > len(data) {
+				t.Fatalf("record %d has bad bounds [%d:%d]", i, start, end)
+			}
+			if flg := getInt32(data, firstPdbRecord+i*8+4); flg != 2*i {
+				t.Fatalf("record %d has unique ID %d", i, flg)
+			}
+			prev = end
+		}
+		if !bytes.Equal(readSection(data, nsec-1), recordEOF) {
+			t.Fatal("last record is not EOF")
+		}
+
+		rec0 := readSection(data, 0)
+		checkRecord0(t, rec0, 6)
+		if c := getInt16(rec0, 0); c != compression+1 {
+			t.Fatalf("expected compression %d, got %d", compression+1, c)
+		}
+		if got := exthStrings(rec0, 100); len(got) != 2 || got[0] != "First Author" || got[1] != "Second Author" {
+			t.Fatalf("unexpected authors %q", got)
+		}
+		for id, want := range map[int]string{101: "Publisher", 104: "9785170902345", 105: "Fiction", 503: "Test Book", 524: "ru"} {
+			if got := exthStrings(rec0, id); len(got) != 1 || got[0] != want {
+				t.Fatalf("EXTH %d: expected %q, got %q", id, want, got)
+			}
+		}
+
+		firstImage := getInt32(rec0, firstRescRecord)
+		cover := readSection(data, firstImage+exthInt(t, rec0, exthCoverOffset))
+		if !bytes.HasPrefix(cover, []byte("\x89PNG")) {
+			t.Fatal("cover offset does not point to cover image")
+		}
+		thumb := readSection(data, firstImage+exthInt(t, rec0, exthThumbOffset))
+		if _, _, err := image.Decode(bytes.NewReader(thumb)); err != nil {
+			t.Fatalf("thumbnail offset does not point to an image: %v", err)
+		}
+
+		kf8 := exthInt(t, rec0, exthKF8Offset)
+		if s := string(readSection(data, kf8-1)); s != "BOUNDARY" {
+			t.Fatalf("no boundary before KF8 header, got %q", s)
+		}
+		kfrec0 := readSection(data, kf8)
+		checkRecord0(t, kfrec0, 8)
+		if n := exthInt(t, kfrec0, 125); n != 2 {
+			t.Fatalf("expected 2 resources in KF8 EXTH, got %d", n)
+		}
+		if s := string(readSection(data, kf8+getInt32(kfrec0, kf8FdstIndex))[:4]); s != "FDST" {
+			t.Fatalf("FDST index points to %q", s)
+		}
+	}
+}
+
+func TestWriterReader(t *testing.T) {
+
+	fname, _ := writeTestBook(t, 1)
+	r, err := NewReader(fname, 20, 30, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.thumbnail) == 0 {
+		t.Fatal("no thumbnail produced from cover")
+	}
+	if _, _, err := image.Decode(bytes.NewReader(r.thumbnail)); err != nil {
+		t.Fatalf("unable to decode thumbnail: %v", err)
+	}
+}
+
+func TestWriterSplitter(t *testing.T) {
+
+	fname, src := writeTestBook(t, 1)
+	u := uuid.MustParse("0c5e7f2a-1b67-4d39-9a5e-6f0e3b9c8d11")
+
+	for _, combo := range []bool{true, false} {
+		s, err := NewSplitter(fname, u, "B000TEST00", combo, true, true, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := filepath.Join(t.TempDir(), "book.azw3")
+		if err := s.SaveResult(out); err != nil {
+			t.Fatalf("combo %t: %v", combo, err)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// splitter adds EXTH records without realigning title, so only check versions here
+		rec0 := readSection(data, 0)
+		if combo {
+			if v := getInt32(rec0, mobiVersion); v != 6 {
+				t.Fatalf("expected MOBI7 header in combo file, got version %d", v)
+			}
+			if getInt16(data, numberOfPdbRecords) != getInt16(src, numberOfPdbRecords) {
+				t.Fatal("combo file has different number of records")
+			}
+		} else {
+			if v := getInt32(rec0, mobiVersion); v != 8 {
+				t.Fatalf("expected KF8 header, got version %d", v)
+			}
+			if firstImage := getInt32(rec0, firstRescRecord); !bytes.HasPrefix(readSection(data, firstImage), []byte("\x89PNG")) {
+				t.Fatal("resources were not moved into KF8 file")
+			}
+		}
+		if got := exthStrings(rec0, exthASIN); len(got) != 1 || got[0] != "B000TEST00" {
+			t.Fatalf("combo %t: unexpected ASIN %q", combo, got)
+		}
+
+		if err := s.SavePageMap(out, false); err != nil {
+			t.Fatal(err)
+		}
+		apnx, err := os.ReadFile(filepath.Join(filepath.Dir(out), "book.apnx"))
+		if err != nil {
+			t.Fatalf("combo %t: APNX was not produced: %v", combo, err)
+		}
+		if getInt16(apnx, 0) != 1 || getInt16(apnx, 2) != 1 {
+			t.Fatalf("bad APNX header % x", apnx[:4])
+		}
+		// page header follows content header
+		ofs := getInt32(apnx, 4)
+		if pages := getInt16(apnx, ofs+4); pages != 2 {
+			t.Fatalf("expected 2 pages in APNX, got %d", pages)
+		}
+		if !bytes.Contains(apnx, []byte(`"asin":"B000TEST00"`)) {
+			t.Fatal("APNX does not reference ASIN")
+		}
+	}
+}
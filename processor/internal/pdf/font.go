@@ -0,0 +1,197 @@
+package pdf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Font is TrueType font embedded into document as composite (Type0) font with Identity-H encoding, so
+// any Unicode text could be shown. Font program is embedded as is, only used glyphs are described.
+type Font struct {
+	name  string
+	data  []byte
+	style Style // what face is designed for, the rest is simulated
+	angle int   // italic angle in degrees
+	ttf   *truetype.Font
+	upem  int
+	used  map[truetype.Index]rune
+	cache map[rune]truetype.Index
+}
+
+// ParseFont prepares TrueType font for embedding.
+func ParseFont(data []byte) (*Font, error) {
+
+	ttf, err := truetype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse font: %w", err)
+	}
+	if ttf.FUnitsPerEm() <= 0 {
+		return nil, errors.New("unable to parse font: bad units per em")
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || strings.ContainsRune("()<>[]{}/%#", r) {
+			return -1
+		}
+		return r
+	}, ttf.Name(truetype.NameIDPostscriptName))
+	if len(name) == 0 {
+		name = "Embedded"
+	}
+
+	style, angle := faceStyle(data)
+	return &Font{
+		name:  name,
+		data:  data,
+		style: style,
+		angle: angle,
+		ttf:   ttf,
+		upem:  int(ttf.FUnitsPerEm()),
+		used:  make(map[truetype.Index]rune),
+		cache: make(map[rune]truetype.Index),
+	}, nil
+}
+
+// faceStyle reads style bits (head.macStyle) and italic angle (post.italicAngle) of the font program.
+func faceStyle(data []byte) (style Style, angle int) {
+
+	if len(data) < 12 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(data[4:]))
+	for i := 0; i < n; i++ {
+		rec := 12 + 16*i
+		if rec+16 > len(data) {
+			break
+		}
+		ofs := int(binary.BigEndian.Uint32(data[rec+8:]))
+		switch string(data[rec : rec+4]) {
+		case "head":
+			if ofs+46 <= len(data) {
+				bits := binary.BigEndian.Uint16(data[ofs+44:])
+				style.Bold, style.Italic = bits&1 != 0, bits&2 != 0
+			}
+		case "post":
+			if ofs+8 <= len(data) {
+				angle = int(int32(binary.BigEndian.Uint32(data[ofs+4:])) >> 16)
+			}
+		}
+	}
+	return style, angle
+}
+
+// Style returns styles font face was designed for, other styles are simulated when text is shown.
+func (f *Font) Style() Style {
+	return f.style
+}
+
+func (f *Font) index(r rune) truetype.Index {
+	if i, ok := f.cache[r]; ok {
+		return i
+	}
+	i := f.ttf.Index(r)
+	f.cache[r] = i
+	return i
+}
+
+// advance returns glyph width in 1/1000 of text space unit.
+func (f *Font) advance(i truetype.Index) int {
+	return int(f.ttf.HMetric(fixed.Int26_6(f.upem), i).AdvanceWidth) * 1000 / f.upem
+}
+
+// Width returns width of the string in points when rendered with font of the specified size.
+func (f *Font) Width(s string, size float64) float64 {
+	var w int
+	for _, r := range s {
+		w += f.advance(f.index(r))
+	}
+	return float64(w) * size / 1000
+}
+
+// Has checks if font has glyph for the rune.
+func (f *Font) Has(r rune) bool {
+	return f.index(r) != 0
+}
+
+// encode converts string to the sequence of glyph indexes (hex string), remembering used glyphs.
+func (f *Font) encode(s string) string {
+	var b strings.Builder
+	b.WriteByte('<')
+	for _, r := range s {
+		i := f.index(r)
+		if _, ok := f.used[i]; !ok {
+			f.used[i] = r
+		}
+		fmt.Fprintf(&b, "%04X", uint16(i))
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+// bbox returns font bounding box in glyph space.
+func (f *Font) bbox() [4]int {
+	b := f.ttf.Bounds(fixed.Int26_6(f.upem))
+	return [4]int{
+		int(b.Min.X) * 1000 / f.upem,
+		int(b.Min.Y) * 1000 / f.upem,
+		int(b.Max.X) * 1000 / f.upem,
+		int(b.Max.Y) * 1000 / f.upem,
+	}
+}
+
+func (f *Font) glyphs() []truetype.Index {
+	res := make([]truetype.Index, 0, len(f.used))
+	for i := range f.used {
+		res = append(res, i)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// widths produces W array of CIDFont.
+func (f *Font) widths() string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for _, i := range f.glyphs() {
+		fmt.Fprintf(&b, "%d [%d] ", i, f.advance(i))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// toUnicode produces CMap making text in resulting document searchable.
+func (f *Font) toUnicode() []byte {
+
+	var b strings.Builder
+	b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n")
+	b.WriteString("/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n")
+	b.WriteString("/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n")
+	b.WriteString("1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+
+	glyphs := f.glyphs()
+	for len(glyphs) > 0 {
+		n := len(glyphs)
+		if n > 100 {
+			n = 100
+		}
+		fmt.Fprintf(&b, "%d beginbfchar\n", n)
+		for _, i := range glyphs[:n] {
+			fmt.Fprintf(&b, "<%04X> <", uint16(i))
+			for _, u := range utf16.Encode([]rune{f.used[i]}) {
+				fmt.Fprintf(&b, "%04X", u)
+			}
+			b.WriteString(">\n")
+		}
+		b.WriteString("endbfchar\n")
+		glyphs = glyphs[n:]
+	}
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	return []byte(b.String())
+}
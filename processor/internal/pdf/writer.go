@@ -0,0 +1,498 @@
+// Package pdf is minimalistic PDF 1.7 writer sufficient to store paginated book: TrueType fonts, images,
+// internal and external links, outlines and document information.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	// supported image formats
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+// Style specifies text decorations.
+type Style struct {
+	Bold   bool
+	Italic bool
+}
+
+// Image is image XObject.
+type Image struct {
+	Width, Height int // in pixels
+	data          []byte
+	filter        string
+	colorSpace    string
+	id            int
+}
+
+// Page is single page of the document, coordinates are in points with origin in the upper left corner.
+type Page struct {
+	doc     *Writer
+	content bytes.Buffer
+	links   []link
+	id      int
+}
+
+type link struct {
+	rect [4]float64
+	dest string // internal destination
+	uri  string
+}
+
+type dest struct {
+	page *Page
+	y    float64
+}
+
+// OutlineItem is document bookmark.
+type OutlineItem struct {
+	Title    string
+	Dest     string
+	Children []*OutlineItem
+	id       int
+}
+
+// Writer accumulates document content.
+type Writer struct {
+	Width, Height float64
+	// document information
+	Title, Author, Lang string
+
+	pages    []*Page
+	fonts    []*Font
+	images   []*Image
+	dests    map[string]dest
+	outlines []*OutlineItem
+	buf      bytes.Buffer
+	offsets  []int
+}
+
+// NewWriter creates document with pages of specified size (in points).
+func NewWriter(width, height float64) *Writer {
+	return &Writer{Width: width, Height: height, dests: make(map[string]dest)}
+}
+
+// AddFont registers font with the document.
+func (w *Writer) AddFont(f *Font) {
+	for _, e := range w.fonts {
+		if e == f {
+			return
+		}
+	}
+	w.fonts = append(w.fonts, f)
+}
+
+func (w *Writer) fontName(f *Font) string {
+	for i, e := range w.fonts {
+		if e == f {
+			return "F" + strconv.Itoa(i+1)
+		}
+	}
+	w.fonts = append(w.fonts, f)
+	return "F" + strconv.Itoa(len(w.fonts))
+}
+
+// AddImage registers image with the document. JPEG images are stored as is, everything else is converted to RGB.
+func (w *Writer) AddImage(data []byte) (*Image, error) {
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode image: %w", err)
+	}
+
+	img := &Image{Width: cfg.Width, Height: cfg.Height}
+	if format == "jpeg" && (cfg.ColorModel == color.YCbCrModel || cfg.ColorModel == color.GrayModel) {
+		img.data, img.filter = data, "DCTDecode"
+		img.colorSpace = "DeviceRGB"
+		if cfg.ColorModel == color.GrayModel {
+			img.colorSpace = "DeviceGray"
+		}
+	} else {
+		src, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode image: %w", err)
+		}
+		// transparent areas are rendered on white
+		rgba := image.NewRGBA(src.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Over)
+
+		raw := make([]byte, 0, 3*img.Width*img.Height)
+		for i := 0; i < len(rgba.Pix); i += 4 {
+			raw = append(raw, rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2])
+		}
+		img.data, img.filter, img.colorSpace = deflate(raw), "FlateDecode", "DeviceRGB"
+	}
+	w.images = append(w.images, img)
+	return img, nil
+}
+
+// NewPage adds empty page to the document.
+func (w *Writer) NewPage() *Page {
+	p := &Page{doc: w}
+	w.pages = append(w.pages, p)
+	return p
+}
+
+// Pages returns number of pages in the document.
+func (w *Writer) Pages() int {
+	return len(w.pages)
+}
+
+// AddDest remembers named position on the page, first registration wins.
+func (w *Writer) AddDest(name string, p *Page, y float64) {
+	if _, ok := w.dests[name]; !ok {
+		w.dests[name] = dest{page: p, y: y}
+	}
+}
+
+// HasDest checks if destination was registered.
+func (w *Writer) HasDest(name string) bool {
+	_, ok := w.dests[name]
+	return ok
+}
+
+// SetOutlines sets document bookmarks.
+func (w *Writer) SetOutlines(items []*OutlineItem) {
+	w.outlines = items
+}
+
+// Text shows string at position (x, y is baseline).
+func (p *Page) Text(f *Font, size, x, y float64, s string, style Style) {
+
+	if len(s) == 0 {
+		return
+	}
+	// only simulate what font face does not have
+	fakeBold, fakeItalic := style.Bold && !f.style.Bold, style.Italic && !f.style.Italic
+	skew := 0.0
+	if fakeItalic {
+		skew = 0.2
+	}
+	fmt.Fprintf(&p.content, "BT /%s %s Tf 1 0 %s 1 %s %s Tm ", p.doc.fontName(f), num(size), num(skew), num(x), num(p.doc.Height-y))
+	if fakeBold {
+		// stroke outlines
+		fmt.Fprintf(&p.content, "2 Tr %s w ", num(size*0.03))
+	}
+	fmt.Fprintf(&p.content, "%s Tj ", f.encode(s))
+	if fakeBold {
+		p.content.WriteString("0 Tr ")
+	}
+	p.content.WriteString("ET\n")
+}
+
+// Image draws image scaled to the rectangle (x, y is upper left corner).
+func (p *Page) Image(img *Image, x, y, width, height float64) {
+	fmt.Fprintf(&p.content, "q %s 0 0 %s %s %s cm /Im%d Do Q\n",
+		num(width), num(height), num(x), num(p.doc.Height-y-height), p.doc.imageIndex(img))
+}
+
+// Line draws line of specified width.
+func (p *Page) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s m %s %s l S\n",
+		num(width), num(x1), num(p.doc.Height-y1), num(x2), num(p.doc.Height-y2))
+}
+
+// Link makes rectangle (x, y is upper left corner) clickable. Target is either internal destination name or URI.
+func (p *Page) Link(x, y, width, height float64, target string, external bool) {
+	l := link{rect: [4]float64{x, p.doc.Height - y - height, x + width, p.doc.Height - y}}
+	if external {
+		l.uri = target
+	} else {
+		l.dest = target
+	}
+	p.links = append(p.links, l)
+}
+
+func (w *Writer) imageIndex(img *Image) int {
+	for i, e := range w.images {
+		if e == img {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// WriteTo produces PDF file.
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+
+	w.buf.Reset()
+	w.offsets = []int{0}
+
+	if len(w.pages) == 0 {
+		w.NewPage()
+	}
+
+	// allocate object numbers
+	var (
+		catalog   = w.alloc()
+		pagesRoot = w.alloc()
+		resources = w.alloc()
+		info      = w.alloc()
+		outlines  int
+	)
+	for _, p := range w.pages {
+		p.id = w.alloc()
+		w.alloc() // content stream
+	}
+	fontIDs := make([]int, len(w.fonts))
+	for i := range w.fonts {
+		fontIDs[i] = w.alloc()
+		w.alloc() // CIDFont
+		w.alloc() // descriptor
+		w.alloc() // font program
+		w.alloc() // ToUnicode
+	}
+	for _, img := range w.images {
+		img.id = w.alloc()
+	}
+	if len(w.outlines) > 0 {
+		outlines = w.alloc()
+		var walk func(items []*OutlineItem)
+		walk = func(items []*OutlineItem) {
+			for _, it := range items {
+				it.id = w.alloc()
+				walk(it.Children)
+			}
+		}
+		walk(w.outlines)
+	}
+
+	w.buf.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+
+	// catalog
+	w.begin(catalog)
+	fmt.Fprintf(&w.buf, "<< /Type /Catalog /Pages %d 0 R", pagesRoot)
+	if outlines > 0 {
+		fmt.Fprintf(&w.buf, " /Outlines %d 0 R /PageMode /UseOutlines", outlines)
+	}
+	if len(w.Lang) > 0 {
+		fmt.Fprintf(&w.buf, " /Lang %s", textString(w.Lang))
+	}
+	w.buf.WriteString(" >>")
+	w.end()
+
+	// page tree
+	w.begin(pagesRoot)
+	fmt.Fprintf(&w.buf, "<< /Type /Pages /Count %d /Kids [", len(w.pages))
+	for _, p := range w.pages {
+		fmt.Fprintf(&w.buf, "%d 0 R ", p.id)
+	}
+	fmt.Fprintf(&w.buf, "] /MediaBox [0 0 %s %s] /Resources %d 0 R >>", num(w.Width), num(w.Height), resources)
+	w.end()
+
+	// pages
+	for _, p := range w.pages {
+		w.begin(p.id)
+		fmt.Fprintf(&w.buf, "<< /Type /Page /Parent %d 0 R /Contents %d 0 R", pagesRoot, p.id+1)
+		if len(p.links) > 0 {
+			w.buf.WriteString(" /Annots [")
+			for _, l := range p.links {
+				d, ok := w.dests[l.dest]
+				if len(l.uri) == 0 && !ok {
+					// dangling link
+					continue
+				}
+				fmt.Fprintf(&w.buf, "<< /Type /Annot /Subtype /Link /Border [0 0 0] /Rect [%s %s %s %s]",
+					num(l.rect[0]), num(l.rect[1]), num(l.rect[2]), num(l.rect[3]))
+				if len(l.uri) > 0 {
+					fmt.Fprintf(&w.buf, " /A << /S /URI /URI %s >>", literalString(l.uri))
+				} else {
+					fmt.Fprintf(&w.buf, " /Dest %s", w.destArray(d))
+				}
+				w.buf.WriteString(" >> ")
+			}
+			w.buf.WriteString("]")
+		}
+		w.buf.WriteString(" >>")
+		w.end()
+		w.stream(p.id+1, "", p.content.Bytes(), true)
+	}
+
+	// resources
+	w.begin(resources)
+	w.buf.WriteString("<< /ProcSet [/PDF /Text /ImageB /ImageC] /Font <<")
+	for i := range w.fonts {
+		fmt.Fprintf(&w.buf, " /F%d %d 0 R", i+1, fontIDs[i])
+	}
+	w.buf.WriteString(" >> /XObject <<")
+	for i, img := range w.images {
+		fmt.Fprintf(&w.buf, " /Im%d %d 0 R", i+1, img.id)
+	}
+	w.buf.WriteString(" >> >>")
+	w.end()
+
+	// fonts
+	for i, f := range w.fonts {
+		id := fontIDs[i]
+		w.begin(id)
+		fmt.Fprintf(&w.buf, "<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>",
+			f.name, id+1, id+4)
+		w.end()
+		w.begin(id + 1)
+		fmt.Fprintf(&w.buf, "<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %d 0 R /CIDToGIDMap /Identity /DW 1000 /W %s >>",
+			f.name, id+2, f.widths())
+		w.end()
+		bb := f.bbox()
+		flags, stemV := 32, 80 // nonsymbolic
+		if f.style.Italic {
+			flags |= 64
+		}
+		if f.style.Bold {
+			flags |= 1 << 18 // force bold
+			stemV = 140
+		}
+		w.begin(id + 2)
+		fmt.Fprintf(&w.buf, "<< /Type /FontDescriptor /FontName /%s /Flags %d /FontBBox [%d %d %d %d] /ItalicAngle %d /Ascent %d /Descent %d /CapHeight %d /StemV %d /FontFile2 %d 0 R >>",
+			f.name, flags, bb[0], bb[1], bb[2], bb[3], f.angle, bb[3], bb[1], bb[3], stemV, id+3)
+		w.end()
+		w.stream(id+3, fmt.Sprintf("/Length1 %d", len(f.data)), f.data, true)
+		w.stream(id+4, "", f.toUnicode(), true)
+	}
+
+	// images
+	for _, img := range w.images {
+		w.stream(img.id, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s",
+			img.Width, img.Height, img.colorSpace, img.filter), img.data, false)
+	}
+
+	// outlines
+	if outlines > 0 {
+		w.begin(outlines)
+		fmt.Fprintf(&w.buf, "<< /Type /Outlines /First %d 0 R /Last %d 0 R /Count %d >>",
+			w.outlines[0].id, w.outlines[len(w.outlines)-1].id, countOutlines(w.outlines))
+		w.end()
+		w.writeOutlines(w.outlines, outlines)
+	}
+
+	// document information
+	w.begin(info)
+	fmt.Fprintf(&w.buf, "<< /Creator (fb2converter) /Producer (fb2converter) /CreationDate %s", literalString(time.Now().Format("D:20060102150405")))
+	if len(w.Title) > 0 {
+		fmt.Fprintf(&w.buf, " /Title %s", textString(w.Title))
+	}
+	if len(w.Author) > 0 {
+		fmt.Fprintf(&w.buf, " /Author %s", textString(w.Author))
+	}
+	w.buf.WriteString(" >>")
+	w.end()
+
+	// cross reference table
+	xref := w.buf.Len()
+	fmt.Fprintf(&w.buf, "xref\n0 %d\n0000000000 65535 f \n", len(w.offsets))
+	for _, ofs := range w.offsets[1:] {
+		fmt.Fprintf(&w.buf, "%010d 00000 n \n", ofs)
+	}
+	fmt.Fprintf(&w.buf, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(w.offsets), catalog, info, xref)
+
+	n, err := out.Write(w.buf.Bytes())
+	return int64(n), err
+}
+
+func (w *Writer) writeOutlines(items []*OutlineItem, parent int) {
+	for i, it := range items {
+		w.begin(it.id)
+		fmt.Fprintf(&w.buf, "<< /Title %s /Parent %d 0 R", textString(it.Title), parent)
+		if i > 0 {
+			fmt.Fprintf(&w.buf, " /Prev %d 0 R", items[i-1].id)
+		}
+		if i < len(items)-1 {
+			fmt.Fprintf(&w.buf, " /Next %d 0 R", items[i+1].id)
+		}
+		if len(it.Children) > 0 {
+			fmt.Fprintf(&w.buf, " /First %d 0 R /Last %d 0 R /Count %d", it.Children[0].id, it.Children[len(it.Children)-1].id, -countOutlines(it.Children))
+		}
+		if d, ok := w.dests[it.Dest]; ok {
+			fmt.Fprintf(&w.buf, " /Dest %s", w.destArray(d))
+		}
+		w.buf.WriteString(" >>")
+		w.end()
+		w.writeOutlines(it.Children, it.id)
+	}
+}
+
+func countOutlines(items []*OutlineItem) int {
+	n := len(items)
+	for _, it := range items {
+		n += countOutlines(it.Children)
+	}
+	return n
+}
+
+func (w *Writer) destArray(d dest) string {
+	return fmt.Sprintf("[%d 0 R /XYZ null %s null]", d.page.id, num(w.Height-d.y))
+}
+
+func (w *Writer) alloc() int {
+	w.offsets = append(w.offsets, 0)
+	return len(w.offsets) - 1
+}
+
+func (w *Writer) begin(id int) {
+	w.offsets[id] = w.buf.Len()
+	fmt.Fprintf(&w.buf, "%d 0 obj\n", id)
+}
+
+func (w *Writer) end() {
+	w.buf.WriteString("\nendobj\n")
+}
+
+func (w *Writer) stream(id int, dict string, data []byte, compress bool) {
+	if compress {
+		data = deflate(data)
+		dict = strings.TrimSpace(dict + " /Filter /FlateDecode")
+	}
+	w.begin(id)
+	fmt.Fprintf(&w.buf, "<< %s /Length %d >>\nstream\n", dict, len(data))
+	w.buf.Write(data)
+	w.buf.WriteString("\nendstream")
+	w.end()
+}
+
+func deflate(data []byte) []byte {
+	var b bytes.Buffer
+	z := zlib.NewWriter(&b)
+	_, _ = z.Write(data)
+	_ = z.Close()
+	return b.Bytes()
+}
+
+// num formats number without unnecessary precision.
+func num(v float64) string {
+	if math.Abs(v) < 0.0005 {
+		return "0"
+	}
+	return strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64)
+}
+
+// literalString escapes ASCII string.
+func literalString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`, "\r", `\r`, "\n", `\n`)
+	return "(" + r.Replace(s) + ")"
+}
+
+// textString encodes arbitrary text as UTF-16BE with BOM.
+func textString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteByte('>')
+	return b.String()
+}
@@ -124,7 +124,7 @@ func (p *Processor) FinalizeAZW3(fname string) error {
 	return nil
 }
 
-// generateIntermediateContent produces temporary mobi file, presently by running kindlegen and returns its full path.
+// generateIntermediateContent produces temporary mobi file, by running kindlegen or built-in writer and returns its full path.
 func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 
 	workDir := filepath.Join(p.tmpDir, DirContent)
@@ -133,6 +133,20 @@ func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 	}
 	workFile := strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname)) + ".mobi"
 
+	if p.env.Cfg.Doc.Kindlegen.Native {
+		return p.generateNativeContent(workDir, workFile)
+	}
+
+	if p.env.KindlegenSlots != nil {
+		// kindlegen is heavy on memory, do not run too many at once
+		select {
+		case p.env.KindlegenSlots <- struct{}{}:
+		case <-p.runCtx.Done():
+			return "", p.runCtx.Err()
+		}
+		defer func() { <-p.env.KindlegenSlots }()
+	}
+
 	args := make([]string, 0, 10)
 	if p.kind == InEpub {
 		args = append(args, filepath.Join(p.tmpDir, filepath.Base(p.src)))
@@ -146,7 +160,8 @@ func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 	}
 	args = append(args, "-o", workFile)
 
-	cmd := exec.Command(p.kindlegenPath, args...)
+	// hung kindlegen is killed when conversion is cancelled
+	cmd := exec.CommandContext(p.runCtx, p.kindlegenPath, args...)
 
 	p.env.Log.Debug("kindlegen staring")
 	defer func(start time.Time) {
@@ -177,6 +192,9 @@ func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 
 	result := filepath.Join(workDir, workFile)
 	if err := cmd.Wait(); err != nil {
+		if cerr := p.runCtx.Err(); cerr != nil {
+			return "", fmt.Errorf("kindlegen was stopped: %w", cerr)
+		}
 		if ee, ok := err.(*exec.ExitError); ok {
 			if len(ee.Stderr) > 0 {
 				p.env.Log.Error("kindlegen", zap.String("stderr", string(ee.Stderr)), zap.Error(err))
@@ -205,3 +223,30 @@ func (p *Processor) generateIntermediateContent(fname string) (string, error) {
 	}
 	return result, nil
 }
+
+// generateNativeContent produces temporary mobi file using built-in writer instead of kindlegen and returns its full path.
+func (p *Processor) generateNativeContent(workDir, workFile string) (string, error) {
+
+	opf := filepath.Join(workDir, "content.opf")
+	if p.kind == InEpub {
+		var err error
+		if opf, err = unzipEPUB(filepath.Join(p.tmpDir, filepath.Base(p.src)), p.tmpDir); err != nil {
+			return "", err
+		}
+	}
+
+	p.env.Log.Debug("Writing MOBI - starting", zap.String("opf", opf))
+	defer func(start time.Time) {
+		p.env.Log.Debug("Writing MOBI - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	w, err := mobi.NewWriter(opf, p.env.Cfg.Doc.Kindlegen.CompressionLevel, p.env.Log)
+	if err != nil {
+		return "", fmt.Errorf("unable to produce MOBI content: %w", err)
+	}
+	result := filepath.Join(workDir, workFile)
+	if err := w.SaveResult(result); err != nil {
+		return "", fmt.Errorf("unable to save MOBI content: %w", err)
+	}
+	return result, nil
+}
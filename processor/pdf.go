@@ -0,0 +1,910 @@
+package processor
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"fb2converter/etree"
+	"fb2converter/processor/internal/pdf"
+	"fb2converter/static"
+)
+
+// pdfProfile describes page geometry, all values are in points.
+type pdfProfile struct {
+	width, height float64
+	margin        float64
+	size          float64 // base font size
+}
+
+// Supported page sizes: e-ink screens (visible area) and paper.
+var pdfProfiles = map[string]pdfProfile{
+	"6in":   {width: 259.2, height: 345.6, margin: 10, size: 9},
+	"7.8in": {width: 337, height: 449, margin: 14, size: 10},
+	"10in":  {width: 445, height: 593, margin: 24, size: 11},
+	"a5":    {width: 420, height: 595, margin: 36, size: 11},
+	"a4":    {width: 595, height: 842, margin: 56, size: 12},
+}
+
+// text alignment
+const (
+	pdfJustify = iota
+	pdfLeft
+	pdfCenter
+	pdfRight
+)
+
+// pdfBox is smallest piece of inline content: word, syllable, space or anchor.
+type pdfBox struct {
+	text     string
+	style    pdf.Style
+	link     string
+	external bool
+	ids      []string
+	glue     bool // breakable space
+	hyph     bool // line could be broken after this box, hyphen is added then
+	br       bool // forced line break
+}
+
+// pdfChunk is unbreakable sequence of boxes.
+type pdfChunk struct {
+	boxes []*pdfBox
+	width float64
+	space bool // preceded by space
+	hyph  bool
+}
+
+type pdfLine struct {
+	chunks []*pdfChunk
+	width  float64 // natural width
+	last   bool    // should not be justified
+}
+
+// pdfPara is formatting of block level content.
+type pdfPara struct {
+	size        float64
+	style       pdf.Style
+	align       int
+	indent      float64 // first line
+	left, right float64 // relative to the page content area
+}
+
+// pdfLayout paginates generated XHTML.
+type pdfLayout struct {
+	p       *Processor
+	w       *pdf.Writer
+	faces   [4]*pdf.Font // indexed by pdfFace
+	prof    pdfProfile
+	headers bool
+	images  map[string]*pdf.Image
+	fname   string // file being processed, to resolve relative links
+
+	page                     *pdf.Page
+	y                        float64 // top of the next line
+	top, bottom, left, right float64
+	pending                  []string // ids to be placed with next content
+
+	title      string // current chapter title for running headers
+	pageTitle  string
+	noHeader   bool // current page starts chapter
+	noFooter   bool // current page is cover
+	chapterNew bool // next page starts chapter
+}
+
+// FinalizePDF lays out XHTML content generated from fb2 and produces paginated pdf document.
+func (p *Processor) FinalizePDF(fname string) error {
+
+	if _, err := os.Stat(fname); err == nil {
+		if !p.env.Debug && !p.overwrite {
+			return fmt.Errorf("output file already exists: %s", fname)
+		}
+		p.env.Log.Warn("Overwriting existing file", zap.String("file", fname))
+		if err = os.Remove(fname); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	cfg := p.env.Cfg.Doc.PDF
+	prof, ok := pdfProfiles[strings.ToLower(cfg.Profile)]
+	if !ok {
+		p.env.Log.Warn("Unknown pdf profile requested, using default", zap.String("profile", cfg.Profile))
+		prof = pdfProfiles["6in"]
+	}
+	if cfg.FontSize > 0 {
+		prof.size = cfg.FontSize
+	}
+	if cfg.Margin > 0 {
+		prof.margin = cfg.Margin
+	}
+
+	faces, err := p.loadPDFFonts()
+	if err != nil {
+		return err
+	}
+
+	l := p.newPDFLayout(prof, faces, cfg.RunningHeaders)
+	l.w.Title = p.Book.Title
+	l.w.Author = p.Book.BookAuthors(p.env.Cfg.Doc.AuthorFormat, false)
+	l.w.Lang = p.Book.Lang.String()
+
+	for _, f := range p.Book.Files {
+		if f.transient&dataNotForSpline != 0 || f.doc == nil {
+			continue
+		}
+		body := f.doc.FindElement("./html/body")
+		if body == nil {
+			continue
+		}
+		l.fname = f.fname
+		switch f.id {
+		case "cover":
+			l.cover(body)
+			continue
+		case "toc":
+			l.pageBreak()
+		}
+		l.anchor("file:" + f.fname)
+		l.blocks(body, l.para())
+		if f.id == "toc" {
+			l.pageBreak()
+		}
+	}
+	l.finishPage()
+
+	l.w.SetOutlines(l.outlines())
+
+	out, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("unable to create PDF (%s): %w", fname, err)
+	}
+	defer out.Close()
+
+	if _, err := l.w.WriteTo(out); err != nil {
+		return fmt.Errorf("unable to write PDF (%s): %w", fname, err)
+	}
+	return nil
+}
+
+// Built-in fonts for the text, files are in DirResources.
+var pdfFonts = [4]string{"Go-Regular.ttf", "Go-Bold.ttf", "Go-Italic.ttf", "Go-Bold-Italic.ttf"}
+
+// pdfFace returns index of the font for the style.
+func pdfFace(style pdf.Style) int {
+	i := 0
+	if style.Bold {
+		i |= 1
+	}
+	if style.Italic {
+		i |= 2
+	}
+	return i
+}
+
+// loadPDFFonts prepares fonts for all text styles. Fonts from configuration are used when specified, styles without
+// font use regular one and built-in fonts are used when there is no regular font in configuration either. Fonts are
+// only embedded into document when text uses them.
+func (p *Processor) loadPDFFonts() (faces [4]*pdf.Font, err error) {
+
+	cfg := p.env.Cfg.Doc.PDF.Fonts
+	names := [4]string{cfg.Regular, cfg.Bold, cfg.Italic, cfg.BoldItalic}
+	for i, name := range names {
+		if i > 0 && len(name) == 0 && len(cfg.Regular) > 0 {
+			faces[i] = faces[0]
+			continue
+		}
+		var data []byte
+		if len(name) > 0 {
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(p.env.Cfg.Path, name)
+			}
+			if data, err = os.ReadFile(name); err != nil {
+				return faces, fmt.Errorf("unable to read pdf font: %w", err)
+			}
+		} else if data, err = static.Asset(path.Join(DirResources, pdfFonts[i])); err != nil {
+			return faces, fmt.Errorf("unable to get default pdf font: %w", err)
+		}
+		if faces[i], err = pdf.ParseFont(data); err != nil {
+			return faces, err
+		}
+	}
+	return faces, nil
+}
+
+// face returns font for text of the style.
+func (l *pdfLayout) face(style pdf.Style) *pdf.Font {
+	return l.faces[pdfFace(style)]
+}
+
+func (p *Processor) newPDFLayout(prof pdfProfile, faces [4]*pdf.Font, headers bool) *pdfLayout {
+	l := &pdfLayout{
+		p:       p,
+		w:       pdf.NewWriter(prof.width, prof.height),
+		faces:   faces,
+		prof:    prof,
+		headers: headers,
+		images:  make(map[string]*pdf.Image),
+		left:    prof.margin,
+		right:   prof.width - prof.margin,
+		top:     prof.margin,
+		bottom:  prof.height - prof.margin - prof.size*1.4,
+	}
+	if l.headers {
+		l.top += prof.size * 1.4
+	}
+	return l
+}
+
+// para returns default paragraph formatting.
+func (l *pdfLayout) para() pdfPara {
+	return pdfPara{size: l.prof.size, align: pdfJustify, indent: l.prof.size * 1.5}
+}
+
+func (l *pdfLayout) lineHeight(size float64) float64 {
+	return size * 1.25
+}
+
+// need makes sure that there is enough vertical space left on the page, starting new one if necessary.
+func (l *pdfLayout) need(h float64) {
+	if l.page == nil || l.y+h > l.bottom && l.y > l.top {
+		l.newPage()
+	}
+}
+
+func (l *pdfLayout) newPage() {
+	l.finishPage()
+	l.page = l.w.NewPage()
+	l.y = l.top
+	l.pageTitle = l.title
+	l.noHeader, l.noFooter = l.chapterNew, false
+	l.chapterNew = false
+}
+
+// finishPage draws page furniture.
+func (l *pdfLayout) finishPage() {
+
+	if l.page == nil || l.noFooter {
+		return
+	}
+	size := l.prof.size * 0.75
+	num := strconv.Itoa(l.w.Pages())
+	regular := l.face(pdf.Style{})
+	l.page.Text(regular, size, (l.prof.width-regular.Width(num, size))/2, l.prof.height-l.prof.margin, num, pdf.Style{})
+
+	if !l.headers || l.noHeader || len(l.pageTitle) == 0 {
+		return
+	}
+	style := pdf.Style{Italic: true}
+	font, title, width := l.face(style), []rune(l.pageTitle), l.right-l.left
+	for len(title) > 1 && font.Width(string(title), size) > width {
+		title = append(title[:len(title)-2], '…')
+	}
+	s := string(title)
+	l.page.Text(font, size, (l.prof.width-font.Width(s, size))/2, l.prof.margin+size, s, style)
+}
+
+// pageBreak makes sure that next content starts new chapter page.
+func (l *pdfLayout) pageBreak() {
+	if l.page != nil && l.y > l.top {
+		l.finishPage()
+		l.page = nil
+		l.chapterNew = true
+	} else if l.page != nil {
+		l.noHeader = true
+	} else {
+		l.chapterNew = true
+	}
+}
+
+// gap adds vertical space, which is never added at the top of the page.
+func (l *pdfLayout) gap(h float64) {
+	if l.page != nil && l.y > l.top {
+		l.y += h
+	}
+}
+
+// anchor remembers destination to be placed with next content.
+func (l *pdfLayout) anchor(id string) {
+	l.pending = append(l.pending, id)
+}
+
+func (l *pdfLayout) place(y float64) {
+	for _, id := range l.pending {
+		l.w.AddDest(id, l.page, y)
+	}
+	l.pending = l.pending[:0]
+}
+
+// dest converts href to the destination name.
+func (l *pdfLayout) dest(href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+	switch {
+	case len(u.Scheme) > 0 || len(u.Host) > 0:
+		return href, true
+	case len(u.Fragment) > 0:
+		// ids are unique book wide (see Book.LinksLocations)
+		return u.Fragment, false
+	case len(u.Path) == 0:
+		return "file:" + l.fname, false
+	default:
+		return "file:" + u.Path, false
+	}
+}
+
+func (l *pdfLayout) outlines() []*pdf.OutlineItem {
+
+	type level struct {
+		level int
+		item  *pdf.OutlineItem
+	}
+
+	var (
+		roots []*pdf.OutlineItem
+		stack []level
+	)
+	for _, e := range l.p.Book.TOC {
+		dest, _ := l.dest(e.ref)
+		it := &pdf.OutlineItem{Title: AllLines(e.title), Dest: dest}
+		for len(stack) > 0 && stack[len(stack)-1].level >= e.level.Int() {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			roots = append(roots, it)
+		} else {
+			parent := stack[len(stack)-1].item
+			parent.Children = append(parent.Children, it)
+		}
+		stack = append(stack, level{level: e.level.Int(), item: it})
+	}
+	return roots
+}
+
+// cover puts cover image on the separate page.
+func (l *pdfLayout) cover(body *etree.Element) {
+
+	var src string
+	if e := body.FindElement(".//image"); e != nil {
+		src = getAttrValue(e, "href")
+	} else if e := body.FindElement(".//img"); e != nil {
+		src = getAttrValue(e, "src")
+	}
+	img := l.image(src)
+	if img == nil {
+		return
+	}
+
+	l.pageBreak()
+	l.newPage()
+	l.noFooter = true
+
+	w, h := l.prof.width, l.prof.height
+	if float64(img.Width)*h > float64(img.Height)*w {
+		h = w * float64(img.Height) / float64(img.Width)
+	} else {
+		w = h * float64(img.Width) / float64(img.Height)
+	}
+	l.page.Image(img, (l.prof.width-w)/2, (l.prof.height-h)/2, w, h)
+	l.y = l.bottom
+	l.pageBreak()
+}
+
+// image loads (once) image referenced from the content.
+func (l *pdfLayout) image(src string) *pdf.Image {
+
+	name := path.Clean(src)
+	if len(src) == 0 || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+		return nil
+	}
+	if img, ok := l.images[name]; ok {
+		return img
+	}
+	l.images[name] = nil
+
+	data, err := os.ReadFile(filepath.Join(l.p.tmpDir, DirContent, filepath.FromSlash(name)))
+	if err != nil {
+		l.p.env.Log.Warn("Unable to read image, skipping", zap.String("ref", src), zap.Error(err))
+		return nil
+	}
+	img, err := l.w.AddImage(data)
+	if err != nil {
+		l.p.env.Log.Warn("Unable to use image, skipping", zap.String("ref", src), zap.Error(err))
+		return nil
+	}
+	l.images[name] = img
+	return img
+}
+
+// blockImage puts image centered between paragraphs, image is scaled down to fit page if necessary.
+func (l *pdfLayout) blockImage(src string, pp pdfPara) {
+
+	img := l.image(src)
+	if img == nil {
+		return
+	}
+
+	// assume 96 dpi
+	w, h := float64(img.Width)*0.75, float64(img.Height)*0.75
+	if avail := l.right - l.left - pp.left - pp.right; w > avail {
+		w, h = avail, h*avail/w
+	}
+	if avail := l.bottom - l.top; h > avail {
+		w, h = w*avail/h, avail
+	}
+
+	l.need(h)
+	l.place(l.y)
+	l.page.Image(img, l.left+pp.left+(l.right-l.left-pp.left-pp.right-w)/2, l.y, w, h)
+	l.y += h
+}
+
+// blocks walks block level content.
+func (l *pdfLayout) blocks(e *etree.Element, pp pdfPara) {
+	for _, c := range e.ChildElements() {
+		l.block(c, pp)
+	}
+}
+
+func (l *pdfLayout) block(c *etree.Element, pp pdfPara) {
+
+	if id := getAttrValue(c, "id"); len(id) > 0 {
+		l.anchor(id)
+	}
+
+	lh := l.lineHeight(pp.size)
+	css := getAttrValue(c, "class")
+	switch {
+	case css == "titleblock":
+		l.pageBreak()
+		l.blocks(c, pp)
+	case textHeaderCSS.MatchString(css):
+		level, _ := strconv.Atoi(css[1:])
+		l.heading(c, level, pp)
+	case textSkippedCSS[css] || c.Tag == "img" || c.Tag == "svg":
+		// vignettes and images
+		if c.Tag == "img" || c.Tag == "svg" {
+			l.blockImages(c, pp)
+		} else {
+			for _, e := range c.ChildElements() {
+				l.blockImages(e, pp)
+			}
+		}
+	case css == "epigraph":
+		pp.left += (l.right - l.left) / 3
+		l.blocks(c, pp)
+		l.gap(lh / 2)
+	case css == "cite" || css == "annotation":
+		pp.left += pp.size * 1.5
+		pp.right += pp.size * 1.5
+		l.blocks(c, pp)
+		l.gap(lh / 2)
+	case css == "poem":
+		pp.left += pp.size * 2
+		pp.align, pp.indent = pdfLeft, 0
+		l.blocks(c, pp)
+		l.gap(lh / 2)
+	case css == "stanza":
+		l.blocks(c, pp)
+		l.gap(lh / 2)
+	case css == "text-author":
+		pp.align, pp.indent, pp.style.Italic = pdfRight, 0, true
+		l.paragraph(l.inline(c, pp.style, nil), pp)
+	case css == "subtitle" || css == "titlenotes":
+		pp.align, pp.indent, pp.style.Bold = pdfCenter, 0, true
+		l.gap(lh / 2)
+		l.paragraph(l.inline(c, pp.style, nil), pp)
+		l.gap(lh / 2)
+	case css == "emptyline":
+		l.gap(lh)
+	case strings.HasPrefix(css, "indent"):
+		// TOC page entries
+		n, _ := strconv.Atoi(strings.TrimPrefix(css, "indent"))
+		pp.left += float64(n) * pp.size * 1.5
+		pp.align, pp.indent = pdfLeft, 0
+		l.paragraph(l.inline(c, pp.style, nil), pp)
+	case c.Tag == "table":
+		l.table(c, pp)
+	case c.Tag == "p" || !hasBlocks(c):
+		l.paragraph(l.inline(c, pp.style, nil), pp)
+	default:
+		l.blocks(c, pp)
+	}
+}
+
+func (l *pdfLayout) blockImages(e *etree.Element, pp pdfPara) {
+	switch e.Tag {
+	case "img":
+		l.blockImage(getAttrValue(e, "src"), pp)
+	case "svg":
+		if i := e.FindElement(".//image"); i != nil {
+			l.blockImage(getAttrValue(i, "href"), pp)
+		}
+	}
+}
+
+// heading draws centered title, keeping it together with following text.
+func (l *pdfLayout) heading(e *etree.Element, level int, pp pdfPara) {
+
+	switch level {
+	case 0:
+		pp.size *= 1.6
+	case 1:
+		pp.size *= 1.4
+	case 2:
+		pp.size *= 1.2
+	default:
+		pp.size *= 1.1
+	}
+	pp.align, pp.indent, pp.style.Bold = pdfCenter, 0, true
+
+	titles := e.SelectElements("p")
+	if len(titles) == 0 {
+		titles = []*etree.Element{e}
+	}
+
+	var (
+		lines [][]*pdfLine
+		plain []string
+		h     float64
+		lh    = l.lineHeight(pp.size)
+	)
+	for _, t := range titles {
+		boxes := l.inline(t, pp.style, nil)
+		ls := l.breakLines(boxes, pp)
+		lines = append(lines, ls)
+		plain = append(plain, plainText(boxes))
+		h += float64(len(ls)) * lh
+	}
+	if level <= 1 {
+		l.title = strings.TrimSpace(strings.Join(plain, " "))
+	}
+
+	l.gap(lh / 2)
+	// keep with next
+	l.need(h + 2*l.lineHeight(l.prof.size))
+	for _, ls := range lines {
+		l.drawLines(ls, pp)
+	}
+	l.gap(lh / 2)
+}
+
+func (l *pdfLayout) table(e *etree.Element, pp pdfPara) {
+
+	rows := e.FindElements(".//tr")
+	cols := 0
+	for _, tr := range rows {
+		if n := len(tr.ChildElements()); n > cols {
+			cols = n
+		}
+	}
+	if cols == 0 {
+		return
+	}
+
+	pp.size *= 0.9
+	pp.indent, pp.left, pp.right = 0, pp.left+2, pp.right+2
+	var (
+		lh    = l.lineHeight(pp.size)
+		x0    = l.left + pp.left - 2
+		width = (l.right - l.left - pp.left - pp.right + 4) / float64(cols)
+	)
+
+	l.gap(lh / 2)
+	for _, tr := range rows {
+		cells := tr.ChildElements()
+		lines := make([][]*pdfLine, len(cells))
+		paras := make([]pdfPara, len(cells))
+		h := 0.0
+		for i, td := range cells {
+			cp := pp
+			cp.left = pp.left + float64(i)*width
+			cp.right = pp.right + float64(cols-i-1)*width
+			cp.align = pdfLeft
+			if td.Tag == "th" {
+				cp.style.Bold, cp.align = true, pdfCenter
+			}
+			paras[i] = cp
+			lines[i] = l.breakLines(l.inline(td, cp.style, nil), cp)
+			if ch := float64(len(lines[i])) * lh; ch > h {
+				h = ch
+			}
+		}
+		h += 4
+
+		l.need(h)
+		l.place(l.y)
+		top := l.y
+		for i := range cells {
+			y := top + 2
+			for _, ln := range lines[i] {
+				l.drawLine(ln, paras[i], y)
+				y += lh
+			}
+		}
+		l.page.Line(x0, top, x0+width*float64(cols), top, 0.5)
+		l.page.Line(x0, top+h, x0+width*float64(cols), top+h, 0.5)
+		for i := 0; i <= cols; i++ {
+			l.page.Line(x0+float64(i)*width, top, x0+float64(i)*width, top+h, 0.5)
+		}
+		l.y += h
+	}
+	l.gap(lh / 2)
+}
+
+// paragraph breaks text into lines and puts them on pages.
+func (l *pdfLayout) paragraph(boxes []*pdfBox, pp pdfPara) {
+	lines := l.breakLines(boxes, pp)
+	if len(lines) == 0 {
+		if len(l.pending) > 0 {
+			// keep anchors of empty paragraphs
+			l.need(0)
+			l.place(l.y)
+		}
+		return
+	}
+	l.drawLines(lines, pp)
+}
+
+func (l *pdfLayout) drawLines(lines []*pdfLine, pp pdfPara) {
+	lh := l.lineHeight(pp.size)
+	for i, ln := range lines {
+		l.need(lh)
+		l.place(l.y)
+		if i > 0 {
+			pp.indent = 0
+		}
+		l.drawLine(ln, pp, l.y)
+		l.y += lh
+	}
+}
+
+// breakLines splits boxes into lines of available width. Simple greedy algorithm is good enough for small screens.
+func (l *pdfLayout) breakLines(boxes []*pdfBox, pp pdfPara) []*pdfLine {
+
+	var (
+		chunks []*pdfChunk
+		cur    *pdfChunk
+		space  bool
+		lines  []*pdfLine
+	)
+	flush := func() {
+		if cur != nil && len(cur.boxes) > 0 {
+			chunks = append(chunks, cur)
+		}
+		cur = nil
+	}
+	for _, b := range boxes {
+		switch {
+		case b.glue:
+			flush()
+			space = true
+			continue
+		case b.br:
+			flush()
+			chunks = append(chunks, nil)
+			space = false
+			continue
+		}
+		if cur == nil {
+			cur = &pdfChunk{space: space}
+			space = false
+		}
+		cur.boxes = append(cur.boxes, b)
+		cur.width += l.face(b.style).Width(b.text, pp.size)
+		if b.hyph {
+			cur.hyph = true
+			flush()
+		}
+	}
+	flush()
+
+	var (
+		spaceW = l.face(pp.style).Width(" ", pp.size)
+		line   = &pdfLine{}
+		avail  = l.right - l.left - pp.left - pp.right - pp.indent
+	)
+	// hyphen is drawn in the style of the last syllable
+	hyphW := func(c *pdfChunk) float64 {
+		return l.face(c.boxes[len(c.boxes)-1].style).Width("-", pp.size)
+	}
+	for _, c := range chunks {
+		if c == nil {
+			// forced break
+			line.last = true
+			lines = append(lines, line)
+			line, avail = &pdfLine{}, l.right-l.left-pp.left-pp.right
+			continue
+		}
+		w := c.width
+		if len(line.chunks) > 0 && c.space {
+			w += spaceW
+		}
+		need := w
+		if c.hyph {
+			need += hyphW(c)
+		}
+		if len(line.chunks) > 0 && line.width+need > avail {
+			lines = append(lines, line)
+			line, avail = &pdfLine{}, l.right-l.left-pp.left-pp.right
+			w = c.width
+		}
+		line.chunks = append(line.chunks, c)
+		line.width += w
+	}
+	if len(line.chunks) > 0 {
+		line.last = true
+		lines = append(lines, line)
+	}
+
+	// drop lines with nothing to show and not anchored
+	res := lines[:0]
+	for _, ln := range lines {
+		if len(ln.chunks) > 0 {
+			if c := ln.chunks[len(ln.chunks)-1]; c.hyph && !ln.last {
+				ln.width += hyphW(c)
+			}
+			res = append(res, ln)
+		}
+	}
+	return res
+}
+
+// drawLine puts line on the current page, y is top of the line.
+func (l *pdfLayout) drawLine(ln *pdfLine, pp pdfPara, y float64) {
+
+	var (
+		spaceW   = l.face(pp.style).Width(" ", pp.size)
+		avail    = l.right - l.left - pp.left - pp.right - pp.indent
+		x        = l.left + pp.left + pp.indent
+		lh       = l.lineHeight(pp.size)
+		baseline = y + lh*0.8
+		spaces   int
+	)
+	for i, c := range ln.chunks {
+		if i > 0 && c.space {
+			spaces++
+		}
+	}
+	switch {
+	case pp.align == pdfCenter:
+		x += (avail - ln.width) / 2
+	case pp.align == pdfRight:
+		x += avail - ln.width
+	case pp.align == pdfJustify && !ln.last && spaces > 0 && ln.width < avail:
+		spaceW += (avail - ln.width) / float64(spaces)
+	}
+
+	for i, c := range ln.chunks {
+		if i > 0 && c.space {
+			x += spaceW
+		}
+		for j, b := range c.boxes {
+			for _, id := range b.ids {
+				l.w.AddDest(id, l.page, y)
+			}
+			text := b.text
+			if j == len(c.boxes)-1 && c.hyph && i == len(ln.chunks)-1 && !ln.last {
+				text += "-"
+			}
+			if len(text) == 0 {
+				continue
+			}
+			font := l.face(b.style)
+			w := font.Width(text, pp.size)
+			l.page.Text(font, pp.size, x, baseline, text, b.style)
+			if len(b.link) > 0 {
+				l.page.Link(x, y, w, lh, b.link, b.external)
+			}
+			x += w
+		}
+	}
+}
+
+// inline collects formatted text of the element.
+func (l *pdfLayout) inline(e *etree.Element, style pdf.Style, link *pdfBox) []*pdfBox {
+
+	var boxes []*pdfBox
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			boxes = l.words(boxes, t.Data, style, link)
+		case *etree.Element:
+			boxes = append(boxes, l.inlineElement(t, style, link)...)
+			boxes = l.words(boxes, t.TailData, style, link)
+		}
+	}
+	return boxes
+}
+
+func (l *pdfLayout) inlineElement(e *etree.Element, style pdf.Style, link *pdfBox) []*pdfBox {
+
+	var boxes []*pdfBox
+	if id := getAttrValue(e, "id"); len(id) > 0 {
+		boxes = append(boxes, &pdfBox{ids: []string{id}})
+	}
+
+	css := getAttrValue(e, "class")
+	switch e.Tag {
+	case "br":
+		return append(boxes, &pdfBox{br: true})
+	case "img", "svg":
+		return boxes
+	case "a":
+		if css == "pagemarker" {
+			return nil
+		}
+		if href := getAttrValue(e, "href"); len(href) > 0 {
+			if dest, external := l.dest(href); len(dest) > 0 {
+				link = &pdfBox{link: dest, external: external}
+			}
+		}
+	case "strong", "b":
+		style.Bold = true
+	case "em", "i":
+		style.Italic = true
+	case "span":
+		switch css {
+		case "strong":
+			style.Bold = true
+		case "emphasis":
+			style.Italic = true
+		}
+	}
+	return append(boxes, l.inline(e, style, link)...)
+}
+
+// words splits text into boxes on spaces and soft hyphens.
+func (l *pdfLayout) words(boxes []*pdfBox, s string, style pdf.Style, link *pdfBox) []*pdfBox {
+
+	var word strings.Builder
+	emit := func(hyph bool) {
+		if word.Len() == 0 {
+			return
+		}
+		b := &pdfBox{text: word.String(), style: style, hyph: hyph}
+		if link != nil {
+			b.link, b.external = link.link, link.external
+		}
+		boxes = append(boxes, b)
+		word.Reset()
+	}
+
+	for _, r := range s {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			emit(false)
+			if len(boxes) == 0 || !boxes[len(boxes)-1].glue {
+				boxes = append(boxes, &pdfBox{glue: true})
+			}
+		case '\u00AD':
+			emit(true)
+		default:
+			word.WriteRune(r)
+		}
+	}
+	emit(false)
+	return boxes
+}
+
+func plainText(boxes []*pdfBox) string {
+	var b strings.Builder
+	for _, box := range boxes {
+		if box.glue {
+			b.WriteByte(' ')
+		} else {
+			b.WriteString(box.text)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,265 @@
+package processor
+
+import (
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+	"fb2converter/processor/internal/pdf"
+	"fb2converter/state"
+	"fb2converter/static"
+)
+
+const pdfTestText = `Молоток — небольшой ударный ручной инструмент, применяемый для забивания гвоздей, разбивания предметов и других
+работ. Обычно изготавливается из стали и имеет деревянную или пластиковую ручку, которая крепится к бойку клином.`
+
+func testPDFLayout(t *testing.T, cfg *config.Config) *pdfLayout {
+	t.Helper()
+
+	if cfg == nil {
+		var err error
+		if cfg, err = config.BuildConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &Processor{Book: &Book{}, env: &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}}
+	faces, err := p.loadPDFFonts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.newPDFLayout(pdfProfiles["6in"], faces, false)
+}
+
+// lineText restores text of the line as it will be drawn.
+func lineText(ln *pdfLine) string {
+	var b strings.Builder
+	for i, c := range ln.chunks {
+		if i > 0 && c.space {
+			b.WriteByte(' ')
+		}
+		for _, box := range c.boxes {
+			b.WriteString(box.text)
+		}
+		if c.hyph && i == len(ln.chunks)-1 && !ln.last {
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+func TestPDFFaces(t *testing.T) {
+
+	l := testPDFLayout(t, nil)
+	for _, st := range []pdf.Style{{}, {Bold: true}, {Italic: true}, {Bold: true, Italic: true}} {
+		if f := l.face(st); f.Style() != st {
+			t.Errorf("built-in font for %+v is designed for %+v", st, f.Style())
+		}
+	}
+	for _, r := range "Молоток Hammer ё—…" {
+		if !l.face(pdf.Style{}).Has(r) {
+			t.Errorf("built-in font has no glyph for %q", r)
+		}
+	}
+
+	// only regular font configured - it is used for all styles
+	data, err := static.Asset(path.Join(DirResources, "Go-Italic.ttf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.BuildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Path = t.TempDir()
+	if err := os.WriteFile(filepath.Join(cfg.Path, "regular.ttf"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Doc.PDF.Fonts.Regular = "regular.ttf"
+	l = testPDFLayout(t, cfg)
+	for i := range l.faces {
+		if l.faces[i] != l.faces[0] || !l.faces[i].Style().Italic {
+			t.Errorf("face %d is not configured regular font", i)
+		}
+	}
+
+	cfg.Doc.PDF.Fonts.Regular = "missing.ttf"
+	p := &Processor{Book: &Book{}, env: &state.LocalEnv{Cfg: cfg, Log: zap.NewNop()}}
+	if _, err := p.loadPDFFonts(); err == nil {
+		t.Error("missing font should not be ignored")
+	}
+}
+
+func TestPDFBreakLines(t *testing.T) {
+
+	l := testPDFLayout(t, nil)
+	pp := l.para()
+	boxes := l.words(nil, pdfTestText, pdf.Style{}, nil)
+	boxes = append(boxes, l.words(nil, " bold", pdf.Style{Bold: true}, nil)...)
+
+	lines := l.breakLines(boxes, pp)
+	if len(lines) < 3 {
+		t.Fatalf("expected several lines, got %d", len(lines))
+	}
+
+	spaceW := l.face(pp.style).Width(" ", pp.size)
+	var words []string
+	for i, ln := range lines {
+		avail := l.right - l.left - pp.left - pp.right
+		if i == 0 {
+			avail -= pp.indent
+		}
+		if ln.width > avail+0.001 {
+			t.Errorf("line %d is too wide: %.2f > %.2f", i, ln.width, avail)
+		}
+		if ln.last != (i == len(lines)-1) {
+			t.Errorf("line %d: unexpected last flag %t", i, ln.last)
+		}
+		// greedy - first word of the next line does not fit
+		if i < len(lines)-1 {
+			if next := lines[i+1].chunks[0]; ln.width+spaceW+next.width <= avail {
+				t.Errorf("line %d: next word %q would fit", i, lineText(&pdfLine{chunks: []*pdfChunk{next}}))
+			}
+		}
+		words = append(words, strings.Fields(lineText(ln))...)
+	}
+	if got, want := strings.Join(words, " "), strings.Join(strings.Fields(pdfTestText+" bold"), " "); got != want {
+		t.Errorf("text was changed:\n%s\n%s", got, want)
+	}
+	last := lines[len(lines)-1].chunks
+	if box := last[len(last)-1].boxes[0]; box.text != "bold" || !box.style.Bold {
+		t.Errorf("style was lost: %+v", box)
+	}
+
+	// forced break
+	boxes = append(l.words(nil, "first", pdf.Style{}, nil), &pdfBox{br: true})
+	boxes = append(boxes, l.words(nil, "second", pdf.Style{}, nil)...)
+	lines = l.breakLines(boxes, pp)
+	if len(lines) != 2 || !lines[0].last || lineText(lines[0]) != "first" || lineText(lines[1]) != "second" {
+		t.Errorf("forced break was not honored: %d lines", len(lines))
+	}
+}
+
+func TestPDFHyphenation(t *testing.T) {
+
+	l := testPDFLayout(t, nil)
+	pp := l.para()
+	pp.indent = 0
+	// narrow column, so second word has to be split
+	pp.right = l.right - l.left - l.face(pdf.Style{}).Width("инструмент за-", pp.size) - 1
+
+	text := strings.Repeat("ин\u00ADстру\u00ADмент за\u00ADби\u00ADва\u00ADния ", 6)
+	lines := l.breakLines(l.words(nil, text, pdf.Style{}, nil), pp)
+
+	avail := l.right - l.left - pp.left - pp.right
+	var (
+		joined     strings.Builder
+		hyphenated int
+	)
+	for i, ln := range lines {
+		s := lineText(ln)
+		if ln.width > avail+0.001 {
+			t.Errorf("line %d %q is too wide: %.2f > %.2f", i, s, ln.width, avail)
+		}
+		if w := l.face(pdf.Style{}).Width(strings.ReplaceAll(s, " ", ""), pp.size); ln.width < w-0.001 {
+			t.Errorf("line %d %q width %.2f does not account for hyphen %.2f", i, s, ln.width, w)
+		}
+		if strings.HasSuffix(s, "-") {
+			hyphenated++
+			s = strings.TrimSuffix(s, "-")
+		} else if i < len(lines)-1 {
+			s += " "
+		}
+		joined.WriteString(s)
+	}
+	if hyphenated == 0 {
+		t.Error("no line was hyphenated")
+	}
+	if got, want := joined.String(), strings.TrimSpace(strings.ReplaceAll(text, "\u00AD", "")); got != want {
+		t.Errorf("text was changed:\n%s\n%s", got, want)
+	}
+}
+
+func TestPDFPageBreaking(t *testing.T) {
+
+	l := testPDFLayout(t, nil)
+	pp := l.para()
+	lh := l.lineHeight(pp.size)
+	perPage := int(math.Floor((l.bottom - l.top) / lh))
+
+	text := strings.Repeat(pdfTestText+" ", 20)
+	lines := l.breakLines(l.words(nil, text, pdf.Style{}, nil), pp)
+	l.anchor("start")
+	l.paragraph(l.words(nil, text, pdf.Style{}, nil), pp)
+	if want := (len(lines) + perPage - 1) / perPage; l.w.Pages() != want {
+		t.Fatalf("%d lines with %d lines per page took %d pages, expected %d", len(lines), perPage, l.w.Pages(), want)
+	}
+	if l.y > l.bottom {
+		t.Fatalf("text below bottom margin: %.2f > %.2f", l.y, l.bottom)
+	}
+	if !l.w.HasDest("start") {
+		t.Fatal("anchor was not placed")
+	}
+
+	// chapter starts new page without header
+	pages := l.w.Pages()
+	l.pageBreak()
+	l.paragraph(l.words(nil, "chapter", pdf.Style{}, nil), pp)
+	if l.w.Pages() != pages+1 || !l.noHeader || l.y != l.top+lh {
+		t.Fatalf("chapter did not start new page: %d pages, y %.2f", l.w.Pages(), l.y)
+	}
+	// break on empty page does not produce another one
+	l.pageBreak()
+	l.pageBreak()
+	l.paragraph(l.words(nil, "chapter", pdf.Style{}, nil), pp)
+	if l.w.Pages() != pages+2 {
+		t.Fatalf("empty page was produced: %d pages", l.w.Pages())
+	}
+
+	// heading is kept with following text
+	for l.y+2*lh <= l.bottom {
+		l.paragraph(l.words(nil, "line", pdf.Style{}, nil), pp)
+	}
+	pages = l.w.Pages()
+	d := etree.NewDocument()
+	if err := d.ReadFromString(`<div class="h2"><p>Heading</p></div>`); err != nil {
+		t.Fatal(err)
+	}
+	l.heading(d.Root(), 2, pp)
+	if l.w.Pages() != pages+1 {
+		t.Fatalf("heading was left at the bottom of the page")
+	}
+}
+
+func TestPDFOutline(t *testing.T) {
+
+	l := testPDFLayout(t, nil)
+	l.fname = "index0.xhtml"
+	l.p.Book.TOC = []*tocEntry{
+		{ref: "index0.xhtml#part1", title: "Part 1", level: 0},
+		{ref: "index0.xhtml#ch1", title: "Chapter 1", level: 1},
+		{ref: "index1.xhtml#ch2", title: "Chapter 2", level: 1},
+		{ref: "index1.xhtml#s1", title: "Section", level: 2},
+		{ref: "index2.xhtml", title: "Part 2", level: 0},
+	}
+
+	roots := l.outlines()
+	if len(roots) != 2 || roots[0].Title != "Part 1" || roots[1].Title != "Part 2" {
+		t.Fatalf("unexpected top level outline: %+v", roots)
+	}
+	if ch := roots[0].Children; len(ch) != 2 || ch[0].Dest != "ch1" || ch[1].Dest != "ch2" {
+		t.Fatalf("unexpected chapters: %+v", ch)
+	}
+	if s := roots[0].Children[1].Children; len(s) != 1 || s[0].Dest != "s1" {
+		t.Fatalf("unexpected sections: %+v", s)
+	}
+	if roots[1].Dest != "file:index2.xhtml" || len(roots[1].Children) != 0 {
+		t.Fatalf("unexpected file destination: %+v", roots[1])
+	}
+}
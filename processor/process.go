@@ -3,6 +3,7 @@ package processor
 
 import (
 	"bytes"
+	gocontext "context"
 	"encoding/base64"
 	"fmt"
 	"image"
@@ -75,13 +76,19 @@ type Processor struct {
 	kindlePageMap  APNXGeneration
 	stampPlacement StampPlacement
 	coverResize    CoverProcessing
+	styleMode      StylesheetMode
+	genreSubjects  GenreSubjects
+	genreAuthority GenreAuthority
 	// working directory
 	tmpDir string
 	// input document
-	doc *etree.Document
+	doc  *etree.Document
+	epub *epubPackage // unpacked EPUB when only description was requested
 	// parsing state and conversion results
 	Book     *Book
 	notFound *binImage
+	// cancellation of the current operation (Process or Save)
+	runCtx gocontext.Context
 	// program environment
 	env             *state.LocalEnv
 	speechTransform *config.Transformation
@@ -108,6 +115,10 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 	if notes != NFloat && notes != NFloatOld && notes != NFloatNew && env.Cfg.Doc.Notes.Renumber {
 		env.Log.Warn("Notes can be renumbered in floating modes only, ignoring", zap.String("mode", env.Cfg.Doc.Notes.Mode))
 	}
+	if (format == OTxt || format == OMd || format == OPdf || format == ODocx) && notes != NDefault {
+		env.Log.Warn("Notes are always rendered as endnotes or footnotes in text, pdf and docx formats, ignoring notes mode", zap.String("mode", env.Cfg.Doc.Notes.Mode))
+		notes = NDefault
+	}
 	toct := ParseTOCTypeString(env.Cfg.Doc.TOC.Type)
 	if toct == UnsupportedTOCType {
 		env.Log.Warn("Unknown TOC type requested, switching to normal", zap.String("type", env.Cfg.Doc.TOC.Type))
@@ -146,6 +157,25 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 			resize = CoverNone
 		}
 	}
+	var subjects GenreSubjects
+	if len(env.Cfg.Doc.Genres.Subjects) > 0 {
+		subjects = ParseGenreSubjectsString(env.Cfg.Doc.Genres.Subjects)
+		if subjects == UnsupportedGenreSubjects {
+			env.Log.Warn("Unknown genre subjects mode requested, using genre names", zap.String("subjects", env.Cfg.Doc.Genres.Subjects))
+			subjects = GenreSubjectsName
+		}
+	}
+	var authority GenreAuthority
+	if len(env.Cfg.Doc.Genres.Authority) > 0 {
+		authority = ParseGenreAuthorityString(env.Cfg.Doc.Genres.Authority)
+		if authority == UnsupportedGenreAuthority {
+			env.Log.Warn("Unknown genre subject classification requested, turning off", zap.String("authority", env.Cfg.Doc.Genres.Authority))
+			authority = GenreAuthorityNone
+		}
+	}
+	if lang := env.Cfg.Doc.Genres.Language; len(lang) > 0 && lang != "en" && lang != "ru" {
+		env.Log.Warn("Genre names are only available in English and Russian, using book language", zap.String("language", lang))
+	}
 
 	p := &Processor{
 		kind:            InFb2,
@@ -161,8 +191,11 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		kindlePageMap:   apnx,
 		stampPlacement:  stamp,
 		coverResize:     resize,
+		genreSubjects:   subjects,
+		genreAuthority:  authority,
 		doc:             etree.NewDocument(),
 		Book:            NewBook(u, filepath.Base(src)),
+		runCtx:          gocontext.Background(),
 		env:             env,
 		speechTransform: env.Cfg.GetTransformation("speech"),
 		dashTransform:   env.Cfg.GetTransformation("dashes"),
@@ -170,7 +203,7 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 	}
 	p.doc.WriteSettings = etree.WriteSettings{CanonicalText: true, CanonicalAttrVal: true}
 
-	if kindle {
+	if kindle && !env.Cfg.Doc.Kindlegen.Native {
 		// Fail early
 		if p.kindlegenPath, err = env.Cfg.GetKindlegenPath(); err != nil {
 			return nil, err
@@ -217,15 +250,34 @@ func NewFB2(r io.Reader, unknownEncoding bool, src, dst string, nodirs, stk, ove
 		}
 	}
 
-	if unknownEncoding {
-		// input file had no BOM mark - most likely was not Unicode
-		p.doc.ReadSettings = etree.ReadSettings{
-			CharsetReader: charset.NewReaderLabel,
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		p.Clean()
+		return nil, fmt.Errorf("unable to read FB2: %w", err)
+	}
+
+	// Fix common defects of real world documents before parsing
+	data, decision, repairs, err := RepairFB2(bytes.NewReader(raw), unknownEncoding)
+	if err != nil {
+		env.Log.Debug("Unable to repair FB2, parsing as is", zap.Error(err))
+		data = raw
+		if unknownEncoding {
+			// input file had no BOM mark - most likely was not Unicode
+			p.doc.ReadSettings = etree.ReadSettings{
+				CharsetReader: charset.NewReaderLabel,
+			}
 		}
 	}
+	if len(decision) > 0 {
+		env.Log.Info("FB2 encoding detected", zap.String("decision", decision))
+	}
+	for _, r := range repairs {
+		env.Log.Warn("Malformed FB2 was repaired", zap.Int("line", r.Line), zap.Int("count", r.Count), zap.String("repair", r.Message))
+	}
 
 	// Read and parse fb2
-	if _, err := p.doc.ReadFrom(r); err != nil {
+	if _, err := p.doc.ReadFrom(bytes.NewReader(data)); err != nil {
+		p.Clean()
 		return nil, fmt.Errorf("unable to parse FB2: %w", err)
 	}
 
@@ -264,21 +316,52 @@ func NewEPUB(r io.Reader, src, dst string, nodirs, stk, overwrite bool, format O
 		}
 	}
 
+	var stamp StampPlacement
+	if len(env.Cfg.Doc.Cover.Placement) > 0 {
+		stamp = ParseStampPlacementString(env.Cfg.Doc.Cover.Placement)
+		if stamp == UnsupportedStampPlacement {
+			env.Log.Warn("Unknown stamp placement requested, turning off", zap.String("placement", env.Cfg.Doc.Cover.Placement))
+			stamp = StampNone
+		}
+	}
+	var resize CoverProcessing
+	if len(env.Cfg.Doc.Cover.Resize) > 0 {
+		resize = ParseCoverProcessingString(env.Cfg.Doc.Cover.Resize)
+		if resize == UnsupportedCoverProcessing {
+			env.Log.Warn("Unknown cover resizing mode requested, using default", zap.String("resize", env.Cfg.Doc.Cover.Resize))
+			resize = CoverNone
+		}
+	}
+	var style StylesheetMode
+	if len(env.Cfg.Doc.Transfer.Stylesheet) > 0 {
+		style = ParseStylesheetModeString(env.Cfg.Doc.Transfer.Stylesheet)
+		if style == UnsupportedStylesheetMode {
+			env.Log.Warn("Unknown stylesheet mode requested, keeping book stylesheet", zap.String("stylesheet", env.Cfg.Doc.Transfer.Stylesheet))
+			style = StylesheetKeep
+		}
+	}
+
 	p := &Processor{
-		kind:          InEpub,
-		src:           src,
-		dst:           dst,
-		nodirs:        nodirs,
-		stk:           stk,
-		kindlePageMap: apnx,
-		overwrite:     overwrite,
-		format:        format,
-		env:           env,
+		kind:           InEpub,
+		src:            src,
+		dst:            dst,
+		nodirs:         nodirs,
+		stk:            stk,
+		kindlePageMap:  apnx,
+		stampPlacement: stamp,
+		coverResize:    resize,
+		styleMode:      style,
+		overwrite:      overwrite,
+		format:         format,
+		runCtx:         gocontext.Background(),
+		env:            env,
 	}
 
 	// Fail early
-	if p.kindlegenPath, err = env.Cfg.GetKindlegenPath(); err != nil {
-		return nil, err
+	if (format == OAzw3 || format == OMobi) && !env.Cfg.Doc.Kindlegen.Native {
+		if p.kindlegenPath, err = env.Cfg.GetKindlegenPath(); err != nil {
+			return nil, err
+		}
 	}
 
 	// re-route temporary directory for debugging
@@ -307,14 +390,16 @@ func NewEPUB(r io.Reader, src, dst string, nodirs, stk, overwrite bool, format O
 		}
 	}
 
-	// copy source file to temporary directory - when we decide what else to do with EPUBs this will be very handy
+	// copy source file to temporary directory, it will be unpacked and processed there
 
 	if destination, err := os.Create(filepath.Join(p.tmpDir, filepath.Base(src))); err == nil {
 		defer destination.Close()
 		if _, err := io.Copy(destination, r); err != nil {
+			p.Clean()
 			return nil, fmt.Errorf("unable to copy source: %w", err)
 		}
 	} else {
+		p.Clean()
 		return nil, fmt.Errorf("unable to copy source: %w", err)
 	}
 
@@ -322,81 +407,117 @@ func NewEPUB(r io.Reader, src, dst string, nodirs, stk, overwrite bool, format O
 	return p, nil
 }
 
-// Process does all the work.
-func (p *Processor) Process() error {
+// Process does all the work. Cancellation is checked between processing steps and while content is transferred, so
+// processing stops shortly after "ctx" is done.
+func (p *Processor) Process(ctx gocontext.Context) error {
+
+	p.runCtx = ctx
+	defer func() { p.runCtx = gocontext.Background() }()
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if p.kind == InEpub {
-		// later we may decide to clean epub, massage its stylesheet, etc.
-		return nil
+		if p.format == OFb2 {
+			// content will be converted directly from the source
+			return nil
+		}
+		return p.processEPUB()
 	}
 
 	// Processing - order of steps and their presence are important as information and context
 	// being built and accumulated...
 
-	if err := p.processNotes(); err != nil {
-		return err
-	}
-	if err := p.processBinaries(); err != nil {
-		return err
-	}
-	if err := p.processDescription(); err != nil {
-		return err
-	}
-	if err := p.processBodies(); err != nil {
-		return err
-	}
-	if err := p.processLinks(); err != nil {
-		return err
-	}
-	if err := p.processImages(); err != nil {
-		return err
-	}
-	if err := p.generateTOCPage(); err != nil {
-		return err
-	}
-	if err := p.generateCover(); err != nil {
-		return err
-	}
-	if err := p.generateNCX(); err != nil {
-		return err
+	for _, step := range []func() error{
+		p.processNotes,
+		p.processBinaries,
+		p.processDescription,
+		p.processBodies,
+		p.processLinks,
+		p.processImages,
+		p.generateTOCPage,
+		p.generateCover,
+		p.generateNCX,
+		p.prepareStylesheet,
+		p.generatePagemap,
+		p.generateNav,
+		p.generateOPF,
+		p.generateMeta,
+		p.KepubifyXHTML,
+	} {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := step(); err != nil {
+			return err
+		}
 	}
-	if err := p.prepareStylesheet(); err != nil {
-		return err
+	return nil
+}
+
+// Describe parses book description only, without converting the book. It is used when book metadata is needed.
+func (p *Processor) Describe() error {
+	if p.kind == InEpub {
+		return p.describeEPUB()
 	}
-	if err := p.generatePagemap(); err != nil {
-		return err
+	return p.processDescription()
+}
+
+// CoverImage returns book cover image as it is stored in the book along with its declared content type. Book description has
+// to be parsed first, nil is returned when book does not have cover.
+func (p *Processor) CoverImage() ([]byte, string, error) {
+
+	if len(p.Book.Cover) == 0 {
+		return nil, "", nil
 	}
-	if err := p.generateOPF(); err != nil {
-		return err
+
+	if p.kind == InEpub {
+		if p.epub == nil {
+			return nil, "", nil
+		}
+		for _, item := range p.epub.items {
+			if getAttrValue(item, "id") == p.Book.Cover {
+				data, err := os.ReadFile(p.epub.path(item))
+				if err != nil {
+					return nil, "", fmt.Errorf("unable to read cover image: %w", err)
+				}
+				return data, getAttrValue(item, "media-type"), nil
+			}
+		}
+		return nil, "", nil
 	}
-	if err := p.generateMeta(); err != nil {
-		return err
+
+	for _, el := range p.doc.FindElements("./FictionBook/binary[@id]") {
+		if getAttrValue(el, "id") != p.Book.Cover {
+			continue
+		}
+		// some files are badly formatted
+		s := strings.Replace(el.Text(), " ", "", -1)
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(s)))
+		n, err := base64.StdEncoding.Decode(data, []byte(s))
+		if err != nil && n == 0 {
+			return nil, "", fmt.Errorf("unable to decode cover image: %w", err)
+		}
+		return data[:n], getAttrValue(el, "content-type"), nil
 	}
-	return p.KepubifyXHTML()
+	return nil, "", nil
 }
 
-// Save makes the conversion results permanent by storing everything properly and cleaning temporary artifacts.
-func (p *Processor) Save() (string, error) {
+// Save makes the conversion results permanent by storing everything properly and cleaning temporary artifacts. When
+// "ctx" is done saving is abandoned, external programs (kindlegen) are killed.
+func (p *Processor) Save(ctx gocontext.Context) (string, error) {
+
+	p.runCtx = ctx
+	defer func() { p.runCtx = gocontext.Background() }()
 
 	p.env.Log.Debug("Saving content - starting", zap.String("tmp", p.tmpDir), zap.String("content", DirContent))
 	defer func(start time.Time) {
 		p.env.Log.Debug("Saving content - done", zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
-	if p.kind == InFb2 {
-		if err := p.Book.flushData(p.tmpDir); err != nil {
-			return "", err
-		}
-		if err := p.Book.flushVignettes(p.tmpDir); err != nil {
-			return "", err
-		}
-		if err := p.Book.flushImages(p.tmpDir); err != nil {
-			return "", err
-		}
-		if err := p.Book.flushXHTML(p.tmpDir); err != nil {
-			return "", err
-		}
-		if err := p.Book.flushMeta(p.tmpDir); err != nil {
+	// EPUB could be written directly from memory, keep files in debug mode for inspection
+	if p.kind == InFb2 && (!p.streamable() || p.env.Debug) {
+		if err := p.flush(ctx); err != nil {
 			return "", err
 		}
 	}
@@ -405,7 +526,7 @@ func (p *Processor) Save() (string, error) {
 
 	var err error
 	switch p.format {
-	case OEpub:
+	case OEpub, OEpub3:
 		err = p.FinalizeEPUB(fname)
 	case OKepub:
 		err = p.FinalizeKEPUB(fname)
@@ -413,10 +534,89 @@ func (p *Processor) Save() (string, error) {
 		err = p.FinalizeMOBI(fname)
 	case OAzw3:
 		err = p.FinalizeAZW3(fname)
+	case OHtml:
+		err = p.FinalizeHTML(fname)
+	case OTxt, OMd:
+		err = p.FinalizeText(fname)
+	case OPdf:
+		err = p.FinalizePDF(fname)
+	case ODocx:
+		err = p.FinalizeDOCX(fname)
+	case OFb2:
+		err = p.FinalizeFB2(fname)
 	}
 	return fname, err
 }
 
+// SaveTo writes conversion results to "w" instead of destination directory and returns name resulting file would have.
+// Only the book itself is written, supplementary files (like APNX) are dropped.
+func (p *Processor) SaveTo(ctx gocontext.Context, w io.Writer) (string, error) {
+
+	if !p.streamable() {
+		// everything else has to be produced on disk first
+		out, err := os.MkdirTemp("", "fb2c-out-")
+		if err != nil {
+			return "", fmt.Errorf("unable to create output directory: %w", err)
+		}
+		defer os.RemoveAll(out)
+
+		dst, nodirs := p.dst, p.nodirs
+		p.dst, p.nodirs = out, true
+		defer func() { p.dst, p.nodirs = dst, nodirs }()
+
+		fname, err := p.Save(ctx)
+		if err != nil {
+			return "", err
+		}
+		f, err := os.Open(fname)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := io.Copy(w, f); err != nil {
+			return "", fmt.Errorf("unable to write results: %w", err)
+		}
+		return filepath.Base(fname), nil
+	}
+
+	p.env.Log.Debug("Saving content - starting", zap.String("tmp", p.tmpDir), zap.String("content", DirContent))
+	defer func(start time.Time) {
+		p.env.Log.Debug("Saving content - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	p.runCtx = ctx
+	defer func() { p.runCtx = gocontext.Background() }()
+
+	if p.env.Debug {
+		if err := p.flush(ctx); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Base(p.prepareOutputName()), p.streamEPUB(w)
+}
+
+// streamable checks if results could be written directly from memory without saving them to temporary directory first.
+func (p *Processor) streamable() bool {
+	return p.kind == InFb2 && (p.format == OEpub || p.format == OEpub3 || p.format == OKepub)
+}
+
+// flush saves book content to temporary directory.
+func (p *Processor) flush(ctx gocontext.Context) error {
+	if err := p.Book.flushData(ctx, p.tmpDir); err != nil {
+		return err
+	}
+	if err := p.Book.flushVignettes(p.tmpDir); err != nil {
+		return err
+	}
+	if err := p.Book.flushImages(ctx, p.tmpDir); err != nil {
+		return err
+	}
+	if err := p.Book.flushXHTML(ctx, p.tmpDir); err != nil {
+		return err
+	}
+	return p.Book.flushMeta(p.tmpDir)
+}
+
 // SendToKindle will mail converted file to specified address and remove file if requested.
 func (p *Processor) SendToKindle(fname string) error {
 
@@ -478,6 +678,17 @@ func (p *Processor) Clean() error {
 	return os.RemoveAll(p.tmpDir)
 }
 
+// outputExt returns extension (with leading dot) for resulting file.
+func (p *Processor) outputExt() string {
+	switch p.format {
+	case OKepub:
+		return "." + OKepub.String() + "." + OEpub.String()
+	case OEpub3:
+		return "." + OEpub.String()
+	}
+	return "." + p.format.String()
+}
+
 // prepareOutputName generates output file name.
 func (p *Processor) prepareOutputName() string {
 
@@ -491,10 +702,7 @@ func (p *Processor) prepareOutputName() string {
 	if p.env.Cfg.Doc.FileNameTransliterate {
 		name = slug.Make(name)
 	}
-	outFile := config.CleanFileName(name) + "." + p.format.String()
-	if p.format == OKepub {
-		outFile += "." + OEpub.String()
-	}
+	outFile := config.CleanFileName(name) + p.outputExt()
 
 	if p.kind == InFb2 && len(p.env.Cfg.Doc.FileNameFormat) > 0 {
 
@@ -505,7 +713,7 @@ func (p *Processor) prepareOutputName() string {
 			return dirs
 		}
 
-		name = filepath.FromSlash(ReplaceKeywords(p.env.Cfg.Doc.FileNameFormat, CreateFileNameKeywordsMap(p.Book, p.env.Cfg.Doc.AuthorFormatFileName, p.env.Cfg.Doc.SeqNumPos)))
+		name = filepath.FromSlash(ReplaceKeywords(p.env.Cfg.Doc.FileNameFormat, CreateFileNameKeywordsMap(p.Book, p.env.Cfg.Doc.AuthorFormatFileName, p.env.Cfg.Doc.SeqNumPos, p.Book.genreLanguage(p.env.Cfg.Doc.Genres.Language))))
 		if len(name) > 0 {
 			first := true
 			dirs := make([]string, 0, 16)
@@ -514,10 +722,7 @@ func (p *Processor) prepareOutputName() string {
 					if p.env.Cfg.Doc.FileNameTransliterate {
 						tail = slug.Make(tail)
 					}
-					outFile = config.CleanFileName(tail) + "." + p.format.String()
-					if p.format == OKepub {
-						outFile += "." + OEpub.String()
-					}
+					outFile = config.CleanFileName(tail) + p.outputExt()
 					first = false
 				} else {
 					if p.env.Cfg.Doc.FileNameTransliterate {
@@ -536,6 +741,65 @@ func (p *Processor) prepareOutputName() string {
 	return filepath.Join(outDir, outFile)
 }
 
+// childText returns trimmed text of the first child element with specified tag.
+func childText(e *etree.Element, tag string) string {
+	if c := e.SelectElement(tag); c != nil {
+		return strings.TrimSpace(c.Text())
+	}
+	return ""
+}
+
+// parseAuthor returns person from author-like element (author, translator), nil if both name and nickname are empty.
+func parseAuthor(e *etree.Element) *config.AuthorName {
+	an := &config.AuthorName{
+		First:    childText(e, "first-name"),
+		Middle:   childText(e, "middle-name"),
+		Last:     childText(e, "last-name"),
+		Nickname: childText(e, "nickname"),
+		ID:       childText(e, "id"),
+	}
+	if len(an.First) == 0 && len(an.Middle) == 0 && len(an.Last) == 0 && len(an.Nickname) == 0 {
+		return nil
+	}
+	for _, c := range e.SelectElements("home-page") {
+		if v := strings.TrimSpace(c.Text()); len(v) > 0 {
+			an.HomePages = append(an.HomePages, v)
+		}
+	}
+	for _, c := range e.SelectElements("email") {
+		if v := strings.TrimSpace(c.Text()); len(v) > 0 {
+			an.Emails = append(an.Emails, v)
+		}
+	}
+	return an
+}
+
+// parseSequence returns name and number of the sequence.
+func (p *Processor) parseSequence(e *etree.Element) (name string, num int) {
+	var err error
+	name = getAttrValue(e, "name")
+	if n := getAttrValue(e, "number"); len(n) > 0 {
+		if !govalidator.IsNumeric(n) {
+			p.env.Log.Warn("Sequence number is not an integer, ignoring", zap.String("xml", getXMLFragmentFromElement(e)))
+		} else if num, err = strconv.Atoi(n); err != nil {
+			p.env.Log.Warn("Unable to parse sequence number, ignoring", zap.String("number", n), zap.Error(err))
+		}
+	}
+	return name, num
+}
+
+// parseSequences returns sequence along with all sequences nested in it, sequences without name are skipped.
+func (p *Processor) parseSequences(e *etree.Element, level int, publisher bool) []Sequence {
+	var res []Sequence
+	if name, num := p.parseSequence(e); len(name) > 0 {
+		res = append(res, Sequence{Name: name, Number: num, Level: level, Publisher: publisher})
+	}
+	for _, c := range e.SelectElements("sequence") {
+		res = append(res, p.parseSequences(c, level+1, publisher)...)
+	}
+	return res
+}
+
 // processDescription processes book description element.
 func (p *Processor) processDescription() error {
 
@@ -553,6 +817,12 @@ func (p *Processor) processDescription() error {
 			zap.String("sequence", p.Book.SeqName),
 			zap.Int("sequence number", p.Book.SeqNum),
 			zap.String("date", p.Book.Date),
+			zap.String("translators", authorsList(p.Book.Translators, p.env.Cfg.Doc.AuthorFormat)),
+			zap.String("publisher", p.Book.Publisher),
+			zap.String("isbn", p.Book.ISBN),
+			zap.String("year", p.Book.PubYear),
+			zap.String("source title", p.Book.SrcTitle),
+			zap.String("document version", p.Book.DocVersion),
 		)
 	}(time.Now())
 
@@ -568,6 +838,43 @@ func (p *Processor) processDescription() error {
 					p.Book.ID = uuid.NewSHA1(nameSpaceFB2, []byte(text))
 				}
 			}
+			for _, e := range info.SelectElements("author") {
+				if an := parseAuthor(e); an != nil {
+					p.Book.DocAuthors = append(p.Book.DocAuthors, an)
+				}
+			}
+			p.Book.DocProgram = childText(info, "program-used")
+			p.Book.DocDate = childText(info, "date")
+			p.Book.DocVersion = childText(info, "version")
+			p.Book.DocSrcOCR = childText(info, "src-ocr")
+			for _, e := range info.SelectElements("src-url") {
+				if u := strings.TrimSpace(e.Text()); len(u) > 0 {
+					p.Book.DocSrcURLs = append(p.Book.DocSrcURLs, u)
+				}
+			}
+		}
+		if info := desc.SelectElement("src-title-info"); info != nil {
+			p.Book.SrcTitle = childText(info, "book-title")
+			for _, e := range info.SelectElements("author") {
+				if an := parseAuthor(e); an != nil {
+					p.Book.SrcAuthors = append(p.Book.SrcAuthors, an)
+				}
+			}
+		}
+		if info := desc.SelectElement("publish-info"); info != nil {
+			p.Book.PubBookName = childText(info, "book-name")
+			p.Book.Publisher = childText(info, "publisher")
+			p.Book.PubCity = childText(info, "city")
+			p.Book.PubYear = childText(info, "year")
+			p.Book.ISBN = childText(info, "isbn")
+			for _, e := range info.SelectElements("sequence") {
+				p.Book.Sequences = append(p.Book.Sequences, p.parseSequences(e, 0, true)...)
+			}
+		}
+		for _, e := range desc.SelectElements("custom-info") {
+			if t := strings.TrimSpace(e.Text()); len(t) > 0 {
+				p.Book.CustomInfo = append(p.Book.CustomInfo, CustomInfo{Type: getAttrValue(e, "info-type"), Text: t})
+			}
 		}
 		if info := desc.SelectElement("title-info"); info != nil {
 			if e := info.SelectElement("book-title"); e != nil {
@@ -592,7 +899,7 @@ func (p *Processor) processDescription() error {
 						}
 					}
 					p.Book.Lang = t
-					if p.env.Cfg.Doc.Hyphenate {
+					if p.env.Cfg.Doc.Hyphenate || p.format == OPdf {
 						p.Book.hyph = newHyph(t, p.env.Log)
 					}
 					if p.format == OKepub {
@@ -618,47 +925,30 @@ func (p *Processor) processDescription() error {
 				}
 			}
 			for _, e := range info.SelectElements("author") {
-				var (
-					an       = new(config.AuthorName)
-					notEmpty bool
-				)
-				if n := e.SelectElement("first-name"); n != nil {
-					if f := strings.TrimSpace(n.Text()); len(f) > 0 {
-						an.First = f
-						notEmpty = true
-					}
-				}
-				if n := e.SelectElement("middle-name"); n != nil {
-					if m := strings.TrimSpace(n.Text()); len(m) > 0 {
-						an.Middle = m
-						notEmpty = true
-					}
-				}
-				if n := e.SelectElement("last-name"); n != nil {
-					if l := strings.TrimSpace(n.Text()); len(l) > 0 {
-						an.Last = l
-						notEmpty = true
-					}
-				}
-				if notEmpty {
+				if an := parseAuthor(e); an != nil {
 					p.Book.Authors = append(p.Book.Authors, an)
 				}
 			}
-			if e := info.SelectElement("sequence"); e != nil {
-				var err error
-				p.Book.SeqName = getAttrValue(e, "name")
-				num := getAttrValue(e, "number")
-				if len(num) > 0 {
-					if !govalidator.IsNumeric(num) {
-						p.env.Log.Warn("Sequence number is not an integer, ignoring", zap.String("xml", getXMLFragmentFromElement(e)))
-					} else {
-						p.Book.SeqNum, err = strconv.Atoi(num)
-						if err != nil {
-							p.env.Log.Warn("Unable to parse sequence number, ignoring", zap.String("number", getAttrValue(e, "number")), zap.Error(err))
-						}
-					}
+			for _, e := range info.SelectElements("translator") {
+				if an := parseAuthor(e); an != nil {
+					p.Book.Translators = append(p.Book.Translators, an)
+				}
+			}
+			for _, k := range strings.FieldsFunc(childText(info, "keywords"), func(r rune) bool { return r == ',' || r == ';' }) {
+				if k = strings.TrimSpace(k); len(k) > 0 {
+					p.Book.Keywords = append(p.Book.Keywords, k)
 				}
 			}
+			p.Book.SrcLang = childText(info, "src-lang")
+			var seqs []Sequence
+			for _, e := range info.SelectElements("sequence") {
+				seqs = append(seqs, p.parseSequences(e, 0, false)...)
+			}
+			if len(seqs) > 0 {
+				p.Book.SeqName, p.Book.SeqNum = seqs[0].Name, seqs[0].Number
+			}
+			// title-info sequences go first, publish-info could be located anywhere
+			p.Book.Sequences = append(seqs, p.Book.Sequences...)
 			if e := info.SelectElement("annotation"); e != nil {
 				p.Book.Annotation = getTextFragment(e)
 				if p.env.Cfg.Doc.Annotation.Create {
@@ -685,6 +975,7 @@ func (p *Processor) processDescription() error {
 			}
 			if e := info.SelectElement("date"); e != nil {
 				p.Book.Date = getTextFragment(e)
+				p.Book.DateValue = strings.TrimSpace(getAttrValue(e, "value"))
 			}
 		}
 	}
@@ -693,6 +984,7 @@ func (p *Processor) processDescription() error {
 	if p.metaOverwrite == nil {
 		return nil
 	}
+	defer p.Book.syncPrimarySequence()
 
 	if len(p.metaOverwrite.ID) > 0 {
 		if u, err := uuid.Parse(strings.TrimSpace(p.metaOverwrite.ID)); err == nil {
@@ -714,7 +1006,7 @@ func (p *Processor) processDescription() error {
 			if t, err := language.Parse(l); err == nil {
 				p.Book.Lang = t
 				p.env.Log.Info("Meta overwrite", zap.Stringer("lang", p.Book.Lang))
-				if p.env.Cfg.Doc.Hyphenate {
+				if p.env.Cfg.Doc.Hyphenate || p.format == OPdf {
 					p.Book.hyph = newHyph(t, p.env.Log)
 				}
 			}
@@ -863,6 +1155,10 @@ func (p *Processor) processBinaries() error {
 
 	for i, el := range p.doc.FindElements("./FictionBook/binary[@id]") {
 
+		if err := p.runCtx.Err(); err != nil {
+			return err
+		}
+
 		id := getAttrValue(el, "id")
 		declaredCT := getAttrValue(el, "content-type")
 
@@ -0,0 +1,461 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Repair describes change made to malformed FB2 document. Identical changes are reported once along with line of their
+// first occurrence.
+type Repair struct {
+	Line    int
+	Count   int
+	Message string
+}
+
+func (r Repair) String() string {
+	if r.Count > 1 {
+		return fmt.Sprintf("%d: %s (%d times)", r.Line, r.Message, r.Count)
+	}
+	return fmt.Sprintf("%d: %s", r.Line, r.Message)
+}
+
+// Elements which may only have text and inline elements.
+var inlineContainers = map[string]bool{"p": true, "v": true, "subtitle": true, "text-author": true, "td": true, "th": true}
+
+// Elements which may be used in paragraphs.
+var inlineMarkup = map[string]bool{
+	"strong": true, "emphasis": true, "style": true, "a": true, "strikethrough": true, "sub": true, "sup": true, "code": true, "image": true,
+}
+
+// fb2Repairer accumulates changes made to document.
+type fb2Repairer struct {
+	repairs  []Repair
+	byText   map[string]int
+	newlines []int
+}
+
+func (rp *fb2Repairer) note(line int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if i, ok := rp.byText[msg]; ok {
+		rp.repairs[i].Count++
+		return
+	}
+	rp.byText[msg] = len(rp.repairs)
+	rp.repairs = append(rp.repairs, Repair{Line: line, Count: 1, Message: msg})
+}
+
+func (rp *fb2Repairer) line(offset int64) int {
+	return sort.SearchInts(rp.newlines, int(offset)) + 1
+}
+
+// RepairFB2 reads FB2 document and fixes common defects which make it unparsable: unclosed and stray tags, HTML entities,
+// unescaped ampersands, illegal control characters and invalid UTF-8, broken base64 in binaries and paragraphs inside of
+// paragraphs. When "unknownEncoding" is set document is decoded according to its XML declaration, or detected encoding if
+// declaration is missing or contradicted by content, otherwise it is expected to be UTF-8. Repaired document is always
+// UTF-8. Returned decision explains detected encoding, it is empty when declaration was used. Choice of encoding is not a
+// repair - returned list describes all changes made to document structure, it is empty if document was fine.
+func RepairFB2(r io.Reader, unknownEncoding bool) ([]byte, string, []Repair, error) {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	rp := &fb2Repairer{byText: make(map[string]int)}
+	var decision string
+	if unknownEncoding {
+		if data, decision, err = decodeFB2(data); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	data = rp.sanitize(data)
+	for i, c := range data {
+		if c == '\n' {
+			rp.newlines = append(rp.newlines, i)
+		}
+	}
+	out, err := rp.rebuild(data)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	sort.SliceStable(rp.repairs, func(i, j int) bool {
+		return rp.repairs[i].Line < rp.repairs[j].Line
+	})
+	return out, decision, rp.repairs, nil
+}
+
+// isXMLChar checks if character is allowed in XML 1.0 document.
+func isXMLChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		(r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) || (r >= 0x10000 && r <= 0x10FFFF)
+}
+
+// Entities defined by XML itself.
+var xmlEntities = map[string]bool{"amp": true, "lt": true, "gt": true, "quot": true, "apos": true}
+
+// sanitize fixes problems on the character level: invalid UTF-8, illegal characters, HTML entities, unescaped ampersands
+// and less-than signs. Number of lines in document is never changed.
+func (rp *fb2Repairer) sanitize(data []byte) []byte {
+
+	out := make([]byte, 0, len(data)+len(data)/16)
+	line := 1
+	skipUntil := "" // terminator of comment or CDATA section
+
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			rp.note(line, "invalid UTF-8 sequence replaced")
+			out = append(out, "�"...)
+			i++
+			continue
+		case !isXMLChar(r):
+			rp.note(line, "illegal character U+%04X removed", r)
+			i += size
+			continue
+		case r == '\n':
+			line++
+		}
+
+		if len(skipUntil) > 0 {
+			if bytes.HasPrefix(data[i:], []byte(skipUntil)) {
+				out = append(out, skipUntil...)
+				i += len(skipUntil)
+				skipUntil = ""
+				continue
+			}
+			out = append(out, data[i:i+size]...)
+			i += size
+			continue
+		}
+
+		switch r {
+		case '<':
+			rest := data[i+1:]
+			switch {
+			case bytes.HasPrefix(rest, []byte("!--")):
+				skipUntil = "-->"
+				out = append(out, "<!--"...)
+				i += 4
+				continue
+			case bytes.HasPrefix(rest, []byte("![CDATA[")):
+				skipUntil = "]]>"
+				out = append(out, "<![CDATA["...)
+				i += 9
+				continue
+			case len(rest) > 0 && (rest[0] == '/' || rest[0] == '!' || rest[0] == '?' || rest[0] == '_' || isNameStart(rest)):
+				out = append(out, '<')
+			default:
+				rp.note(line, "unescaped < escaped")
+				out = append(out, "&lt;"...)
+			}
+			i++
+		case '&':
+			name, n := entityName(data[i+1:])
+			switch {
+			case n == 0:
+				rp.note(line, "unescaped & escaped")
+				out = append(out, "&amp;"...)
+			case xmlEntities[name]:
+				out = append(out, data[i:i+n+1]...)
+			case strings.HasPrefix(name, "#"):
+				if c, ok := charReference(name); ok && isXMLChar(c) {
+					out = append(out, data[i:i+n+1]...)
+				} else {
+					rp.note(line, "invalid character reference &%s; removed", name)
+				}
+			case len(xml.HTMLEntity[name]) > 0:
+				rp.note(line, "HTML entity &%s; replaced with character", name)
+				out = append(out, escapeXMLText(xml.HTMLEntity[name])...)
+			default:
+				rp.note(line, "unknown entity &%s; escaped", name)
+				out = append(out, "&amp;"...)
+				out = append(out, data[i+1:i+n+1]...)
+			}
+			i += n + 1
+		default:
+			out = append(out, data[i:i+size]...)
+			i += size
+		}
+	}
+	return out
+}
+
+// isNameStart checks if data starts with character which could start XML name.
+func isNameStart(data []byte) bool {
+	r, _ := utf8.DecodeRune(data)
+	return r == ':' || r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || r > 0x7F
+}
+
+// entityName returns name of the entity reference (following "&") and its length including ";". Zero length means
+// there is no entity reference.
+func entityName(data []byte) (string, int) {
+	for i := 0; i < len(data) && i < 32; i++ {
+		c := data[i]
+		switch {
+		case c == ';':
+			if i == 0 {
+				return "", 0
+			}
+			return string(data[:i]), i + 1
+		case c == '#' && i == 0:
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		default:
+			return "", 0
+		}
+	}
+	return "", 0
+}
+
+// charReference decodes numeric character reference name (without "&" and ";").
+func charReference(name string) (rune, bool) {
+	var (
+		n   uint64
+		err error
+	)
+	if strings.HasPrefix(name, "#x") || strings.HasPrefix(name, "#X") {
+		n, err = strconv.ParseUint(name[2:], 16, 32)
+	} else {
+		n, err = strconv.ParseUint(name[1:], 10, 32)
+	}
+	if err != nil {
+		return 0, false
+	}
+	return rune(n), true
+}
+
+func escapeXMLText(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func escapeXMLAttr(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace(s)
+}
+
+func rawName(n xml.Name) string {
+	if len(n.Space) > 0 {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// openElement is element in the rebuilt document which was not closed yet.
+type openElement struct {
+	name xml.Name
+	line int
+	id   string
+	data []byte // content of binary
+}
+
+// rebuild re-creates document from tokens keeping elements balanced: missing end tags are added, stray ones are dropped
+// and paragraphs are closed before block elements. Binaries are checked and their content is repaired if possible.
+func (rp *fb2Repairer) rebuild(data []byte) ([]byte, error) {
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	// document was decoded already
+	d.CharsetReader = func(label string, input io.Reader) (io.Reader, error) { return input, nil }
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+1024))
+	var stack []*openElement
+	root := false
+
+	// start tag is finished when its content is known, so empty elements are kept self-closing
+	pending := false
+	finishStart := func() {
+		if pending {
+			out.WriteString(">")
+			pending = false
+		}
+	}
+	closeTop := func() {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		var content string
+		if e.name.Local == "binary" {
+			content = rp.repairBinary(e)
+		}
+		if pending && len(content) == 0 {
+			out.WriteString("/>")
+			pending = false
+			return
+		}
+		finishStart()
+		out.WriteString(content)
+		out.WriteString("</" + rawName(e.name) + ">")
+	}
+
+	for {
+		offset := d.InputOffset()
+		t, err := d.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to repair FB2: %w", err)
+		}
+		line := rp.line(offset)
+
+		switch t := t.(type) {
+		case xml.ProcInst:
+			finishStart()
+			if t.Target == "xml" {
+				out.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+				continue
+			}
+			out.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+		case xml.Directive:
+			finishStart()
+			out.WriteString("<!" + string(t) + ">")
+		case xml.Comment:
+			finishStart()
+			out.WriteString("<!--" + string(t) + "-->")
+		case xml.CharData:
+			if len(stack) == 0 {
+				if len(bytes.TrimSpace(t)) > 0 {
+					rp.note(line, "text outside of root element removed")
+				} else {
+					out.Write(t)
+				}
+				continue
+			}
+			if top := stack[len(stack)-1]; top.name.Local == "binary" {
+				top.data = append(top.data, t...)
+				continue
+			}
+			finishStart()
+			out.WriteString(escapeXMLText(string(t)))
+		case xml.StartElement:
+			if len(stack) == 0 && root {
+				rp.note(line, "second root element %s ignored", t.Name.Local)
+				if err := skipRaw(d); err != nil {
+					return nil, fmt.Errorf("unable to repair FB2: %w", err)
+				}
+				continue
+			}
+			root = true
+			if _, known := fb2Schema[t.Name.Local]; known && !inlineMarkup[t.Name.Local] {
+				// block element could not be inside of paragraph, close paragraph first
+				i := len(stack) - 1
+				for i >= 0 && inlineMarkup[stack[i].name.Local] {
+					i--
+				}
+				if i >= 0 && inlineContainers[stack[i].name.Local] {
+					for len(stack) > i {
+						rp.note(line, "unclosed %s closed before %s", stack[len(stack)-1].name.Local, t.Name.Local)
+						closeTop()
+					}
+				}
+			}
+			e := &openElement{name: t.Name, line: line}
+			finishStart()
+			out.WriteString("<" + rawName(t.Name))
+			for _, a := range t.Attr {
+				if a.Name.Local == "id" && len(a.Name.Space) == 0 {
+					e.id = a.Value
+				}
+				out.WriteString(" " + rawName(a.Name) + `="` + escapeXMLAttr(a.Value) + `"`)
+			}
+			pending = true
+			stack = append(stack, e)
+		case xml.EndElement:
+			i := len(stack) - 1
+			for ; i >= 0; i-- {
+				if stack[i].name == t.Name {
+					break
+				}
+			}
+			if i < 0 {
+				rp.note(line, "stray end tag </%s> removed", rawName(t.Name))
+				continue
+			}
+			for len(stack) > i+1 {
+				rp.note(line, "unclosed %s closed", stack[len(stack)-1].name.Local)
+				closeTop()
+			}
+			closeTop()
+		}
+	}
+	if !root {
+		return nil, errors.New("unable to repair FB2: document has no root element")
+	}
+	for len(stack) > 0 {
+		rp.note(len(rp.newlines)+1, "unclosed %s closed at the end of document", stack[len(stack)-1].name.Local)
+		closeTop()
+	}
+	return out.Bytes(), nil
+}
+
+// skipRaw skips content of the element which start was just read, Decoder.Skip could not be used as it does not see
+// elements read as raw tokens. End tags do not have to match, unclosed element ends with document.
+func skipRaw(d *xml.Decoder) error {
+	for depth := 1; depth > 0; {
+		t, err := d.RawToken()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return nil
+}
+
+// repairBinary returns content of the binary, fixing broken base64 encoding when necessary. Content which could not be
+// repaired is dropped.
+func (rp *fb2Repairer) repairBinary(e *openElement) string {
+
+	content := strings.TrimSpace(string(e.data))
+	compact := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, content)
+	if _, err := base64.StdEncoding.DecodeString(compact); err == nil {
+		return escapeXMLText(string(e.data))
+	}
+
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '+', r == '/':
+			return r
+		case r == '-':
+			return '+'
+		case r == '_':
+			return '/'
+		}
+		return -1
+	}, compact)
+	switch len(cleaned) % 4 {
+	case 1:
+		cleaned = cleaned[:len(cleaned)-1]
+	case 2:
+		cleaned += "=="
+	case 3:
+		cleaned += "="
+	}
+	if _, err := base64.StdEncoding.DecodeString(cleaned); err != nil || len(cleaned) == 0 {
+		rp.note(e.line, "binary %q with broken content left empty", e.id)
+		return ""
+	}
+	rp.note(e.line, "broken base64 in binary %q repaired", e.id)
+	return cleaned
+}
@@ -0,0 +1,167 @@
+package processor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRepairFB2Fine(t *testing.T) {
+
+	for _, unknownEncoding := range []bool{false, true} {
+		out, decision, repairs, err := RepairFB2(strings.NewReader(fixtureBook), unknownEncoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decision) > 0 {
+			t.Errorf("unknown encoding %t: unexpected encoding decision %q", unknownEncoding, decision)
+		}
+		if len(repairs) > 0 {
+			t.Errorf("unknown encoding %t: unexpected repairs %q", unknownEncoding, repairs)
+		}
+		violations, err := ValidateFB2(strings.NewReader(string(out)), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(violations) > 0 {
+			t.Errorf("unknown encoding %t: document was broken by repair %q", unknownEncoding, violations)
+		}
+	}
+}
+
+func TestRepairFB2(t *testing.T) {
+
+	const text = "<p>Текст <a l:href=\"#note1\">[1]</a>.</p>"
+
+	cases := []struct {
+		name            string
+		doc             string
+		unknownEncoding bool
+		repairs         []Repair
+		fixed           string // expected in repaired document
+	}{
+		{"invalid UTF-8", fixture(t, "Примечание.", "Примечание\xff."), false,
+			[]Repair{{25, 1, "invalid UTF-8 sequence replaced"}},
+			"<p>Примечание\uFFFD.</p>"},
+		{"illegal character", fixture(t, "Примечание.", "При\x01меча\x01ние."), false,
+			[]Repair{{25, 2, "illegal character U+0001 removed"}},
+			"<p>Примечание.</p>"},
+		{"unescaped less-than", fixture(t, "Примечание.", "1 < 2"), false,
+			[]Repair{{25, 1, "unescaped < escaped"}},
+			"<p>1 &lt; 2</p>"},
+		{"unescaped ampersand", fixture(t, "Примечание.", "Петров & сыновья"), false,
+			[]Repair{{25, 1, "unescaped & escaped"}},
+			"<p>Петров &amp; сыновья</p>"},
+		{"invalid character reference", fixture(t, "Примечание.", "При&#1;мечание."), false,
+			[]Repair{{25, 1, "invalid character reference &#1; removed"}},
+			"<p>Примечание.</p>"},
+		{"HTML entity", fixture(t, "Примечание.", "При&nbsp;мечание &copy;"), false,
+			[]Repair{{25, 1, "HTML entity &nbsp; replaced with character"}, {25, 1, "HTML entity &copy; replaced with character"}},
+			"<p>При\u00a0мечание ©</p>"},
+		{"unknown entity", fixture(t, "Примечание.", "При&foo;мечание."), false,
+			[]Repair{{25, 1, "unknown entity &foo; escaped"}},
+			"<p>При&amp;foo;мечание.</p>"},
+		{"text outside of root", fixtureBook + "мусор\n", false,
+			[]Repair{{28, 1, "text outside of root element removed"}},
+			"</binary>\n</FictionBook>"},
+		{"second root", fixtureBook + "<FictionBook><body><section><p>Текст</p></section></body></FictionBook>\n", false,
+			[]Repair{{29, 1, "second root element FictionBook ignored"}},
+			"</binary>\n</FictionBook>\n"},
+		{"paragraph in paragraph", fixture(t, text, "<p>Текст <emphasis>начало\n<p>Вложенный</p>"), false,
+			[]Repair{{21, 1, "unclosed emphasis closed before p"}, {21, 1, "unclosed p closed before p"}},
+			"<p>Текст <emphasis>начало\n</emphasis></p><p>Вложенный</p>"},
+		{"stray end tag", fixture(t, "Примечание.", "Примечание.</strong>"), false,
+			[]Repair{{25, 1, "stray end tag </strong> removed"}},
+			"<p>Примечание.</p>"},
+		{"unclosed element", fixture(t, "Примечание.", "<strong>Примечание."), false,
+			[]Repair{{25, 1, "unclosed strong closed"}},
+			"<p><strong>Примечание.</strong></p>"},
+		{"unclosed at the end", strings.TrimSuffix(fixtureBook, "</FictionBook>\n"), false,
+			[]Repair{{28, 1, "unclosed FictionBook closed at the end of document"}},
+			"</binary>\n</FictionBook>"},
+		{"broken base64", fixture(t, fixturePNG, fixturePNG[:8]+"\n-_!"+fixturePNG[8:len(fixturePNG)-2]), false,
+			[]Repair{{27, 1, `broken base64 in binary "pic.png" repaired`}},
+			">" + fixturePNG[:8] + "+/" + fixturePNG[8:len(fixturePNG)-2] + "</binary>"},
+		{"hopeless base64", fixture(t, fixturePNG, "!"), false,
+			[]Repair{{27, 1, `binary "pic.png" with broken content left empty`}},
+			`<binary id="pic.png" content-type="image/png"/>`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, _, repairs, err := RepairFB2(strings.NewReader(c.doc), c.unknownEncoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(repairs, c.repairs) {
+				t.Errorf("repairs %q, expected %q", repairs, c.repairs)
+			}
+			if !strings.Contains(string(out), c.fixed) {
+				t.Errorf("repaired document does not have %q:\n%s", c.fixed, out)
+			}
+			if n := strings.Count(string(out), "<FictionBook"); n != 1 {
+				t.Errorf("repaired document has %d root elements", n)
+			}
+			// repaired document must always be parsable
+			violations, err := ValidateFB2(strings.NewReader(string(out)), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range violations {
+				if strings.HasPrefix(v.Message, "document is not well-formed") {
+					t.Errorf("repaired document is not well-formed: %s", v)
+				}
+			}
+		})
+	}
+}
+
+func TestRepairFB2NoRoot(t *testing.T) {
+
+	if _, _, _, err := RepairFB2(strings.NewReader(`<?xml version="1.0"?>`+"\nтекст\n"), false); err == nil {
+		t.Error("document without root element was repaired")
+	}
+}
+
+func TestRepairFB2Encoding(t *testing.T) {
+
+	for _, c := range []struct {
+		name     string
+		doc      string
+		decision string
+	}{
+		{"contradicts declaration", string(encodeText(t, fixtureBook, "windows-1251")),
+			"encoding windows-1251 detected, declared encoding utf-8 contradicts content"},
+		{"no declaration", string(encodeText(t, strings.Replace(fixtureBook, `<?xml version="1.0" encoding="UTF-8"?>`, `<?xml version="1.0"?>`, 1), "windows-1251")),
+			"encoding windows-1251 detected, document has no encoding declaration"},
+	} {
+		out, decision, repairs, err := RepairFB2(strings.NewReader(c.doc), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision != c.decision {
+			t.Errorf("%s: decision %q, expected %q", c.name, decision, c.decision)
+		}
+		// properly decoded document needs no repairs
+		if len(repairs) > 0 {
+			t.Errorf("%s: unexpected repairs %q", c.name, repairs)
+		}
+		if !strings.Contains(string(out), "<p>Примечание.</p>") {
+			t.Errorf("%s: document was not decoded:\n%s", c.name, out)
+		}
+	}
+}
+
+func TestRepairString(t *testing.T) {
+
+	for _, c := range []struct {
+		r    Repair
+		want string
+	}{
+		{Repair{Line: 3, Count: 1, Message: "unescaped & escaped"}, "3: unescaped & escaped"},
+		{Repair{Line: 3, Count: 4, Message: "unescaped & escaped"}, "3: unescaped & escaped (4 times)"},
+	} {
+		if got := c.r.String(); got != c.want {
+			t.Errorf("%q, expected %q", got, c.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package processor
 import (
 	"fmt"
 	"image"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
@@ -57,30 +58,20 @@ func (p *Processor) stampCover(im image.Image) (image.Image, error) {
 	dc := gg.NewContextForImage(im)
 
 	// prepare font
-	if len(p.env.Cfg.Doc.Cover.Font) > 0 {
-		absname := p.env.Cfg.Doc.Cover.Font
-		if !filepath.IsAbs(absname) {
-			absname = filepath.Join(p.env.Cfg.Path, absname)
-		}
-		if err := dc.LoadFontFace(absname, fh); err != nil {
-			// misconfiguration - get out
-			return nil, err
-		}
-	} else {
-		data, err := static.Asset(path.Join(DirResources, "LinLibertine_RBah.ttf"))
-		if err != nil {
-			return nil, fmt.Errorf("unable to get default stamp font: %w", err)
-		}
-		f, err := truetype.Parse(data)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse default stamp font: %w", err)
-		}
-		face := truetype.NewFace(f, &truetype.Options{
-			Size: fh,
-			// Hinting: font.HintingFull,
-		})
-		dc.SetFontFace(face)
+	data, err := p.loadFont()
+	if err != nil {
+		// misconfiguration - get out
+		return nil, err
+	}
+	f, err := truetype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse stamp font: %w", err)
 	}
+	face := truetype.NewFace(f, &truetype.Options{
+		Size: fh,
+		// Hinting: font.HintingFull,
+	})
+	dc.SetFontFace(face)
 
 	var x, y, w, h = float64(0), float64(0), float64(im.Bounds().Dx()), float64(im.Bounds().Dy()) / 4
 	switch p.stampPlacement {
@@ -105,3 +96,24 @@ func (p *Processor) stampCover(im image.Image) (image.Image, error) {
 	}
 	return nil, nil
 }
+
+// loadFont returns TrueType font program specified by configuration or built-in default font.
+func (p *Processor) loadFont() ([]byte, error) {
+
+	if len(p.env.Cfg.Doc.Cover.Font) > 0 {
+		absname := p.env.Cfg.Doc.Cover.Font
+		if !filepath.IsAbs(absname) {
+			absname = filepath.Join(p.env.Cfg.Path, absname)
+		}
+		data, err := os.ReadFile(absname)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read font: %w", err)
+		}
+		return data, nil
+	}
+	data, err := static.Asset(path.Join(DirResources, "LinLibertine_RBah.ttf"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get default font: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,430 @@
+package processor
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+
+	"fb2converter/etree"
+)
+
+var (
+	textSpaces     = regexp.MustCompile(`[ \t\r\n]+`)
+	textHeaderCSS  = regexp.MustCompile(`^h[0-9]$`)
+	textMdEscaper  = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `&lt;`)
+	textBlockTags  = map[string]bool{"p": true, "div": true, "table": true, "aside": true, "blockquote": true, "ul": true, "ol": true}
+	textSkippedCSS = map[string]bool{
+		"vignette_title_before": true, "vignette_title_after": true, "vignette_chapter_end": true, "chapter_end": true, "image": true,
+	}
+)
+
+// textWriter renders generated XHTML as plain text or markdown.
+type textWriter struct {
+	md    bool
+	wrap  int
+	notes map[string]int // note id -> endnote number
+	// depth of poems, epigraphs and citations, titles inside of them are not headings
+	quoted int
+	out    strings.Builder
+	// pending block separator
+	sep       bool
+	sepPrefix string
+}
+
+// FinalizeText produces txt or md file out of XHTML content generated from fb2.
+func (p *Processor) FinalizeText(fname string) error {
+
+	if err := p.prepareOutputFile(fname); err != nil {
+		return err
+	}
+
+	var enc encoding.Encoding
+	if name := p.env.Cfg.Doc.Text.Encoding; len(name) > 0 && !strings.EqualFold(name, "utf-8") && !strings.EqualFold(name, "utf8") {
+		var err error
+		if enc, err = ianaindex.IANA.Encoding(name); err != nil || enc == nil {
+			p.env.Log.Warn("Unknown text encoding requested, using UTF-8", zap.String("encoding", name), zap.Error(err))
+			enc = nil
+		}
+	}
+
+	w := &textWriter{
+		md:    p.format == OMd,
+		wrap:  p.env.Cfg.Doc.Text.Wrap,
+		notes: make(map[string]int),
+	}
+
+	// files with notes bodies are replaced with endnotes
+	notesFiles := make(map[string]bool)
+	for i, nl := range p.Book.NotesOrder {
+		w.notes[nl.id] = i + 1
+		if f, ok := p.Book.LinksLocations[nl.id]; ok {
+			notesFiles[f] = true
+		}
+	}
+
+	for _, f := range p.Book.Files {
+		if f.transient&dataNotForSpline != 0 || f.doc == nil || f.id == "toc" || notesFiles[f.fname] {
+			continue
+		}
+		if body := f.doc.FindElement("./html/body"); body != nil {
+			w.blocks(body, "")
+		}
+	}
+
+	bodyName := ""
+	for _, nl := range p.Book.NotesOrder {
+		n, ok := p.Book.Notes[nl.id]
+		if !ok {
+			continue
+		}
+		if nl.bodyName != bodyName || len(bodyName) == 0 {
+			bodyName = nl.bodyName
+			title := strings.Title(bodyName)
+			if t, ok := p.Book.NoteBodyTitles[bodyName]; ok {
+				title = t.title
+			}
+			w.heading(1, strings.Split(title, "\n"))
+		}
+		body := strings.TrimSpace(textSpaces.ReplaceAllString(n.body, " "))
+		if w.md {
+			w.paragraph("[^"+strconv.Itoa(w.notes[nl.id])+"]: "+textMdEscaper.Replace(body), "")
+		} else {
+			w.paragraph("["+strconv.Itoa(w.notes[nl.id])+"] "+body, "")
+		}
+	}
+
+	// soft hyphens are not needed in text
+	result := strings.ReplaceAll(w.out.String(), "\u00AD", "")
+	data := []byte(result)
+	if enc != nil {
+		var err error
+		if data, err = encoding.ReplaceUnsupported(enc.NewEncoder()).Bytes(data); err != nil {
+			return fmt.Errorf("unable to encode text: %w", err)
+		}
+	}
+	if err := os.WriteFile(fname, data, 0644); err != nil {
+		return fmt.Errorf("unable to write text (%s): %w", fname, err)
+	}
+	return nil
+}
+
+// separate finishes current block, separator is written lazily so enclosing block could replace it.
+func (w *textWriter) separate(prefix string) {
+	if w.out.Len() > 0 {
+		w.sep, w.sepPrefix = true, strings.TrimRight(prefix, " ")
+	}
+}
+
+func (w *textWriter) line(prefix, s string) {
+	if w.sep {
+		w.out.WriteString(w.sepPrefix + "\n")
+		w.sep = false
+	}
+	w.out.WriteString(prefix + s + "\n")
+}
+
+// paragraph writes (wrapped if requested) text block.
+func (w *textWriter) paragraph(s, prefix string) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return
+	}
+	for _, l := range strings.Split(s, "\n") {
+		for _, wl := range wrapLine(strings.TrimSpace(l), w.wrap-utf8.RuneCountInString(prefix)) {
+			w.line(prefix, wl)
+		}
+	}
+	w.separate(prefix)
+}
+
+func (w *textWriter) heading(level int, lines []string) {
+
+	var title []string
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); len(l) > 0 {
+			title = append(title, l)
+		}
+	}
+	if len(title) == 0 {
+		return
+	}
+
+	w.separate("")
+	if w.md {
+		if level > 5 {
+			level = 5
+		}
+		w.line("", strings.Repeat("#", level+1)+" "+textMdEscaper.Replace(strings.Join(title, " ")))
+		w.separate("")
+		return
+	}
+	var width int
+	for _, l := range title {
+		w.line("", l)
+		if n := utf8.RuneCountInString(l); n > width {
+			width = n
+		}
+	}
+	switch level {
+	case 0:
+		w.line("", strings.Repeat("=", width))
+	case 1:
+		w.line("", strings.Repeat("-", width))
+	}
+	w.separate("")
+}
+
+// blocks walks block level content.
+func (w *textWriter) blocks(e *etree.Element, prefix string) {
+	for _, c := range e.ChildElements() {
+		w.block(c, prefix)
+	}
+}
+
+func (w *textWriter) block(c *etree.Element, prefix string) {
+
+	css := getAttrValue(c, "class")
+	if textSkippedCSS[css] {
+		return
+	}
+
+	switch {
+	case textHeaderCSS.MatchString(css):
+		level, _ := strconv.Atoi(css[1:])
+		var lines []string
+		if titles := c.SelectElements("p"); len(titles) > 0 {
+			for _, t := range titles {
+				lines = append(lines, w.inline(t))
+			}
+		} else {
+			lines = append(lines, w.inline(c))
+		}
+		if w.quoted == 0 {
+			w.heading(level, lines)
+		} else if t := strings.Join(lines, "\n"); w.md {
+			w.paragraph(mdWrap(t, "**"), prefix)
+		} else {
+			w.paragraph(t, prefix)
+		}
+	case css == "epigraph" || css == "cite":
+		w.quoted++
+		if w.md {
+			w.blocks(c, prefix+"> ")
+		} else {
+			w.blocks(c, prefix+"    ")
+		}
+		w.quoted--
+		w.separate(prefix)
+	case css == "poem":
+		w.quoted++
+		w.poem(c, prefix)
+		w.quoted--
+	case css == "emptyline":
+		w.separate(prefix)
+	case css == "text-author":
+		if t := w.inline(c); w.md {
+			w.paragraph(mdWrap(t, "*"), prefix)
+		} else {
+			w.paragraph(t, prefix)
+		}
+	case css == "subtitle" || css == "titlenotes":
+		if t := w.inline(c); w.md {
+			w.paragraph(mdWrap(t, "**"), prefix)
+		} else {
+			w.paragraph(t, prefix)
+		}
+	case c.Tag == "table":
+		w.table(c, prefix)
+	case c.Tag == "svg" || c.Tag == "img":
+		// images are not supported
+	case c.Tag == "p" || !hasBlocks(c):
+		w.paragraph(w.inline(c), prefix)
+	default:
+		w.blocks(c, prefix)
+	}
+}
+
+func (w *textWriter) poem(e *etree.Element, prefix string) {
+
+	if !w.md {
+		prefix += "    "
+	}
+	for _, c := range e.ChildElements() {
+		switch getAttrValue(c, "class") {
+		case "stanza":
+			verses := c.SelectElements("p")
+			for i, v := range verses {
+				l := strings.TrimSpace(w.inline(v))
+				if w.md && i < len(verses)-1 {
+					// hard line break
+					l += `\`
+				}
+				w.line(prefix, l)
+			}
+			w.separate(prefix)
+		default:
+			w.block(c, prefix)
+		}
+	}
+}
+
+func (w *textWriter) table(e *etree.Element, prefix string) {
+
+	for i, tr := range e.FindElements(".//tr") {
+		var cells []string
+		for _, td := range tr.ChildElements() {
+			cells = append(cells, strings.TrimSpace(strings.ReplaceAll(w.inline(td), "\n", " ")))
+		}
+		if w.md {
+			w.line(prefix, "| "+strings.Join(cells, " | ")+" |")
+			if i == 0 {
+				w.line(prefix, "|"+strings.Repeat(" --- |", len(cells)))
+			}
+		} else {
+			w.line(prefix, strings.Join(cells, " | "))
+		}
+	}
+	w.separate(prefix)
+}
+
+// inline returns formatted text of the element.
+func (w *textWriter) inline(e *etree.Element) string {
+
+	var b strings.Builder
+	for _, t := range e.Child {
+		switch t := t.(type) {
+		case *etree.CharData:
+			b.WriteString(w.text(t.Data))
+		case *etree.Element:
+			b.WriteString(w.inlineElement(t))
+			b.WriteString(w.text(t.TailData))
+		}
+	}
+	return b.String()
+}
+
+func (w *textWriter) inlineElement(e *etree.Element) string {
+
+	css := getAttrValue(e, "class")
+	switch e.Tag {
+	case "br":
+		return "\n"
+	case "img", "svg":
+		return ""
+	case "a":
+		if css == "pagemarker" {
+			return ""
+		}
+		href := getAttrValue(e, "href")
+		if u, err := url.Parse(href); err == nil {
+			if n, ok := w.notes[u.Fragment]; ok && len(u.Fragment) > 0 {
+				if w.md {
+					return "[^" + strconv.Itoa(n) + "]"
+				}
+				return "[" + strconv.Itoa(n) + "]"
+			}
+			if w.md && len(u.Scheme) > 0 {
+				return "[" + w.inline(e) + "](" + href + ")"
+			}
+		}
+	case "code":
+		if w.md {
+			return mdWrap(e.Text(), "`")
+		}
+	case "sub":
+		// indexes would merge with surrounding text otherwise
+		if w.md {
+			return mdWrap(w.inline(e), "~")
+		}
+		return surround(w.inline(e), "_", "")
+	case "sup":
+		if w.md {
+			return mdWrap(w.inline(e), "^")
+		}
+		return surround(w.inline(e), "^", "")
+	case "span":
+		if w.md {
+			switch css {
+			case "strong":
+				return mdWrap(w.inline(e), "**")
+			case "emphasis":
+				return mdWrap(w.inline(e), "*")
+			case "strike":
+				return mdWrap(w.inline(e), "~~")
+			}
+		}
+	}
+	return w.inline(e)
+}
+
+func (w *textWriter) text(s string) string {
+	s = textSpaces.ReplaceAllString(s, " ")
+	if w.md {
+		s = textMdEscaper.Replace(s)
+	}
+	return s
+}
+
+// hasBlocks checks if element has any block level children.
+func hasBlocks(e *etree.Element) bool {
+	for _, c := range e.ChildElements() {
+		if textBlockTags[c.Tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// mdWrap surrounds text with markdown formatting characters keeping outer spaces outside.
+func mdWrap(s, mark string) string {
+	return surround(s, mark, mark)
+}
+
+// surround puts marks around text keeping outer spaces outside.
+func surround(s, before, after string) string {
+	t := strings.TrimSpace(s)
+	if len(t) == 0 {
+		return s
+	}
+	start := strings.Index(s, t)
+	return s[:start] + before + t + after + s[start+len(t):]
+}
+
+// wrapLine splits line on spaces so no part is longer than width (unless single word is). Width <= 0 means no wrapping.
+func wrapLine(s string, width int) []string {
+
+	if width <= 0 || utf8.RuneCountInString(s) <= width {
+		return []string{s}
+	}
+
+	var (
+		res    []string
+		cur    strings.Builder
+		curLen int
+	)
+	for _, word := range strings.Fields(s) {
+		n := utf8.RuneCountInString(word)
+		if curLen > 0 && curLen+1+n > width {
+			res = append(res, cur.String())
+			cur.Reset()
+			curLen = 0
+		}
+		if curLen > 0 {
+			cur.WriteByte(' ')
+			curLen++
+		}
+		cur.WriteString(word)
+		curLen += n
+	}
+	if curLen > 0 {
+		res = append(res, cur.String())
+	}
+	return res
+}
@@ -160,6 +160,11 @@ func CreateAuthorKeywordsMap(an *config.AuthorName) map[string]string {
 	} else {
 		rd["#l"] = ""
 	}
+	rd["#n"] = an.Nickname
+	// for persons known by nickname only it takes place of the last name, so formats without #n still work
+	if len(an.First) == 0 && len(an.Middle) == 0 && len(an.Last) == 0 {
+		rd["#l"] = an.Nickname
+	}
 	return rd
 }
 
@@ -174,20 +179,7 @@ func CreateTitleKeywordsMap(b *Book, pos int, src string) map[string]string {
 	if len(base) > 1 {
 		rd["#file_name"], rd["#file_name_ext"] = strings.TrimSuffix(base, filepath.Ext(base)), base
 	}
-	rd["#series"], rd["#abbrseries"], rd["#ABBRseries"] = "", "", ""
-	if len(b.SeqName) > 0 {
-		rd["#series"] = b.SeqName
-		abbr := abbrSeq(b.SeqName)
-		if len(abbr) > 0 {
-			rd["#abbrseries"] = strings.ToLower(abbr)
-			rd["#ABBRseries"] = strings.ToUpper(abbr)
-		}
-	}
-	rd["#number"], rd["#padnumber"] = "", ""
-	if b.SeqNum > 0 {
-		rd["#number"] = fmt.Sprintf("%d", b.SeqNum)
-		rd["#padnumber"] = fmt.Sprintf(fmt.Sprintf("%%0%dd", pos), b.SeqNum)
-	}
+	addSequenceKeywords(rd, b, pos)
 	rd["#date"] = ""
 	if len(b.Date) > 0 {
 		rd["#date"] = b.Date
@@ -195,6 +187,45 @@ func CreateTitleKeywordsMap(b *Book, pos int, src string) map[string]string {
 	return rd
 }
 
+// addSequenceKeywords adds keywords for all sequences book belongs to: primary one (#series, #number), other sequences from
+// title-info (#series2, #number2, ...), sub-sequence of the primary one (#subseries, #subnumber) and publisher's sequence
+// (#pubseries, #pubnumber).
+func addSequenceKeywords(rd map[string]string, b *Book, pos int) {
+
+	add := func(series, number, name string, num int) {
+		rd["#"+series], rd["#abbr"+series], rd["#ABBR"+series] = "", "", ""
+		if len(name) > 0 {
+			rd["#"+series] = name
+			abbr := abbrSeq(name)
+			if len(abbr) > 0 {
+				rd["#abbr"+series] = strings.ToLower(abbr)
+				rd["#ABBR"+series] = strings.ToUpper(abbr)
+			}
+		}
+		rd["#"+number], rd["#pad"+number] = "", ""
+		if num > 0 {
+			rd["#"+number] = fmt.Sprintf("%d", num)
+			rd["#pad"+number] = fmt.Sprintf(fmt.Sprintf("%%0%dd", pos), num)
+		}
+	}
+
+	add("series", "number", b.SeqName, b.SeqNum)
+	// keywords for missing sequences are always defined, otherwise #series2 would become value of #series followed by 2
+	seqs := b.secondarySequences()
+	for i := 0; i < len(seqs) || i < 8; i++ {
+		var s Sequence
+		if i < len(seqs) {
+			s = seqs[i]
+		}
+		n := strconv.Itoa(i + 2)
+		add("series"+n, "number"+n, s.Name, s.Number)
+	}
+	sub, _ := b.subSequence()
+	add("subseries", "subnumber", sub.Name, sub.Number)
+	pub, _ := b.publisherSequence()
+	add("pubseries", "pubnumber", pub.Name, pub.Number)
+}
+
 func abbrSeq(seq string) (abbr string) {
 	for _, w := range strings.Split(seq, " ") {
 		for len(w) > 0 {
@@ -210,29 +241,23 @@ func abbrSeq(seq string) (abbr string) {
 }
 
 // CreateFileNameKeywordsMap prepares keywords map for replacement.
-func CreateFileNameKeywordsMap(b *Book, format string, pos int) map[string]string {
+func CreateFileNameKeywordsMap(b *Book, format string, pos int, genreLang string) map[string]string {
 	rd := make(map[string]string)
 	rd["#title"] = ""
 	if len(b.Title) > 0 {
 		rd["#title"] = b.Title
 	}
-	rd["#series"], rd["#abbrseries"], rd["#ABBRseries"] = "", "", ""
-	if len(b.SeqName) > 0 {
-		rd["#series"] = b.SeqName
-		abbr := abbrSeq(b.SeqName)
-		if len(abbr) > 0 {
-			rd["#abbrseries"] = strings.ToLower(abbr)
-			rd["#ABBRseries"] = strings.ToUpper(abbr)
-		}
-	}
-	rd["#number"], rd["#padnumber"] = "", ""
-	if b.SeqNum > 0 {
-		rd["#number"] = fmt.Sprintf("%d", b.SeqNum)
-		rd["#padnumber"] = fmt.Sprintf(fmt.Sprintf("%%0%dd", pos), b.SeqNum)
-	}
+	addSequenceKeywords(rd, b, pos)
 	rd["#authors"] = b.BookAuthors(format, false)
 	rd["#author"] = b.BookAuthors(format, true)
 	rd["#bookid"] = b.ID.String()
+	rd["#genre"], rd["#genres"], rd["#genrecode"], rd["#genregroup"] = "", "", "", ""
+	if len(b.Genres) > 0 {
+		rd["#genre"] = GenreName(b.Genres[0], genreLang)
+		rd["#genres"] = strings.Join(b.GenreNames(genreLang), ", ")
+		rd["#genrecode"] = b.Genres[0]
+		rd["#genregroup"] = GenreName(GenreGroup(b.Genres[0]), genreLang)
+	}
 	return rd
 }
 
@@ -82,6 +82,15 @@ var cases = []testCase{
 		},
 		out: `_a_b_c_ _A_B_C_`,
 	},
+	testCase{
+		in: `#series{ - #series2}{ (#subseries)}`,
+		m: map[string]string{
+			"#series":    "Main",
+			"#series2":   "Second",
+			"#subseries": "",
+		},
+		out: `Main - Second`,
+	},
 }
 
 func TestReplaceKeywords(t *testing.T) {
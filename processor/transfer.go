@@ -0,0 +1,516 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/language"
+
+	"fb2converter/config"
+	"fb2converter/etree"
+)
+
+// epubPackage keeps unpacked EPUB state while its content is being processed.
+type epubPackage struct {
+	opf   string // full path to package document
+	dir   string // directory of package document, manifest hrefs are relative to it
+	doc   *etree.Document
+	items []*etree.Element
+	dirty bool
+}
+
+// path returns full path to the file referenced by manifest item.
+func (pkg *epubPackage) path(item *etree.Element) string {
+	href := getAttrValue(item, "href")
+	if i := strings.IndexByte(href, '#'); i >= 0 {
+		href = href[:i]
+	}
+	if u, err := url.PathUnescape(href); err == nil {
+		href = u
+	}
+	return filepath.Join(pkg.dir, filepath.FromSlash(href))
+}
+
+// href returns manifest href for the file.
+func (pkg *epubPackage) href(fname string) string {
+	rel, err := filepath.Rel(pkg.dir, fname)
+	if err != nil {
+		return filepath.ToSlash(fname)
+	}
+	return (&url.URL{Path: filepath.ToSlash(rel)}).String()
+}
+
+// uniqueID returns manifest id not yet used in the package.
+func (pkg *epubPackage) uniqueID(id string) string {
+	used := make(map[string]bool, len(pkg.items))
+	for _, item := range pkg.items {
+		used[getAttrValue(item, "id")] = true
+	}
+	res := id
+	for i := 1; used[res]; i++ {
+		res = fmt.Sprintf("%s_%d", id, i)
+	}
+	return res
+}
+
+// addItem adds file to the package manifest.
+func (pkg *epubPackage) addItem(id, fname, ct string) {
+	m := pkg.doc.Root().SelectElement("manifest")
+	if m == nil {
+		return
+	}
+	pkg.items = append(pkg.items, m.AddNext("item",
+		attr("id", pkg.uniqueID(id)),
+		attr("href", pkg.href(fname)),
+		attr("media-type", ct),
+	))
+	pkg.dirty = true
+}
+
+// removeItem removes file from the package manifest and from disk.
+func (pkg *epubPackage) removeItem(item *etree.Element) error {
+	if err := os.Remove(pkg.path(item)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if m := item.Parent(); m != nil {
+		m.RemoveChild(item)
+	}
+	for i, it := range pkg.items {
+		if it == item {
+			pkg.items = append(pkg.items[:i], pkg.items[i+1:]...)
+			break
+		}
+	}
+	pkg.dirty = true
+	return nil
+}
+
+// readXHTML reads content document leniently - EPUBs in the wild frequently use HTML entities.
+func readXHTML(fname string) (*etree.Document, error) {
+	doc := etree.NewDocument()
+	doc.ReadSettings = etree.ReadSettings{
+		CharsetReader: charset.NewReaderLabel,
+		Permissive:    true,
+		Entity:        xml.HTMLEntity,
+	}
+	if err := doc.ReadFromFile(fname); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", fname, err)
+	}
+	return doc, nil
+}
+
+// processEPUB unpacks EPUB, processes its content according to configuration and packs it back, so kindlegen or
+// built-in writer get already prepared book.
+func (p *Processor) processEPUB() error {
+
+	p.env.Log.Debug("Processing EPUB - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Processing EPUB - done", zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	pkg, err := p.openEPUB()
+	if err != nil {
+		return err
+	}
+
+	if err := p.transferStylesheet(pkg); err != nil {
+		return err
+	}
+	if err := p.transferXHTML(pkg); err != nil {
+		return err
+	}
+	if err := p.transferImages(pkg); err != nil {
+		return err
+	}
+
+	if pkg.dirty {
+		if err := pkg.doc.WriteToFile(pkg.opf); err != nil {
+			return fmt.Errorf("unable to write package document: %w", err)
+		}
+	}
+
+	// pack it back in place of the original
+	epub := filepath.Join(p.tmpDir, filepath.Base(p.src))
+	if err := os.Remove(epub); err != nil {
+		return fmt.Errorf("unable to remove original EPUB: %w", err)
+	}
+	return p.writeEPUB(epub)
+}
+
+// openEPUB unpacks source EPUB in temporary directory, reads its package document and fills in book description.
+func (p *Processor) openEPUB() (*epubPackage, error) {
+
+	opf, err := unzipEPUB(filepath.Join(p.tmpDir, filepath.Base(p.src)), p.tmpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := &epubPackage{opf: opf, dir: filepath.Dir(opf)}
+	if pkg.doc, err = readXHTML(opf); err != nil {
+		return nil, err
+	}
+	root := pkg.doc.Root()
+	if root == nil || root.SelectElement("manifest") == nil {
+		return nil, fmt.Errorf("bad package document in EPUB: %s", filepath.Base(opf))
+	}
+	pkg.items = root.SelectElement("manifest").SelectElements("item")
+
+	p.Book = NewBook(uuid.Nil, filepath.Base(p.src))
+	p.epubMetadata(root.SelectElement("metadata"), getAttrValue(root, "unique-identifier"))
+	return pkg, nil
+}
+
+// describeEPUB reads book description from EPUB package and locates its cover.
+func (p *Processor) describeEPUB() error {
+
+	pkg, err := p.openEPUB()
+	if err != nil {
+		return err
+	}
+	p.epub = pkg
+	p.Book.Cover = pkg.coverID()
+	return nil
+}
+
+// coverID returns manifest id of the cover image.
+func (pkg *epubPackage) coverID() string {
+	if meta := pkg.doc.Root().SelectElement("metadata"); meta != nil {
+		for _, m := range meta.SelectElements("meta") {
+			if getAttrValue(m, "name") == "cover" {
+				return getAttrValue(m, "content")
+			}
+		}
+	}
+	for _, item := range pkg.items {
+		if hasToken(getAttrValue(item, "properties"), "cover-image") {
+			return getAttrValue(item, "id")
+		}
+	}
+	return ""
+}
+
+// epubMetadata fills in book description from the package metadata - it is needed for cover stamping and resulting book ID.
+func (p *Processor) epubMetadata(meta *etree.Element, uid string) {
+
+	if meta == nil {
+		p.Book.ID = uuid.New()
+		return
+	}
+
+	refines := make(map[string]map[string]string)
+	for _, m := range meta.SelectElements("meta") {
+		if prop, ref := getAttrValue(m, "property"), strings.TrimPrefix(getAttrValue(m, "refines"), "#"); len(prop) > 0 && len(ref) > 0 {
+			if refines[ref] == nil {
+				refines[ref] = make(map[string]string)
+			}
+			refines[ref][prop] = strings.TrimSpace(m.Text())
+		}
+	}
+	refined := func(e *etree.Element, prop string) string {
+		if v := getAttrValue(e, prop); len(v) > 0 {
+			return v
+		}
+		if r, ok := refines[getAttrValue(e, "id")]; ok {
+			return r[prop]
+		}
+		return ""
+	}
+
+	var title string
+	for _, t := range meta.SelectElements("title") {
+		if tt := refined(t, "title-type"); len(title) == 0 || tt == "main" {
+			title = normalizeSpace(t.Text())
+		}
+	}
+	if len(title) > 0 {
+		p.Book.Title = title
+	}
+
+	for _, c := range meta.SelectElements("creator") {
+		if role := refined(c, "role"); len(role) > 0 && role != "aut" {
+			continue
+		}
+		an, nick := epubAuthorName(strings.TrimSpace(c.Text()), refined(c, "file-as"))
+		if an == nil && len(nick) > 0 {
+			an = &config.AuthorName{Nickname: nick}
+		}
+		if an != nil {
+			p.Book.Authors = append(p.Book.Authors, an)
+		}
+	}
+
+	for _, m := range meta.SelectElements("meta") {
+		switch {
+		case getAttrValue(m, "name") == "calibre:series":
+			p.Book.SeqName = strings.TrimSpace(getAttrValue(m, "content"))
+		case getAttrValue(m, "name") == "calibre:series_index":
+			p.Book.SeqNum, _ = strconv.Atoi(seqNumber(getAttrValue(m, "content")))
+		case getAttrValue(m, "property") == "belongs-to-collection" && len(getAttrValue(m, "refines")) == 0 && len(p.Book.SeqName) == 0:
+			p.Book.SeqName = strings.TrimSpace(m.Text())
+			p.Book.SeqNum, _ = strconv.Atoi(seqNumber(refined(m, "group-position")))
+		}
+	}
+
+	if l := meta.SelectElement("language"); l != nil {
+		if t, err := language.Parse(strings.TrimSpace(l.Text())); err == nil {
+			p.Book.Lang = t
+		} else {
+			p.env.Log.Warn("Unable to parse book language, using default", zap.String("lang", l.Text()), zap.Error(err))
+		}
+	}
+	if p.env.Cfg.Doc.Hyphenate {
+		p.Book.hyph = newHyph(p.Book.Lang, p.env.Log)
+	}
+
+	var id string
+	for _, i := range meta.SelectElements("identifier") {
+		if getAttrValue(i, "id") == uid || len(id) == 0 {
+			id = strings.TrimSpace(i.Text())
+		}
+	}
+	id = strings.TrimPrefix(strings.TrimPrefix(id, "urn:uuid:"), "uuid:")
+	if u, err := uuid.Parse(id); err == nil {
+		p.Book.ID = u
+	} else if len(id) > 0 {
+		p.Book.ID = uuid.NewSHA1(nameSpaceFB2, []byte(id))
+	} else {
+		p.Book.ID = uuid.New()
+	}
+}
+
+// transferStylesheet replaces or supplements book stylesheets with configured one.
+func (p *Processor) transferStylesheet(pkg *epubPackage) error {
+
+	if p.styleMode == StylesheetKeep {
+		return nil
+	}
+
+	if p.styleMode == StylesheetReplace {
+		for _, item := range append([]*etree.Element{}, pkg.items...) {
+			if getAttrValue(item, "media-type") == "text/css" {
+				if err := pkg.removeItem(item); err != nil {
+					return fmt.Errorf("unable to remove stylesheet: %w", err)
+				}
+			}
+		}
+	}
+
+	if err := p.prepareStylesheet(); err != nil {
+		return err
+	}
+
+	// move stylesheet and its resources next to the package document
+	rel, err := filepath.Rel(p.tmpDir, pkg.dir)
+	if err != nil {
+		return fmt.Errorf("unable to locate package document: %w", err)
+	}
+	for _, d := range p.Book.Data {
+		d.relpath = filepath.Join(rel, strings.TrimPrefix(d.relpath, DirContent))
+		if d.id == "style" {
+			// do not overwrite book files
+			name, ext := strings.TrimSuffix(d.fname, filepath.Ext(d.fname)), filepath.Ext(d.fname)
+			for i := 1; ; i++ {
+				if _, err := os.Stat(filepath.Join(p.tmpDir, d.relpath, d.fname)); os.IsNotExist(err) {
+					break
+				}
+				d.fname = fmt.Sprintf("%s%d%s", name, i, ext)
+			}
+		}
+	}
+	if err := p.Book.flushData(p.runCtx, p.tmpDir); err != nil {
+		return err
+	}
+	for _, d := range p.Book.Data {
+		pkg.addItem(d.id, filepath.Join(p.tmpDir, d.relpath, d.fname), d.ct)
+	}
+	return nil
+}
+
+// words to hyphenate
+var reWord = regexp.MustCompile(`[\p{L}\p{M}]+`)
+
+// elements which content should not be touched
+var noHyphenation = map[string]bool{
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"pre": true, "code": true, "kbd": true, "samp": true, "tt": true,
+	"script": true, "style": true, "svg": true, "math": true,
+}
+
+func (p *Processor) hyphenateText(in string) string {
+	return reWord.ReplaceAllStringFunc(in, func(word string) string {
+		if utf8.RuneCountInString(word) > 2 {
+			return p.Book.hyph.hyphenate(word)
+		}
+		return word
+	})
+}
+
+// hyphenateElement inserts soft hyphens into all text under the element.
+func (p *Processor) hyphenateElement(e *etree.Element) {
+	for _, t := range e.Child {
+		switch c := t.(type) {
+		case *etree.CharData:
+			c.Data = p.hyphenateText(c.Data)
+		case *etree.Element:
+			if !noHyphenation[strings.ToLower(c.Tag)] {
+				p.hyphenateElement(c)
+			}
+			c.TailData = p.hyphenateText(c.TailData)
+		}
+	}
+}
+
+// transferXHTML goes over content documents linking new stylesheet and hyphenating text.
+func (p *Processor) transferXHTML(pkg *epubPackage) error {
+
+	var style string
+	if p.styleMode != StylesheetKeep {
+		for _, d := range p.Book.Data {
+			if d.id == "style" {
+				style = filepath.Join(p.tmpDir, d.relpath, d.fname)
+			}
+		}
+	}
+	if len(style) == 0 && p.Book.hyph == nil {
+		return nil
+	}
+
+	for _, item := range pkg.items {
+		if getAttrValue(item, "media-type") != "application/xhtml+xml" {
+			continue
+		}
+		fname := pkg.path(item)
+		doc, err := readXHTML(fname)
+		if err != nil {
+			p.env.Log.Warn("Unable to process content document, leaving as is", zap.String("file", fname), zap.Error(err))
+			continue
+		}
+
+		if head := doc.FindElement("./html/head"); head != nil && len(style) > 0 {
+			if p.styleMode == StylesheetReplace {
+				for _, e := range append(head.SelectElements("link"), head.SelectElements("style")...) {
+					if e.Tag == "style" || hasToken(strings.ToLower(getAttrValue(e, "rel")), "stylesheet") {
+						head.RemoveChild(e)
+					}
+				}
+			}
+			href, err := filepath.Rel(filepath.Dir(fname), style)
+			if err != nil {
+				return fmt.Errorf("unable to link stylesheet: %w", err)
+			}
+			head.AddNext("link",
+				attr("rel", "stylesheet"),
+				attr("type", "text/css"),
+				attr("href", (&url.URL{Path: filepath.ToSlash(href)}).String()),
+			)
+		}
+
+		if body := doc.FindElement("./html/body"); body != nil && p.Book.hyph != nil {
+			p.hyphenateElement(body)
+		}
+
+		if err := doc.WriteToFile(fname); err != nil {
+			return fmt.Errorf("unable to write content document: %w", err)
+		}
+	}
+	return nil
+}
+
+// transferImages runs book images through the same processing pipeline as FB2 binaries, including cover resizing and stamping.
+func (p *Processor) transferImages(pkg *epubPackage) error {
+
+	p.env.Log.Debug("Processing images - start")
+	defer func(start time.Time) {
+		p.env.Log.Debug("Processing images - done",
+			zap.Duration("elapsed", time.Since(start)),
+			zap.Int("images", len(p.Book.Images)),
+		)
+	}(time.Now())
+
+	cover := pkg.coverID()
+
+	items := make(map[*binImage]*etree.Element)
+	for _, item := range pkg.items {
+
+		ct := getAttrValue(item, "media-type")
+		if !strings.HasPrefix(ct, "image/") || strings.HasSuffix(ct, "svg+xml") {
+			continue
+		}
+		id := getAttrValue(item, "id")
+
+		fname := pkg.path(item)
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			p.env.Log.Warn("Unable to read image, ignoring", zap.String("file", fname), zap.Error(err))
+			continue
+		}
+		_, imgType, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			p.env.Log.Warn("Unable to decode image, leaving as is", zap.String("id", id), zap.String("declared", ct), zap.Error(err))
+			continue
+		}
+		rel, err := filepath.Rel(p.tmpDir, filepath.Dir(fname))
+		if err != nil {
+			return fmt.Errorf("unable to locate image: %w", err)
+		}
+
+		b := &binImage{
+			log:     p.env.Log,
+			id:      id,
+			ct:      ct,
+			fname:   filepath.Base(fname),
+			relpath: rel,
+			imgType: imgType,
+			data:    data,
+		}
+		if !isImageSupported(b.imgType) && (p.format == OMobi || p.format == OAzw3) {
+			b.flags |= imageKindle
+		}
+		if p.env.Cfg.Doc.RemovePNGTransparency && imgType == "png" {
+			b.flags |= imageOpaquePNG
+		}
+		if p.env.Cfg.Doc.ImagesScaleFactor > 0 && (imgType == "png" || imgType == "jpeg") {
+			b.flags |= imageScale
+			b.scaleFactor = p.env.Cfg.Doc.ImagesScaleFactor
+		}
+		if id == cover {
+			if b.img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+				p.env.Log.Warn("Unable to decode cover image", zap.String("id", id), zap.Error(err))
+			}
+			p.Book.Cover = id
+		}
+		p.Book.Images = append(p.Book.Images, b)
+		items[b] = item
+	}
+
+	if err := p.generateCover(); err != nil {
+		return err
+	}
+
+	for _, b := range p.Book.Images {
+		if b.flags == 0 {
+			continue
+		}
+		if err := b.flush(p.tmpDir); err != nil {
+			return err
+		}
+		if item := items[b]; getAttrValue(item, "media-type") != b.ct {
+			item.CreateAttr("media-type", b.ct)
+			pkg.dirty = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,458 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Namespaces used by FB2 documents.
+const (
+	nsFB2   = "http://www.gribuser.ru/xml/fictionbook/2.0"
+	nsXLink = "http://www.w3.org/1999/xlink"
+)
+
+// Violation is a single problem found in FB2 document.
+type Violation struct {
+	Line    int    `json:"line"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%d: %s: %s", v.Line, v.Path, v.Message)
+}
+
+// contentModel describes what element may contain according to FictionBook 2.1/2.2 schema. Order of children is only
+// checked where it matters for processing.
+type contentModel struct {
+	children []string // allowed child elements, none - only text is allowed
+	required []string // child elements which must be present
+	attrs    []string // attributes which must be present
+	text     bool     // element may have text
+	loose    bool     // content is not checked
+}
+
+var (
+	inlineElements = []string{"strong", "emphasis", "style", "a", "strikethrough", "sub", "sup", "code", "image"}
+	textOnly       = contentModel{text: true}
+	inline         = contentModel{children: inlineElements, text: true}
+	authorModel    = contentModel{children: []string{"first-name", "middle-name", "last-name", "nickname", "home-page", "email", "id"}}
+	titleInfoModel = contentModel{
+		children: []string{"genre", "author", "book-title", "annotation", "keywords", "date", "coverpage", "lang", "src-lang", "translator", "sequence"},
+		required: []string{"genre", "author", "book-title", "lang"},
+	}
+	flowModel = contentModel{children: []string{"p", "poem", "cite", "subtitle", "table", "empty-line"}}
+)
+
+var fb2Schema = map[string]contentModel{
+	"FictionBook": {children: []string{"stylesheet", "description", "body", "binary"}, required: []string{"description", "body"}},
+	"stylesheet":  {text: true, attrs: []string{"type"}},
+	"description": {
+		children: []string{"title-info", "src-title-info", "document-info", "publish-info", "custom-info", "output"},
+		required: []string{"title-info", "document-info"},
+	},
+	"title-info":     titleInfoModel,
+	"src-title-info": titleInfoModel,
+	"document-info": {
+		children: []string{"author", "program-used", "date", "src-url", "src-ocr", "id", "version", "history", "publisher"},
+		required: []string{"author", "date", "id", "version"},
+	},
+	"publish-info":  {children: []string{"book-name", "publisher", "city", "year", "isbn", "sequence"}},
+	"custom-info":   {text: true, attrs: []string{"info-type"}},
+	"output":        {loose: true},
+	"author":        authorModel,
+	"translator":    authorModel,
+	"genre":         textOnly,
+	"book-title":    textOnly,
+	"keywords":      textOnly,
+	"date":          textOnly,
+	"lang":          textOnly,
+	"src-lang":      textOnly,
+	"first-name":    textOnly,
+	"middle-name":   textOnly,
+	"last-name":     textOnly,
+	"nickname":      textOnly,
+	"home-page":     textOnly,
+	"email":         textOnly,
+	"id":            textOnly,
+	"program-used":  textOnly,
+	"src-url":       textOnly,
+	"src-ocr":       textOnly,
+	"version":       textOnly,
+	"book-name":     textOnly,
+	"publisher":     {text: true, children: authorModel.children},
+	"city":          textOnly,
+	"year":          textOnly,
+	"isbn":          textOnly,
+	"coverpage":     {children: []string{"image"}, required: []string{"image"}},
+	"sequence":      {children: []string{"sequence"}, attrs: []string{"name"}},
+	"annotation":    flowModel,
+	"history":       flowModel,
+	"body":          {children: []string{"image", "title", "epigraph", "section"}, required: []string{"section"}},
+	"section":       {children: []string{"title", "epigraph", "image", "annotation", "section", "p", "poem", "subtitle", "cite", "empty-line", "table"}},
+	"title":         {children: []string{"p", "empty-line"}},
+	"epigraph":      {children: []string{"p", "poem", "cite", "empty-line", "text-author"}},
+	"cite":          {children: []string{"p", "poem", "empty-line", "subtitle", "table", "text-author"}},
+	"poem":          {children: []string{"title", "epigraph", "stanza", "text-author", "date"}, required: []string{"stanza"}},
+	"stanza":        {children: []string{"title", "subtitle", "v"}, required: []string{"v"}},
+	"table":         {children: []string{"tr"}, required: []string{"tr"}},
+	"tr":            {children: []string{"th", "td"}},
+	"p":             inline,
+	"v":             inline,
+	"subtitle":      inline,
+	"text-author":   inline,
+	"th":            inline,
+	"td":            inline,
+	"strong":        inline,
+	"emphasis":      inline,
+	"style":         inline,
+	"a":             inline,
+	"strikethrough": inline,
+	"sub":           inline,
+	"sup":           inline,
+	"code":          inline,
+	"image":         {attrs: []string{"href"}},
+	"empty-line":    {},
+	"binary":        {text: true, attrs: []string{"id", "content-type"}},
+}
+
+// Content types of images FB2 readers are expected to support.
+var fb2ImageTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+
+// validationFrame is an element being validated.
+type validationFrame struct {
+	name     string
+	path     string
+	line     int
+	model    contentModel
+	counts   map[string]int
+	content  bool   // section has paragraphs or other content
+	subs     bool   // section has subsections
+	text     []byte // collected for binaries only
+	skip     bool   // foreign or unknown element - content is not checked
+	children []string
+}
+
+// fb2Link is a reference found in the document.
+type fb2Link struct {
+	line   int
+	path   string
+	target string
+	image  bool
+}
+
+// fb2Validator checks single document.
+type fb2Validator struct {
+	newlines   []int
+	violations []Violation
+	stack      []*validationFrame
+	ids        map[string]int // id -> line
+	binaries   map[string]bool
+	links      []fb2Link
+}
+
+func (v *fb2Validator) line(offset int64) int {
+	return sort.SearchInts(v.newlines, int(offset)) + 1
+}
+
+func (v *fb2Validator) report(line int, path, format string, args ...interface{}) {
+	v.violations = append(v.violations, Violation{Line: line, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateFB2 checks FB2 document against FictionBook 2.1/2.2 schema rules and reports problems found along with their
+// location: missing required elements and attributes, invalid nesting, dangling references, duplicate ids, undeclared
+// binaries and bad content types. When "unknownEncoding" is set document is decoded according to its XML declaration
+// and content (encoding which contradicts content is reported), otherwise it is expected to be UTF-8. Error is only
+// returned if document cannot be read.
+func ValidateFB2(r io.Reader, unknownEncoding bool) ([]Violation, error) {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	v := &fb2Validator{ids: make(map[string]int), binaries: make(map[string]bool)}
+	if unknownEncoding {
+		var decision string
+		if data, decision, err = decodeFB2(data); err != nil {
+			return []Violation{{Line: 1, Path: "/", Message: err.Error()}}, nil
+		}
+		if len(decision) > 0 {
+			v.report(1, "/", "%s", decision)
+		}
+	}
+	for i, c := range data {
+		if c == '\n' {
+			v.newlines = append(v.newlines, i)
+		}
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	// document was decoded already
+	d.CharsetReader = func(label string, input io.Reader) (io.Reader, error) { return input, nil }
+
+	root := false
+	for {
+		offset := d.InputOffset()
+		t, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			line := v.line(d.InputOffset())
+			var se *xml.SyntaxError
+			if errors.As(err, &se) {
+				line = se.Line
+			}
+			v.report(line, v.path(), "document is not well-formed: %s", err)
+			return v.violations, nil
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			line := v.line(offset)
+			if !root {
+				root = true
+				if t.Name.Local != "FictionBook" || t.Name.Space != nsFB2 {
+					v.report(line, "/"+t.Name.Local, "root element must be FictionBook in namespace %s", nsFB2)
+					return v.violations, nil
+				}
+			}
+			v.start(t, line)
+		case xml.EndElement:
+			v.end(v.line(offset))
+		case xml.CharData:
+			lead := len(t) - len(bytes.TrimLeft(t, " \t\r\n"))
+			v.chars(t, v.line(offset+int64(lead)))
+		}
+	}
+	if !root {
+		v.report(1, "/", "document has no root element")
+		return v.violations, nil
+	}
+	v.finish()
+	return v.violations, nil
+}
+
+func (v *fb2Validator) path() string {
+	if len(v.stack) == 0 {
+		return "/"
+	}
+	return v.stack[len(v.stack)-1].path
+}
+
+func (v *fb2Validator) start(t xml.StartElement, line int) {
+
+	var parent *validationFrame
+	if len(v.stack) > 0 {
+		parent = v.stack[len(v.stack)-1]
+	}
+
+	f := &validationFrame{name: t.Name.Local, line: line, counts: make(map[string]int)}
+	if parent == nil {
+		f.path = "/" + f.name
+	} else {
+		parent.counts[f.name]++
+		f.path = fmt.Sprintf("%s/%s[%d]", parent.path, f.name, parent.counts[f.name])
+		parent.children = append(parent.children, f.name)
+	}
+	v.stack = append(v.stack, f)
+
+	switch {
+	case parent != nil && parent.skip:
+		f.skip = true
+		return
+	case t.Name.Space != nsFB2:
+		// foreign content is not ours to check
+		f.skip = true
+		return
+	}
+
+	model, ok := fb2Schema[f.name]
+	if !ok {
+		v.report(line, f.path, "unknown element %s", f.name)
+		f.skip = true
+		return
+	}
+	f.model = model
+
+	if parent != nil && !parent.model.loose && !isOneOf(f.name, parent.model.children) {
+		v.report(line, f.path, "element %s is not allowed in %s", f.name, parent.name)
+	}
+	if parent != nil && parent.name == "section" {
+		switch f.name {
+		case "section":
+			if parent.content {
+				v.report(line, f.path, "section cannot have both content and subsections")
+			}
+			parent.subs = true
+		case "title", "epigraph", "annotation":
+			if parent.content || parent.subs {
+				v.report(line, f.path, "%s must precede section content", f.name)
+			}
+		case "image":
+			if parent.subs {
+				v.report(line, f.path, "section cannot have both content and subsections")
+			}
+		default:
+			if parent.subs {
+				v.report(line, f.path, "section cannot have both content and subsections")
+			}
+			parent.content = true
+		}
+	}
+	if parent != nil && parent.name == "FictionBook" && f.name == "description" && len(parent.children) > 1 {
+		for _, c := range parent.children[:len(parent.children)-1] {
+			if c != "stylesheet" {
+				v.report(line, f.path, "description must precede book content")
+				break
+			}
+		}
+	}
+
+	attrs := make(map[string]string, len(t.Attr))
+	for _, a := range t.Attr {
+		switch {
+		case a.Name.Space == nsXLink && a.Name.Local == "href":
+			attrs["href"] = a.Value
+		case len(a.Name.Space) == 0:
+			attrs[a.Name.Local] = a.Value
+		}
+	}
+	for _, a := range f.model.attrs {
+		if len(strings.TrimSpace(attrs[a])) == 0 {
+			v.report(line, f.path, "missing required attribute %s", a)
+		}
+	}
+
+	if id, ok := attrs["id"]; ok && len(id) > 0 {
+		if first, dup := v.ids[id]; dup {
+			v.report(line, f.path, "duplicate id %q, first used on line %d", id, first)
+		} else {
+			v.ids[id] = line
+		}
+		if f.name == "binary" {
+			v.binaries[id] = true
+		}
+	}
+	if href, ok := attrs["href"]; ok && len(href) > 0 && (f.name == "a" || f.name == "image") {
+		v.links = append(v.links, fb2Link{line: line, path: f.path, target: href, image: f.name == "image"})
+	}
+	if f.name == "binary" {
+		if ct := attrs["content-type"]; len(ct) > 0 && !fb2ImageTypes[strings.ToLower(ct)] {
+			v.report(line, f.path, "unsupported binary content type %s", ct)
+		}
+		f.text = make([]byte, 0, 1024)
+	}
+}
+
+func (v *fb2Validator) chars(data xml.CharData, line int) {
+
+	if len(v.stack) == 0 {
+		return
+	}
+	f := v.stack[len(v.stack)-1]
+	if f.skip || f.model.loose {
+		return
+	}
+	if f.name == "binary" {
+		f.text = append(f.text, data...)
+		return
+	}
+	if f.model.text || len(bytes.TrimSpace(data)) == 0 {
+		return
+	}
+	if f.name == "section" {
+		v.report(line, f.path, "text is not allowed directly in section, it should be in paragraph")
+		return
+	}
+	v.report(line, f.path, "text is not allowed in %s", f.name)
+}
+
+func (v *fb2Validator) end(line int) {
+
+	f := v.stack[len(v.stack)-1]
+	v.stack = v.stack[:len(v.stack)-1]
+	if f.skip {
+		return
+	}
+
+	for _, r := range f.model.required {
+		if f.counts[r] == 0 {
+			v.report(f.line, f.path, "missing required element %s", r)
+		}
+	}
+	if f.name == "author" && len(v.stack) > 0 && v.stack[len(v.stack)-1].name != "publisher" {
+		if f.counts["nickname"] == 0 && (f.counts["first-name"] == 0 || f.counts["last-name"] == 0) {
+			v.report(f.line, f.path, "author must have first-name and last-name or nickname")
+		}
+	}
+	if f.name == "binary" {
+		v.checkBinary(f)
+	}
+}
+
+// checkBinary makes sure binary could be decoded and its content matches declared type.
+func (v *fb2Validator) checkBinary(f *validationFrame) {
+
+	s := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, string(f.text))
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		v.report(f.line, f.path, "binary is not properly base64 encoded: %s", err)
+		return
+	}
+	if len(data) == 0 {
+		v.report(f.line, f.path, "binary is empty")
+		return
+	}
+	ct := http.DetectContentType(data)
+	if !strings.HasPrefix(ct, "image/") {
+		v.report(f.line, f.path, "binary does not contain image (%s)", ct)
+	}
+}
+
+func (v *fb2Validator) finish() {
+
+	for _, l := range v.links {
+		if !strings.HasPrefix(l.target, "#") {
+			if l.image {
+				v.report(l.line, l.path, "image refers to external resource %s, images must be stored in binaries", l.target)
+			}
+			continue
+		}
+		target := l.target[1:]
+		switch {
+		case l.image && !v.binaries[target]:
+			v.report(l.line, l.path, "image refers to undeclared binary %s", target)
+		case !l.image:
+			if _, ok := v.ids[target]; !ok {
+				v.report(l.line, l.path, "link refers to missing element %s", target)
+			}
+		}
+	}
+
+	sort.SliceStable(v.violations, func(i, j int) bool {
+		return v.violations[i].Line < v.violations[j].Line
+	})
+}
+
+func isOneOf(name string, names []string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package processor
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// fixturePNG is base64 encoded content recognized as PNG image.
+var fixturePNG = base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01"))
+
+// fixtureBook is a valid document, line numbers are referenced by tests.
+var fixtureBook = `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description>
+<title-info>
+<genre>prose_contemporary</genre>
+<author><first-name>Иван</first-name><last-name>Петров</last-name></author>
+<book-title>Тестовая книга</book-title>
+<lang>ru</lang>
+</title-info>
+<document-info>
+<author><nickname>tester</nickname></author>
+<date>2020</date>
+<id>11111111-2222-3333-4444-555555555555</id>
+<version>1.0</version>
+</document-info>
+</description>
+<body>
+<section id="ch1">
+<title><p>Глава</p></title>
+<p>Текст <a l:href="#note1">[1]</a>.</p>
+<image l:href="#pic.png"/>
+</section>
+</body>
+<body name="notes">
+<section id="note1"><p>Примечание.</p></section>
+</body>
+<binary id="pic.png" content-type="image/png">` + fixturePNG + `</binary>
+</FictionBook>
+`
+
+// fixture returns test book with a single change.
+func fixture(t *testing.T, old, new string) string {
+	t.Helper()
+
+	if !strings.Contains(fixtureBook, old) {
+		t.Fatalf("%q is not in test book", old)
+	}
+	return strings.Replace(fixtureBook, old, new, 1)
+}
+
+func TestValidateFB2Valid(t *testing.T) {
+
+	for _, unknownEncoding := range []bool{false, true} {
+		violations, err := ValidateFB2(strings.NewReader(fixtureBook), unknownEncoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(violations) > 0 {
+			t.Errorf("unknown encoding %t: unexpected violations %q", unknownEncoding, violations)
+		}
+	}
+}
+
+func TestValidateFB2(t *testing.T) {
+
+	const (
+		section = "/FictionBook/body[1]/section[1]"
+		binary  = `<binary id="pic.png" content-type="image/png">`
+	)
+
+	cases := []struct {
+		name            string
+		doc             string
+		unknownEncoding bool
+		want            Violation
+	}{
+		{"encoding contradicts declaration", string(encodeText(t, fixtureBook, "windows-1251")), true,
+			Violation{1, "/", "encoding windows-1251 detected, declared encoding utf-8 contradicts content"}},
+		{"unsupported encoding", `<?xml version="1.0" encoding="x-unknown"?><FictionBook/>`, true,
+			Violation{1, "/", "unsupported encoding: x-unknown"}},
+		{"not well-formed", fixture(t, "</title-info>", "</title-inf>"), false,
+			Violation{9, "/FictionBook/description[1]/title-info[1]", "document is not well-formed: XML syntax error on line 9: element <title-info> closed by </title-inf>"}},
+		{"wrong root", `<?xml version="1.0"?>` + "\n" + `<html><body/></html>`, false,
+			Violation{2, "/html", "root element must be FictionBook in namespace " + nsFB2}},
+		{"wrong namespace", fixture(t, `xmlns="http://www.gribuser.ru/xml/fictionbook/2.0"`, `xmlns="http://www.gribuser.ru/xml/fictionbook/2.1"`), false,
+			Violation{2, "/FictionBook", "root element must be FictionBook in namespace " + nsFB2}},
+		{"no root", `<?xml version="1.0"?>` + "\n", false,
+			Violation{1, "/", "document has no root element"}},
+		{"unknown element", fixture(t, "<lang>ru</lang>", "<lang>ru</lang><flavour/>"), false,
+			Violation{8, "/FictionBook/description[1]/title-info[1]/flavour[1]", "unknown element flavour"}},
+		{"element not allowed", fixture(t, "<title><p>Глава</p></title>", `<title><p>Глава</p><image l:href="#pic.png"/></title>`), false,
+			Violation{19, section + "/title[1]/image[1]", "element image is not allowed in title"}},
+		{"content and subsections", fixture(t, `<image l:href="#pic.png"/>`, "<section><p>Вложенная</p></section>"), false,
+			Violation{21, section + "/section[1]", "section cannot have both content and subsections"}},
+		{"epigraph after content", fixture(t, `<image l:href="#pic.png"/>`, "<epigraph><p>Эпиграф</p></epigraph>"), false,
+			Violation{21, section + "/epigraph[1]", "epigraph must precede section content"}},
+		{"description after content", fixture(t, "<description>", `<binary id="first.png" content-type="image/png">`+fixturePNG+"</binary><description>"), false,
+			Violation{3, "/FictionBook/description[1]", "description must precede book content"}},
+		{"missing attribute", fixture(t, binary, `<binary id="pic.png">`), false,
+			Violation{27, "/FictionBook/binary[1]", "missing required attribute content-type"}},
+		{"duplicate id", fixture(t, "<p>Примечание.</p>", `<p id="ch1">Примечание.</p>`), false,
+			Violation{25, "/FictionBook/body[2]/section[1]/p[1]", `duplicate id "ch1", first used on line 18`}},
+		{"unsupported content type", fixture(t, binary, `<binary id="pic.png" content-type="image/bmp">`), false,
+			Violation{27, "/FictionBook/binary[1]", "unsupported binary content type image/bmp"}},
+		{"text in section", fixture(t, `<image l:href="#pic.png"/>`, "Просто текст"), false,
+			Violation{21, section, "text is not allowed directly in section, it should be in paragraph"}},
+		{"text not allowed", fixture(t, "<author><nickname>tester</nickname>", "<author>tester<nickname>tester</nickname>"), false,
+			Violation{11, "/FictionBook/description[1]/document-info[1]/author[1]", "text is not allowed in author"}},
+		{"missing element", fixture(t, "<lang>ru</lang>\n", ""), false,
+			Violation{4, "/FictionBook/description[1]/title-info[1]", "missing required element lang"}},
+		{"author without names", fixture(t, "<first-name>Иван</first-name>", ""), false,
+			Violation{6, "/FictionBook/description[1]/title-info[1]/author[1]", "author must have first-name and last-name or nickname"}},
+		{"binary not encoded", fixture(t, fixturePNG, "@@@@"), false,
+			Violation{27, "/FictionBook/binary[1]", "binary is not properly base64 encoded: illegal base64 data at input byte 0"}},
+		{"binary empty", fixture(t, fixturePNG, " "), false,
+			Violation{27, "/FictionBook/binary[1]", "binary is empty"}},
+		{"binary not image", fixture(t, fixturePNG, base64.StdEncoding.EncodeToString([]byte("plain text"))), false,
+			Violation{27, "/FictionBook/binary[1]", "binary does not contain image (text/plain; charset=utf-8)"}},
+		{"external image", fixture(t, `<image l:href="#pic.png"/>`, `<image l:href="http://example.com/pic.png"/>`), false,
+			Violation{21, section + "/image[1]", "image refers to external resource http://example.com/pic.png, images must be stored in binaries"}},
+		{"undeclared binary", fixture(t, `<image l:href="#pic.png"/>`, `<image l:href="#other.png"/>`), false,
+			Violation{21, section + "/image[1]", "image refers to undeclared binary other.png"}},
+		{"missing link target", fixture(t, "#note1", "#note2"), false,
+			Violation{20, section + "/p[1]/a[1]", "link refers to missing element note2"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			violations, err := ValidateFB2(strings.NewReader(c.doc), c.unknownEncoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(violations) != 1 || violations[0] != c.want {
+				t.Errorf("violations %q, expected %q", violations, c.want)
+			}
+		})
+	}
+}
+
+func TestValidateFB2Order(t *testing.T) {
+
+	doc := fixture(t, "#note1", "#note2")
+	doc = strings.Replace(doc, "<lang>ru</lang>\n", "", 1)
+	violations, err := ValidateFB2(strings.NewReader(doc), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 2 || violations[0].Line != 4 || violations[1].Line != 19 {
+		t.Errorf("violations are not ordered by line: %q", violations)
+	}
+}
@@ -20,6 +20,11 @@ import (
 	"fb2converter/etree"
 )
 
+// epubNS checks if XHTML requires epub namespace for semantic markup.
+func (p *Processor) epubNS() bool {
+	return p.notesMode == NFloatNew || p.format == OEpub3
+}
+
 // processBody parses fb2 document body and produces formatted output.
 func (p *Processor) processBody(index int, from *etree.Element) (err error) {
 
@@ -43,7 +48,7 @@ func (p *Processor) processBody(index int, from *etree.Element) (err error) {
 	if p.notesMode == NDefault || !IsOneOf(p.ctx().bodyName, p.env.Cfg.Doc.Notes.BodyNames) {
 		// initialize first XHTML buffer
 		ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-		if p.notesMode == NFloatNew {
+		if p.epubNS() {
 			ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
 		}
 		to, f := p.ctx().createXHTML("", ns...)
@@ -59,7 +64,7 @@ func (p *Processor) processBody(index int, from *etree.Element) (err error) {
 
 	// initialize XHTML buffer for notes
 	ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-	if p.notesMode == NFloatNew {
+	if p.epubNS() {
 		ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
 	}
 	to, f := p.ctx().createXHTML("", ns...)
@@ -265,7 +270,11 @@ func (p *Processor) formatText(in string, breakable, tail bool, to *etree.Elemen
 				if len(textOut) > 0 {
 					bufWriteString(textOut, kobo)
 				}
-				buf.WriteString(`<a class="pagemarker" id=` + fmt.Sprintf("\"page_%d\"/>", page))
+				if p.format == OEpub3 {
+					buf.WriteString(`<a class="pagemarker" epub:type="pagebreak" id=` + fmt.Sprintf("\"page_%d\"/>", page))
+				} else {
+					buf.WriteString(`<a class="pagemarker" id=` + fmt.Sprintf("\"page_%d\"/>", page))
+				}
 				p.ctx().pageLength, textOutLen, textOut = 0, 0, ""
 				page++
 			}
@@ -324,6 +333,11 @@ func (p *Processor) formatText(in string, breakable, tail bool, to *etree.Elemen
 // NOTE: decorations (if any) are (order important): name of new html tag, its css class, href attribute.
 func (p *Processor) transfer(from, to *etree.Element, decorations ...string) error {
 
+	// pathological books could take forever
+	if err := p.runCtx.Err(); err != nil {
+		return err
+	}
+
 	// See if decorations are requested
 	var tag, css, href string
 	for i, p := range decorations {
@@ -343,6 +357,7 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 	processChildren := true
 
 	// links are notes - probably
+	var noteRef bool
 	if tag == "a" && len(href) > 0 {
 		var noteID string
 		// Some people does not know how to format url properly
@@ -355,6 +370,8 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 			case NDefault:
 				if _, ok := p.Book.Notes[noteID]; !ok {
 					css = "linkanchor"
+				} else {
+					noteRef = true
 				}
 			case NInline:
 				fallthrough
@@ -373,6 +390,7 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 				if note, ok := p.Book.Notes[noteID]; !ok {
 					css = "linkanchor"
 				} else {
+					noteRef = true
 					if p.env.Cfg.Doc.Notes.Renumber {
 						var name string
 						if t, ok := p.Book.NoteBodyTitles[note.bodyName]; ok {
@@ -423,7 +441,7 @@ func (p *Processor) transfer(from, to *etree.Element, decorations ...string) err
 			attrs[0] = attr("id", newid)
 			attrs[1] = attr("class", css)
 			attrs[2] = attr("href", href)
-			if p.notesMode == NFloatNew && tag == "a" {
+			if tag == "a" && (p.notesMode == NFloatNew || p.format == OEpub3 && noteRef) {
 				attrs = append(attrs, attr("epub:type", "noteref"))
 			}
 			inner = to.AddNext(tag, attrs...)
@@ -590,7 +608,7 @@ func transferSubtitle(p *Processor, from, to *etree.Element) error {
 				if t == dv && !p.ctx().inHeader && !p.ctx().inSubHeader && len(p.ctx().bodyName) == 0 && !p.ctx().specialParagraph {
 					// open next XHTML
 					ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-					if p.notesMode == NFloatNew {
+					if p.epubNS() {
 						ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
 					}
 					var f *dataFile
@@ -616,7 +634,7 @@ func transferParagraph(p *Processor, from, to *etree.Element) error {
 			!p.ctx().inHeader && !p.ctx().inSubHeader && len(p.ctx().bodyName) == 0 && !p.ctx().specialParagraph {
 			// open next XHTML
 			ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-			if p.notesMode == NFloatNew {
+			if p.epubNS() {
 				ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
 			}
 			var f *dataFile
@@ -766,7 +784,7 @@ func transferSection(p *Processor, from, to *etree.Element) error {
 		if len(p.ctx().bodyName) == 0 && p.ctx().header.Int() < p.env.Cfg.Doc.ChapterLevel {
 			// open next XHTML
 			ns := []*etree.Attr{attr("xmlns", `http://www.w3.org/1999/xhtml`)}
-			if p.notesMode == NFloatNew {
+			if p.epubNS() {
 				ns = append(ns, attr("xmlns:epub", `http://www.idpf.org/2007/ops`))
 			}
 			var f *dataFile
@@ -14,6 +14,9 @@ type LocalEnv struct {
 
 	Cfg *config.Config
 	Log *zap.Logger
+
+	// When books are converted concurrently limits number of simultaneously running kindlegen processes, nil - no limit
+	KindlegenSlots chan struct{}
 }
 
 // NewLocalEnv creates LocalEnv and initializes it.